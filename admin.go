@@ -0,0 +1,225 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+var (
+	adminUnix     = flag.String("admin-unix", "", "also serve the control API on this unix socket path")
+	adminUnixMode = flag.String("admin-unix-mode", "0660", "file permissions of the -admin-unix socket")
+	adminUnixOnly = flag.Bool("admin-unix-only", false, "serve the control API only on -admin-unix, never over TCP")
+)
+
+var adminTokenFlag = flag.String("admin-token", "", "comma-separated bearer tokens required on the control API, each optionally prefixed ro: or rw: (default rw; default $UPSTREAMGATE_ADMIN_TOKEN)")
+
+// token roles; read-only tokens may only call GET endpoints
+const (
+	roleReadOnly  = "ro"
+	roleReadWrite = "rw"
+)
+
+// adminToken is an accepted bearer token, kept as its SHA-256 so every
+// comparison takes the same time whatever the length of the token sent
+type adminToken struct {
+	sum  [sha256.Size]byte
+	role string
+}
+
+// adminTokens holds the accepted bearer tokens; empty leaves the API open
+var adminTokens []adminToken
+
+func loadAdminTokens() {
+	raw := *adminTokenFlag
+	if raw == "" {
+		raw = os.Getenv("UPSTREAMGATE_ADMIN_TOKEN")
+	}
+	for _, t := range strings.Split(raw, ",") {
+		// trimmed first, so " ro:abc" doesn't become a read-write token
+		t = strings.TrimSpace(t)
+		role := roleReadWrite
+		if r, secret, ok := strings.Cut(t, ":"); ok && (r == roleReadOnly || r == roleReadWrite) {
+			role, t = r, strings.TrimSpace(secret)
+		}
+		if t != "" {
+			adminTokens = append(adminTokens, adminToken{sha256.Sum256([]byte(t)), role})
+		}
+	}
+}
+
+func newAdminMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/upstream", upstreamHandler)
+	mux.HandleFunc("/upstreams", upstreamsHandler)
+	mux.HandleFunc("/upstream/test", testUpstreamHandler)
+	mux.HandleFunc("/upstream/history", historyHandler)
+	mux.HandleFunc("/upstream/rollback", rollbackHandler)
+	mux.HandleFunc("/upstream/stage", stageHandler)
+	mux.HandleFunc("/upstream/staged", stagedHandler)
+	mux.HandleFunc("/upstream/commit", commitHandler)
+	mux.HandleFunc("/upstream/abort", abortHandler)
+	mux.HandleFunc("/upstream/disconnect", disconnectHandler)
+	mux.HandleFunc("/reload", reloadHandler)
+	mux.HandleFunc("/export", exportHandler)
+	mux.HandleFunc("/import", importHandler)
+	mux.HandleFunc("/audit", auditHandler)
+	mux.HandleFunc("/ipmap", ipMapHandler)
+	mux.HandleFunc("/bans", bansHandler)
+	mux.HandleFunc("/credentials", credentialsHandler)
+	mux.HandleFunc("/password", passwordHandler)
+	mux.HandleFunc("/keys", apiKeysHandler)
+	mux.HandleFunc("/stats", statsHandler)
+	mux.HandleFunc("/version", versionHandler)
+	if *dashboard {
+		mux.HandleFunc("/admin", dashboardHandler)
+	}
+	return mux
+}
+
+// requireAdmin rejects requests without a valid bearer token when tokens are
+// configured, and writes with a read-only token. The dashboard page, and
+// /version with -public-version, are exempt.
+func requireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isDashboardPage(r) || (*publicVersion && r.URL.Path == "/version") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if withAPIKey(w, r, next) {
+			return
+		}
+		role := callerRole(bearerToken(r))
+		if role == "" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="upstreamgate"`)
+			writeError(w, http.StatusUnauthorized, "unauthorized", "missing or invalid admin token")
+			return
+		}
+		if role == roleReadOnly && r.Method != http.MethodGet && r.Method != http.MethodHead {
+			writeError(w, http.StatusForbidden, "read_only_token", "token is read-only")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func bearerToken(r *http.Request) string {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "bearer") {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
+
+func validAdminToken(token string) bool {
+	return adminRole(token) != ""
+}
+
+// adminRole returns the role granted by token, or "" if it isn't accepted
+func adminRole(token string) string {
+	if token == "" {
+		return ""
+	}
+	given := sha256.Sum256([]byte(token))
+	// check every token so timing doesn't reveal which one matched
+	match := -1
+	for i, t := range adminTokens {
+		match = subtle.ConstantTimeSelect(subtle.ConstantTimeCompare(given[:], t.sum[:]), i, match)
+	}
+	if match < 0 {
+		return ""
+	}
+	return adminTokens[match].role
+}
+
+// callerRole is the role a control API caller acts with, "" if rejected.
+// Without configured tokens every caller may write.
+func callerRole(token string) string {
+	if len(adminTokens) == 0 {
+		return roleReadWrite
+	}
+	return adminRole(token)
+}
+
+// sourceOf identifies the caller of an admin request for the audit log: the
+// API key's id, the client certificate's CN under mutual TLS, otherwise the
+// token fingerprint.
+// Tokens are never recorded in the clear.
+func sourceOf(r *http.Request) changeSource {
+	if k := requestAPIKey(r); k != nil {
+		return changeSource{Actor: "key:" + k.ID, Role: roleUserKey, RemoteAddr: r.RemoteAddr}
+	}
+	token := bearerToken(r)
+	if cn := clientCertCN(r); cn != "" {
+		return changeSource{Actor: "cert:" + cn, Role: callerRole(token), RemoteAddr: r.RemoteAddr}
+	}
+	return changeSource{Actor: tokenActor(token), Role: callerRole(token), RemoteAddr: r.RemoteAddr}
+}
+
+func tokenActor(token string) string {
+	if token == "" || len(adminTokens) == 0 {
+		return "anonymous"
+	}
+	sum := sha256.Sum256([]byte(token))
+	return "token:" + hex.EncodeToString(sum[:4])
+}
+
+// unixServer serves HTTP on a unix socket with the given file mode
+type unixServer struct {
+	path string
+	mode os.FileMode
+	*http.Server
+}
+
+func newUnixServer(path, mode string, h http.Handler) (*unixServer, error) {
+	m, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil || m > 0o777 {
+		return nil, fmt.Errorf("bad socket mode %q", mode)
+	}
+	if err := clearStaleSocket(path); err != nil {
+		return nil, err
+	}
+	return &unixServer{path: path, mode: os.FileMode(m), Server: &http.Server{Handler: h}}, nil
+}
+
+func (s *unixServer) ListenAndServe() error {
+	ln, err := net.Listen("unix", s.path)
+	if err != nil {
+		return err
+	}
+	// the listener unlinks the socket when it is closed on shutdown
+	if err := os.Chmod(s.path, s.mode); err != nil {
+		ln.Close()
+		return err
+	}
+	return s.Serve(ln)
+}
+
+// clearStaleSocket removes a socket left behind by a previous run. It refuses
+// to touch anything that isn't a socket, or a socket something still listens on.
+func clearStaleSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if fi.Mode().Type() != fs.ModeSocket {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+	if c, err := net.Dial("unix", path); err == nil {
+		c.Close()
+		return fmt.Errorf("%s is in use by another process", path)
+	}
+	return os.Remove(path)
+}
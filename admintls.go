@@ -0,0 +1,84 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"sync/atomic"
+)
+
+var (
+	adminTLSCert  = flag.String("admin-tls-cert", "", "serve -admin-addr over TLS with this certificate file")
+	adminTLSKey   = flag.String("admin-tls-key", "", "private key for -admin-tls-cert")
+	adminClientCA = flag.String("admin-client-ca", "", "require -admin-addr clients to present a certificate signed by this CA bundle")
+)
+
+// adminTLSConfig is swapped on SIGHUP so new handshakes pick up renewed
+// certificates without restarting the listener
+var adminTLSConfig atomic.Pointer[tls.Config]
+
+func adminTLSEnabled() bool {
+	return *adminTLSCert != "" || *adminTLSKey != "" || *adminClientCA != ""
+}
+
+// loadAdminTLS reads the certificate, key and client CA from disk
+func loadAdminTLS() error {
+	if *adminTLSCert == "" || *adminTLSKey == "" {
+		return errors.New("-admin-tls-cert and -admin-tls-key are both required")
+	}
+	cert, err := tls.LoadX509KeyPair(*adminTLSCert, *adminTLSKey)
+	if err != nil {
+		return err
+	}
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if *adminClientCA != "" {
+		pem, err := os.ReadFile(*adminClientCA)
+		if err != nil {
+			return err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("%s: no certificates found", *adminClientCA)
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	adminTLSConfig.Store(cfg)
+	return nil
+}
+
+// tlsServer serves HTTPS with whatever config holds at handshake time
+type tlsServer struct {
+	*http.Server
+}
+
+func newTLSServer(addr string, h http.Handler, config *atomic.Pointer[tls.Config]) *tlsServer {
+	return &tlsServer{&http.Server{
+		Addr:    addr,
+		Handler: h,
+		TLSConfig: &tls.Config{
+			GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+				return config.Load(), nil
+			},
+		},
+	}}
+}
+
+func (s *tlsServer) ListenAndServe() error {
+	return s.ListenAndServeTLS("", "")
+}
+
+// helper to get the common name of a verified client certificate
+func clientCertCN(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return ""
+	}
+	return r.TLS.VerifiedChains[0][0].Subject.CommonName
+}
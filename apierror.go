@@ -0,0 +1,49 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+)
+
+// apiError is the body of every non-2xx control API response, wrapped as
+// { "error": { "code":"...", "message":"...", "field":"..." } }. Codes are
+// stable and meant for programs; messages are for people and may change.
+type apiError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Field   string `json:"field,omitempty"`
+	Details any    `json:"details,omitempty"` // per-entry results of batch requests
+}
+
+func writeAPIError(w http.ResponseWriter, status int, e *apiError) {
+	writeJSON(w, status, struct {
+		Error *apiError `json:"error"`
+	}{e})
+}
+
+// helper to write an error response without a field
+func writeError(w http.ResponseWriter, status int, code, msg string) {
+	writeAPIError(w, status, &apiError{Code: code, Message: msg})
+}
+
+// helper to answer 400 for a validation error, naming the field when known
+func writeInvalid(w http.ResponseWriter, err error) {
+	var fe *fieldError
+	if errors.As(err, &fe) {
+		writeAPIError(w, http.StatusBadRequest, &apiError{Code: fe.code(), Message: fe.Msg, Field: fe.Field})
+		return
+	}
+	writeError(w, http.StatusBadRequest, "invalid_request", err.Error())
+}
+
+func writeMethodNotAllowed(w http.ResponseWriter) {
+	writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "method not allowed")
+}
+
+func writeStoreError(w http.ResponseWriter) {
+	writeError(w, http.StatusInternalServerError, "store_error", "store error")
+}
+
+func writeUserLimit(w http.ResponseWriter) {
+	writeError(w, http.StatusInsufficientStorage, "user_limit_reached", "user limit reached")
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// API keys let a customer manage their own mapping through /upstream and
+// nothing else. A key is "ugk_<id>.<secret>"; only a hash of the secret is
+// kept.
+const (
+	apiKeyPrefix      = "ugk_"
+	maxAPIKeysPerUser = 16
+	roleUserKey       = "user"
+)
+
+type apiKey struct {
+	ID        string
+	User      string
+	Label     string
+	Hash      [sha256.Size]byte
+	CreatedAt time.Time
+	uses      secretUsage
+}
+
+var (
+	apiKeysMu sync.RWMutex
+	apiKeys   = map[string]*apiKey{} // id -> key
+)
+
+type apiKeyCtx struct{}
+
+// apiKeyFor returns the key a bearer token belongs to, nil if it isn't one
+func apiKeyFor(token string) *apiKey {
+	rest, ok := strings.CutPrefix(token, apiKeyPrefix)
+	if !ok {
+		return nil
+	}
+	id, secret, ok := strings.Cut(rest, ".")
+	if !ok {
+		return nil
+	}
+	apiKeysMu.RLock()
+	k := apiKeys[id]
+	apiKeysMu.RUnlock()
+	if k == nil {
+		return nil
+	}
+	sum := sha256.Sum256([]byte(secret))
+	if subtle.ConstantTimeCompare(sum[:], k.Hash[:]) != 1 {
+		return nil
+	}
+	k.uses.add(time.Now())
+	return k
+}
+
+// requestAPIKey returns the API key a control API request was made with
+func requestAPIKey(r *http.Request) *apiKey {
+	k, _ := r.Context().Value(apiKeyCtx{}).(*apiKey)
+	return k
+}
+
+// withAPIKey admits a request made with an API key, which may only use
+// /upstream, and reports whether the token was one
+func withAPIKey(w http.ResponseWriter, r *http.Request, next http.Handler) bool {
+	k := apiKeyFor(bearerToken(r))
+	if k == nil {
+		return false
+	}
+	if r.URL.Path != "/upstream" {
+		writeError(w, http.StatusForbidden, "api_key_scope", "API keys may only use /upstream")
+		return true
+	}
+	next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), apiKeyCtx{}, k)))
+	return true
+}
+
+// keyAllowsUser answers 403 when an API key names another user than its own
+func keyAllowsUser(w http.ResponseWriter, r *http.Request, user string) bool {
+	k := requestAPIKey(r)
+	if k == nil || k.User == user {
+		return true
+	}
+	writeError(w, http.StatusForbidden, "forbidden_user", "API key may only manage its own user")
+	return false
+}
+
+// apiKeyRecord is how a key is persisted in the state file
+type apiKeyRecord struct {
+	ID         string     `json:"id"`
+	User       string     `json:"user"`
+	Label      string     `json:"label,omitempty"`
+	Hash       string     `json:"hash"`
+	CreatedAt  time.Time  `json:"created_at"`
+	Uses       uint64     `json:"uses,omitempty"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+}
+
+func snapshotAPIKeys() []apiKeyRecord {
+	apiKeysMu.RLock()
+	defer apiKeysMu.RUnlock()
+	out := make([]apiKeyRecord, 0, len(apiKeys))
+	for _, k := range apiKeys {
+		uses, last := k.uses.read()
+		out = append(out, apiKeyRecord{k.ID, k.User, k.Label, hex.EncodeToString(k.Hash[:]), k.CreatedAt, uses, last})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out
+}
+
+// restoreAPIKeys loads the keys saved in the state file
+func restoreAPIKeys(saved []apiKeyRecord) {
+	m := make(map[string]*apiKey, len(saved))
+	for _, rec := range saved {
+		k := &apiKey{ID: rec.ID, User: rec.User, Label: rec.Label, CreatedAt: rec.CreatedAt}
+		if n, err := hex.Decode(k.Hash[:], []byte(rec.Hash)); err != nil || n != sha256.Size || rec.ID == "" {
+			log.Printf("state: skipping API key %q: bad hash", rec.ID)
+			continue
+		}
+		k.uses.uses.Store(rec.Uses)
+		if rec.LastUsedAt != nil {
+			k.uses.lastUsed.Store(rec.LastUsedAt.Unix())
+		}
+		m[k.ID] = k
+	}
+	apiKeysMu.Lock()
+	apiKeys = m
+	apiKeysMu.Unlock()
+}
+
+func apiKeysHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		listAPIKeysHandler(w, r)
+	case http.MethodPost:
+		createAPIKeyHandler(w, r)
+	case http.MethodDelete:
+		deleteAPIKeyHandler(w, r)
+	default:
+		writeMethodNotAllowed(w)
+	}
+}
+
+type apiKeyEntry struct {
+	ID         string     `json:"id"`
+	User       string     `json:"user"`
+	Label      string     `json:"label,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	Uses       uint64     `json:"uses"`
+	LastUsedAt *time.Time `json:"last_used_at"` // null until first used
+}
+
+func (k *apiKey) entry() apiKeyEntry {
+	uses, last := k.uses.read()
+	return apiKeyEntry{k.ID, k.User, k.Label, k.CreatedAt, uses, last}
+}
+
+// GET /keys[?user=u]
+func listAPIKeysHandler(w http.ResponseWriter, r *http.Request) {
+	user := r.URL.Query().Get("user")
+	entries := []apiKeyEntry{}
+	apiKeysMu.RLock()
+	for _, k := range apiKeys {
+		if user == "" || k.User == user {
+			entries = append(entries, k.entry())
+		}
+	}
+	apiKeysMu.RUnlock()
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].User != entries[j].User {
+			return entries[i].User < entries[j].User
+		}
+		return entries[i].CreatedAt.Before(entries[j].CreatedAt)
+	})
+
+	writeJSON(w, http.StatusOK, entries)
+}
+
+// POST /keys { "user":"u", "label":"customer portal" }
+//
+// Issues a key that may only manage u's mapping. The key is returned once.
+func createAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		User  string `json:"user"`
+		Label string `json:"label"`
+	}
+	if !decodeJSON(w, r, *maxBodyBytes, &req) {
+		return
+	}
+	if err := validateUser(req.User); err != nil {
+		writeInvalid(w, err)
+		return
+	}
+	if req.User == defaultUser {
+		writeInvalid(w, &fieldError{"user", "keys can't be issued for the default mapping"})
+		return
+	}
+	if req.Label != "" {
+		if err := validateCredentialLabel(req.Label); err != nil {
+			writeInvalid(w, err)
+			return
+		}
+	}
+
+	id, secret := make([]byte, 8), make([]byte, 32)
+	rand.Read(id)
+	rand.Read(secret)
+	k := &apiKey{ID: hex.EncodeToString(id), User: req.User, Label: req.Label, CreatedAt: time.Now().UTC()}
+	token := base64.RawURLEncoding.EncodeToString(secret)
+	k.Hash = sha256.Sum256([]byte(token))
+
+	apiKeysMu.Lock()
+	n := 0
+	for _, o := range apiKeys {
+		if o.User == req.User {
+			n++
+		}
+	}
+	if n >= maxAPIKeysPerUser {
+		apiKeysMu.Unlock()
+		writeError(w, http.StatusConflict, "too_many_keys", "user already has the maximum number of API keys")
+		return
+	}
+	apiKeys[k.ID] = k
+	apiKeysMu.Unlock()
+	scheduleStateSave()
+	log.Printf("admin: %s issued API key %s for %q", sourceOf(r).Actor, k.ID, k.User)
+
+	writeJSON(w, http.StatusCreated, struct {
+		apiKeyEntry
+		Key string `json:"key"`
+	}{k.entry(), apiKeyPrefix + k.ID + "." + token})
+}
+
+// DELETE /keys?id=0123456789abcdef
+func deleteAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("id")
+	if id == "" && r.ContentLength != 0 {
+		var req struct {
+			ID string `json:"id"`
+		}
+		if !decodeJSON(w, r, *maxBodyBytes, &req) {
+			return
+		}
+		id = req.ID
+	}
+	if id == "" {
+		writeInvalid(w, &fieldError{"id", "missing"})
+		return
+	}
+
+	apiKeysMu.Lock()
+	k, ok := apiKeys[id]
+	delete(apiKeys, id)
+	apiKeysMu.Unlock()
+	if !ok {
+		writeError(w, http.StatusNotFound, "key_not_found", "no API key with that id")
+		return
+	}
+	scheduleStateSave()
+	log.Printf("admin: %s revoked API key %s of %q", sourceOf(r).Actor, id, k.User)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// totalAPIKeyUsage sums the requests made with every API key
+func totalAPIKeyUsage() uint64 {
+	apiKeysMu.RLock()
+	defer apiKeysMu.RUnlock()
+	var n uint64
+	for _, k := range apiKeys {
+		n += k.uses.uses.Load()
+	}
+	return n
+}
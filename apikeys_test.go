@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// useAdminToken requires token on the control API until the test ends
+func useAdminToken(t *testing.T, token string) {
+	tokens := adminTokens
+	t.Cleanup(func() { adminTokens = tokens })
+	setFlag(t, adminTokenFlag, token)
+	adminTokens = nil
+	loadAdminTokens()
+}
+
+func TestAPIKeyScope(t *testing.T) {
+	useAdminToken(t, "admin-secret")
+	apiKeysMu.Lock()
+	saved := apiKeys
+	apiKeys = map[string]*apiKey{}
+	apiKeysMu.Unlock()
+	t.Cleanup(func() {
+		apiKeysMu.Lock()
+		apiKeys = saved
+		apiKeysMu.Unlock()
+	})
+	setTestMapping(t, "alice", "direct", "")
+	setTestMapping(t, "bob", "direct", "")
+
+	admin := requireAdmin(newAdminMux())
+	call := func(method, target, token, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, strings.NewReader(body))
+		if body != "" {
+			r.Header.Set("Content-Type", "application/json")
+		}
+		r.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		admin.ServeHTTP(w, r)
+		return w
+	}
+	expect := func(t *testing.T, w *httptest.ResponseRecorder, status int, code, what string) {
+		t.Helper()
+		if w.Code != status || (code != "" && !strings.Contains(w.Body.String(), `"code":"`+code+`"`)) {
+			t.Errorf("%s = %d %s, want %d %s", what, w.Code, strings.TrimSpace(w.Body.String()), status, code)
+		}
+	}
+
+	w := call(http.MethodPost, "/keys", "admin-secret", `{"user":"alice","label":"portal"}`)
+	var created struct {
+		ID  string `json:"id"`
+		Key string `json:"key"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&created); err != nil || w.Code != http.StatusCreated {
+		t.Fatalf("POST /keys = %d, %v", w.Code, err)
+	}
+	key := created.Key
+
+	t.Run("only /upstream", func(t *testing.T) {
+		for _, path := range []string{
+			"/upstreams", "/upstream/test", "/upstream/history?user=alice", "/upstream/rollback", "/upstream/stage",
+			"/upstream/staged", "/upstream/commit", "/upstream/abort", "/upstream/disconnect", "/reload", "/export",
+			"/import", "/audit", "/ipmap", "/bans", "/credentials?user=alice", "/password", "/keys", "/stats", "/version",
+			"/upstream/", "/upstream/../keys", "/nonexistent",
+		} {
+			for _, method := range []string{http.MethodGet, http.MethodPost} {
+				body := ""
+				if method == http.MethodPost {
+					body = `{"user":"alice"}`
+				}
+				expect(t, call(method, path, key, body), http.StatusForbidden, "api_key_scope", method+" "+path)
+			}
+		}
+	})
+
+	t.Run("own user", func(t *testing.T) {
+		expect(t, call(http.MethodGet, "/upstream?user=alice", key, ""), http.StatusOK, "", "GET alice")
+		expect(t, call(http.MethodPost, "/upstream", key, `{"user":"alice","upstream":"direct://?bind=127.0.0.1"}`), http.StatusNoContent, "", "POST alice")
+	})
+
+	t.Run("other users", func(t *testing.T) {
+		expect(t, call(http.MethodGet, "/upstream?user=bob", key, ""), http.StatusForbidden, "forbidden_user", "GET bob")
+		expect(t, call(http.MethodPost, "/upstream", key, `{"user":"bob","upstream":"direct"}`), http.StatusForbidden, "forbidden_user", "POST bob")
+		expect(t, call(http.MethodPost, "/upstream", key, `{"user":"bob","upstream":""}`), http.StatusForbidden, "forbidden_user", "clear bob")
+		expect(t, call(http.MethodDelete, "/upstream?user=bob", key, ""), http.StatusForbidden, "forbidden_user", "DELETE bob")
+		expect(t, call(http.MethodPost, "/upstream", key, `{"user":"`+defaultUser+`","upstream":"direct"}`), http.StatusForbidden, "forbidden_user", "POST the default")
+		upstreamsMu.RLock()
+		bob := upstreams["bob"]
+		upstreamsMu.RUnlock()
+		if bob == nil || bob.Raw != "direct" {
+			t.Errorf("bob's mapping = %+v, want it untouched", bob)
+		}
+	})
+
+	t.Run("wrong secret", func(t *testing.T) {
+		expect(t, call(http.MethodGet, "/upstream?user=alice", key+"x", ""), http.StatusUnauthorized, "unauthorized", "a tampered key")
+	})
+
+	t.Run("revoked", func(t *testing.T) {
+		expect(t, call(http.MethodDelete, "/keys?id="+created.ID, "admin-secret", ""), http.StatusNoContent, "", "DELETE /keys")
+		expect(t, call(http.MethodGet, "/upstream?user=alice", key, ""), http.StatusUnauthorized, "unauthorized", "a revoked key")
+		expect(t, call(http.MethodPost, "/upstream", key, `{"user":"alice","upstream":"direct"}`), http.StatusUnauthorized, "unauthorized", "a revoked key")
+	})
+}
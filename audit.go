@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	pb "github.com/sarp/UpstreamGate/proto"
+)
+
+var auditLogPath = flag.String("audit-log", "", "append a JSON line for every upstream change to this file")
+
+// changeSource describes who or what made a change, and how
+type changeSource struct {
+	Actor      string // token fingerprint, or the subsystem for internal changes
+	Role       string // role of the caller's token; empty for internal changes
+	RemoteAddr string
+	KeepConns  bool   // leave existing connections on their old upstream
+	Event      string // a change to credentials only, e.g. "password.changed"; empty for upstream changes
+}
+
+type auditEntry struct {
+	Time        time.Time `json:"time"`
+	Actor       string    `json:"actor"`
+	Role        string    `json:"role,omitempty"`
+	RemoteAddr  string    `json:"remote_addr,omitempty"`
+	User        string    `json:"user"`
+	Event       string    `json:"event,omitempty"`
+	OldUpstream string    `json:"old_upstream,omitempty"`
+	NewUpstream string    `json:"new_upstream,omitempty"`
+}
+
+var (
+	auditMu   sync.Mutex
+	auditFile *os.File
+)
+
+func openAuditLog() error {
+	if *auditLogPath == "" {
+		return nil
+	}
+	f, err := os.OpenFile(*auditLogPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	auditFile = f
+	return nil
+}
+
+// recordChange is called after every successful change to a user's mapping;
+// prev or next is nil when the mapping was created or removed, and closed
+// is the number of connections that were force-closed. A change with an
+// Event only touched the user's credentials, so it is audited and announced
+// under that name but isn't part of the upstream history.
+func recordChange(src changeSource, user string, prev, next *Upstream, closed int) {
+	now := time.Now().UTC()
+	if next == nil {
+		forgetUser(user)
+		forgetHistory(user)
+	}
+	writeAudit(auditEntry{
+		Time:        now,
+		Actor:       src.Actor,
+		Role:        src.Role,
+		RemoteAddr:  src.RemoteAddr,
+		User:        user,
+		Event:       src.Event,
+		OldUpstream: prev.redacted(),
+		NewUpstream: next.redacted(),
+	})
+	event := src.Event
+	if event == "" {
+		event = "upstream.changed"
+		if next != nil {
+			recordHistory(user, historyEntry{
+				Time:       now,
+				Upstream:   next.redacted(),
+				Actor:      src.Actor,
+				RemoteAddr: src.RemoteAddr,
+			})
+		}
+		publishChange(&pb.ChangeEvent{
+			Time:              timestamppb.New(now),
+			Actor:             src.Actor,
+			User:              user,
+			OldUpstream:       prev.redacted(),
+			NewUpstream:       next.redacted(),
+			ClosedConnections: int32(closed),
+		})
+	}
+	notifyChange(changeEvent{
+		Event:             event,
+		Time:              now,
+		User:              user,
+		OldUpstream:       prev.redacted(),
+		NewUpstream:       next.redacted(),
+		ClosedConnections: closed,
+	})
+}
+
+func writeAudit(e auditEntry) {
+	if auditFile == nil {
+		return
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	auditMu.Lock()
+	defer auditMu.Unlock()
+	if _, err := auditFile.Write(append(b, '\n')); err != nil {
+		log.Printf("audit: write failed: %v", err)
+	}
+}
+
+// GET /audit[?user=u][&limit=n]
+//
+// Returns the most recent entries, oldest first.
+func auditHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeMethodNotAllowed(w)
+		return
+	}
+	if *auditLogPath == "" {
+		writeError(w, http.StatusNotFound, "audit_disabled", "audit log not enabled")
+		return
+	}
+
+	user := r.URL.Query().Get("user")
+	limit := 100
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			writeInvalid(w, &fieldError{"limit", "must be a positive integer"})
+			return
+		}
+		limit = n
+	}
+
+	f, err := os.Open(*auditLogPath)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "audit_read_failed", "cannot read audit log")
+		return
+	}
+	defer f.Close()
+
+	// keep the last limit matches in a ring
+	ring := make([]auditEntry, 0, min(limit, 1024))
+	next := 0
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var e auditEntry
+		if json.Unmarshal(sc.Bytes(), &e) != nil {
+			continue
+		}
+		if user != "" && e.User != user {
+			continue
+		}
+		if len(ring) < limit {
+			ring = append(ring, e)
+			continue
+		}
+		ring[next] = e
+		next = (next + 1) % limit
+	}
+	entries := append(ring[next:], ring[:next]...)
+
+	writeJSON(w, http.StatusOK, entries)
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"container/list"
+	"flag"
+	"log"
+	"math"
+	"net/http"
+	"net/netip"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	authFailLimit  = flag.Int("auth-fail-limit", 0, "failed proxy logins allowed per source IP and per username within -auth-fail-window before a ban (0 = never ban)")
+	authFailWindow = flag.Duration("auth-fail-window", time.Minute, "window in which -auth-fail-limit failures lead to a ban")
+	authBanTime    = flag.Duration("auth-ban", 10*time.Minute, "how long a source IP or username is refused after too many failed logins")
+)
+
+// maxAuthSubjects bounds how many source IPs and usernames are tracked; the
+// least recently seen one is forgotten first
+const maxAuthSubjects = 1 << 16
+
+// authSubject is what failures are counted against
+type authSubject struct {
+	kind  string // "ip" or "user"
+	value string
+}
+
+type authFailures struct {
+	subject     authSubject
+	count       int
+	windowStart time.Time
+	bannedUntil time.Time
+}
+
+var (
+	authFailMu  sync.Mutex
+	authFailLRU = list.New() // of *authFailures, most recent first
+	authFailBy  = map[authSubject]*list.Element{}
+	authBans    = map[authSubject]time.Time{} // active bans, to notice them lift
+)
+
+// helper to get the tracked entry for s, creating it and evicting the least
+// recently seen one if needed; callers hold authFailMu
+func authFailuresFor(s authSubject) *authFailures {
+	if e, ok := authFailBy[s]; ok {
+		authFailLRU.MoveToFront(e)
+		return e.Value.(*authFailures)
+	}
+	if authFailLRU.Len() >= maxAuthSubjects {
+		oldest := authFailLRU.Back()
+		authFailLRU.Remove(oldest)
+		delete(authFailBy, oldest.Value.(*authFailures).subject)
+	}
+	f := &authFailures{subject: s}
+	authFailBy[s] = authFailLRU.PushFront(f)
+	return f
+}
+
+// authBanned reports how long the source IP or user is still banned for
+func authBanned(ip, user string, now time.Time) (time.Duration, bool) {
+	if *authFailLimit <= 0 {
+		return 0, false
+	}
+	authFailMu.Lock()
+	defer authFailMu.Unlock()
+	var wait time.Duration
+	for _, s := range []authSubject{{"ip", ip}, {"user", user}} {
+		if s.value == "" {
+			continue
+		}
+		if e, ok := authFailBy[s]; ok {
+			wait = max(wait, e.Value.(*authFailures).bannedUntil.Sub(now))
+		}
+	}
+	return wait, wait > 0
+}
+
+// authFailed counts a failed login against the source IP and the user it
+// claimed, banning either once it reaches -auth-fail-limit in the window
+func authFailed(ip, user string, now time.Time) {
+	if *authFailLimit <= 0 {
+		return
+	}
+	authFailMu.Lock()
+	defer authFailMu.Unlock()
+	for _, s := range []authSubject{{"ip", ip}, {"user", user}} {
+		if s.value == "" {
+			continue
+		}
+		f := authFailuresFor(s)
+		if now.Sub(f.windowStart) > *authFailWindow {
+			f.count, f.windowStart = 0, now
+		}
+		f.count++
+		if f.count >= *authFailLimit && !now.Before(f.bannedUntil) {
+			f.bannedUntil = now.Add(*authBanTime)
+			f.count = 0
+			authBans[s] = f.bannedUntil
+			log.Printf("proxy: banning %s %q for %s after %d failed logins", s.kind, s.value, *authBanTime, *authFailLimit)
+			e := newBanEvent("auth.banned", s, now)
+			e.Failures, e.WindowSeconds = *authFailLimit, authFailWindow.Seconds()
+			until := f.bannedUntil.UTC()
+			e.BannedUntil = &until
+			notifyBan(e)
+		}
+	}
+}
+
+// expireBans notes bans that have run out, or whose subject was forgotten to
+// make room for others
+func expireBans(now time.Time) {
+	if *authFailLimit <= 0 {
+		return
+	}
+	authFailMu.Lock()
+	defer authFailMu.Unlock()
+	for s, until := range authBans {
+		if _, tracked := authFailBy[s]; tracked && now.Before(until) {
+			continue
+		}
+		delete(authBans, s)
+		notifyBan(newBanEvent("auth.unbanned", s, now))
+	}
+}
+
+// helper to answer a banned proxy client
+func writeAuthBanned(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	http.Error(w, "too many failed logins", http.StatusTooManyRequests)
+}
+
+type banEntry struct {
+	IP          string    `json:"ip,omitempty"`
+	User        string    `json:"user,omitempty"`
+	BannedUntil time.Time `json:"banned_until"`
+}
+
+func bansHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		listBansHandler(w, r)
+	case http.MethodDelete:
+		clearBanHandler(w, r)
+	default:
+		writeMethodNotAllowed(w)
+	}
+}
+
+// GET /bans
+func listBansHandler(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	bans := []banEntry{}
+	authFailMu.Lock()
+	for e := authFailLRU.Front(); e != nil; e = e.Next() {
+		f := e.Value.(*authFailures)
+		if !now.Before(f.bannedUntil) {
+			continue
+		}
+		b := banEntry{BannedUntil: f.bannedUntil}
+		if f.subject.kind == "ip" {
+			b.IP = f.subject.value
+		} else {
+			b.User = f.subject.value
+		}
+		bans = append(bans, b)
+	}
+	authFailMu.Unlock()
+	sort.Slice(bans, func(i, j int) bool { return bans[i].BannedUntil.Before(bans[j].BannedUntil) })
+
+	writeJSON(w, http.StatusOK, bans)
+}
+
+// DELETE /bans?ip=203.0.113.7 or /bans?user=u
+//
+// Lifts the ban and forgets the failures counted so far.
+func clearBanHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	var s authSubject
+	switch {
+	case q.Get("ip") != "" && q.Get("user") != "":
+		writeInvalid(w, &fieldError{"ip", "give either ip or user"})
+		return
+	case q.Get("ip") != "":
+		s = authSubject{"ip", q.Get("ip")}
+		if addr, err := netip.ParseAddr(s.value); err == nil {
+			s.value = addr.Unmap().String() // as the proxy listener records it
+		}
+	case q.Get("user") != "":
+		s = authSubject{"user", q.Get("user")}
+	default:
+		writeInvalid(w, &fieldError{"user", "missing ip or user"})
+		return
+	}
+
+	now := time.Now()
+	authFailMu.Lock()
+	e, ok := authFailBy[s]
+	banned := ok && now.Before(e.Value.(*authFailures).bannedUntil)
+	if ok {
+		authFailLRU.Remove(e)
+		delete(authFailBy, s)
+	}
+	if banned {
+		delete(authBans, s)
+		ev := newBanEvent("auth.unbanned", s, now)
+		ev.Actor = sourceOf(r).Actor
+		notifyBan(ev)
+	}
+	authFailMu.Unlock()
+	if !banned {
+		writeError(w, http.StatusNotFound, "ban_not_found", "no active ban")
+		return
+	}
+	log.Printf("admin: %s lifted the ban on %s %q", sourceOf(r).Actor, s.kind, s.value)
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+var (
+	authExecPath = flag.String("auth-exec", "", "command deciding proxy logins of users without a local password: "+
+		"run with the username as its only argument, the password and a newline on stdin, and "+
+		"UPSTREAMGATE_USER and UPSTREAMGATE_CLIENT_IP in its environment; exit 0 allows, any other exit denies")
+	authExecTimeout     = flag.Duration("auth-exec-timeout", 5*time.Second, "how long -auth-exec may run, including waiting for a free worker, before the login is refused")
+	authExecWorkers     = flag.Int("auth-exec-workers", 8, "how many -auth-exec commands may run at once")
+	authExecTTL         = flag.Duration("auth-exec-ttl", time.Minute, "how long an allow from -auth-exec is remembered")
+	authExecNegativeTTL = flag.Duration("auth-exec-negative-ttl", 10*time.Second, "how long a deny from -auth-exec is remembered")
+)
+
+// authExecSlots bounds the commands running at once
+var authExecSlots chan struct{}
+
+// checkAuthExec validates -auth-exec and sets up its worker pool
+func checkAuthExec() error {
+	if *authWebhookURL != "" {
+		return errors.New("-auth-exec and -auth-webhook are mutually exclusive")
+	}
+	if *authExecWorkers < 1 {
+		return errors.New("-auth-exec-workers must be at least 1")
+	}
+	st, err := os.Stat(*authExecPath)
+	if err != nil {
+		return err
+	}
+	if st.IsDir() || st.Mode()&0o111 == 0 {
+		return fmt.Errorf("%s is not executable", *authExecPath)
+	}
+	authExecSlots = make(chan struct{}, *authExecWorkers)
+	return nil
+}
+
+// execAllows asks -auth-exec about a login, remembering the answer for
+// -auth-exec-ttl (allow) or -auth-exec-negative-ttl (deny). Commands that
+// fail to run or time out refuse the login without being remembered.
+func execAllows(user, password, clientIP string) bool {
+	allow, err := cachedDecision("exec", user, password, clientIP, *authExecTTL, *authExecNegativeTTL, func() (bool, error) {
+		return runAuthExec(user, password, clientIP)
+	})
+	if err != nil {
+		log.Printf("auth-exec: %q: %v", user, err)
+		return false
+	}
+	return allow
+}
+
+// helper to run the command once a worker is free
+func runAuthExec(user, password, clientIP string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), *authExecTimeout)
+	defer cancel()
+	select {
+	case authExecSlots <- struct{}{}:
+		defer func() { <-authExecSlots }()
+	case <-ctx.Done():
+		return false, errors.New("no free worker before the timeout")
+	}
+
+	cmd := exec.CommandContext(ctx, *authExecPath, user)
+	cmd.Stdin = strings.NewReader(password + "\n")
+	cmd.Env = append(os.Environ(), "UPSTREAMGATE_USER="+user, "UPSTREAMGATE_CLIENT_IP="+clientIP)
+	// don't wait long on grandchildren that inherited stdin
+	cmd.WaitDelay = time.Second
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	switch {
+	case ctx.Err() != nil:
+		return false, fmt.Errorf("timed out after %s", *authExecTimeout)
+	case err == nil:
+		return true, nil
+	case errors.As(err, &exitErr) && exitErr.Exited():
+		return false, nil
+	}
+	return false, err
+}
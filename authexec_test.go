@@ -0,0 +1,205 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeAuthExec is the -auth-exec of the tests. It logs the start and end of
+// each run to $CALLS and allows alice and slow* users with open-sesame from
+// 127.0.0.1. slow* users take 0.3s, hang hangs, and crash kills itself.
+const fakeAuthExec = `#!/bin/sh
+read -r password
+echo "start $1 $UPSTREAMGATE_USER" >> "$CALLS"
+case "$1" in
+slow*) sleep 0.3 ;;
+hang) sleep 30 ;;
+crash) kill -9 $$ ;;
+esac
+echo "end $1" >> "$CALLS"
+[ "$1" = alice ] || [ "${1#slow}" != "$1" ] || exit 1
+[ "$password" = open-sesame ] && [ "$UPSTREAMGATE_CLIENT_IP" = 127.0.0.1 ]
+`
+
+// useAuthExec installs the fake script as -auth-exec with the given limits
+// until the test ends, and returns the file its calls are logged to
+func useAuthExec(t *testing.T, workers int, timeout time.Duration) string {
+	t.Helper()
+	dir := t.TempDir()
+	script := filepath.Join(dir, "check-user")
+	if err := os.WriteFile(script, []byte(fakeAuthExec), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	calls := filepath.Join(dir, "calls")
+	t.Setenv("CALLS", calls)
+
+	path, w, d := *authExecPath, *authExecWorkers, *authExecTimeout
+	t.Cleanup(func() {
+		*authExecPath, *authExecWorkers, *authExecTimeout = path, w, d
+		authExecSlots = nil
+		authDecisionsMu.Lock()
+		clear(authDecisions)
+		authDecisionsMu.Unlock()
+	})
+	*authExecPath, *authExecWorkers, *authExecTimeout = script, workers, timeout
+	if err := checkAuthExec(); err != nil {
+		t.Fatal(err)
+	}
+	return calls
+}
+
+// helper to read the script's call log, one line per start and end
+func authExecCalls(t *testing.T, calls string) []string {
+	t.Helper()
+	b, err := os.ReadFile(calls)
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	return strings.Split(strings.TrimSuffix(string(b), "\n"), "\n")
+}
+
+func TestAuthExecDecides(t *testing.T) {
+	calls := useAuthExec(t, 2, 5*time.Second)
+	proxyAddr := startProxy(t)
+	target := startEchoServer(t)
+
+	resp, conn := dialConnect(t, proxyAddr, target, basicAuth("alice", "open-sesame"))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("allowed login: status = %d, want 200", resp.StatusCode)
+	}
+	expectEcho(t, conn, "hi")
+	for _, auth := range []string{basicAuth("alice", "wrong"), basicAuth("bob", "open-sesame")} {
+		if resp, _ := dialConnect(t, proxyAddr, target, auth); resp.StatusCode != http.StatusProxyAuthRequired {
+			t.Errorf("denied login: status = %d, want 407", resp.StatusCode)
+		}
+	}
+	want := "start alice alice,end alice,start alice alice,end alice,start bob bob,end bob"
+	if got := strings.Join(authExecCalls(t, calls), ","); got != want {
+		t.Errorf("calls = %q, want %q", got, want)
+	}
+
+	// both answers are remembered
+	dialConnect(t, proxyAddr, target, basicAuth("alice", "open-sesame"))
+	dialConnect(t, proxyAddr, target, basicAuth("bob", "open-sesame"))
+	if got := strings.Join(authExecCalls(t, calls), ","); got != want {
+		t.Errorf("calls after repeated logins = %q, want no new ones", got)
+	}
+}
+
+func TestAuthExecTimeout(t *testing.T) {
+	calls := useAuthExec(t, 1, 200*time.Millisecond)
+	proxyAddr := startProxy(t)
+	target := startEchoServer(t)
+
+	for i := 0; i < 2; i++ {
+		start := time.Now()
+		resp, _ := dialConnect(t, proxyAddr, target, basicAuth("hang", "open-sesame"))
+		if resp.StatusCode != http.StatusProxyAuthRequired {
+			t.Errorf("hung command: status = %d, want 407", resp.StatusCode)
+		}
+		// the command is killed at the timeout; WaitDelay bounds the rest
+		if d := time.Since(start); d > 2*time.Second {
+			t.Errorf("hung command held the login for %s", d)
+		}
+	}
+	// a timeout isn't remembered, so the second login ran the command again
+	if got := authExecCalls(t, calls); len(got) != 2 || got[0] != "start hang hang" || got[1] != got[0] {
+		t.Errorf("calls = %q, want two starts that never ended", got)
+	}
+
+	// a crash refuses the login too
+	if resp, _ := dialConnect(t, proxyAddr, target, basicAuth("crash", "open-sesame")); resp.StatusCode != http.StatusProxyAuthRequired {
+		t.Errorf("crashed command: status = %d, want 407", resp.StatusCode)
+	}
+}
+
+func TestAuthExecWorkers(t *testing.T) {
+	calls := useAuthExec(t, 1, 5*time.Second)
+	proxyAddr := startProxy(t)
+	target := startEchoServer(t)
+
+	var wg sync.WaitGroup
+	for _, user := range []string{"slow1", "slow2", "slow3"} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, conn, err := sendConnect(proxyAddr, target, basicAuth(user, "open-sesame"))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			conn.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Errorf("%s: status = %d, want 200", user, resp.StatusCode)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// with one worker, every command ends before the next starts
+	got := authExecCalls(t, calls)
+	if len(got) != 6 {
+		t.Fatalf("calls = %q, want three runs", got)
+	}
+	for i := 0; i < len(got); i += 2 {
+		user := strings.Fields(got[i])[1]
+		if got[i+1] != "end "+user {
+			t.Fatalf("calls = %q: %s didn't end before the next command started", got, user)
+		}
+	}
+
+	// a login waiting too long for the worker is refused
+	*authExecTimeout = 100 * time.Millisecond
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if _, conn, err := sendConnect(proxyAddr, target, basicAuth("slow4", "open-sesame")); err == nil {
+			conn.Close()
+		}
+	}()
+	defer func() { <-done }()
+	time.Sleep(50 * time.Millisecond)
+	if resp, _ := dialConnect(t, proxyAddr, target, basicAuth("slow5", "open-sesame")); resp.StatusCode != http.StatusProxyAuthRequired {
+		t.Errorf("login queued past the timeout: status = %d, want 407", resp.StatusCode)
+	}
+}
+
+func TestCheckAuthExec(t *testing.T) {
+	dir := t.TempDir()
+	plain := filepath.Join(dir, "plain")
+	os.WriteFile(plain, []byte("#!/bin/sh\n"), 0o644)
+	script := filepath.Join(dir, "script")
+	os.WriteFile(script, []byte("#!/bin/sh\n"), 0o755)
+
+	defer func(path string, workers int, webhook string) {
+		*authExecPath, *authExecWorkers, *authWebhookURL = path, workers, webhook
+		authExecSlots = nil
+	}(*authExecPath, *authExecWorkers, *authWebhookURL)
+	for _, tt := range []struct {
+		path    string
+		workers int
+		webhook string
+		wantErr string
+	}{
+		{path: script, workers: 1},
+		{path: filepath.Join(dir, "missing"), workers: 1, wantErr: "no such file"},
+		{path: plain, workers: 1, wantErr: "not executable"},
+		{path: dir, workers: 1, wantErr: "not executable"},
+		{path: script, workers: 0, wantErr: "at least 1"},
+		{path: script, workers: 1, webhook: "https://auth.example.com", wantErr: "mutually exclusive"},
+	} {
+		*authExecPath, *authExecWorkers, *authWebhookURL = tt.path, tt.workers, tt.webhook
+		err := checkAuthExec()
+		switch {
+		case tt.wantErr == "" && err != nil:
+			t.Errorf("%s: %v", tt.path, err)
+		case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+			t.Errorf("%s, %d workers, webhook %q: err = %v, want %q", tt.path, tt.workers, tt.webhook, err, tt.wantErr)
+		}
+	}
+}
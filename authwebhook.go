@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+var (
+	authWebhookURL         = flag.String("auth-webhook", "", "HTTPS URL asked to allow or deny proxy logins of users without a local password")
+	authWebhookTimeout     = flag.Duration("auth-webhook-timeout", 5*time.Second, "how long to wait for -auth-webhook")
+	authWebhookTTL         = flag.Duration("auth-webhook-ttl", 5*time.Minute, "how long an allow from -auth-webhook is remembered")
+	authWebhookNegativeTTL = flag.Duration("auth-webhook-negative-ttl", 10*time.Second, "how long a deny from -auth-webhook is remembered")
+	authWebhookFailOpen    = flag.Bool("auth-webhook-fail-open", false, "allow logins when -auth-webhook fails or times out instead of refusing them")
+)
+
+type authWebhookRequest struct {
+	User     string `json:"user"`
+	Password string `json:"password"`
+	ClientIP string `json:"client_ip,omitempty"`
+}
+
+type authDecision struct {
+	allow   bool
+	expires time.Time
+}
+
+var (
+	authWebhookClient *http.Client
+	authDecisionsMu   sync.Mutex
+	authDecisions     = map[[sha256.Size]byte]authDecision{} // HMAC of kind, user, password and IP
+)
+
+// checkAuthWebhook validates -auth-webhook: passwords are sent in the body,
+// so plain http is only allowed to loopback addresses
+func checkAuthWebhook() error {
+	u, err := url.Parse(*authWebhookURL)
+	if err != nil {
+		return err
+	}
+	switch u.Scheme {
+	case "https":
+	case "http":
+		if !isLoopbackHost(u.Hostname()) {
+			return errors.New("must use https unless it points at a loopback address")
+		}
+	default:
+		return errors.New("must be an http(s) URL")
+	}
+	authWebhookClient = &http.Client{Timeout: *authWebhookTimeout}
+	return nil
+}
+
+// isLoopbackHost reports "localhost" and loopback addresses, where secrets
+// may go over plain http
+func isLoopbackHost(host string) bool {
+	ip := net.ParseIP(host)
+	return host == "localhost" || (ip != nil && ip.IsLoopback())
+}
+
+// webhookAllows asks -auth-webhook about a login, remembering the answer for
+// -auth-webhook-ttl (allow) or -auth-webhook-negative-ttl (deny)
+func webhookAllows(user, password, clientIP string) bool {
+	allow, err := cachedDecision("webhook", user, password, clientIP, *authWebhookTTL, *authWebhookNegativeTTL, func() (bool, error) {
+		return askAuthWebhook(authWebhookRequest{user, password, clientIP})
+	})
+	if err != nil {
+		log.Printf("auth-webhook: %q: %v", user, err)
+		return *authWebhookFailOpen
+	}
+	return allow
+}
+
+// cachedDecision returns the remembered answer of an external check of a
+// login, or asks for one and remembers it for ttl (allow) or negativeTTL
+// (deny). Errors are not remembered.
+func cachedDecision(kind, user, password, clientIP string, ttl, negativeTTL time.Duration, ask func() (bool, error)) (bool, error) {
+	key := authMAC(kind, user, password, clientIP)
+	now := time.Now()
+	authDecisionsMu.Lock()
+	d, ok := authDecisions[key]
+	authDecisionsMu.Unlock()
+	if ok && now.Before(d.expires) {
+		return d.allow, nil
+	}
+
+	allow, err := ask()
+	if err != nil {
+		return false, err
+	}
+	if !allow {
+		ttl = negativeTTL
+	}
+	authDecisionsMu.Lock()
+	if len(authDecisions) >= authCacheMax {
+		for k, d := range authDecisions {
+			if !now.Before(d.expires) {
+				delete(authDecisions, k)
+			}
+		}
+		if len(authDecisions) >= authCacheMax {
+			clear(authDecisions)
+		}
+	}
+	authDecisions[key] = authDecision{allow, now.Add(ttl)}
+	authDecisionsMu.Unlock()
+	return allow, nil
+}
+
+// helper to POST one login to the webhook: 200 allows, 403 denies and
+// anything else is an error
+func askAuthWebhook(body authWebhookRequest) (bool, error) {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return false, err
+	}
+	req, err := http.NewRequest(http.MethodPost, *authWebhookURL, bytes.NewReader(b))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	signWebhook(req, *webhookSecret, b)
+	resp, err := authWebhookClient.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4<<10))
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusForbidden:
+		return false, nil
+	}
+	return false, fmt.Errorf("unexpected status %s", resp.Status)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"flag"
+	"sync"
+	"time"
+)
+
+var securityWebhookURL = flag.String("security-webhook", "", "URL that receives a JSON POST when a source IP or username is banned for failed logins and when the ban lifts (default -change-webhook)")
+
+const (
+	// banEventInterval is how often ban events are sent; a flood of bans in
+	// one interval is coalesced into a single summary
+	banEventInterval = 5 * time.Second
+	banEventsPerSend = 10
+)
+
+type banEvent struct {
+	Event         string     `json:"event"` // auth.banned or auth.unbanned
+	Time          time.Time  `json:"time"`
+	IP            string     `json:"ip,omitempty"`
+	User          string     `json:"user,omitempty"`
+	Failures      int        `json:"failures,omitempty"`
+	WindowSeconds float64    `json:"window_seconds,omitempty"`
+	BannedUntil   *time.Time `json:"banned_until,omitempty"`
+	Actor         string     `json:"actor,omitempty"` // who lifted the ban early
+}
+
+// banSummary stands in for the events beyond banEventsPerSend in one interval
+type banSummary struct {
+	Event    string    `json:"event"` // auth.bans_coalesced
+	Time     time.Time `json:"time"`
+	Banned   int       `json:"banned"`
+	Unbanned int       `json:"unbanned"`
+}
+
+var (
+	securityHook *webhook
+
+	banEventsMu sync.Mutex
+	banEvents   []banEvent
+	banOverflow banSummary // counts of the events that didn't fit
+)
+
+// startSecurityWebhook sends ban events to -security-webhook, or to
+// -change-webhook when there is no dedicated one
+func startSecurityWebhook() {
+	switch {
+	case *securityWebhookURL != "":
+		securityHook = newWebhook(*securityWebhookURL, *webhookSecret)
+	case changeHook != nil:
+		securityHook = changeHook
+	default:
+		return
+	}
+	go sendBanEvents()
+}
+
+// helper to queue a ban event for the next send; it never blocks for long,
+// so it may be called with authFailMu held
+func notifyBan(e banEvent) {
+	if securityHook == nil {
+		return
+	}
+	banEventsMu.Lock()
+	defer banEventsMu.Unlock()
+	if len(banEvents) < banEventsPerSend {
+		banEvents = append(banEvents, e)
+		return
+	}
+	if e.Event == "auth.banned" {
+		banOverflow.Banned++
+	} else {
+		banOverflow.Unbanned++
+	}
+}
+
+func sendBanEvents() {
+	t := time.NewTicker(banEventInterval)
+	defer t.Stop()
+	for now := range t.C {
+		banEventsMu.Lock()
+		events, overflow := banEvents, banOverflow
+		banEvents, banOverflow = nil, banSummary{}
+		banEventsMu.Unlock()
+
+		for _, e := range events {
+			securityHook.send(e)
+		}
+		if overflow.Banned+overflow.Unbanned > 0 {
+			overflow.Event, overflow.Time = "auth.bans_coalesced", now.UTC()
+			securityHook.send(overflow)
+		}
+	}
+}
+
+// helper to build the event for subject s
+func newBanEvent(event string, s authSubject, now time.Time) banEvent {
+	e := banEvent{Event: event, Time: now.UTC()}
+	if s.kind == "ip" {
+		e.IP = s.value
+	} else {
+		e.User = s.value
+	}
+	return e
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+var (
+	maxBodyBytes     = flag.Int64("admin-max-body", 16<<10, "largest control API request body in bytes, except bulk set and import")
+	maxBulkBodyBytes = flag.Int64("admin-max-bulk-body", 32<<20, "largest request body in bytes for POST /upstreams and POST /import")
+)
+
+// decodeJSON decodes the body of a control request into v. The body must be
+// sent as application/json, hold exactly one JSON value of at most limit
+// bytes, and use only fields v knows about, so typos are caught rather than
+// silently ignored. On failure the error response has been written and
+// false is returned.
+func decodeJSON(w http.ResponseWriter, r *http.Request, limit int64, v any) bool {
+	if mt, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err != nil || mt != "application/json" {
+		writeError(w, http.StatusUnsupportedMediaType, "unsupported_media_type", "Content-Type must be application/json")
+		return false
+	}
+
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, limit))
+	dec.DisallowUnknownFields()
+	err := dec.Decode(v)
+	if err == io.EOF {
+		err = errors.New("request body is empty")
+	} else if err == nil {
+		var extra json.RawMessage
+		if err = dec.Decode(&extra); err == io.EOF {
+			return true
+		}
+		if tooBig := (*http.MaxBytesError)(nil); !errors.As(err, &tooBig) {
+			err = errors.New("unexpected data after the JSON value")
+		}
+	}
+
+	var tooBig *http.MaxBytesError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &tooBig):
+		writeError(w, http.StatusRequestEntityTooLarge, "body_too_large", fmt.Sprintf("request body larger than %d bytes", limit))
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		// encoding/json has no typed error for this one
+		field, uerr := strconv.Unquote(strings.TrimPrefix(err.Error(), "json: unknown field "))
+		if uerr != nil {
+			field = ""
+		}
+		writeAPIError(w, http.StatusBadRequest, &apiError{Code: "unknown_field", Message: "unknown field", Field: field})
+	case errors.As(err, &typeErr):
+		writeAPIError(w, http.StatusBadRequest, &apiError{Code: "invalid_json", Message: "wrong type, want " + typeErr.Type.String(), Field: typeErr.Field})
+	default:
+		writeError(w, http.StatusBadRequest, "invalid_json", "invalid json: "+err.Error())
+	}
+	return false
+}
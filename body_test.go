@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDecodeJSON(t *testing.T) {
+	type request struct {
+		User  string `json:"user"`
+		Count int    `json:"count"`
+	}
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		limit       int64
+		status      int    // 0 when the body decodes
+		code        string // the error code
+		field       string // the error's field, if any
+	}{
+		{name: "valid", body: `{"user":"alice","count":2}`},
+		{name: "charset parameter", contentType: "application/json; charset=utf-8", body: `{"user":"alice"}`},
+		{name: "trailing whitespace", body: "{\"user\":\"alice\"}\n\t "},
+		{name: "exactly the limit", body: `{"user":"alice"}`, limit: int64(len(`{"user":"alice"}`))},
+
+		{name: "no content type", contentType: "-", body: `{"user":"alice"}`, status: 415, code: "unsupported_media_type"},
+		{name: "form content type", contentType: "application/x-www-form-urlencoded", body: `{"user":"alice"}`, status: 415, code: "unsupported_media_type"},
+		{name: "text content type", contentType: "text/plain", body: `{"user":"alice"}`, status: 415, code: "unsupported_media_type"},
+		{name: "malformed content type", contentType: "application/json; =", body: `{"user":"alice"}`, status: 415, code: "unsupported_media_type"},
+
+		{name: "one byte over the limit", body: `{"user":"alice"} `, limit: int64(len(`{"user":"alice"}`)), status: 413, code: "body_too_large"},
+		{name: "far over the limit", body: `{"user":"` + strings.Repeat("a", 1<<16) + `"}`, limit: 1 << 10, status: 413, code: "body_too_large"},
+		{name: "trailing value over the limit", body: `{"user":"alice"}` + strings.Repeat(" ", 100) + `{}`, limit: 64, status: 413, code: "body_too_large"},
+
+		{name: "unknown field", body: `{"user":"alice","usr":"bob"}`, status: 400, code: "unknown_field", field: "usr"},
+		{name: "unknown field only", body: `{"upstream":"direct"}`, status: 400, code: "unknown_field", field: "upstream"},
+		{name: "wrong type", body: `{"count":"2"}`, status: 400, code: "invalid_json", field: "count"},
+
+		{name: "second object", body: `{"user":"alice"}{"user":"bob"}`, status: 400, code: "invalid_json"},
+		{name: "trailing garbage", body: `{"user":"alice"} x`, status: 400, code: "invalid_json"},
+		{name: "trailing array", body: `{"user":"alice"}[]`, status: 400, code: "invalid_json"},
+
+		{name: "empty body", body: "", status: 400, code: "invalid_json"},
+		{name: "whitespace only", body: " \n", status: 400, code: "invalid_json"},
+
+		{name: "truncated object", body: `{"user":"ali`, status: 400, code: "invalid_json"},
+		{name: "missing closing brace", body: `{"user":"alice"`, status: 400, code: "invalid_json"},
+		{name: "not JSON", body: `user=alice`, status: 400, code: "invalid_json"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/upstream", strings.NewReader(tt.body))
+			switch tt.contentType {
+			case "":
+				r.Header.Set("Content-Type", "application/json")
+			case "-":
+			default:
+				r.Header.Set("Content-Type", tt.contentType)
+			}
+			limit := tt.limit
+			if limit == 0 {
+				limit = *maxBodyBytes
+			}
+			w := httptest.NewRecorder()
+			var req request
+			ok := decodeJSON(w, r, limit, &req)
+
+			if tt.status == 0 {
+				if !ok {
+					t.Fatalf("decodeJSON failed: %d %s", w.Code, w.Body)
+				}
+				if req.User != "alice" {
+					t.Errorf("user = %q, want alice", req.User)
+				}
+				return
+			}
+			if ok {
+				t.Fatalf("decodeJSON accepted %q", tt.body)
+			}
+			if w.Code != tt.status {
+				t.Errorf("status = %d, want %d", w.Code, tt.status)
+			}
+			var resp struct {
+				Error apiError `json:"error"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("error body %q: %v", w.Body, err)
+			}
+			if resp.Error.Code != tt.code || resp.Error.Field != tt.field {
+				t.Errorf("error = %+v, want code %q field %q", resp.Error, tt.code, tt.field)
+			}
+		})
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// An upstream may be a comma-separated chain of proxy URLs, e.g.
+// "http://corp:3128,socks5://exit:1080": the first hop is dialed directly,
+// each later one through the hops before it, and the last one reaches the
+// target.
+
+// maxUpstreamHops bounds the length of a chain
+const maxUpstreamHops = 8
+
+// upstreamDirect is how the first hop is reached
+var upstreamDirect = upstreamHostDialer{timeout: 10 * time.Second}
+
+func isChain(raw string) bool {
+	return strings.Contains(raw, ",")
+}
+
+// upstreamHops parses each hop of a chain
+func upstreamHops(raw string) ([]*url.URL, error) {
+	parts := strings.Split(raw, ",")
+	if len(parts) > maxUpstreamHops {
+		return nil, fmt.Errorf("chains may have at most %d hops", maxUpstreamHops)
+	}
+	hops := make([]*url.URL, len(parts))
+	for i, p := range parts {
+		u, err := parseUpstream(strings.TrimSpace(p))
+		if err != nil {
+			return nil, fmt.Errorf("hop %d: %w", i+1, err)
+		}
+		if u.Scheme == "direct" {
+			return nil, fmt.Errorf("hop %d: direct can't be part of a chain", i+1)
+		}
+		if u.Scheme == "h3" && i > 0 {
+			return nil, fmt.Errorf("hop %d: h3 runs over UDP, so it can only be the first hop", i+1)
+		}
+		hops[i] = u
+	}
+	return hops, nil
+}
+
+// redactChain masks the passwords of every hop
+func redactChain(raw string) string {
+	hops, err := upstreamHops(raw)
+	if err != nil {
+		return raw
+	}
+	out := make([]string, len(hops))
+	for i, u := range hops {
+		out[i] = u.Redacted()
+	}
+	return strings.Join(out, ",")
+}
+
+// chainDialer dials hops in turn, each through the ones before it. cfg
+// applies to the last hop.
+func chainDialer(raw string, params map[string]string, cfg hopConfig) (proxy.Dialer, error) {
+	hops, err := upstreamHops(raw)
+	if err != nil {
+		return nil, err
+	}
+	var d proxy.Dialer = upstreamDirect
+	via := ""
+	for i, u := range hops {
+		var hc hopConfig
+		if i == len(hops)-1 {
+			hc = cfg
+		}
+		hd, err := hopDialer(expandUserParams(u, params), d, via, hc)
+		if err != nil {
+			return nil, fmt.Errorf("hop %d: %w", i+1, err)
+		}
+		d = &chainHop{hd, i + 1, u.Redacted()}
+		via += u.String() + ","
+	}
+	return d, nil
+}
+
+// hopError is a failure of one hop of a chain
+type hopError struct {
+	hop int
+	url string // redacted
+	err error
+}
+
+func (e *hopError) Error() string { return fmt.Sprintf("hop %d (%s): %v", e.hop, e.url, e.err) }
+func (e *hopError) Unwrap() error { return e.err }
+
+// chainHop names the hop in errors that didn't come from a hop before it
+type chainHop struct {
+	proxy.Dialer
+	hop int
+	url string
+}
+
+func (h *chainHop) Dial(network, addr string) (net.Conn, error) {
+	conn, err := h.Dialer.Dial(network, addr)
+	var earlier *hopError
+	if err != nil && !errors.As(err, &earlier) {
+		err = &hopError{h.hop, h.url, err}
+	}
+	return conn, err
+}
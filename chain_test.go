@@ -0,0 +1,135 @@
+package main
+
+import (
+	"crypto/x509"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestUpstreamChain(t *testing.T) {
+	echo := startEchoServer(t)
+	proxyAddr := startProxy(t)
+
+	t.Run("http then socks5", func(t *testing.T) {
+		corp := &connectProxy{}
+		corpSrv := httptest.NewServer(corp)
+		defer corpSrv.Close()
+		exit := startFakeSOCKS5(t, "exit-user", "exit-pw")
+		setTestMapping(t, "alice", "http://corp:corp-pw@"+corpSrv.Listener.Addr().String()+",socks5h://exit-user:exit-pw@"+exit.addr, "")
+
+		resp, conn := dialConnect(t, proxyAddr, echo, basicAuth("alice", "x"))
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("status = %d, want 200", resp.StatusCode)
+		}
+		expectEcho(t, conn, "two hops")
+
+		corp.mu.Lock()
+		defer corp.mu.Unlock()
+		if len(corp.targets) != 1 || corp.targets[0] != exit.addr || corp.auths[0] != basicAuth("corp", "corp-pw") {
+			t.Errorf("first hop got CONNECT %q with %q, want the second hop with its own credentials", corp.targets, corp.auths)
+		}
+		if req := exit.lastRequest(t); net.JoinHostPort(req.host, itoa(req.port)) != echo {
+			t.Errorf("second hop got %s:%d, want the target %s", req.host, req.port, echo)
+		}
+	})
+
+	t.Run("socks5 then https then socks4", func(t *testing.T) {
+		first := startFakeSOCKS5(t, "", "")
+		middle, middleSrv, _ := startTLSConnectProxy(t)
+		roots := x509.NewCertPool()
+		roots.AddCert(middleSrv.Certificate())
+		upstreamRoots.Store(roots)
+		defer upstreamRoots.Store(nil)
+		last := startFakeSOCKS4(t, 0x5a)
+		setTestMapping(t, "alice", "socks5://"+first.addr+", https://"+middleSrv.Listener.Addr().String()+" ,socks4://ident@"+last.addr, "")
+
+		resp, conn := dialConnect(t, proxyAddr, echo, basicAuth("alice", "x"))
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("status = %d, want 200", resp.StatusCode)
+		}
+		expectEcho(t, conn, "three hops")
+
+		if req := first.lastRequest(t); net.JoinHostPort(req.host, itoa(req.port)) != middleSrv.Listener.Addr().String() {
+			t.Errorf("first hop was asked for %s:%d, want the second hop", req.host, req.port)
+		}
+		middle.mu.Lock()
+		if len(middle.targets) != 1 || middle.targets[0] != last.addr {
+			t.Errorf("second hop was asked for %q, want the third hop", middle.targets)
+		}
+		middle.mu.Unlock()
+		if req := last.lastRequest(t); net.JoinHostPort(req.ip.String(), itoa(req.port)) != echo || req.userID != "ident" {
+			t.Errorf("third hop was asked for %s:%d as %q, want the target", req.ip, req.port, req.userID)
+		}
+	})
+}
+
+// A failing hop is named, with its number and redacted URL, in the log
+func TestUpstreamChainHopErrors(t *testing.T) {
+	logs := captureLog(t)
+	setFlag(t, accessLog, true)
+
+	echo := startEchoServer(t)
+	proxyAddr := startProxy(t)
+	corpSrv := httptest.NewServer(&connectProxy{})
+	defer corpSrv.Close()
+	exit := startFakeSOCKS5(t, "exit-user", "exit-pw")
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed.Close()
+
+	for _, tt := range []struct {
+		name, chain, hop string
+	}{
+		{"first hop unreachable", "http://" + closed.Addr().String() + ",socks5://" + exit.addr, "hop 1 (http://" + closed.Addr().String() + ")"},
+		{"second hop refuses the login", "http://" + corpSrv.Listener.Addr().String() + ",socks5://exit-user:wrong@" + exit.addr, "hop 2 (socks5://exit-user:xxxxx@" + exit.addr + ")"},
+		// the first hop is what fails to reach the second
+		{"second hop unreachable", "http://" + corpSrv.Listener.Addr().String() + ",socks5://" + closed.Addr().String(), "hop 1 (http://" + corpSrv.Listener.Addr().String() + "): proxy connect failed: 502"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			logs.Reset()
+			setTestMapping(t, "alice", tt.chain, "")
+			resp, _ := dialConnect(t, proxyAddr, echo, basicAuth("alice", "x"))
+			if resp.StatusCode != http.StatusBadGateway {
+				t.Errorf("status = %d, want 502", resp.StatusCode)
+			}
+			if logs.waitFor(t, tt.hop) && strings.Contains(logs.String(), "wrong") {
+				t.Errorf("log shows a hop's password:\n%s", logs.String())
+			}
+		})
+	}
+}
+
+func TestUpstreamHops(t *testing.T) {
+	for _, tt := range []struct {
+		raw     string
+		hops    int
+		wantErr string
+	}{
+		{raw: "http://a:1,socks5://b:2", hops: 2},
+		{raw: " http://a:1 , socks5h://b:2 ,socks4a://c:3", hops: 3},
+		{raw: "h3://a:443,http://b:1", hops: 2},
+		{raw: "http://a:1,direct", wantErr: "hop 2: direct can't be part of a chain"},
+		{raw: "http://a:1,h3://b:443", wantErr: "hop 2: h3 runs over UDP"},
+		{raw: "http://a:1,socks5://:1080", wantErr: "hop 2: socks5 upstream needs a host:port"},
+		{raw: "http://a:1,", wantErr: "hop 2: missing scheme"},
+		{raw: strings.Repeat("http://a:1,", 8) + "http://a:1", wantErr: "at most 8 hops"},
+	} {
+		hops, err := upstreamHops(tt.raw)
+		switch {
+		case tt.wantErr == "" && err != nil:
+			t.Errorf("%q: %v", tt.raw, err)
+		case tt.wantErr == "" && len(hops) != tt.hops:
+			t.Errorf("%q: %d hops, want %d", tt.raw, len(hops), tt.hops)
+		case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+			t.Errorf("%q: err = %v, want %q", tt.raw, err, tt.wantErr)
+		}
+	}
+}
+
+func itoa(port uint16) string { return strconv.Itoa(int(port)) }
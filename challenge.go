@@ -0,0 +1,43 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"net/http"
+	"strings"
+	"unicode"
+)
+
+var authRealm = flag.String("auth-realm", "proxy", "realm shown in proxy auth challenges; changing it invalidates stored Digest hashes")
+
+// checkAuthRealm rejects realms that can't be sent as a quoted string
+func checkAuthRealm() error {
+	if *authRealm == "" {
+		return errors.New("may not be empty")
+	}
+	if strings.ContainsAny(*authRealm, `"\`) || strings.IndexFunc(*authRealm, unicode.IsControl) >= 0 {
+		return errors.New(`may not contain quotes, backslashes or control characters`)
+	}
+	return nil
+}
+
+// proxyChallenges returns a Proxy-Authenticate challenge for every enabled
+// scheme, strongest first
+func proxyChallenges(stale bool) []string {
+	var out []string
+	if *proxyDigest {
+		out = append(out, digestChallenges(stale)...)
+	}
+	if jwtEnabled() || oauthEnabled() {
+		out = append(out, `Bearer realm="`+*authRealm+`"`)
+	}
+	return append(out, `Basic realm="`+*authRealm+`"`)
+}
+
+// proxyAuthRequired answers 407 with the challenges of proxyChallenges
+func proxyAuthRequired(w http.ResponseWriter, stale bool) {
+	for _, c := range proxyChallenges(stale) {
+		w.Header().Add("Proxy-Authenticate", c)
+	}
+	w.WriteHeader(http.StatusProxyAuthRequired)
+}
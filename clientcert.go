@@ -0,0 +1,165 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var upstreamClientCertDir = flag.String("upstream-client-cert-dir", "", "directory that client_cert and ca files of TLS upstreams may be read from; empty allows only inline PEM")
+
+// clientCertSpec is where a mapping's client certificate comes from: inline
+// PEM or a cert/key file pair under -upstream-client-cert-dir. It is the
+// form taken by set requests and kept in records.
+type clientCertSpec struct {
+	CertPEM  string `json:"cert_pem,omitempty"`
+	KeyPEM   string `json:"key_pem,omitempty"`
+	CertFile string `json:"cert_file,omitempty"`
+	KeyFile  string `json:"key_file,omitempty"`
+}
+
+// upstreamClientCert is the certificate presented to a TLS upstream
+type upstreamClientCert struct {
+	spec   clientCertSpec
+	cert   tls.Certificate
+	leaf   *x509.Certificate
+	sha256 string // of the leaf, hex
+}
+
+// clientCertInfo describes a client certificate in responses, without the key
+type clientCertInfo struct {
+	Source   string    `json:"source"` // inline or file
+	CertFile string    `json:"cert_file,omitempty"`
+	KeyFile  string    `json:"key_file,omitempty"`
+	Subject  string    `json:"subject"`
+	NotAfter time.Time `json:"not_after"`
+	SHA256   string    `json:"sha256"`
+}
+
+func (c *upstreamClientCert) info() *clientCertInfo {
+	if c == nil {
+		return nil
+	}
+	info := &clientCertInfo{Source: "inline", Subject: c.leaf.Subject.String(), NotAfter: c.leaf.NotAfter, SHA256: c.sha256}
+	if c.spec.CertFile != "" {
+		info.Source, info.CertFile, info.KeyFile = "file", c.spec.CertFile, c.spec.KeyFile
+	}
+	return info
+}
+
+// helper to apply the optional client_cert of a set request. The pair is
+// loaded and checked here, so a key that doesn't match its certificate is
+// refused before the mapping changes.
+func setClientCert(up *Upstream, spec *clientCertSpec) error {
+	if spec == nil {
+		return nil
+	}
+	if s := up.URL.Scheme; s != "https" && s != "h3" && !isSOCKS5TLS(s) {
+		return &fieldError{"client_cert", "only https, h3 and socks5+tls upstreams take a client certificate"}
+	}
+	c, err := loadClientCert(*spec)
+	if err != nil {
+		return &fieldError{"client_cert", err.Error()}
+	}
+	up.ClientCert = c
+	return nil
+}
+
+// loadClientCert parses the pair named by spec. Errors never quote the key.
+func loadClientCert(spec clientCertSpec) (*upstreamClientCert, error) {
+	inline := spec.CertPEM != "" || spec.KeyPEM != ""
+	files := spec.CertFile != "" || spec.KeyFile != ""
+	var certPEM, keyPEM []byte
+	switch {
+	case inline && files:
+		return nil, errors.New("give either cert_pem and key_pem or cert_file and key_file")
+	case inline:
+		switch {
+		case spec.KeyPEM == "" && spec.CertPEM != "":
+			return nil, errors.New("key_pem is missing; exports leave inline keys out")
+		case spec.CertPEM == "":
+			return nil, errors.New("cert_pem and key_pem go together")
+		}
+		certPEM, keyPEM = []byte(spec.CertPEM), []byte(spec.KeyPEM)
+	case files:
+		if spec.CertFile == "" || spec.KeyFile == "" {
+			return nil, errors.New("cert_file and key_file go together")
+		}
+		var err error
+		if certPEM, err = readUpstreamTLSFile(spec.CertFile); err != nil {
+			return nil, err
+		}
+		if keyPEM, err = readUpstreamTLSFile(spec.KeyFile); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errors.New("missing")
+	}
+
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, errors.New("not a usable certificate and key pair")
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, errors.New("certificate doesn't parse")
+	}
+	sum := sha256.Sum256(leaf.Raw)
+	return &upstreamClientCert{spec: spec, cert: cert, leaf: leaf, sha256: hex.EncodeToString(sum[:])}, nil
+}
+
+// readUpstreamTLSFile reads a client_cert or ca file, which must resolve to
+// a path inside -upstream-client-cert-dir
+func readUpstreamTLSFile(name string) ([]byte, error) {
+	if *upstreamClientCertDir == "" {
+		return nil, errors.New("files are not allowed without -upstream-client-cert-dir")
+	}
+	if !filepath.IsAbs(name) {
+		return nil, errors.New(name + " is not an absolute path")
+	}
+	dir, err := filepath.EvalSymlinks(*upstreamClientCertDir)
+	if err != nil {
+		return nil, errors.New("-upstream-client-cert-dir is unavailable")
+	}
+	path, err := filepath.EvalSymlinks(name)
+	if err != nil {
+		return nil, errors.New(name + " can't be read")
+	}
+	if rel, err := filepath.Rel(dir, path); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return nil, errors.New(name + " is outside -upstream-client-cert-dir")
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.New(name + " can't be read")
+	}
+	return b, nil
+}
+
+// exported returns rec without the inline private keys of its client
+// certificates, for GET /export
+func (rec upstreamRecord) exported() upstreamRecord {
+	if rec.ClientCert != nil && rec.ClientCert.KeyPEM != "" {
+		cc := *rec.ClientCert
+		cc.KeyPEM = ""
+		rec.ClientCert = &cc
+	}
+	if rec.Previous != nil {
+		prev := rec.Previous.exported()
+		rec.Previous = &prev
+	}
+	return rec
+}
+
+func sameClientCert(a, b *upstreamClientCert) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.spec == b.spec && a.sha256 == b.sha256
+}
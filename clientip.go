@@ -0,0 +1,106 @@
+package main
+
+import (
+	"flag"
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+var trustedProxiesFlag = flag.String("trusted-proxies", "", "comma-separated CIDRs of proxies in front of the proxy listener; only their X-Forwarded-For is used as the client address")
+
+// trustedProxies is parsed from -trusted-proxies; empty trusts no one
+var trustedProxies []netip.Prefix
+
+func loadTrustedProxies() error {
+	for _, s := range strings.Split(*trustedProxiesFlag, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		p, err := parseCIDR(s)
+		if err != nil {
+			return err
+		}
+		trustedProxies = append(trustedProxies, p)
+	}
+	return nil
+}
+
+func isTrustedProxy(addr netip.Addr) bool {
+	return slices.ContainsFunc(trustedProxies, func(p netip.Prefix) bool { return p.Contains(addr) })
+}
+
+// clientAddr returns the address of the proxy client: the TCP peer, or when
+// that is a trusted proxy, the nearest X-Forwarded-For hop it vouches for
+func clientAddr(r *http.Request) (netip.Addr, bool) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	addr = addr.Unmap()
+	if !isTrustedProxy(addr) {
+		return addr, true
+	}
+
+	xff := r.Header.Values("X-Forwarded-For")
+	if len(xff) == 0 {
+		return addr, true
+	}
+	// walk from the right, where hops appended by trusted proxies are
+	hops := strings.Split(strings.Join(xff, ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			return netip.Addr{}, false
+		}
+		addr = hop.Unmap()
+		if !isTrustedProxy(addr) {
+			break
+		}
+	}
+	return addr, true
+}
+
+// helper to check a client address against a mapping's allowlist, where an
+// empty list allows any address
+func addrAllowed(up *Upstream, addr netip.Addr, ok bool) bool {
+	if len(up.AllowedIPs) == 0 {
+		return true
+	}
+	return ok && slices.ContainsFunc(up.AllowedIPs, func(p netip.Prefix) bool { return p.Contains(addr) })
+}
+
+// helper to apply the optional allowed_ips of a set request: nil keeps the
+// list of the mapping being replaced, empty removes it
+func setAllowedIPs(up *Upstream, list []string) error {
+	if list == nil {
+		up.keepAllowedIPs = true
+		return nil
+	}
+	prefixes, err := parseAllowedIPs(list)
+	up.AllowedIPs = prefixes
+	return err
+}
+
+// parseAllowedIPs validates the allowed_ips of a set request
+func parseAllowedIPs(list []string) ([]netip.Prefix, error) {
+	if len(list) > 256 {
+		return nil, &fieldError{"allowed_ips", "more than 256 entries"}
+	}
+	var out []netip.Prefix
+	for _, s := range list {
+		p, err := parseCIDR(s)
+		if err != nil {
+			return nil, &fieldError{"allowed_ips", strconv.Quote(s) + " is not a CIDR or IP address"}
+		}
+		out = append(out, p)
+	}
+	return out, nil
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+var configPath = flag.String("config", "", "YAML or JSON file with listen address, default upstream and initial users")
+
+type configFile struct {
+	Listen          string       `yaml:"listen"`
+	DefaultUpstream string       `yaml:"default_upstream"`
+	Users           []configUser `yaml:"users"`
+
+	upstreams map[string]*Upstream // default_upstream is included as user "*"
+	passwords map[string]string    // plaintext from the file, hashed only when applied
+}
+
+type configUser struct {
+	User     string `yaml:"user"`
+	Password string `yaml:"password"`
+	Upstream string `yaml:"upstream"`
+
+	line int
+}
+
+func (cu *configUser) UnmarshalYAML(n *yaml.Node) error {
+	// n.Decode doesn't inherit KnownFields, so check keys by hand
+	if n.Kind == yaml.MappingNode {
+		for i := 0; i < len(n.Content); i += 2 {
+			switch k := n.Content[i]; k.Value {
+			case "user", "password", "upstream":
+			default:
+				return fmt.Errorf("line %d: unknown field %q", k.Line, k.Value)
+			}
+		}
+	}
+	type plain configUser
+	if err := n.Decode((*plain)(cu)); err != nil {
+		return err
+	}
+	cu.line = n.Line
+	return nil
+}
+
+// loadConfig parses and validates a config file. JSON is accepted as well
+// since it is valid YAML. Errors name the file, line and offending field.
+func loadConfig(path string) (*configFile, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &configFile{}
+	dec := yaml.NewDecoder(bytes.NewReader(b))
+	dec.KnownFields(true)
+	if err := dec.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	now := time.Now()
+	cfg.upstreams = map[string]*Upstream{}
+	cfg.passwords = map[string]string{}
+	if cfg.DefaultUpstream != "" {
+		u, err := parseUpstream(cfg.DefaultUpstream)
+		if err != nil {
+			return nil, fmt.Errorf("%s: default_upstream: %w", path, err)
+		}
+		cfg.upstreams[defaultUser] = &Upstream{Raw: cfg.DefaultUpstream, URL: u, SetAt: now}
+	}
+
+	for i, cu := range cfg.Users {
+		where := fmt.Sprintf("%s:%d: users[%d]", path, cu.line, i)
+		if err := validateUser(cu.User); err != nil {
+			return nil, fmt.Errorf("%s.%w", where, err)
+		}
+		switch {
+		case cu.Upstream == "":
+			return nil, fmt.Errorf("%s.upstream: missing", where)
+		case len(cu.Password) > 72:
+			return nil, fmt.Errorf("%s.password: longer than 72 bytes", where)
+		}
+		if _, dup := cfg.upstreams[cu.User]; dup {
+			if cu.User == defaultUser {
+				return nil, fmt.Errorf("%s.user: %q conflicts with default_upstream", where, cu.User)
+			}
+			return nil, fmt.Errorf("%s.user: duplicate user %q", where, cu.User)
+		}
+		u, err := parseUpstream(cu.Upstream)
+		if err != nil {
+			return nil, fmt.Errorf("%s.upstream: %w", where, err)
+		}
+		cfg.upstreams[cu.User] = &Upstream{Raw: cu.Upstream, URL: u, SetAt: now}
+		cfg.passwords[cu.User] = cu.Password
+	}
+	return cfg, nil
+}
+
+// configEntry is a user as last read from the config file
+type configEntry struct {
+	raw      string
+	password [32]byte // authMAC of the password, so changes are seen without keeping it
+}
+
+var (
+	configUsersMu sync.Mutex
+	configUsers   = map[string]configEntry{}
+)
+
+func (cfg *configFile) entry(user string) configEntry {
+	return configEntry{cfg.upstreams[user].Raw, authMAC(cfg.passwords[user])}
+}
+
+// helper to hash the file's password into a mapping about to be applied
+func (cfg *configFile) hashPassword(user string, up *Upstream) error {
+	return storePassword(user, up, cfg.passwords[user])
+}
+
+func rememberConfigUsers(cfg *configFile) {
+	users := make(map[string]configEntry, len(cfg.upstreams))
+	for user := range cfg.upstreams {
+		users[user] = cfg.entry(user)
+	}
+	configUsersMu.Lock()
+	configUsers = users
+	configUsersMu.Unlock()
+}
+
+func loadedConfigUsers() map[string]configEntry {
+	configUsersMu.Lock()
+	defer configUsersMu.Unlock()
+	return configUsers
+}
+
+// applyConfig seeds mappings from the config file. Users already restored
+// from the state file or store keep their runtime value.
+func applyConfig(cfg *configFile) error {
+	rememberConfigUsers(cfg)
+
+	upstreamsMu.RLock()
+	seed := map[string]*Upstream{}
+	for user, up := range cfg.upstreams {
+		if _, ok := upstreams[user]; !ok {
+			seed[user] = up
+		}
+	}
+	upstreamsMu.RUnlock()
+	for user, up := range seed {
+		if err := cfg.hashPassword(user, up); err != nil {
+			return err
+		}
+	}
+
+	if len(seed) == 0 {
+		return nil
+	}
+	log.Printf("config: seeding %d users from %s", len(seed), *configPath)
+	return putUpstreams(changeSource{Actor: "config"}, seed)
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startScriptedProxy serves an HTTP proxy whose answer to each CONNECT is
+// up to answer. answer returns false to end the connection; after a 200 it
+// may keep the connection and relay.
+func startScriptedProxy(t *testing.T, answer func(conn net.Conn, br *bufio.Reader, req *http.Request) bool) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				br := bufio.NewReader(conn)
+				for {
+					req, err := http.ReadRequest(br)
+					if err != nil || !answer(conn, br, req) {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// eagerTunnel answers with a 200 and the target's greeting in a single
+// write, as a proxy relaying a server that speaks first does, then relays
+func eagerTunnel(conn net.Conn, br *bufio.Reader, req *http.Request) bool {
+	dest, err := net.Dial("tcp", req.Host)
+	if err != nil {
+		io.WriteString(conn, "HTTP/1.1 502 Bad Gateway\r\nContent-Length: 0\r\n\r\n")
+		return false
+	}
+	io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n220 greeting from the target\r\n")
+	relay(&bufferedConn{conn, br}, dest)
+	return false
+}
+
+func TestUpstreamBytesAfterConnectReply(t *testing.T) {
+	echo := startEchoServer(t)
+	proxyAddr := startProxy(t)
+	plain := startScriptedProxy(t, eagerTunnel)
+	// NTLM ends in the same 200, after a challenge on the connection
+	ntlm := startScriptedProxy(t, func(conn net.Conn, br *bufio.Reader, req *http.Request) bool {
+		msg, _ := base64.StdEncoding.DecodeString(strings.TrimPrefix(req.Header.Get("Proxy-Authorization"), "NTLM "))
+		if len(msg) >= 12 && binary.LittleEndian.Uint32(msg[8:]) == 3 {
+			return eagerTunnel(conn, br, req)
+		}
+		fmt.Fprintf(conn, "HTTP/1.1 407 Proxy Authentication Required\r\nProxy-Authenticate: NTLM %s\r\nContent-Length: 0\r\n\r\n",
+			base64.StdEncoding.EncodeToString(fakeNTLMChallenge("CORP")))
+		return true
+	})
+
+	for _, tt := range []struct{ name, raw string }{
+		{"http", "http://u:p@" + plain},
+		{"ntlm", "ntlm://CORP%5Cu:p@" + ntlm},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			setTestMapping(t, "alice", tt.raw, "")
+			resp, conn := dialConnect(t, proxyAddr, echo, basicAuth("alice", "x"))
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("status = %d, want 200", resp.StatusCode)
+			}
+			want := "220 greeting from the target\r\n"
+			got := make([]byte, len(want))
+			if _, err := io.ReadFull(conn, got); err != nil {
+				t.Fatalf("reading the greeting: %v", err)
+			}
+			if string(got) != want {
+				t.Fatalf("tunnel began with %q, want %q", got, want)
+			}
+			expectEcho(t, conn, "and the rest")
+		})
+	}
+}
+
+// A refused CONNECT closes the connection to the upstream without reading
+// more of the body than its text needs
+func TestUpstreamRefusalClosesConnection(t *testing.T) {
+	echo := startEchoServer(t)
+	proxyAddr := startProxy(t)
+	closed := make(chan time.Duration, 1)
+	upstream := startScriptedProxy(t, func(conn net.Conn, br *bufio.Reader, req *http.Request) bool {
+		// a body far longer than it is, which is never sent in full
+		io.WriteString(conn, "HTTP/1.1 403 Forbidden\r\nContent-Type: text/plain\r\nContent-Length: 1000000\r\n\r\nblocked by policy")
+		start := time.Now()
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		io.Copy(io.Discard, br)
+		closed <- time.Since(start)
+		return false
+	})
+	setTestMapping(t, "alice", "http://"+upstream, "")
+
+	start := time.Now()
+	resp, _ := dialConnect(t, proxyAddr, echo, basicAuth("alice", "x"))
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusBadGateway || !strings.Contains(string(body), "403 Forbidden: blocked by policy") {
+		t.Errorf("%d %q, want 502 with the refusal", resp.StatusCode, body)
+	}
+	// the text is read until refusalTextTimeout, not until the body ends
+	if d := time.Since(start); d > refusalTextTimeout+time.Second {
+		t.Errorf("refusal took %s", d)
+	}
+	select {
+	case d := <-closed:
+		if d > refusalTextTimeout+time.Second {
+			t.Errorf("upstream connection closed after %s", d)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("upstream connection left open")
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"flag"
+	"net/http"
+	"strings"
+)
+
+var adminCORSOrigins = flag.String("admin-cors-origins", "", "comma-separated browser origins allowed to call the control API, or * for any (empty disables CORS)")
+
+// corsAdmin adds CORS headers for allowed origins and answers their
+// preflight requests before authentication, since browsers send preflights
+// without the Authorization header. It wraps only the control API.
+func corsAdmin(next http.Handler) http.Handler {
+	origins := map[string]bool{}
+	for _, o := range strings.Split(*adminCORSOrigins, ",") {
+		if o = strings.TrimSpace(o); o != "" {
+			origins[o] = true
+		}
+	}
+	if len(origins) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" || !(origins["*"] || origins[origin]) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		// echo the origin rather than "*" so the Authorization header is allowed
+		h := w.Header()
+		h.Add("Vary", "Origin")
+		h.Set("Access-Control-Allow-Origin", origin)
+		h.Set("Access-Control-Expose-Headers", "ETag, Retry-After")
+
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			h.Set("Access-Control-Allow-Methods", "GET, POST, DELETE")
+			h.Set("Access-Control-Allow-Headers", "Authorization, Content-Type, If-Match")
+			h.Set("Access-Control-Max-Age", "600")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
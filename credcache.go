@@ -0,0 +1,89 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"sync"
+	"time"
+)
+
+// Basic logins that passed are remembered by their Proxy-Authorization
+// header, so repeat connects skip decoding it and checking the password.
+// Entries are tied to the mapping and htpasswd file they were checked
+// against; any change to the user's mapping replaces it and so invalidates
+// them.
+const (
+	basicCacheTTL = 10 * time.Second
+	basicCacheMax = 4096
+)
+
+type basicCacheEntry struct {
+	key     [sha256.Size]byte // HMAC of the header, so no password is kept
+	user    string
+	up      *Upstream
+	file    *htpasswdFile
+	use     *secretUsage // counters of the password that matched, if any
+	expires time.Time
+}
+
+var (
+	basicCacheMu  sync.Mutex
+	basicCacheLRU = list.New() // front is most recently used
+	basicCache    = map[[sha256.Size]byte]*list.Element{}
+)
+
+// basicCacheLookup returns the user of a header that recently passed, if the
+// entry hasn't expired
+func basicCacheLookup(key [sha256.Size]byte, now time.Time) *basicCacheEntry {
+	basicCacheMu.Lock()
+	defer basicCacheMu.Unlock()
+	el, ok := basicCache[key]
+	if !ok {
+		return nil
+	}
+	e := el.Value.(*basicCacheEntry)
+	if !now.Before(e.expires) {
+		basicCacheLRU.Remove(el)
+		delete(basicCache, key)
+		return nil
+	}
+	basicCacheLRU.MoveToFront(el)
+	return e
+}
+
+// validFor reports whether the login was checked against this mapping and
+// the current htpasswd file
+func (e *basicCacheEntry) validFor(up *Upstream, now time.Time) bool {
+	return e.up == up && e.file == htpasswd.Load() && now.Before(e.expires)
+}
+
+// basicCacheStore remembers a header that passed against up. The entry never
+// outlives a password or credential of the mapping that expires sooner.
+func basicCacheStore(key [sha256.Size]byte, user string, up *Upstream, use *secretUsage, now time.Time) {
+	expires := now.Add(basicCacheTTL)
+	if up != nil {
+		if t := up.PasswordExpiresAt; !t.IsZero() && t.Before(expires) {
+			expires = t
+		}
+		for _, c := range up.Credentials {
+			if !c.ExpiresAt.IsZero() && c.ExpiresAt.Before(expires) {
+				expires = c.ExpiresAt
+			}
+		}
+	}
+	e := &basicCacheEntry{key, user, up, htpasswd.Load(), use, expires}
+
+	basicCacheMu.Lock()
+	defer basicCacheMu.Unlock()
+	if el, ok := basicCache[key]; ok {
+		el.Value = e
+		basicCacheLRU.MoveToFront(el)
+		return
+	}
+	basicCache[key] = basicCacheLRU.PushFront(e)
+	if basicCacheLRU.Len() > basicCacheMax {
+		oldest := basicCacheLRU.Back()
+		basicCacheLRU.Remove(oldest)
+		delete(basicCache, oldest.Value.(*basicCacheEntry).key)
+	}
+}
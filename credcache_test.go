@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// benchmarkMapping maps user to direct with password, for the length of b
+func benchmarkMapping(b *testing.B, user, password string) {
+	b.Helper()
+	up := &Upstream{Raw: "direct", URL: &url.URL{Scheme: "direct"}}
+	if err := storePassword(user, up, password); err != nil {
+		b.Fatal(err)
+	}
+	upstreamsMu.Lock()
+	upstreams[user] = up
+	upstreamsMu.Unlock()
+	b.Cleanup(func() {
+		upstreamsMu.Lock()
+		delete(upstreams, user)
+		upstreamsMu.Unlock()
+		clearBasicCache()
+	})
+}
+
+func clearBasicCache() {
+	basicCacheMu.Lock()
+	clear(basicCache)
+	basicCacheLRU.Init()
+	basicCacheMu.Unlock()
+}
+
+func clearAuthCache() {
+	authCacheMu.Lock()
+	clear(authCache)
+	authCacheMu.Unlock()
+}
+
+// BenchmarkAuthenticateBasic measures a repeat connect with the same Basic
+// header. "uncached" empties the header cache before every connect, which
+// is what each connect cost before it: decoding the header and looking up
+// the verified password. "cold" empties the password cache as well, so
+// bcrypt runs every time.
+func BenchmarkAuthenticateBasic(b *testing.B) {
+	for _, bc := range []struct {
+		name     string
+		password string
+		clear    func()
+	}{
+		{"no-password/uncached", "", clearBasicCache},
+		{"no-password/cached", "", nil},
+		{"bcrypt/cold", "s3cret", func() { clearBasicCache(); clearAuthCache() }},
+		{"bcrypt/uncached", "s3cret", clearBasicCache},
+		{"bcrypt/cached", "s3cret", nil},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			benchmarkMapping(b, "bench", bc.password)
+			b.Cleanup(clearAuthCache)
+			r := &http.Request{Method: http.MethodConnect, Header: http.Header{}, RemoteAddr: "192.0.2.1:40000"}
+			r.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte("bench:s3cret")))
+			if _, refused := authenticateProxy(r); refused != nil {
+				b.Fatalf("refused: %+v", refused)
+			}
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if bc.clear != nil {
+					b.StopTimer()
+					bc.clear()
+					b.StartTimer()
+				}
+				if _, refused := authenticateProxy(r); refused != nil {
+					b.Fatalf("refused: %+v", refused)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkBasicCacheLookup measures the cache itself when it is full
+func BenchmarkBasicCacheLookup(b *testing.B) {
+	b.Cleanup(clearBasicCache)
+	now := time.Now()
+	up := &Upstream{Raw: "direct", URL: &url.URL{Scheme: "direct"}}
+	for i := 0; i < basicCacheMax; i++ {
+		basicCacheStore(authMAC("basic", strconv.Itoa(i)), "u", up, nil, now)
+	}
+	key := authMAC("basic", strconv.Itoa(basicCacheMax/2))
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if basicCacheLookup(key, now) == nil {
+			b.Fatal("entry missing")
+		}
+	}
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+	"unicode"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// maxCredentials bounds the extra passwords per user; a failed login checks
+// every one of them with bcrypt
+const maxCredentials = 16
+
+var (
+	errNoMapping          = errors.New("no mapping for user")
+	errNoCredential       = errors.New("no such credential")
+	errTooManyCredentials = errors.New("too many credentials")
+)
+
+// credential is an extra password a user may authenticate with next to the
+// one set with the mapping, e.g. while rotating to a new one
+type credential struct {
+	Label string
+	secret
+	CreatedAt time.Time
+	ExpiresAt time.Time // zero means it never expires
+}
+
+func (c credential) expired(now time.Time) bool {
+	return !c.ExpiresAt.IsZero() && !now.Before(c.ExpiresAt)
+}
+
+func (c credential) equal(o credential) bool {
+	return c.Label == o.Label && c.secret == o.secret && c.CreatedAt.Equal(o.CreatedAt) && c.ExpiresAt.Equal(o.ExpiresAt)
+}
+
+// hasPassword reports whether the user must authenticate with a password,
+// even if all of them have expired
+func (up *Upstream) hasPassword() bool {
+	return up.PasswordHash != "" || len(up.Credentials) > 0
+}
+
+// passwordExpired reports a user who needs a password but has none left
+func (up *Upstream) passwordExpired(now time.Time) bool {
+	return up.hasPassword() && len(up.liveSecrets(now)) == 0
+}
+
+// liveSecrets returns the password of the mapping and its credentials that
+// have not expired
+func (up *Upstream) liveSecrets(now time.Time) []secret {
+	var out []secret
+	if up.PasswordHash != "" && (up.PasswordExpiresAt.IsZero() || now.Before(up.PasswordExpiresAt)) {
+		out = append(out, secret{up.PasswordHash, up.DigestMD5, up.DigestSHA256})
+	}
+	for _, c := range up.Credentials {
+		if !c.expired(now) {
+			out = append(out, c.secret)
+		}
+	}
+	return out
+}
+
+// updateCredentials applies fn to a copy of the user's credentials and
+// writes the mapping back. Connections are kept: credentials are only
+// checked on connect.
+func updateCredentials(src changeSource, user string, fn func([]credential) ([]credential, error)) error {
+	src.KeepConns, src.Event = true, "credentials.changed"
+	return updateMapping(src, user, func(up *Upstream) error {
+		creds, err := fn(slices.Clone(up.Credentials))
+		up.Credentials = creds
+		return err
+	})
+}
+
+// credentialRecord is how a credential is persisted; like the mapping's own
+// password, only hashes are kept
+type credentialRecord struct {
+	Label        string     `json:"label"`
+	PasswordHash string     `json:"password_hash"`
+	DigestMD5    string     `json:"digest_md5,omitempty"`
+	DigestSHA256 string     `json:"digest_sha256,omitempty"`
+	CreatedAt    time.Time  `json:"created_at"`
+	ExpiresAt    *time.Time `json:"expires_at,omitempty"`
+}
+
+func (c credential) record() credentialRecord {
+	rec := credentialRecord{Label: c.Label, PasswordHash: c.Hash, DigestMD5: c.DigestMD5, DigestSHA256: c.DigestSHA256, CreatedAt: c.CreatedAt}
+	if !c.ExpiresAt.IsZero() {
+		rec.ExpiresAt = &c.ExpiresAt
+	}
+	return rec
+}
+
+func (rec credentialRecord) credential() (credential, error) {
+	if _, err := bcrypt.Cost([]byte(rec.PasswordHash)); err != nil {
+		return credential{}, fmt.Errorf("credential %q: password_hash is not a bcrypt hash", rec.Label)
+	}
+	c := credential{Label: rec.Label, secret: secret{rec.PasswordHash, rec.DigestMD5, rec.DigestSHA256}, CreatedAt: rec.CreatedAt}
+	if rec.ExpiresAt != nil {
+		c.ExpiresAt = *rec.ExpiresAt
+	}
+	return c, nil
+}
+
+func validateCredentialLabel(label string) error {
+	switch {
+	case strings.TrimSpace(label) == "":
+		return &fieldError{"label", "missing or blank"}
+	case len(label) > 64:
+		return &fieldError{"label", "longer than 64 bytes"}
+	case strings.IndexFunc(label, unicode.IsControl) >= 0:
+		return &fieldError{"label", "may not contain control characters"}
+	}
+	return nil
+}
+
+func credentialsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		listCredentialsHandler(w, r)
+	case http.MethodPost:
+		addCredentialHandler(w, r)
+	case http.MethodDelete:
+		deleteCredentialHandler(w, r)
+	default:
+		writeMethodNotAllowed(w)
+	}
+}
+
+type credentialEntry struct {
+	Label      string     `json:"label"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	Uses       uint64     `json:"uses"`
+	LastUsedAt *time.Time `json:"last_used_at"` // null until the first login
+}
+
+// GET /credentials?user=u
+func listCredentialsHandler(w http.ResponseWriter, r *http.Request) {
+	user := r.URL.Query().Get("user")
+	if user == "" {
+		writeInvalid(w, &fieldError{"user", "missing"})
+		return
+	}
+
+	now := time.Now()
+	upstreamsMu.RLock()
+	up, ok := upstreams[user]
+	upstreamsMu.RUnlock()
+	if !ok || up.expired(now) {
+		writeError(w, http.StatusNotFound, "mapping_not_found", "no mapping for user")
+		return
+	}
+
+	entries := []credentialEntry{}
+	for _, c := range up.Credentials {
+		if c.expired(now) {
+			continue
+		}
+		e := credentialEntry{Label: c.Label, CreatedAt: c.CreatedAt}
+		if !c.ExpiresAt.IsZero() {
+			e.ExpiresAt = &c.ExpiresAt
+		}
+		e.Uses, e.LastUsedAt = peekSecretUsage(c.Hash).read()
+		entries = append(entries, e)
+	}
+	var pwUses uint64
+	var pwLast *time.Time
+	if up.PasswordHash != "" {
+		pwUses, pwLast = peekSecretUsage(up.PasswordHash).read()
+	}
+	writeJSON(w, http.StatusOK, struct {
+		User        string            `json:"user"`
+		Password    bool              `json:"password_set"` // the mapping's own password
+		PasswordUse uint64            `json:"password_uses"`
+		PasswordAt  *time.Time        `json:"password_last_used_at"`
+		Credentials []credentialEntry `json:"credentials"`
+	}{user, up.PasswordHash != "", pwUses, pwLast, entries})
+}
+
+// POST /credentials { "user":"u", "label":"2024-q2", "password":"...", "ttl_seconds":86400 }
+//
+// Adds a password the user may authenticate with, or replaces the one with
+// the same label. The user must have a mapping.
+func addCredentialHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		User       string     `json:"user"`
+		Label      string     `json:"label"`
+		Password   string     `json:"password"`
+		TTLSeconds int64      `json:"ttl_seconds"`
+		ExpiresAt  *time.Time `json:"expires_at"`
+	}
+	if !decodeJSON(w, r, *maxBodyBytes, &req) {
+		return
+	}
+	if err := validateUser(req.User); err != nil {
+		writeInvalid(w, err)
+		return
+	}
+	if err := validateCredentialLabel(req.Label); err != nil {
+		writeInvalid(w, err)
+		return
+	}
+	if req.Password == "" {
+		writeInvalid(w, &fieldError{"password", "missing"})
+		return
+	}
+
+	now := time.Now()
+	c := credential{Label: req.Label, CreatedAt: now}
+	switch {
+	case req.TTLSeconds != 0 && req.ExpiresAt != nil:
+		writeInvalid(w, &fieldError{"ttl_seconds", "ttl_seconds and expires_at are mutually exclusive"})
+		return
+	case req.TTLSeconds < 0:
+		writeInvalid(w, &fieldError{"ttl_seconds", "must be positive"})
+		return
+	case req.TTLSeconds > 0:
+		c.ExpiresAt = now.Add(time.Duration(req.TTLSeconds) * time.Second)
+	case req.ExpiresAt != nil:
+		if !req.ExpiresAt.After(now) {
+			writeInvalid(w, &fieldError{"expires_at", "is in the past"})
+			return
+		}
+		c.ExpiresAt = *req.ExpiresAt
+	}
+	var err error
+	if c.secret, err = hashSecret(req.User, req.Password); err != nil {
+		writeInvalid(w, err)
+		return
+	}
+
+	err = updateCredentials(sourceOf(r), req.User, func(creds []credential) ([]credential, error) {
+		creds = slices.DeleteFunc(creds, func(o credential) bool { return o.Label == c.Label || o.expired(now) })
+		if len(creds) >= maxCredentials {
+			return nil, errTooManyCredentials
+		}
+		return append(creds, c), nil
+	})
+	switch err {
+	case nil:
+	case errNoMapping:
+		writeError(w, http.StatusNotFound, "mapping_not_found", "no mapping for user")
+		return
+	case errTooManyCredentials:
+		writeError(w, http.StatusConflict, "too_many_credentials", "user already has the maximum number of credentials")
+		return
+	default:
+		log.Printf("store: adding credential for %q failed: %v", req.User, err)
+		writeStoreError(w)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// DELETE /credentials?user=u&label=2024-q1
+func deleteCredentialHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	user, label := q.Get("user"), q.Get("label")
+	if user == "" && label == "" && r.ContentLength != 0 {
+		var req struct {
+			User  string `json:"user"`
+			Label string `json:"label"`
+		}
+		if !decodeJSON(w, r, *maxBodyBytes, &req) {
+			return
+		}
+		user, label = req.User, req.Label
+	}
+	if user == "" {
+		writeInvalid(w, &fieldError{"user", "missing"})
+		return
+	}
+	if label == "" {
+		writeInvalid(w, &fieldError{"label", "missing"})
+		return
+	}
+
+	err := updateCredentials(sourceOf(r), user, func(creds []credential) ([]credential, error) {
+		i := slices.IndexFunc(creds, func(c credential) bool { return c.Label == label })
+		if i < 0 {
+			return nil, errNoCredential
+		}
+		return slices.Delete(creds, i, i+1), nil
+	})
+	switch err {
+	case nil:
+	case errNoMapping:
+		writeError(w, http.StatusNotFound, "mapping_not_found", "no mapping for user")
+		return
+	case errNoCredential:
+		writeError(w, http.StatusNotFound, "credential_not_found", "no credential with that label")
+		return
+	default:
+		log.Printf("store: deleting credential of %q failed: %v", user, err)
+		writeStoreError(w)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// expireCredentials drops expired credentials from every mapping. They are
+// kept while they are all a mapping without its own password has, since
+// dropping them would let the user in with any password.
+func expireCredentials(now time.Time) {
+	var users []string
+	upstreamsMu.RLock()
+	for user, up := range upstreams {
+		if slices.ContainsFunc(up.Credentials, func(c credential) bool { return c.expired(now) }) &&
+			(up.PasswordHash != "" || slices.ContainsFunc(up.Credentials, func(c credential) bool { return !c.expired(now) })) {
+			users = append(users, user)
+		}
+	}
+	upstreamsMu.RUnlock()
+
+	for _, user := range users {
+		err := updateCredentials(changeSource{Actor: "expiry"}, user, func(creds []credential) ([]credential, error) {
+			return slices.DeleteFunc(creds, func(c credential) bool { return c.expired(now) }), nil
+		})
+		if err != nil && err != errNoMapping {
+			log.Printf("expiry: purging credentials of %q failed: %v", user, err)
+		}
+	}
+}
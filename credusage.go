@@ -0,0 +1,170 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// secretUsage counts the logins a mapping password or credential
+// authenticated. Counters are keyed by the secret's bcrypt hash, which is
+// salted and so unique, and outlive the copies of the mapping holding it.
+type secretUsage struct {
+	uses     atomic.Uint64
+	lastUsed atomic.Int64 // unix seconds, 0 if never used
+}
+
+// secretUsagePruneInterval is how often counters of removed secrets are dropped
+const secretUsagePruneInterval = time.Minute
+
+var (
+	secretUsageMu     sync.Mutex
+	secretUsages      = map[string]*secretUsage{} // bcrypt hash -> usage
+	secretUsagePruned time.Time
+)
+
+// add notes one login; nil, for logins without a secret of the mapping,
+// does nothing
+func (u *secretUsage) add(now time.Time) {
+	if u == nil {
+		return
+	}
+	u.uses.Add(1)
+	u.lastUsed.Store(now.Unix())
+}
+
+// helper to read the counters; last is nil if the secret was never used
+func (u *secretUsage) read() (uses uint64, last *time.Time) {
+	if u == nil {
+		return 0, nil
+	}
+	if s := u.lastUsed.Load(); s != 0 {
+		t := time.Unix(s, 0).UTC()
+		last = &t
+	}
+	return u.uses.Load(), last
+}
+
+// usageOfSecret returns the counters of the secret with this hash, creating
+// them on first use
+func usageOfSecret(hash string) *secretUsage {
+	secretUsageMu.Lock()
+	defer secretUsageMu.Unlock()
+	u := secretUsages[hash]
+	if u == nil {
+		u = &secretUsage{}
+		secretUsages[hash] = u
+	}
+	return u
+}
+
+// helper to look up the counters of a secret without creating them
+func peekSecretUsage(hash string) *secretUsage {
+	secretUsageMu.Lock()
+	defer secretUsageMu.Unlock()
+	return secretUsages[hash]
+}
+
+// pruneSecretUsage forgets the counters of secrets no mapping holds anymore,
+// at most every secretUsagePruneInterval
+func pruneSecretUsage(now time.Time) {
+	secretUsageMu.Lock()
+	n := len(secretUsages)
+	due := now.Sub(secretUsagePruned) >= secretUsagePruneInterval
+	if due {
+		secretUsagePruned = now
+	}
+	secretUsageMu.Unlock()
+	if n == 0 || !due {
+		return
+	}
+	live := map[string]bool{}
+	upstreamsMu.RLock()
+	for _, up := range upstreams {
+		live[up.PasswordHash] = true
+		for _, c := range up.Credentials {
+			live[c.Hash] = true
+		}
+	}
+	upstreamsMu.RUnlock()
+	secretUsageMu.Lock()
+	for h := range secretUsages {
+		if !live[h] {
+			delete(secretUsages, h)
+		}
+	}
+	secretUsageMu.Unlock()
+}
+
+// totalSecretUsage sums the logins of every mapping password and credential
+func totalSecretUsage() uint64 {
+	secretUsageMu.Lock()
+	defer secretUsageMu.Unlock()
+	var n uint64
+	for _, u := range secretUsages {
+		n += u.uses.Load()
+	}
+	return n
+}
+
+// secretUsageRecord is how the counters of one secret are persisted in the
+// state file; Label is empty for the mapping's own password
+type secretUsageRecord struct {
+	User       string    `json:"user"`
+	Label      string    `json:"label,omitempty"`
+	Uses       uint64    `json:"uses"`
+	LastUsedAt time.Time `json:"last_used_at"`
+}
+
+func snapshotSecretUsage() []secretUsageRecord {
+	var out []secretUsageRecord
+	add := func(user, label, hash string) {
+		if uses, last := peekSecretUsage(hash).read(); last != nil {
+			out = append(out, secretUsageRecord{user, label, uses, *last})
+		}
+	}
+	upstreamsMu.RLock()
+	for user, up := range upstreams {
+		if up.PasswordHash != "" {
+			add(user, "", up.PasswordHash)
+		}
+		for _, c := range up.Credentials {
+			add(user, c.Label, c.Hash)
+		}
+	}
+	upstreamsMu.RUnlock()
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].User != out[j].User {
+			return out[i].User < out[j].User
+		}
+		return out[i].Label < out[j].Label
+	})
+	return out
+}
+
+// restoreSecretUsage loads the counters saved in the state file for the
+// secrets of the restored mappings
+func restoreSecretUsage(saved []secretUsageRecord, loaded map[string]*Upstream) {
+	for _, rec := range saved {
+		up := loaded[rec.User]
+		if up == nil {
+			continue
+		}
+		hash := up.PasswordHash
+		if rec.Label != "" {
+			hash = ""
+			for _, c := range up.Credentials {
+				if c.Label == rec.Label {
+					hash = c.Hash
+				}
+			}
+		}
+		if hash == "" {
+			continue
+		}
+		u := usageOfSecret(hash)
+		u.uses.Store(rec.Uses)
+		u.lastUsed.Store(rec.LastUsedAt.Unix())
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	_ "embed"
+	"flag"
+	"net/http"
+)
+
+var dashboard = flag.Bool("dashboard", false, "serve the built-in web dashboard at /admin on the control API")
+
+//go:embed dashboard.html
+var dashboardHTML []byte
+
+// isDashboardPage reports whether r fetches the dashboard page itself. The
+// page holds no data, so it is served without a token; every call it makes
+// goes through the normal token check.
+func isDashboardPage(r *http.Request) bool {
+	return *dashboard && r.URL.Path == "/admin" && (r.Method == http.MethodGet || r.Method == http.MethodHead)
+}
+
+// GET /admin
+func dashboardHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeMethodNotAllowed(w)
+		return
+	}
+	h := w.Header()
+	h.Set("Content-Type", "text/html; charset=utf-8")
+	h.Set("Cache-Control", "no-store")
+	h.Set("Content-Security-Policy", "default-src 'none'; script-src 'unsafe-inline'; style-src 'unsafe-inline'; connect-src 'self'; frame-ancestors 'none'")
+	h.Set("X-Content-Type-Options", "nosniff")
+	w.Write(dashboardHTML)
+}
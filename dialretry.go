@@ -0,0 +1,126 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+var (
+	upstreamDialAttempts = flag.Int("upstream-dial-attempts", 1, "how many times a tunnel's upstream dial is tried when the connection can't be established (1 = no retries)")
+	upstreamDialBackoff  = flag.Duration("upstream-dial-backoff", 200*time.Millisecond, "wait before the first upstream dial retry, doubled before each later one")
+	upstreamDialBudget   = flag.Duration("upstream-dial-budget", 15*time.Second, "total time an upstream dial and its retries may take; no retry starts after it")
+)
+
+// dialStatsTTL is how long the retry counts of an upstream no longer dialed
+// are kept
+const dialStatsTTL = time.Hour
+
+// checkDialRetry validates the -upstream-dial flags
+func checkDialRetry() error {
+	switch {
+	case *upstreamDialAttempts < 1 || *upstreamDialAttempts > 10:
+		return fmt.Errorf("-upstream-dial-attempts is %d, want 1 to 10", *upstreamDialAttempts)
+	case *upstreamDialBackoff < 0:
+		return errors.New("-upstream-dial-backoff may not be negative")
+	case *upstreamDialBudget <= 0:
+		return errors.New("-upstream-dial-budget must be positive")
+	}
+	return nil
+}
+
+// dialWithRetry dials addr through d, trying again after errors that
+// happen before a connection is established, and returns the attempts used.
+// Answers from the upstream, such as a refused CONNECT, are final.
+func dialWithRetry(d proxy.Dialer, addr string) (net.Conn, int, error) {
+	start := time.Now()
+	backoff := *upstreamDialBackoff
+	for attempt := 1; ; attempt++ {
+		conn, err := d.Dial("tcp", addr)
+		if err == nil || attempt >= *upstreamDialAttempts || !retryableDialError(err) ||
+			time.Since(start)+backoff >= *upstreamDialBudget {
+			return conn, attempt, err
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// retryableDialError reports whether err means the connection was never
+// established: refused, reset, unreachable or timed out
+func retryableDialError(err error) bool {
+	// lookups are cached, so asking again would get the same answer
+	var unresolved *upstreamResolveError
+	if errors.As(err, &unresolved) {
+		return false
+	}
+	for _, errno := range []syscall.Errno{syscall.ECONNREFUSED, syscall.ECONNRESET, syscall.ETIMEDOUT, syscall.EHOSTUNREACH, syscall.ENETUNREACH} {
+		if errors.Is(err, errno) {
+			return true
+		}
+	}
+	var nerr net.Error
+	return errors.As(err, &nerr) && nerr.Timeout()
+}
+
+// dialStats counts the dials through one upstream while retries are on
+type dialStats struct {
+	Dials    uint64 `json:"dials"`
+	Retried  uint64 `json:"retried"` // dials that needed more than one attempt
+	Attempts uint64 `json:"attempts"`
+	Failed   uint64 `json:"failed"` // dials that failed after their last attempt
+	lastUsed time.Time
+}
+
+var (
+	dialStatsMu       sync.Mutex
+	upstreamDialStats = map[string]*dialStats{} // redacted upstream -> counts
+)
+
+// recordDial counts a dial through upstream that took attempts
+func recordDial(upstream string, attempts int, failed bool, now time.Time) {
+	dialStatsMu.Lock()
+	defer dialStatsMu.Unlock()
+	s := upstreamDialStats[upstream]
+	if s == nil {
+		s = &dialStats{}
+		upstreamDialStats[upstream] = s
+	}
+	s.Dials++
+	s.Attempts += uint64(attempts)
+	if attempts > 1 {
+		s.Retried++
+	}
+	if failed {
+		s.Failed++
+	}
+	s.lastUsed = now
+}
+
+// dialStatsSummary is the upstream_dials of /stats
+func dialStatsSummary() map[string]dialStats {
+	dialStatsMu.Lock()
+	defer dialStatsMu.Unlock()
+	out := make(map[string]dialStats, len(upstreamDialStats))
+	for upstream, s := range upstreamDialStats {
+		out[upstream] = *s
+	}
+	return out
+}
+
+// pruneDialStats forgets upstreams not dialed for dialStatsTTL
+func pruneDialStats(now time.Time) {
+	dialStatsMu.Lock()
+	defer dialStatsMu.Unlock()
+	for upstream, s := range upstreamDialStats {
+		if now.Sub(s.lastUsed) >= dialStatsTTL {
+			delete(upstreamDialStats, upstream)
+		}
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	proxyDigest      = flag.Bool("proxy-digest", false, "also accept Digest proxy auth (MD5 and SHA-256); passwords set while enabled are also kept as Digest hashes")
+	digestAlgorithms = flag.String("digest-algorithms", "SHA-256,MD5", "Digest algorithms offered and accepted, strongest first")
+	digestQop        = flag.String("digest-qop", "auth", "Digest qop values offered and accepted: auth, auth-int or both")
+)
+
+// parsed -digest-algorithms and -digest-qop
+var digestAlgs, digestQops []string
+
+// digestNonceTTL is how long a nonce is accepted before the client is told
+// it is stale and must retry with a fresh one
+const digestNonceTTL = 5 * time.Minute
+
+var (
+	digestSeenMu sync.Mutex
+	digestSeen   = map[string]*digestNonceUse{} // nonce -> highest nc used
+)
+
+type digestNonceUse struct {
+	nc      uint64
+	expires time.Time
+}
+
+// digestHA1 returns the MD5 and SHA-256 Digest hashes of user:realm:password
+func digestHA1(user, password string) (md5HA1, sha256HA1 string) {
+	s := user + ":" + *authRealm + ":" + password
+	return md5Hex(s), sha256Hex(s)
+}
+
+func md5Hex(s string) string {
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func sha256Hex(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// newDigestNonce issues a nonce that carries its own issue time and MAC, so
+// nothing has to be stored until a client uses it
+func newDigestNonce(now time.Time) string {
+	ts := strconv.FormatInt(now.UnixNano(), 36)
+	mac := authMAC("digest-nonce", ts)
+	return ts + "." + hex.EncodeToString(mac[:16])
+}
+
+// helper to check a nonce's MAC and return when it stops being accepted
+func digestNonceExpiry(nonce string) (time.Time, bool) {
+	ts, tag, ok := strings.Cut(nonce, ".")
+	if !ok {
+		return time.Time{}, false
+	}
+	mac := authMAC("digest-nonce", ts)
+	if !hmac.Equal([]byte(tag), []byte(hex.EncodeToString(mac[:16]))) {
+		return time.Time{}, false
+	}
+	n, err := strconv.ParseInt(ts, 36, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(0, n).Add(digestNonceTTL), true
+}
+
+// useNonceCount records nc for nonce and rejects replays: every request on a
+// nonce must use a higher nonce count than the ones before it
+func useNonceCount(nonce string, nc uint64, expires, now time.Time) bool {
+	digestSeenMu.Lock()
+	defer digestSeenMu.Unlock()
+	if len(digestSeen) > 1024 {
+		for n, u := range digestSeen {
+			if now.After(u.expires) {
+				delete(digestSeen, n)
+			}
+		}
+	}
+	u := digestSeen[nonce]
+	if u == nil {
+		digestSeen[nonce] = &digestNonceUse{nc, expires}
+		return true
+	}
+	if nc <= u.nc {
+		return false
+	}
+	u.nc = nc
+	return true
+}
+
+// parseDigestParams splits the parameters of a Digest header, unquoting
+// quoted values
+func parseDigestParams(s string) map[string]string {
+	params := map[string]string{}
+	for {
+		s = strings.TrimLeft(s, " \t,")
+		if s == "" {
+			return params
+		}
+		key, rest, ok := strings.Cut(s, "=")
+		if !ok {
+			return params
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		rest = strings.TrimLeft(rest, " \t")
+		var val string
+		if strings.HasPrefix(rest, `"`) {
+			var b strings.Builder
+			i := 1
+			for ; i < len(rest) && rest[i] != '"'; i++ {
+				if rest[i] == '\\' && i+1 < len(rest) {
+					i++
+				}
+				b.WriteByte(rest[i])
+			}
+			val, s = b.String(), rest[min(i+1, len(rest)):]
+		} else {
+			val, s, _ = strings.Cut(rest, ",")
+			val = strings.TrimSpace(val)
+		}
+		params[key] = val
+	}
+}
+
+// digestOK verifies a Digest response against the user's stored hashes.
+// stale reports a correct response on an expired nonce, so the client can
+// retry without asking for the password again.
+func digestOK(r *http.Request, c *proxyCredentials, up *Upstream, fallback bool) (ok, stale bool) {
+	if fallback || !up.hasPassword() {
+		// -htpasswd entries, -auth-webhook and -auth-exec need the password itself
+		_, inFile := htpasswdHash(c.user)
+		return !inFile && *authWebhookURL == "" && *authExecPath == "" && !*requirePassword, false
+	}
+	now := time.Now()
+	secrets := up.liveSecrets(now)
+	p := c.params
+	var h func(string) string
+	ha1 := func(s secret) string { return s.DigestMD5 }
+	alg := strings.ToUpper(p["algorithm"])
+	if alg == "" {
+		alg = "MD5" // RFC 7616's default when the client omits it
+	}
+	if !slices.Contains(digestAlgs, alg) {
+		return false, false
+	}
+	switch alg {
+	case "MD5":
+		h = md5Hex
+	case "SHA-256":
+		h, ha1 = sha256Hex, func(s secret) string { return s.DigestSHA256 }
+	}
+	if p["realm"] != *authRealm || !slices.Contains(digestQops, p["qop"]) || p["uri"] != r.RequestURI {
+		return false, false
+	}
+	expires, valid := digestNonceExpiry(p["nonce"])
+	if !valid {
+		return false, false
+	}
+	nc, err := strconv.ParseUint(p["nc"], 16, 64)
+	if err != nil {
+		return false, false
+	}
+
+	ha2 := h(r.Method + ":" + p["uri"])
+	if p["qop"] == "auth-int" {
+		// proxy requests carry no body, so this hashes the empty one
+		ha2 = h(r.Method + ":" + p["uri"] + ":" + h(""))
+	}
+	i := slices.IndexFunc(secrets, func(s secret) bool {
+		if ha1(s) == "" {
+			return false // set before -proxy-digest was enabled
+		}
+		want := h(ha1(s) + ":" + p["nonce"] + ":" + p["nc"] + ":" + p["cnonce"] + ":" + p["qop"] + ":" + ha2)
+		return subtle.ConstantTimeCompare([]byte(want), []byte(strings.ToLower(p["response"]))) == 1
+	})
+	if i < 0 {
+		return false, false
+	}
+	if now.After(expires) {
+		return false, true
+	}
+	if !useNonceCount(p["nonce"], nc, expires, now) {
+		return false, false
+	}
+	usageOfSecret(secrets[i].Hash).add(now)
+	return true, false
+}
+
+// checkDigestFlags parses -digest-algorithms and -digest-qop
+func checkDigestFlags() error {
+	digestAlgs, digestQops = nil, nil
+	for _, a := range strings.Split(*digestAlgorithms, ",") {
+		a = strings.ToUpper(strings.TrimSpace(a))
+		if a != "SHA-256" && a != "MD5" {
+			return fmt.Errorf("digest-algorithms: unsupported algorithm %q, want SHA-256 or MD5", a)
+		}
+		digestAlgs = append(digestAlgs, a)
+	}
+	for _, q := range strings.Split(*digestQop, ",") {
+		q = strings.ToLower(strings.TrimSpace(q))
+		if q != "auth" && q != "auth-int" {
+			return fmt.Errorf("digest-qop: unsupported qop %q, want auth or auth-int", q)
+		}
+		digestQops = append(digestQops, q)
+	}
+	return nil
+}
+
+// digestChallenges returns one Digest challenge per -digest-algorithms entry
+func digestChallenges(stale bool) []string {
+	nonce := newDigestNonce(time.Now())
+	var out []string
+	for _, alg := range digestAlgs {
+		c := `Digest realm="` + *authRealm + `", qop="` + strings.Join(digestQops, ",") + `", algorithm=` + alg + `, nonce="` + nonce + `"`
+		if stale {
+			c += ", stale=true"
+		}
+		out = append(out, c)
+	}
+	return out
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// digestAuth answers a Digest challenge for a CONNECT to target the way a
+// client does; alg "" leaves the algorithm out, meaning MD5
+func digestAuth(user, password, target, nonce, nc, alg, qop string) string {
+	h := md5Hex
+	if alg == "SHA-256" {
+		h = sha256Hex
+	}
+	const cnonce = "0a4f113b"
+	ha1 := h(user + ":" + *authRealm + ":" + password)
+	ha2 := h("CONNECT:" + target)
+	if qop == "auth-int" {
+		ha2 = h("CONNECT:" + target + ":" + h(""))
+	}
+	response := h(ha1 + ":" + nonce + ":" + nc + ":" + cnonce + ":" + qop + ":" + ha2)
+	v := fmt.Sprintf(`Digest username="%s", realm="%s", nonce="%s", uri="%s", qop=%s, nc=%s, cnonce="%s", response="%s"`,
+		user, *authRealm, nonce, target, qop, nc, cnonce, response)
+	if alg != "" {
+		v += ", algorithm=" + alg
+	}
+	return v
+}
+
+// enableDigest turns on -proxy-digest with both qops until the test ends
+func enableDigest(t *testing.T) {
+	// runs last, once the flags are back
+	t.Cleanup(func() { checkDigestFlags() })
+	setFlag(t, proxyDigest, true)
+	setFlag(t, digestQop, "auth,auth-int")
+	if err := checkDigestFlags(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDigestAuth(t *testing.T) {
+	enableDigest(t)
+	echo := startEchoServer(t)
+	proxyAddr := startProxy(t)
+	setTestMapping(t, "alice", "direct", "s3cret")
+	fresh := func() string { return newDigestNonce(time.Now()) }
+	stale := newDigestNonce(time.Now().Add(-digestNonceTTL - time.Minute))
+	forged := fresh()
+	forged = strings.Replace(forged, forged[:3], "zzz", 1)
+
+	for _, tt := range []struct {
+		name      string
+		auth      string
+		ok, stale bool
+	}{
+		{"MD5", digestAuth("alice", "s3cret", echo, fresh(), "00000001", "MD5", "auth"), true, false},
+		{"MD5 by default", digestAuth("alice", "s3cret", echo, fresh(), "00000001", "", "auth"), true, false},
+		{"SHA-256", digestAuth("alice", "s3cret", echo, fresh(), "00000001", "SHA-256", "auth"), true, false},
+		{"SHA-256 auth-int", digestAuth("alice", "s3cret", echo, fresh(), "00000001", "SHA-256", "auth-int"), true, false},
+		{"wrong password", digestAuth("alice", "wrong", echo, fresh(), "00000001", "SHA-256", "auth"), false, false},
+		{"another target's uri", digestAuth("alice", "s3cret", "example.com:443", fresh(), "00000001", "MD5", "auth"), false, false},
+		{"stale nonce", digestAuth("alice", "s3cret", echo, stale, "00000001", "MD5", "auth"), false, true},
+		{"stale nonce, wrong password", digestAuth("alice", "wrong", echo, stale, "00000001", "MD5", "auth"), false, false},
+		{"unknown nonce", digestAuth("alice", "s3cret", echo, "lq3x9k.00112233445566778899aabbccddeeff", "00000001", "MD5", "auth"), false, false},
+		{"nonce with another time", digestAuth("alice", "s3cret", echo, forged, "00000001", "MD5", "auth"), false, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, conn := dialConnect(t, proxyAddr, echo, tt.auth)
+			if !tt.ok {
+				if resp.StatusCode != http.StatusProxyAuthRequired {
+					t.Fatalf("status = %d, want 407", resp.StatusCode)
+				}
+				challenges := strings.Join(resp.Header.Values("Proxy-Authenticate"), "\n")
+				if got := strings.Contains(challenges, "stale=true"); got != tt.stale {
+					t.Errorf("stale = %t, want %t:\n%s", got, tt.stale, challenges)
+				}
+				return
+			}
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("status = %d, want 200", resp.StatusCode)
+			}
+			expectEcho(t, conn, "over digest")
+		})
+	}
+}
+
+// Every request on a nonce must use a higher nonce count than the last
+func TestDigestNonceCountReplay(t *testing.T) {
+	enableDigest(t)
+	echo := startEchoServer(t)
+	proxyAddr := startProxy(t)
+	setTestMapping(t, "alice", "direct", "s3cret")
+	nonce := newDigestNonce(time.Now())
+
+	for _, tt := range []struct {
+		nc     string
+		status int
+	}{
+		{"00000001", http.StatusOK},
+		{"00000001", http.StatusProxyAuthRequired}, // replayed
+		{"00000003", http.StatusOK},
+		{"00000002", http.StatusProxyAuthRequired}, // older than the last
+		{"00000004", http.StatusOK},
+	} {
+		resp, _ := dialConnect(t, proxyAddr, echo, digestAuth("alice", "s3cret", echo, nonce, tt.nc, "SHA-256", "auth"))
+		if resp.StatusCode != tt.status {
+			t.Errorf("nc=%s: status = %d, want %d", tt.nc, resp.StatusCode, tt.status)
+		}
+	}
+}
+
+// A user without a password takes any Digest response, unless
+// -require-password refuses such users
+func TestDigestRequirePassword(t *testing.T) {
+	enableDigest(t)
+	echo := startEchoServer(t)
+	proxyAddr := startProxy(t)
+	setTestMapping(t, "alice", "direct", "s3cret")
+	setTestMapping(t, "bob", "direct", "")
+
+	for _, tt := range []struct {
+		user, password string
+		require        bool
+		status         int
+	}{
+		{"bob", "anything", false, http.StatusOK},
+		{"bob", "anything", true, http.StatusProxyAuthRequired},
+		{"alice", "s3cret", true, http.StatusOK},
+		{"alice", "wrong", true, http.StatusProxyAuthRequired},
+	} {
+		t.Run(fmt.Sprintf("%s:%s require=%t", tt.user, tt.password, tt.require), func(t *testing.T) {
+			setFlag(t, requirePassword, tt.require)
+			resp, _ := dialConnect(t, proxyAddr, echo, digestAuth(tt.user, tt.password, echo, newDigestNonce(time.Now()), "00000001", "MD5", "auth"))
+			if resp.StatusCode != tt.status {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.status)
+			}
+		})
+	}
+}
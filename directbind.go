@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"net/url"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// direct://?bind=203.0.113.7 connects straight to the target like "direct",
+// from the given local address, so a gateway with several addresses can
+// pick the one each user egresses from.
+
+// validateDirectUpstream checks a direct:// upstream: no host, and at most
+// a bind address that belongs to one of this machine's interfaces
+func validateDirectUpstream(u *url.URL) error {
+	if u.Host != "" || u.User != nil || (u.Path != "" && u.Path != "/") {
+		return errors.New(`direct upstreams take no host, only ?bind=<local address>`)
+	}
+	q := u.Query()
+	for k := range q {
+		if k != "bind" {
+			return fmt.Errorf("unknown direct upstream parameter %q, want bind", k)
+		}
+	}
+	if !q.Has("bind") {
+		return nil
+	}
+	ip, err := netip.ParseAddr(q.Get("bind"))
+	if err != nil || ip.IsUnspecified() || ip.IsMulticast() {
+		return fmt.Errorf("bind is %q, want an IP address", q.Get("bind"))
+	}
+	if !localAddr(ip) {
+		return fmt.Errorf("bind address %s is not assigned to this host", ip)
+	}
+	return nil
+}
+
+// helper to report whether ip is one of the addresses of the local interfaces
+func localAddr(ip netip.Addr) bool {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	ip = ip.WithZone("").Unmap()
+	for _, a := range addrs {
+		if n, ok := a.(*net.IPNet); ok {
+			if la, ok := netip.AddrFromSlice(n.IP); ok && la.Unmap() == ip {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// directDialer connects to targets directly, from u's bind address if it
+// has one
+func directDialer(u *url.URL) proxy.Dialer {
+	bind := u.Query().Get("bind")
+	if bind == "" {
+		return proxy.FromEnvironment()
+	}
+	ip, _ := netip.ParseAddr(bind)
+	// the dialer only tries target addresses of the bind address's family
+	return &net.Dialer{
+		LocalAddr: &net.TCPAddr{IP: ip.AsSlice(), Zone: ip.Zone()},
+		Timeout:   10 * time.Second,
+	}
+}
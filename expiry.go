@@ -0,0 +1,55 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// expirySweepInterval is how often expired mappings are removed. Lookups
+// check expiry themselves, so this only bounds how long a stale entry and
+// its connections linger.
+const expirySweepInterval = time.Second
+
+func expireLoop() {
+	t := time.NewTicker(expirySweepInterval)
+	defer t.Stop()
+	for now := range t.C {
+		expireUpstreams(now)
+		expireCredentials(now)
+		closeExpiredPasswordConns(now)
+		expireStaged(now)
+		pruneSecretUsage(now)
+		expireBans(now)
+		closeIdleSSHSessions(now)
+		forgetClosedH2Sessions()
+		closeIdleH3Sessions(now)
+		expireUpstreamDNS(now)
+		expireStickySessions(now)
+		pruneDialStats(now)
+	}
+}
+
+// expireUpstreams removes every mapping that has expired by now and closes
+// the affected users' connections. Once removed, a user falls back to the
+// same routing as any unmapped user.
+func expireUpstreams(now time.Time) {
+	expired := map[string]*Upstream{}
+	upstreamsMu.RLock()
+	for user, up := range upstreams {
+		if up.expired(now) {
+			expired[user] = up
+		}
+	}
+	upstreamsMu.RUnlock()
+
+	for user, up := range expired {
+		ok, err := expireUpstream(user, up)
+		if err != nil {
+			log.Printf("expiry: removing %q failed: %v", user, err)
+			continue
+		}
+		if ok {
+			log.Printf("expiry: mapping for %q expired", user)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+)
+
+// GET /export
+//
+// Streams the full table in the state-file format, metadata included.
+func exportHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeMethodNotAllowed(w)
+		return
+	}
+
+	doc := stateDoc{Upstreams: map[string]upstreamRecord{}}
+	upstreamsMu.RLock()
+	for user, up := range upstreams {
+		doc.Upstreams[user] = up.record().exported()
+	}
+	upstreamsMu.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", `attachment; filename="upstreamgate-export.json"`)
+	json.NewEncoder(w).Encode(doc)
+}
+
+type importResult struct {
+	User   string `json:"user"`
+	Action string `json:"action,omitempty"` // set, unchanged or removed
+	Error  string `json:"error,omitempty"`
+}
+
+// POST /import?mode=merge|replace
+//
+// Accepts a document produced by GET /export. Every entry is validated
+// before anything changes; merge (the default) leaves users missing from
+// the document alone while replace removes them.
+func importHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeMethodNotAllowed(w)
+		return
+	}
+	mode := r.URL.Query().Get("mode")
+	if mode == "" {
+		mode = "merge"
+	}
+	if mode != "merge" && mode != "replace" {
+		writeInvalid(w, &fieldError{"mode", "must be merge or replace"})
+		return
+	}
+
+	var doc stateDoc
+	if !decodeJSON(w, r, *maxBulkBodyBytes, &doc) {
+		return
+	}
+
+	users := make([]string, 0, len(doc.Upstreams))
+	for user := range doc.Upstreams {
+		users = append(users, user)
+	}
+	sort.Strings(users)
+
+	results := []importResult{}
+	incoming := map[string]*Upstream{}
+	failed := false
+	for _, user := range users {
+		res := importResult{User: user}
+		up, err := doc.Upstreams[user].upstream()
+		uerr := validateUser(user)
+		switch {
+		case uerr != nil:
+			res.Error = uerr.Error()
+		case err != nil:
+			res.Error = "upstream: " + err.Error()
+		}
+		if res.Error != "" {
+			failed = true
+		} else {
+			up.ownCredentials = true // exports carry them
+		}
+		incoming[user] = up
+		results = append(results, res)
+	}
+	if failed {
+		writeAPIError(w, http.StatusBadRequest, &apiError{Code: "validation_failed", Message: "some entries are invalid, nothing was imported", Details: results})
+		return
+	}
+
+	upstreamsMu.RLock()
+	set := map[string]*Upstream{}
+	for i, user := range users {
+		if sameUpstream(upstreams[user], incoming[user]) {
+			results[i].Action = "unchanged"
+			continue
+		}
+		results[i].Action = "set"
+		set[user] = incoming[user]
+	}
+	var removed []string
+	if mode == "replace" {
+		for user := range upstreams {
+			if _, ok := incoming[user]; !ok {
+				removed = append(removed, user)
+			}
+		}
+	}
+	upstreamsMu.RUnlock()
+	sort.Strings(removed)
+
+	if len(set) > 0 {
+		err := putUpstreams(sourceOf(r), set)
+		if err == errTooManyUsers {
+			writeUserLimit(w)
+			return
+		}
+		if err != nil {
+			log.Printf("store: import failed: %v", err)
+			writeStoreError(w)
+			return
+		}
+	}
+	for _, user := range removed {
+		res := importResult{User: user, Action: "removed"}
+		if _, err := removeUpstream(sourceOf(r), user); err != nil {
+			log.Printf("store: import removing %q failed: %v", user, err)
+			res.Action, res.Error = "", "store error"
+		}
+		results = append(results, res)
+	}
+
+	writeJSON(w, http.StatusOK, results)
+}
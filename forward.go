@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// Requests other than CONNECT are forwarded when they carry an absolute
+// http:// URL, the way clients send plain HTTP to a proxy. Authentication
+// and the choice of upstream are the same as for CONNECT. A request routed
+// through a single http or https upstream is handed to that proxy as it
+// is; any other upstream gets a tunnel to the origin server, and the
+// request is sent over it. Hop-by-hop headers are dropped both ways,
+// redirects are passed back rather than followed, and connections aren't
+// reused between requests. While it runs, a request counts as one of its
+// user's connections, and closing those cancels it.
+
+// forwardRoute is what proxyHandler worked out for a forwarded request
+type forwardRoute struct {
+	user     string
+	fallback bool
+	up       *Upstream // the user's mapping
+	via      *Upstream // the upstream the request goes through
+	params   map[string]string
+	dialer   proxy.Dialer
+	logAuth  string
+	labels   []string // the mapping's, for the access log
+}
+
+// forwardTarget is the host:port an absolute http:// request is for, or ""
+// if r isn't one
+func forwardTarget(r *http.Request) string {
+	if !r.URL.IsAbs() || r.URL.Scheme != "http" || r.URL.Hostname() == "" {
+		return ""
+	}
+	port := r.URL.Port()
+	if port == "" {
+		port = "80"
+	}
+	return net.JoinHostPort(r.URL.Hostname(), port)
+}
+
+// forwardsToProxy reports whether requests through up are handed to it as
+// they are: up is one http or https proxy that takes plain requests. NTLM
+// and ?proto=h2 proxies only get tunnels.
+func forwardsToProxy(up *Upstream) bool {
+	s := up.URL.Scheme
+	return (s == "http" || s == "https") && !isChain(up.Raw) && !isNTLMUpstream(up.URL) && !isH2Upstream(up.URL)
+}
+
+// forwardRequest stands for a forwarded request among its user's
+// connections, so it is closed along with their tunnels
+type forwardRequest struct {
+	cancel context.CancelFunc
+	closed atomic.Bool
+}
+
+func (f *forwardRequest) Close() error {
+	f.closed.Store(true)
+	f.cancel()
+	return nil
+}
+
+// errForwardClosed is a forwarded request cancelled by closing the user's
+// connections
+var errForwardClosed = errors.New("closed by the gateway")
+
+func forwardHTTP(w http.ResponseWriter, r *http.Request, fr forwardRoute) {
+	start := time.Now()
+	target := forwardTarget(r)
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	reg := &forwardRequest{cancel: cancel}
+	registerConn(fr.user, reg, fr.up, fr.fallback)
+	defer unregisterConn(fr.user, reg)
+	r = r.WithContext(ctx)
+	tr := &http.Transport{DisableKeepAlives: true, DisableCompression: true}
+	dial := func(d proxy.Dialer, via *Upstream) func(context.Context, string, string) (net.Conn, error) {
+		return func(_ context.Context, network, addr string) (net.Conn, error) {
+			conn, attempts, err := dialWithRetry(d, addr)
+			if *upstreamDialAttempts > 1 {
+				recordDial(via.redacted(), attempts, err != nil, time.Now())
+			}
+			return conn, err
+		}
+	}
+	var proxyAuth string
+	var proxyHeaders map[string]string
+	if forwardsToProxy(fr.via) {
+		u := expandUserParams(fr.via.URL, fr.params)
+		cfg := fr.via.hopConfig(r.Header.Get("Proxy-Authorization"))
+		if sni := u.Query().Get("sni"); sni != "" {
+			cfg.serverName = sni
+		}
+		// like httpConnectDialer.tunnel, headers win over a forwarded
+		// Proxy-Authorization, which wins over the URL's credentials
+		_, set := cfg.headers["Proxy-Authorization"]
+		switch {
+		case cfg.proxyAuth != "" && !set:
+			proxyAuth = cfg.proxyAuth
+		case u.User != nil && !set:
+			proxyAuth = basicProxyAuth(u)
+		}
+		proxyHeaders = cfg.headers
+		tr.Proxy = http.ProxyURL(&url.URL{Scheme: u.Scheme, Host: u.Host})
+		tr.DialContext = dial(upstreamDirect, fr.via)
+		if u.Scheme == "https" {
+			tc, err := upstreamTLSConfig(u.Host, cfg)
+			if err != nil {
+				http.Error(w, "invalid upstream", http.StatusInternalServerError)
+				return
+			}
+			tr.TLSClientConfig = tc
+			tr.TLSHandshakeTimeout = upstreamTLSHandshakeTimeout
+		}
+	} else {
+		tr.DialContext = dial(fr.dialer, fr.via)
+	}
+
+	var failure error
+	rp := &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			// Rewrite drops the client's forwarding headers; a proxy passes
+			// them on as they are, and adds none of its own
+			for _, name := range []string{"Forwarded", "X-Forwarded-For", "X-Forwarded-Host", "X-Forwarded-Proto"} {
+				if v, ok := pr.In.Header[name]; ok {
+					pr.Out.Header[name] = v
+				}
+			}
+			for name, v := range proxyHeaders {
+				pr.Out.Header.Set(name, v)
+			}
+			if proxyAuth != "" {
+				pr.Out.Header.Set("Proxy-Authorization", proxyAuth)
+			}
+		},
+		Transport:     tr,
+		FlushInterval: -1,
+		ErrorLog:      log.New(io.Discard, "", 0),
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			failure = err
+			status, reason := dialFailure(err)
+			if reason == "" {
+				w.WriteHeader(status)
+				return
+			}
+			http.Error(w, reason, status)
+		},
+	}
+
+	cw := &countingWriter{ResponseWriter: w}
+	var body *countingBody
+	if r.Body != nil && r.Body != http.NoBody {
+		body = &countingBody{ReadCloser: r.Body}
+		r.Body = body
+	}
+	if !fr.fallback {
+		touchUser(fr.user, start)
+	}
+	// deferred, since ReverseProxy aborts the handler with a panic when the
+	// response breaks off while streaming
+	defer func() {
+		sent := int64(0)
+		if body != nil {
+			sent = body.n
+		}
+		if !fr.fallback {
+			addUserBytes(fr.user, sent, cw.n)
+		}
+		if !*accessLog {
+			return
+		}
+		if reg.closed.Load() {
+			failure = errForwardClosed
+		}
+		if failure != nil {
+			log.Printf("request user=%q method=%s target=%s upstream=%s error=%q", fr.user, r.Method, target, fr.via.redacted(), failure)
+			return
+		}
+		log.Printf("request user=%q%s method=%s target=%s upstream=%s status=%d duration=%s %s",
+			fr.user, fr.logAuth, r.Method, target, fr.via.redacted(), cw.status, time.Since(start).Round(time.Millisecond), strings.Join(fr.labels, " "))
+	}()
+	rp.ServeHTTP(cw, r)
+}
+
+// countingWriter counts the response bytes written to the client
+type countingWriter struct {
+	http.ResponseWriter
+	n      int64
+	status int // the final status, after any 1xx
+}
+
+func (c *countingWriter) WriteHeader(code int) {
+	if c.status == 0 && code >= 200 {
+		c.status = code
+	}
+	c.ResponseWriter.WriteHeader(code)
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	if c.status == 0 {
+		c.status = http.StatusOK
+	}
+	n, err := c.ResponseWriter.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController flush and hijack the connection
+func (c *countingWriter) Unwrap() http.ResponseWriter { return c.ResponseWriter }
+
+// countingBody counts the request body bytes read from the client
+type countingBody struct {
+	io.ReadCloser
+	n int64
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n += int64(n)
+	return n, err
+}
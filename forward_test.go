@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startStreamingOrigin serves a response that sends its first line and then
+// hangs until the request is cancelled, which it reports on the channel
+func startStreamingOrigin(t *testing.T) (string, <-chan struct{}) {
+	t.Helper()
+	cancelled := make(chan struct{}, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "first line\n")
+		w.(http.Flusher).Flush()
+		select {
+		case <-r.Context().Done():
+			cancelled <- struct{}{}
+		case <-time.After(10 * time.Second):
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL, cancelled
+}
+
+// startForward sends a GET for target through the proxy as alice and
+// returns the response once its first line has arrived
+func startForward(t *testing.T, proxyAddr, target string) *http.Response {
+	t.Helper()
+	client := &http.Client{Transport: &http.Transport{
+		Proxy: http.ProxyURL(&url.URL{Scheme: "http", User: url.UserPassword("alice", "x"), Host: proxyAddr}),
+	}}
+	t.Cleanup(client.CloseIdleConnections)
+	resp, err := client.Get(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want 200", resp.StatusCode)
+	}
+	line := make([]byte, len("first line\n"))
+	if _, err := io.ReadFull(resp.Body, line); err != nil {
+		t.Fatalf("reading the first line: %v", err)
+	}
+	return resp
+}
+
+// activeConnections is active_connections from GET /stats
+func activeConnections(t *testing.T) int {
+	t.Helper()
+	w := httptest.NewRecorder()
+	statsHandler(w, httptest.NewRequest(http.MethodGet, "/stats", nil))
+	var stats struct {
+		Active int `json:"active_connections"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&stats); err != nil {
+		t.Fatal(err)
+	}
+	return stats.Active
+}
+
+// A forwarded request counts as one of its user's connections while it runs,
+// and is cancelled by anything that closes them
+func TestForwardedRequestClosedWithUserConns(t *testing.T) {
+	setFlag(t, accessLog, true)
+	logs := captureLog(t)
+	proxyAddr := startProxy(t)
+
+	for _, tt := range []struct {
+		name  string
+		close func(t *testing.T)
+	}{
+		{"closeUserConns", func(t *testing.T) {
+			if n := closeUserConns("alice"); n != 1 {
+				t.Errorf("closed %d connections, want 1", n)
+			}
+		}},
+		{"upstream change", func(t *testing.T) {
+			setTestMapping(t, "alice", "direct://?bind=127.0.0.1", "")
+		}},
+		{"POST /upstream/disconnect", func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/upstream/disconnect", strings.NewReader(`{"user":"alice"}`))
+			r.Header.Set("Content-Type", "application/json")
+			w := httptest.NewRecorder()
+			disconnectHandler(w, r)
+			if got := strings.TrimSpace(w.Body.String()); w.Code != http.StatusOK || got != `{"closed":1}` {
+				t.Errorf("disconnect = %d %s, want 200 {\"closed\":1}", w.Code, got)
+			}
+		}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			up := setTestMapping(t, "alice", "direct", "")
+			origin, cancelled := startStreamingOrigin(t)
+			logs.Reset()
+			resp := startForward(t, proxyAddr, origin)
+
+			if n := userConnCount("alice"); n != 1 {
+				t.Errorf("userConnCount = %d while streaming, want 1", n)
+			}
+			if n := activeConnections(t); n != 1 {
+				t.Errorf("active_connections = %d while streaming, want 1", n)
+			}
+			// idle GC keeps a user whose request is still running
+			if removed, err := removeIdleUpstream("alice", up); removed || err != nil {
+				t.Errorf("removeIdleUpstream = %v, %v while streaming, want kept", removed, err)
+			}
+
+			tt.close(t)
+			done := make(chan error, 1)
+			go func() {
+				_, err := io.ReadAll(resp.Body)
+				done <- err
+			}()
+			select {
+			case err := <-done:
+				if err == nil {
+					t.Error("response ended cleanly, want it cut off")
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("response still streaming after its connections were closed")
+			}
+			select {
+			case <-cancelled:
+			case <-time.After(5 * time.Second):
+				t.Error("origin request not cancelled")
+			}
+			logs.waitFor(t, `error="closed by the gateway"`)
+			if n := userConnCount("alice"); n != 0 {
+				t.Errorf("userConnCount = %d after the request, want 0", n)
+			}
+		})
+	}
+}
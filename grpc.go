@@ -0,0 +1,343 @@
+package main
+
+//go:generate protoc -I proto --go_out=proto --go_opt=paths=source_relative --go-grpc_out=proto --go-grpc_opt=paths=source_relative upstreamgate.proto
+
+import (
+	"context"
+	"flag"
+	"log"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	pb "github.com/sarp/UpstreamGate/proto"
+)
+
+var grpcAddr = flag.String("grpc-addr", "", "serve the gRPC control API on this address (e.g. 127.0.0.1:8092)")
+
+// watchBuffer is how many events a WatchChanges stream may fall behind
+// before it is cut off
+const watchBuffer = 64
+
+// grpcServer runs the gRPC control API with the same lifecycle as the HTTP servers
+type grpcServer struct {
+	addr string
+	quit chan struct{} // closed on shutdown to end WatchChanges streams
+	*grpc.Server
+}
+
+func newGRPCServer(addr string) *grpcServer {
+	s := &grpcServer{
+		addr: addr,
+		quit: make(chan struct{}),
+		Server: grpc.NewServer(
+			grpc.ChainUnaryInterceptor(grpcUnaryRateLimit, grpcUnaryAuth),
+			grpc.ChainStreamInterceptor(grpcStreamRateLimit, grpcStreamAuth),
+		),
+	}
+	pb.RegisterUpstreamGateServer(s.Server, &grpcService{quit: s.quit})
+	reflection.Register(s.Server)
+	return s
+}
+
+func (s *grpcServer) ListenAndServe() error {
+	ln, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(ln)
+}
+
+func (s *grpcServer) Shutdown(ctx context.Context) error {
+	close(s.quit)
+	done := make(chan struct{})
+	go func() {
+		s.GracefulStop()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		s.Stop()
+		return ctx.Err()
+	}
+}
+
+// grpcReadOnly lists the methods a read-only token may call
+var grpcReadOnly = map[string]bool{
+	pb.UpstreamGate_GetUpstream_FullMethodName:   true,
+	pb.UpstreamGate_ListUpstreams_FullMethodName: true,
+	pb.UpstreamGate_WatchChanges_FullMethodName:  true,
+}
+
+// grpcAuth applies the -admin-token check to the "authorization" metadata
+func grpcAuth(ctx context.Context, method string) error {
+	switch callerRole(grpcBearerToken(ctx)) {
+	case "":
+		return status.Error(codes.Unauthenticated, "unauthorized")
+	case roleReadOnly:
+		if !grpcReadOnly[method] {
+			return status.Error(codes.PermissionDenied, "token is read-only")
+		}
+	}
+	return nil
+}
+
+func grpcUnaryAuth(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	if err := grpcAuth(ctx, info.FullMethod); err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func grpcStreamAuth(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if err := grpcAuth(ss.Context(), info.FullMethod); err != nil {
+		return err
+	}
+	return handler(srv, ss)
+}
+
+// grpcRateLimit applies -admin-rate and -admin-global-rate to a call,
+// keyed by the peer's IP like the HTTP control API
+func grpcRateLimit(ctx context.Context) error {
+	l := adminLimits()
+	if l == nil {
+		return nil
+	}
+	ip := ""
+	if p, ok := peer.FromContext(ctx); ok {
+		ip = p.Addr.String()
+		if host, _, err := net.SplitHostPort(ip); err == nil {
+			ip = host
+		}
+	}
+	if ok, wait := l.allow(ip); !ok {
+		grpc.SetHeader(ctx, metadata.Pairs("retry-after", strconv.Itoa(int(math.Ceil(wait.Seconds())))))
+		return status.Error(codes.ResourceExhausted, "too many requests")
+	}
+	return nil
+}
+
+func grpcUnaryRateLimit(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	if err := grpcRateLimit(ctx); err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func grpcStreamRateLimit(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if err := grpcRateLimit(ss.Context()); err != nil {
+		return err
+	}
+	return handler(srv, ss)
+}
+
+func grpcBearerToken(ctx context.Context) string {
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, v := range md.Get("authorization") {
+		if scheme, token, ok := strings.Cut(v, " "); ok && strings.EqualFold(scheme, "bearer") {
+			return strings.TrimSpace(token)
+		}
+	}
+	return ""
+}
+
+// grpcSourceOf is sourceOf for gRPC calls
+func grpcSourceOf(ctx context.Context) changeSource {
+	token := grpcBearerToken(ctx)
+	src := changeSource{Actor: tokenActor(token), Role: callerRole(token)}
+	if p, ok := peer.FromContext(ctx); ok {
+		src.RemoteAddr = p.Addr.String()
+	}
+	return src
+}
+
+// grpcService implements the UpstreamGate service on top of the same
+// helpers the HTTP handlers use
+type grpcService struct {
+	pb.UnimplementedUpstreamGateServer
+	quit <-chan struct{}
+}
+
+func (s *grpcService) SetUpstream(ctx context.Context, req *pb.SetUpstreamRequest) (*pb.Mapping, error) {
+	if err := validateUser(req.User); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	var expiresAt *time.Time
+	if req.ExpiresAt != nil {
+		t := req.ExpiresAt.AsTime()
+		expiresAt = &t
+	}
+	up, err := buildUpstream(req.Upstream, req.TtlSeconds, expiresAt, req.Labels)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	// passwords and allowlists are managed over HTTP; keep the current ones
+	up.keepPassword, up.keepAllowedIPs = true, true
+
+	if req.Verify {
+		if err := probeUpstream(req.User, up, *probeTarget); err != nil {
+			return nil, status.Error(codes.FailedPrecondition, "upstream verification failed: "+err.Error())
+		}
+	}
+
+	src := grpcSourceOf(ctx)
+	src.KeepConns = req.KeepConnections
+	if req.IfVersion != 0 {
+		err = putUpstreamIfMatch(src, req.User, up, (&Upstream{Version: req.IfVersion}).etag())
+	} else {
+		err = putUpstreams(src, map[string]*Upstream{req.User: up})
+	}
+	if err == errPreconditionFailed {
+		return nil, status.Error(codes.Aborted, "mapping was modified")
+	}
+	if err == errTooManyUsers {
+		return nil, status.Error(codes.ResourceExhausted, "user limit reached")
+	}
+	if err != nil {
+		log.Printf("store: set %q failed: %v", req.User, err)
+		return nil, status.Error(codes.Internal, "store error")
+	}
+	return mappingOf(req.User, up, up.Raw), nil
+}
+
+func (s *grpcService) GetUpstream(ctx context.Context, req *pb.GetUpstreamRequest) (*pb.Mapping, error) {
+	if req.User == "" {
+		return nil, status.Error(codes.InvalidArgument, "missing user")
+	}
+	upstreamsMu.RLock()
+	up, ok := upstreams[req.User]
+	upstreamsMu.RUnlock()
+	if !ok || up.expired(time.Now()) {
+		return nil, status.Error(codes.NotFound, "no mapping for user")
+	}
+	return mappingOf(req.User, up, up.Raw), nil
+}
+
+func (s *grpcService) DeleteUpstream(ctx context.Context, req *pb.DeleteUpstreamRequest) (*pb.DeleteUpstreamResponse, error) {
+	if req.User == "" {
+		return nil, status.Error(codes.InvalidArgument, "missing user")
+	}
+	ok, err := removeUpstream(grpcSourceOf(ctx), req.User)
+	if err != nil {
+		log.Printf("store: delete %q failed: %v", req.User, err)
+		return nil, status.Error(codes.Internal, "store error")
+	}
+	if !ok {
+		return nil, status.Error(codes.NotFound, "no mapping for user")
+	}
+	return &pb.DeleteUpstreamResponse{}, nil
+}
+
+func (s *grpcService) ListUpstreams(ctx context.Context, req *pb.ListUpstreamsRequest) (*pb.ListUpstreamsResponse, error) {
+	now := time.Now()
+	var out []*pb.Mapping
+	upstreamsMu.RLock()
+	for user, up := range upstreams {
+		if up.expired(now) {
+			continue
+		}
+		raw := up.Raw
+		if !req.Reveal {
+			raw = up.redacted()
+		}
+		out = append(out, mappingOf(user, up, raw))
+	}
+	upstreamsMu.RUnlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].User < out[j].User })
+	return &pb.ListUpstreamsResponse{Mappings: out}, nil
+}
+
+func (s *grpcService) WatchChanges(req *pb.WatchChangesRequest, stream pb.UpstreamGate_WatchChangesServer) error {
+	w := addWatcher(req.User)
+	defer removeWatcher(w)
+	for {
+		select {
+		case ev, ok := <-w.events:
+			if !ok {
+				return status.Error(codes.ResourceExhausted, "watcher fell behind")
+			}
+			if err := stream.Send(ev); err != nil {
+				return err
+			}
+		case <-stream.Context().Done():
+			return nil
+		case <-s.quit:
+			return status.Error(codes.Unavailable, "server shutting down")
+		}
+	}
+}
+
+// helper to convert a mapping to its protobuf form
+func mappingOf(user string, up *Upstream, raw string) *pb.Mapping {
+	m := &pb.Mapping{
+		User:              user,
+		Upstream:          raw,
+		Scheme:            up.URL.Scheme,
+		Host:              up.URL.Host,
+		SetAt:             timestamppb.New(up.SetAt),
+		Version:           up.Version,
+		Labels:            up.Labels,
+		ActiveConnections: int32(userConnCount(user)),
+	}
+	if !up.ExpiresAt.IsZero() {
+		m.ExpiresAt = timestamppb.New(up.ExpiresAt)
+	}
+	return m
+}
+
+// watcher is one WatchChanges stream; events is closed if it falls behind
+type watcher struct {
+	user   string
+	events chan *pb.ChangeEvent
+}
+
+var (
+	watchersMu sync.Mutex
+	watchers   = map[*watcher]struct{}{}
+)
+
+func addWatcher(user string) *watcher {
+	w := &watcher{user: user, events: make(chan *pb.ChangeEvent, watchBuffer)}
+	watchersMu.Lock()
+	watchers[w] = struct{}{}
+	watchersMu.Unlock()
+	return w
+}
+
+func removeWatcher(w *watcher) {
+	watchersMu.Lock()
+	delete(watchers, w)
+	watchersMu.Unlock()
+}
+
+// publishChange fans a change out to every WatchChanges stream; a stream
+// that can't keep up is ended rather than silently missing events
+func publishChange(ev *pb.ChangeEvent) {
+	watchersMu.Lock()
+	defer watchersMu.Unlock()
+	for w := range watchers {
+		if w.user != "" && w.user != ev.User {
+			continue
+		}
+		select {
+		case w.events <- ev:
+		default:
+			close(w.events)
+			delete(watchers, w)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Clients speaking HTTP/2 to the TLS proxy port send each CONNECT as a
+// stream of one shared connection. A stream can't be hijacked, so its
+// request body and response writer are the tunnel, and HTTP/2 flow control
+// paces both directions. On shutdown the connection gets a GOAWAY, and its
+// open tunnels have the shutdown grace period to finish.
+
+// h2StreamConn is a tunnel over one inbound CONNECT stream
+type h2StreamConn struct {
+	w      http.ResponseWriter
+	rc     *http.ResponseController
+	body   io.ReadCloser
+	local  net.Addr
+	remote string
+
+	mu      sync.Mutex
+	closed  bool
+	writing bool // a Write may be waiting on flow control
+}
+
+func newH2StreamConn(w http.ResponseWriter, r *http.Request) *h2StreamConn {
+	local, _ := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	return &h2StreamConn{w: w, rc: http.NewResponseController(w), body: r.Body, local: local, remote: r.RemoteAddr}
+}
+
+// reply answers the CONNECT: 200 once the upstream is dialed, or the
+// status dialFailure gives for err
+func (c *h2StreamConn) reply(err error) {
+	if err == nil {
+		c.w.WriteHeader(http.StatusOK)
+		c.rc.Flush()
+		return
+	}
+	status, reason := dialFailure(err)
+	if reason == "" {
+		c.w.WriteHeader(status)
+		return
+	}
+	http.Error(c.w, reason, status)
+}
+
+func (c *h2StreamConn) Read(p []byte) (int, error) { return c.body.Read(p) }
+
+// Write sends p to the client right away rather than when the handler returns
+func (c *h2StreamConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return 0, net.ErrClosed
+	}
+	c.writing = true
+	c.mu.Unlock()
+	n, err := c.w.Write(p)
+	if err == nil {
+		err = c.rc.Flush()
+	}
+	c.mu.Lock()
+	c.writing = false
+	c.mu.Unlock()
+	return n, err
+}
+
+// Close ends both directions. A write still waiting for the client to
+// open its flow-control window is cut off with an expired deadline, which
+// resets the stream; otherwise the stream ends normally once the handler
+// returns.
+func (c *h2StreamConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	c.body.Close()
+	if c.writing {
+		c.rc.SetWriteDeadline(time.Now())
+	}
+	return nil
+}
+
+func (c *h2StreamConn) LocalAddr() net.Addr {
+	if c.local == nil {
+		return h2Addr("")
+	}
+	return c.local
+}
+func (c *h2StreamConn) RemoteAddr() net.Addr { return h2Addr(c.remote) }
+
+func (c *h2StreamConn) SetDeadline(t time.Time) error {
+	if err := c.rc.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.rc.SetWriteDeadline(t)
+}
+func (c *h2StreamConn) SetReadDeadline(t time.Time) error  { return c.rc.SetReadDeadline(t) }
+func (c *h2StreamConn) SetWriteDeadline(t time.Time) error { return c.rc.SetWriteDeadline(t) }
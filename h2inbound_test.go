@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// startH2Proxy serves the proxy over TLS with h2 offered by ALPN, as
+// -tls-cert does, and returns an HTTP/2 client trusting its certificate
+func startH2Proxy(t *testing.T) (string, *http2.Transport) {
+	t.Helper()
+	var handlers sync.WaitGroup
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handlers.Add(1)
+		defer handlers.Done()
+		proxyHandler(w, r)
+	}))
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	roots := x509.NewCertPool()
+	roots.AddCert(srv.Certificate())
+	tr := &http2.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}
+	t.Cleanup(func() {
+		tr.CloseIdleConnections()
+		srv.Close()
+		handlers.Wait()
+	})
+	return srv.Listener.Addr().String(), tr
+}
+
+// h2Connect opens a CONNECT stream to target and returns the response with
+// the writing side of the stream, once the proxy answered
+func h2Connect(t *testing.T, tr *http2.Transport, proxyAddr, target, auth string) (*http.Response, io.WriteCloser) {
+	t.Helper()
+	pr, pw := io.Pipe()
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Scheme: "https", Host: proxyAddr},
+		Host:   target,
+		Header: http.Header{},
+		Body:   pr,
+	}
+	if auth != "" {
+		req.Header.Set("Proxy-Authorization", auth)
+	}
+	resp, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		pw.Close()
+		resp.Body.Close()
+	})
+	if resp.ProtoMajor != 2 {
+		t.Fatalf("proto = %s, want HTTP/2", resp.Proto)
+	}
+	return resp, pw
+}
+
+func TestH2InboundConnect(t *testing.T) {
+	echo := startEchoServer(t)
+	proxyAddr, tr := startH2Proxy(t)
+	setTestMapping(t, "alice", "direct", "s3cret")
+
+	t.Run("relays both ways", func(t *testing.T) {
+		resp, w := h2Connect(t, tr, proxyAddr, echo, basicAuth("alice", "s3cret"))
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("status = %d, want 200", resp.StatusCode)
+		}
+		// larger than the initial flow-control window, so both directions
+		// have to wait for WINDOW_UPDATEs
+		msg := make([]byte, 256<<10)
+		rand.Read(msg)
+		go w.Write(msg)
+		got := make([]byte, len(msg))
+		if _, err := io.ReadFull(resp.Body, got); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, msg) {
+			t.Error("echo differs from what was sent")
+		}
+	})
+
+	t.Run("several streams", func(t *testing.T) {
+		for _, msg := range []string{"first", "second", "third"} {
+			resp, w := h2Connect(t, tr, proxyAddr, echo, basicAuth("alice", "s3cret"))
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("status = %d, want 200", resp.StatusCode)
+			}
+			w.Write([]byte(msg))
+			got := make([]byte, len(msg))
+			if _, err := io.ReadFull(resp.Body, got); err != nil || string(got) != msg {
+				t.Errorf("echo = %q, %v, want %q", got, err, msg)
+			}
+		}
+	})
+
+	t.Run("no credentials", func(t *testing.T) {
+		resp, _ := h2Connect(t, tr, proxyAddr, echo, "")
+		if resp.StatusCode != http.StatusProxyAuthRequired {
+			t.Fatalf("status = %d, want 407", resp.StatusCode)
+		}
+		if resp.Header.Get("Proxy-Authenticate") == "" {
+			t.Error("407 without a Proxy-Authenticate challenge")
+		}
+	})
+
+	t.Run("wrong password", func(t *testing.T) {
+		resp, _ := h2Connect(t, tr, proxyAddr, echo, basicAuth("alice", "wrong"))
+		if resp.StatusCode != http.StatusProxyAuthRequired {
+			t.Fatalf("status = %d, want 407", resp.StatusCode)
+		}
+	})
+
+	t.Run("closed by closeUserConns", func(t *testing.T) {
+		resp, w := h2Connect(t, tr, proxyAddr, echo, basicAuth("alice", "s3cret"))
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("status = %d, want 200", resp.StatusCode)
+		}
+		w.Write([]byte("ping"))
+		if _, err := io.ReadFull(resp.Body, make([]byte, 4)); err != nil {
+			t.Fatal(err)
+		}
+		// streams of the subtests before may still be unregistering
+		if n := closeUserConns("alice"); n < 1 {
+			t.Errorf("closeUserConns = %d, want the open stream", n)
+		}
+		ended := make(chan error, 1)
+		go func() {
+			_, err := resp.Body.Read(make([]byte, 1))
+			ended <- err
+		}()
+		select {
+		case err := <-ended:
+			if err == nil {
+				t.Error("read data after the tunnel was closed")
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("stream still open after closeUserConns")
+		}
+		// only the stream ended; new ones still work
+		resp, w = h2Connect(t, tr, proxyAddr, echo, basicAuth("alice", "s3cret"))
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("status after the close = %d, want 200", resp.StatusCode)
+		}
+		w.Write([]byte("again"))
+		got := make([]byte, 5)
+		if _, err := io.ReadFull(resp.Body, got); err != nil || string(got) != "again" {
+			t.Errorf("echo after the close = %q, %v", got, err)
+		}
+	})
+}
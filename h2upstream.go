@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/proxy"
+)
+
+// https upstreams with ?proto=h2 carry every tunnel as a CONNECT stream of
+// one shared HTTP/2 connection instead of a TCP connection each
+
+const (
+	h2ConnectTimeout = 10 * time.Second
+	h2IdleTimeout    = 5 * time.Minute
+)
+
+// h2Transport only frames streams; connections are dialed by h2Dialer. A
+// connection that stops answering pings, or that can't write for
+// WriteByteTimeout because the upstream stopped reading, is closed, which
+// fails its tunnels and makes the next dial reconnect.
+var h2Transport = &http2.Transport{
+	ReadIdleTimeout:  30 * time.Second,
+	PingTimeout:      15 * time.Second,
+	WriteByteTimeout: 30 * time.Second,
+	IdleConnTimeout:  h2IdleTimeout,
+}
+
+// validateHTTPSProto checks the proto parameter of an http(s) upstream
+func validateHTTPSProto(u *url.URL) error {
+	switch p := u.Query().Get("proto"); {
+	case p == "":
+	case p != "h2":
+		return fmt.Errorf("unknown proto %q, want h2", p)
+	case u.Scheme != "https":
+		return errors.New("proto=h2 needs an https upstream")
+	}
+	return nil
+}
+
+func isH2Upstream(u *url.URL) bool {
+	return u.Scheme == "https" && u.Query().Get("proto") == "h2"
+}
+
+// h2Session is an HTTP/2 connection shared by every tunnel through the same
+// upstream URL
+type h2Session struct {
+	mu sync.Mutex
+	cc *http2.ClientConn
+}
+
+var (
+	h2SessionsMu sync.Mutex
+	h2Sessions   = map[string]*h2Session{} // upstream URL -> session
+)
+
+// h2Dialer implements proxy.Dialer by opening CONNECT streams on a cached
+// HTTP/2 connection
+type h2Dialer struct {
+	upstreamURL *url.URL
+	forward     proxy.Dialer
+	via         string // hops before this one, so chains get their own sessions
+	hopConfig
+}
+
+func (d *h2Dialer) Dial(network, addr string) (net.Conn, error) {
+	key := d.via + d.upstreamURL.String() + d.tlsKey()
+	h2SessionsMu.Lock()
+	s := h2Sessions[key]
+	if s == nil {
+		s = &h2Session{}
+		h2Sessions[key] = s
+	}
+	h2SessionsMu.Unlock()
+
+	for attempt := 0; ; attempt++ {
+		cc, err := d.session(s)
+		if err != nil {
+			return nil, err
+		}
+		conn, err := d.connect(cc, addr)
+		if err == nil || attempt > 0 {
+			return conn, err
+		}
+		// an answer from the upstream is final; anything else, like a GOAWAY
+		// that raced the stream or a dead connection, is retried once on a
+		// fresh connection
+		var refused *connectRefused
+		if errors.As(err, &refused) {
+			return nil, err
+		}
+		s.mu.Lock()
+		if s.cc == cc {
+			s.cc = nil
+		}
+		s.mu.Unlock()
+		if cc.State().StreamsActive == 0 {
+			cc.Close()
+		}
+	}
+}
+
+// helper to return the session's connection, replacing it if the upstream
+// sent GOAWAY or it died. A replaced connection drains its open tunnels
+// before it closes.
+func (d *h2Dialer) session(s *h2Session) (*http2.ClientConn, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cc != nil && s.cc.CanTakeNewRequest() {
+		return s.cc, nil
+	}
+	start := time.Now()
+	conn, err := d.forward.Dial("tcp", d.upstreamURL.Host)
+	if err != nil {
+		return nil, err
+	}
+	tc, err := upstreamTLS(conn, d.upstreamURL.Host, d.hopConfig, "h2")
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if p := tc.ConnectionState().NegotiatedProtocol; p != "h2" {
+		tc.Close()
+		return nil, errors.New("upstream didn't agree to HTTP/2")
+	}
+	cc, err := h2Transport.NewClientConn(tc)
+	if err != nil {
+		tc.Close()
+		return nil, err
+	}
+	h2Latency.handshake.observe(time.Since(start))
+	s.cc = cc
+	return cc, nil
+}
+
+// connectRefused is a CONNECT the upstream answered with an error status,
+// and the text of its body if it had one
+type connectRefused struct {
+	status string
+	text   string
+}
+
+func (e *connectRefused) Error() string {
+	if e.text != "" {
+		return "proxy connect failed: " + e.status + ": " + e.text
+	}
+	return "proxy connect failed: " + e.status
+}
+
+// helper to open a CONNECT stream to addr
+func (d *h2Dialer) connect(cc *http2.ClientConn, addr string) (net.Conn, error) {
+	pr, pw := io.Pipe()
+	ctx, cancel := context.WithCancel(context.Background())
+	req := (&http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Host: addr},
+		Host:   addr,
+		Header: http.Header{},
+		Body:   pr,
+	}).WithContext(ctx)
+	if d.proxyAuth != "" {
+		req.Header.Set("Proxy-Authorization", d.proxyAuth)
+	} else if d.upstreamURL.User != nil {
+		req.Header.Set("Proxy-Authorization", basicProxyAuth(d.upstreamURL))
+	}
+	for name, v := range d.headers {
+		req.Header.Set(name, v)
+	}
+
+	// the context lives as long as the stream, so the timeout only covers
+	// waiting for the response
+	start := time.Now()
+	timeout := time.AfterFunc(h2ConnectTimeout, cancel)
+	resp, err := cc.RoundTrip(req)
+	if !timeout.Stop() && err == nil {
+		err = errors.New("timed out waiting for the upstream to answer CONNECT")
+		resp.Body.Close()
+	}
+	if err != nil {
+		cancel()
+		pw.Close()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		cancel()
+		pw.Close()
+		return nil, &connectRefused{status: resp.Status}
+	}
+	h2Latency.connect.observe(time.Since(start))
+	return &h2Conn{body: resp.Body, pw: pw, cancel: cancel, remote: d.upstreamURL.Host}, nil
+}
+
+// h2Conn is a tunnel over one CONNECT stream
+type h2Conn struct {
+	body   io.ReadCloser
+	pw     *io.PipeWriter
+	cancel context.CancelFunc
+	remote string
+	once   sync.Once
+}
+
+func (c *h2Conn) Read(p []byte) (int, error)  { return c.body.Read(p) }
+func (c *h2Conn) Write(p []byte) (int, error) { return c.pw.Write(p) }
+
+func (c *h2Conn) Close() error {
+	c.once.Do(func() {
+		c.pw.Close()
+		c.body.Close()
+		c.cancel()
+	})
+	return nil
+}
+
+func (c *h2Conn) LocalAddr() net.Addr  { return h2Addr("") }
+func (c *h2Conn) RemoteAddr() net.Addr { return h2Addr(c.remote) }
+
+var errH2Deadline = errors.New("deadlines are not supported on http/2 tunnels")
+
+func (c *h2Conn) SetDeadline(time.Time) error      { return errH2Deadline }
+func (c *h2Conn) SetReadDeadline(time.Time) error  { return errH2Deadline }
+func (c *h2Conn) SetWriteDeadline(time.Time) error { return errH2Deadline }
+
+// h2Addr is the upstream a stream goes through
+type h2Addr string
+
+func (a h2Addr) Network() string { return "h2" }
+func (a h2Addr) String() string  { return string(a) }
+
+// forgetClosedH2Sessions drops sessions whose connection was closed, which
+// the transport does after h2IdleTimeout without tunnels
+func forgetClosedH2Sessions() {
+	h2SessionsMu.Lock()
+	defer h2SessionsMu.Unlock()
+	for key, s := range h2Sessions {
+		// a session that is connecting is in use
+		if !s.mu.TryLock() {
+			continue
+		}
+		if s.cc == nil || s.cc.State().Closed {
+			delete(h2Sessions, key)
+		}
+		s.mu.Unlock()
+	}
+}
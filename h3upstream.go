@@ -0,0 +1,359 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// h3 upstreams are HTTP/3 proxies: every tunnel is a CONNECT request stream
+// of one shared QUIC connection. QUIC runs over UDP, so an h3 upstream can't
+// be reached through other proxies and may only be the first hop of a chain.
+
+const (
+	h3HandshakeTimeout   = 10 * time.Second
+	h3MaxIdleTimeout     = 30 * time.Second // without packets from the proxy the connection is dead
+	h3SessionIdleTimeout = 5 * time.Minute  // without tunnels the connection is closed
+)
+
+// h3Transport only frames streams; connections are dialed by h3Dialer.
+// Compression is off so CONNECT doesn't ask for gzip.
+var h3Transport = &http3.Transport{DisableCompression: true}
+
+// h3QUICConfig keeps connections alive between tunnels; one that stops
+// answering is closed after h3MaxIdleTimeout, and the next dial reconnects
+var h3QUICConfig = &quic.Config{
+	HandshakeIdleTimeout: h3HandshakeTimeout,
+	MaxIdleTimeout:       h3MaxIdleTimeout,
+	KeepAlivePeriod:      h3MaxIdleTimeout / 2,
+}
+
+// validateH3Upstream checks the parameters of an h3 upstream
+func validateH3Upstream(u *url.URL) error {
+	for k, v := range u.Query() {
+		switch k {
+		case "sni":
+			continue
+		case "0rtt":
+		default:
+			return fmt.Errorf("unknown h3 upstream parameter %q, want 0rtt or sni", k)
+		}
+		if _, err := strconv.ParseBool(v[0]); err != nil {
+			return fmt.Errorf("0rtt is %q, want true or false", v[0])
+		}
+	}
+	return nil
+}
+
+// h3Session is a QUIC connection shared by every tunnel through the same
+// upstream URL
+type h3Session struct {
+	mu      sync.Mutex // held while connecting
+	qc      *quic.Conn
+	cc      *http3.ClientConn
+	tickets tls.ClientSessionCache
+
+	active   int // open tunnels, guarded by h3SessionsMu
+	lastUsed time.Time
+}
+
+var (
+	h3SessionsMu sync.Mutex
+	h3Sessions   = map[string]*h3Session{} // upstream URL -> session
+)
+
+// h3Tickets holds the session tickets that let a new connection resume,
+// and send its first CONNECT in 0-RTT. They outlive idle sessions.
+var h3Tickets = tls.NewLRUClientSessionCache(256)
+
+// h3TicketCache keeps the tickets of a session apart from those of other
+// sessions to the same server, which may use another client certificate
+type h3TicketCache string
+
+func (c h3TicketCache) Get(key string) (*tls.ClientSessionState, bool) {
+	return h3Tickets.Get(string(c) + "#" + key)
+}
+
+func (c h3TicketCache) Put(key string, cs *tls.ClientSessionState) {
+	h3Tickets.Put(string(c)+"#"+key, cs)
+}
+
+// h3Dialer implements proxy.Dialer by opening CONNECT streams on a cached
+// QUIC connection
+type h3Dialer struct {
+	upstreamURL *url.URL
+	early       bool // send the first CONNECT in 0-RTT when resuming
+	hopConfig
+}
+
+func (d *h3Dialer) Dial(network, addr string) (net.Conn, error) {
+	key := d.upstreamURL.String() + d.tlsKey()
+	h3SessionsMu.Lock()
+	s := h3Sessions[key]
+	if s == nil {
+		s = &h3Session{tickets: h3TicketCache(key)}
+		h3Sessions[key] = s
+	}
+	// counted from here on so an idle sweep leaves the session alone
+	s.active++
+	h3SessionsMu.Unlock()
+
+	for attempt := 0; ; attempt++ {
+		cc, err := d.session(s)
+		if err != nil {
+			s.release()
+			return nil, err
+		}
+		conn, err := d.connect(cc, s, addr)
+		if err == nil {
+			return conn, nil
+		}
+		// an answer from the upstream is final; anything else, like a
+		// GOAWAY or a dead connection, is retried once on a fresh connection.
+		// A rejected 0-RTT gets another try on the same connection.
+		var refused *connectRefused
+		rejected := errors.Is(err, quic.Err0RTTRejected)
+		if errors.As(err, &refused) || attempt > 1 || (attempt > 0 && !rejected) {
+			s.release()
+			return nil, err
+		}
+		s.mu.Lock()
+		if s.cc == cc {
+			s.cc = nil
+			if rejected {
+				s.resume()
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+// helper to go on with a connection whose 0-RTT was rejected: the
+// handshake completes as usual, but streams must be opened again
+func (s *h3Session) resume() {
+	ctx, cancel := context.WithTimeout(context.Background(), h3HandshakeTimeout)
+	defer cancel()
+	if qc, err := s.qc.NextConnection(ctx); err == nil {
+		s.qc = qc
+		s.cc = h3Transport.NewClientConn(qc)
+	}
+}
+
+func (s *h3Session) release() {
+	h3SessionsMu.Lock()
+	s.active--
+	s.lastUsed = time.Now()
+	h3SessionsMu.Unlock()
+}
+
+// helper to return the session's connection, reconnecting if it timed out
+// or was replaced. A replaced connection drains its open tunnels before it
+// closes.
+func (d *h3Dialer) session(s *h3Session) (*http3.ClientConn, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cc != nil && s.cc.Context().Err() == nil {
+		return s.cc, nil
+	}
+	start := time.Now()
+	qc, err := d.dial(s.tickets)
+	if err != nil {
+		return nil, err
+	}
+	if d.early {
+		// the connection is usable before the handshake is done
+		go func() {
+			select {
+			case <-qc.HandshakeComplete():
+				h3Latency.handshake.observe(time.Since(start))
+			case <-qc.Context().Done():
+			}
+		}()
+	} else {
+		h3Latency.handshake.observe(time.Since(start))
+	}
+	s.qc = qc
+	s.cc = h3Transport.NewClientConn(qc)
+	return s.cc, nil
+}
+
+// helper to open a QUIC connection to the upstream, trying each of its
+// addresses in turn
+func (d *h3Dialer) dial(tickets tls.ClientSessionCache) (*quic.Conn, error) {
+	host, port, err := net.SplitHostPort(d.upstreamURL.Host)
+	if err != nil {
+		return nil, err
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		return nil, err
+	}
+	var addrs []*net.UDPAddr
+	if ip, err := netip.ParseAddr(host); err == nil {
+		addrs = []*net.UDPAddr{{IP: ip.AsSlice(), Port: p, Zone: ip.Zone()}}
+	} else {
+		ips, err := lookupUpstreamHost(host)
+		if err != nil {
+			return nil, &upstreamResolveError{host, err}
+		}
+		if len(ips) == 0 {
+			return nil, &upstreamResolveError{host, errors.New("no addresses")}
+		}
+		for _, ip := range ips {
+			addrs = append(addrs, &net.UDPAddr{IP: ip, Port: p})
+		}
+	}
+	tc, err := upstreamTLSConfig(d.upstreamURL.Host, d.hopConfig, http3.NextProtoH3)
+	if err != nil {
+		return nil, err
+	}
+	tc.ClientSessionCache = tickets
+
+	ctx, cancel := context.WithTimeout(context.Background(), h3HandshakeTimeout)
+	defer cancel()
+	deadline, _ := ctx.Deadline()
+	for i, addr := range addrs {
+		// like upstreamHostDialer, split the time left between the addresses
+		actx, acancel := context.WithTimeout(ctx, time.Until(deadline)/time.Duration(len(addrs)-i))
+		var qc *quic.Conn
+		qc, err = d.dialAddr(actx, addr, tc)
+		acancel()
+		if err == nil {
+			return qc, nil
+		}
+	}
+	var verr *tls.CertificateVerificationError
+	if errors.As(err, &verr) {
+		return nil, upstreamTLSError(d.upstreamURL.Host, tc.ServerName, err)
+	}
+	return nil, fmt.Errorf("quic handshake with upstream %s: %w", d.upstreamURL.Host, err)
+}
+
+// helper to dial one address from a socket of its own, which is closed
+// with the connection
+func (d *h3Dialer) dialAddr(ctx context.Context, addr *net.UDPAddr, tc *tls.Config) (*quic.Conn, error) {
+	udp, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, err
+	}
+	tr := &quic.Transport{Conn: udp}
+	var qc *quic.Conn
+	if d.early {
+		qc, err = tr.DialEarly(ctx, addr, tc, h3QUICConfig)
+	} else {
+		qc, err = tr.Dial(ctx, addr, tc, h3QUICConfig)
+	}
+	if err != nil {
+		tr.Close()
+		return nil, err
+	}
+	go func() {
+		<-qc.Context().Done()
+		tr.Close()
+	}()
+	return qc, nil
+}
+
+// helper to open a CONNECT stream to addr
+func (d *h3Dialer) connect(cc *http3.ClientConn, s *h3Session, addr string) (net.Conn, error) {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Host: addr},
+		Host:   addr,
+		Header: http.Header{},
+	}
+	if d.proxyAuth != "" {
+		req.Header.Set("Proxy-Authorization", d.proxyAuth)
+	} else if d.upstreamURL.User != nil {
+		req.Header.Set("Proxy-Authorization", basicProxyAuth(d.upstreamURL))
+	}
+	for name, v := range d.headers {
+		req.Header.Set(name, v)
+	}
+
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), h2ConnectTimeout)
+	defer cancel()
+	str, err := cc.OpenRequestStream(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// the deadline only covers waiting for the response
+	str.SetReadDeadline(start.Add(h2ConnectTimeout))
+	if err := str.SendRequestHeader(req); err != nil {
+		str.CancelRead(quic.StreamErrorCode(http3.ErrCodeRequestCanceled))
+		str.CancelWrite(quic.StreamErrorCode(http3.ErrCodeRequestCanceled))
+		return nil, err
+	}
+	resp, err := str.ReadResponse()
+	if err != nil {
+		str.CancelRead(quic.StreamErrorCode(http3.ErrCodeRequestCanceled))
+		str.CancelWrite(quic.StreamErrorCode(http3.ErrCodeRequestCanceled))
+		var nerr net.Error
+		if errors.As(err, &nerr) && nerr.Timeout() {
+			err = errors.New("timed out waiting for the upstream to answer CONNECT")
+		}
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		str.CancelRead(quic.StreamErrorCode(http3.ErrCodeNoError))
+		str.Close()
+		return nil, &connectRefused{status: resp.Status}
+	}
+	str.SetReadDeadline(time.Time{})
+	h3Latency.connect.observe(time.Since(start))
+	return &h3Conn{RequestStream: str, session: s, local: cc.Conn().LocalAddr(), remote: cc.Conn().RemoteAddr()}, nil
+}
+
+// h3Conn is a tunnel over one CONNECT stream, counted while it is open
+type h3Conn struct {
+	*http3.RequestStream
+	session       *h3Session
+	local, remote net.Addr
+	once          sync.Once
+}
+
+func (c *h3Conn) Close() error {
+	c.once.Do(func() {
+		c.RequestStream.CancelRead(quic.StreamErrorCode(http3.ErrCodeNoError))
+		c.RequestStream.Close()
+		c.session.release()
+	})
+	return nil
+}
+
+func (c *h3Conn) LocalAddr() net.Addr  { return c.local }
+func (c *h3Conn) RemoteAddr() net.Addr { return c.remote }
+
+// closeIdleH3Sessions closes sessions that have had no tunnels for
+// h3SessionIdleTimeout, which also drops those of upstreams no longer in use
+func closeIdleH3Sessions(now time.Time) {
+	var idle []*h3Session
+	h3SessionsMu.Lock()
+	for key, s := range h3Sessions {
+		if s.active == 0 && now.Sub(s.lastUsed) >= h3SessionIdleTimeout {
+			idle = append(idle, s)
+			delete(h3Sessions, key)
+		}
+	}
+	h3SessionsMu.Unlock()
+
+	for _, s := range idle {
+		s.mu.Lock()
+		if s.cc != nil {
+			s.cc.CloseWithError(http3.ErrCodeNoError, "")
+		}
+		s.mu.Unlock()
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+var upstreamHandshakeTimeout = flag.Duration("upstream-handshake-timeout", 15*time.Second, "how long the CONNECT or SOCKS exchange with an http, https, ntlm, socks4 or socks5 upstream may take, TLS included")
+
+// handshakeTimeoutError is an upstream that took longer than
+// -upstream-handshake-timeout to set up a tunnel. Clients get 504 for it.
+type handshakeTimeoutError struct {
+	upstream string // host:port
+	err      error
+}
+
+func (e *handshakeTimeoutError) Error() string {
+	return fmt.Sprintf("handshake with upstream %s timed out", e.upstream)
+}
+func (e *handshakeTimeoutError) Unwrap() error { return e.err }
+
+// handshakeTimeout names the upstream in err if err is a deadline running
+// out, unless a hop before it already was. The whole chain is looked at,
+// since a net.OpError wrapping a timeout, as the SOCKS5 dialer returns,
+// doesn't report one itself.
+func handshakeTimeout(upstream string, err error) error {
+	var named *handshakeTimeoutError
+	if errors.As(err, &named) {
+		return err
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return &handshakeTimeoutError{upstream, err}
+	}
+	for e := err; e != nil; e = errors.Unwrap(e) {
+		if nerr, ok := e.(net.Error); ok && nerr.Timeout() {
+			return &handshakeTimeoutError{upstream, err}
+		}
+	}
+	return err
+}
+
+// socks5Dialer runs the dial and handshake of a SOCKS5 dialer under
+// -upstream-handshake-timeout; the deadline is cleared once the tunnel is up
+type socks5Dialer struct {
+	proxy.ContextDialer
+	upstream string
+}
+
+func (d socks5Dialer) Dial(network, addr string) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), *upstreamHandshakeTimeout)
+	defer cancel()
+	conn, err := d.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, handshakeTimeout(d.upstream, err)
+	}
+	return conn, nil
+}
+
+// contextHop gives the dialer a SOCKS5 dialer reaches its proxy through a
+// DialContext. x/net's fallback for a plain Dialer runs it in a goroutine
+// that still writes its result after the deadline ended the dial, racing
+// with the caller. Every hop bounds its own handshake, so a plain Dial is
+// run as it is, and a hop before this one that times out is the one named.
+type contextHop struct {
+	proxy.Dialer
+}
+
+func (h contextHop) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if cd, ok := h.Dialer.(proxy.ContextDialer); ok {
+		return cd.DialContext(ctx, network, addr)
+	}
+	return h.Dial(network, addr)
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// startBlackHole accepts connections and never answers or closes them
+// until the test ends
+func startBlackHole(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mu sync.Mutex
+	var conns []net.Conn
+	t.Cleanup(func() {
+		ln.Close()
+		mu.Lock()
+		defer mu.Unlock()
+		for _, c := range conns {
+			c.Close()
+		}
+	})
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			conns = append(conns, c)
+			mu.Unlock()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestUpstreamHandshakeTimeout(t *testing.T) {
+	const timeout = 300 * time.Millisecond
+	setFlag(t, upstreamHandshakeTimeout, timeout)
+	echo := startEchoServer(t)
+	hole := startBlackHole(t)
+	corp := httptest.NewServer(&connectProxy{})
+	defer corp.Close()
+
+	for _, tt := range []struct {
+		name, raw string
+	}{
+		{"http", "http://u:p@" + hole},
+		{"ntlm", "ntlm://CORP%5Cu:p@" + hole},
+		{"https", "https://" + hole},
+		{"socks5", "socks5://u:p@" + hole},
+		{"socks5h", "socks5h://" + hole},
+		{"socks5+tls", "socks5+tls://" + hole},
+		{"socks4", "socks4://" + hole},
+		{"first hop of a chain", "http://" + hole + ",socks5://127.0.0.1:1"},
+		{"second hop of a chain", "http://" + corp.Listener.Addr().String() + ",socks5://" + hole},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			up, err := buildUpstream(tt.raw, 0, nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			d, err := dialerFor(up, nil, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			start := time.Now()
+			conn, err := d.Dial("tcp", echo)
+			elapsed := time.Since(start)
+			if err == nil {
+				conn.Close()
+				t.Fatal("dial through a black hole succeeded")
+			}
+			var timedOut *handshakeTimeoutError
+			if !errors.As(err, &timedOut) {
+				t.Fatalf("err = %v (%T), want a handshakeTimeoutError", err, err)
+			}
+			if !strings.Contains(err.Error(), hole) {
+				t.Errorf("err = %v, want it to name %s", err, hole)
+			}
+			if elapsed < timeout || elapsed > timeout+time.Second {
+				t.Errorf("gave up after %s, want about %s", elapsed, timeout)
+			}
+		})
+	}
+}
+
+// The client of a black-holed upstream gets 504 naming it, and the tunnel
+// before it still works
+func TestUpstreamHandshakeTimeoutResponse(t *testing.T) {
+	setFlag(t, upstreamHandshakeTimeout, 300*time.Millisecond)
+	echo := startEchoServer(t)
+	hole := startBlackHole(t)
+	proxyAddr := startProxy(t)
+
+	setTestMapping(t, "alice", "socks5://"+hole, "")
+	resp, _ := dialConnect(t, proxyAddr, echo, basicAuth("alice", "x"))
+	body, _ := io.ReadAll(resp.Body)
+	if want := "handshake with upstream " + hole + " timed out"; resp.StatusCode != http.StatusGatewayTimeout || !strings.Contains(string(body), want) {
+		t.Errorf("%d %q, want 504 %q", resp.StatusCode, body, want)
+	}
+
+	// the deadline doesn't outlive the handshake
+	upstream := startFakeSOCKS5(t, "", "")
+	setTestMapping(t, "alice", "socks5://"+upstream.addr, "")
+	resp, conn := dialConnect(t, proxyAddr, echo, basicAuth("alice", "x"))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want 200", resp.StatusCode)
+	}
+	time.Sleep(500 * time.Millisecond)
+	expectEcho(t, conn, "still open after the handshake timeout")
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// historyLen is how many changes are kept per user; older ones are dropped
+const historyLen = 50
+
+type historyEntry struct {
+	Time       time.Time `json:"time"`
+	Upstream   string    `json:"upstream"` // redacted
+	Actor      string    `json:"actor"`
+	RemoteAddr string    `json:"remote_addr,omitempty"`
+}
+
+var (
+	historyMu sync.Mutex
+	history   = map[string][]historyEntry{} // oldest first, at most historyLen each
+)
+
+// helper to append a change to a user's history, dropping the oldest entry when full
+func recordHistory(user string, e historyEntry) {
+	historyMu.Lock()
+	defer historyMu.Unlock()
+	h := history[user]
+	if len(h) < historyLen {
+		history[user] = append(h, e)
+		return
+	}
+	copy(h, h[1:])
+	h[len(h)-1] = e
+}
+
+// helper to drop a user's history once their mapping is gone, so removed
+// users don't keep entries in memory and in the state file
+func forgetHistory(user string) {
+	historyMu.Lock()
+	delete(history, user)
+	historyMu.Unlock()
+}
+
+// helper to copy the history of every user, for the state file
+func snapshotHistory() map[string][]historyEntry {
+	historyMu.Lock()
+	defer historyMu.Unlock()
+	out := make(map[string][]historyEntry, len(history))
+	for user, h := range history {
+		out[user] = append([]historyEntry(nil), h...)
+	}
+	return out
+}
+
+// restoreHistory keeps the saved history of users that still have a
+// mapping; files written before removal dropped history may hold others
+func restoreHistory(saved map[string][]historyEntry, loaded map[string]*Upstream) {
+	historyMu.Lock()
+	defer historyMu.Unlock()
+	for user, h := range saved {
+		if loaded[user] == nil {
+			continue
+		}
+		if len(h) > historyLen {
+			h = h[len(h)-historyLen:]
+		}
+		history[user] = h
+	}
+}
+
+// GET /upstream/history?user=u
+//
+// Returns the user's recent upstream changes, oldest first.
+func historyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeMethodNotAllowed(w)
+		return
+	}
+	user := r.URL.Query().Get("user")
+	if user == "" {
+		writeInvalid(w, &fieldError{"user", "missing"})
+		return
+	}
+
+	historyMu.Lock()
+	entries := append([]historyEntry{}, history[user]...)
+	historyMu.Unlock()
+
+	writeJSON(w, http.StatusOK, entries)
+}
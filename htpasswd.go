@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+var htpasswdPath = flag.String("htpasswd", "", "also check proxy passwords against this htpasswd file (bcrypt, MD5-crypt or {SHA} entries), re-read on SIGHUP and when it changes")
+
+// htpasswdPollInterval is how often the file's mtime is checked
+const htpasswdPollInterval = 5 * time.Second
+
+// htpasswdFile is a parsed htpasswd file, swapped whole on reload
+type htpasswdFile struct {
+	users   map[string]string // user -> hash
+	modTime time.Time
+}
+
+var htpasswd atomic.Pointer[htpasswdFile]
+
+// loadHtpasswd parses the -htpasswd file, naming the line of any entry it
+// can't use
+func loadHtpasswd() error {
+	f, err := os.Open(*htpasswdPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	users := map[string]string{}
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		user, hash, ok := strings.Cut(line, ":")
+		if !ok || user == "" {
+			return fmt.Errorf("line %d: want user:hash", n)
+		}
+		if !supportedHtpasswdHash(hash) {
+			return fmt.Errorf("line %d: unsupported hash format for user %q; use bcrypt, MD5-crypt ($apr1$) or {SHA}", n, user)
+		}
+		users[user] = hash
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+	htpasswd.Store(&htpasswdFile{users, st.ModTime()})
+	return nil
+}
+
+func supportedHtpasswdHash(hash string) bool {
+	switch {
+	case strings.HasPrefix(hash, "$2"):
+		_, err := bcrypt.Cost([]byte(hash))
+		return err == nil
+	case strings.HasPrefix(hash, "$apr1$"), strings.HasPrefix(hash, "$1$"):
+		return strings.Count(hash, "$") == 3
+	case strings.HasPrefix(hash, "{SHA}"):
+		b, err := base64.StdEncoding.DecodeString(hash[len("{SHA}"):])
+		return err == nil && len(b) == sha1.Size
+	}
+	return false
+}
+
+// htpasswdHash returns the user's entry in the -htpasswd file
+func htpasswdHash(user string) (string, bool) {
+	f := htpasswd.Load()
+	if f == nil {
+		return "", false
+	}
+	hash, ok := f.users[user]
+	return hash, ok
+}
+
+// verifyHash checks a password against a bcrypt, MD5-crypt or {SHA} hash
+func verifyHash(hash, password string) bool {
+	var want string
+	switch {
+	case strings.HasPrefix(hash, "$2"):
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+	case strings.HasPrefix(hash, "$apr1$"), strings.HasPrefix(hash, "$1$"):
+		magic := hash[:strings.Index(hash[1:], "$")+2]
+		salt, _, _ := strings.Cut(hash[len(magic):], "$")
+		want = md5Crypt(password, salt, magic)
+	case strings.HasPrefix(hash, "{SHA}"):
+		sum := sha1.Sum([]byte(password))
+		want = "{SHA}" + base64.StdEncoding.EncodeToString(sum[:])
+	}
+	return want != "" && subtle.ConstantTimeCompare([]byte(want), []byte(hash)) == 1
+}
+
+// md5Crypt is the MD5-based crypt(3) used by htpasswd -m, with magic "$apr1$"
+// for Apache's variant and "$1$" for the original
+func md5Crypt(password, salt, magic string) string {
+	pw := []byte(password)
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+
+	alt := md5.Sum([]byte(password + salt + password))
+	d := md5.New()
+	d.Write([]byte(password + magic + salt))
+	for i := len(pw); i > 0; i -= 16 {
+		d.Write(alt[:min(i, 16)])
+	}
+	for i := len(pw); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			d.Write([]byte{0})
+		} else {
+			d.Write(pw[:1])
+		}
+	}
+	final := d.Sum(nil)
+
+	for i := 0; i < 1000; i++ {
+		d := md5.New()
+		if i&1 != 0 {
+			d.Write(pw)
+		} else {
+			d.Write(final)
+		}
+		if i%3 != 0 {
+			d.Write([]byte(salt))
+		}
+		if i%7 != 0 {
+			d.Write(pw)
+		}
+		if i&1 != 0 {
+			d.Write(final)
+		} else {
+			d.Write(pw)
+		}
+		final = d.Sum(nil)
+	}
+
+	const itoa64 = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+	var out []byte
+	enc := func(a, b, c byte, n int) {
+		v := uint(a)<<16 | uint(b)<<8 | uint(c)
+		for ; n > 0; n-- {
+			out = append(out, itoa64[v&0x3f])
+			v >>= 6
+		}
+	}
+	enc(final[0], final[6], final[12], 4)
+	enc(final[1], final[7], final[13], 4)
+	enc(final[2], final[8], final[14], 4)
+	enc(final[3], final[9], final[15], 4)
+	enc(final[4], final[10], final[5], 4)
+	enc(0, 0, final[11], 2)
+	return magic + salt + "$" + string(out)
+}
+
+// reloadHtpasswd re-reads the file, keeping the current entries on error
+func reloadHtpasswd() error {
+	if err := loadHtpasswd(); err != nil {
+		log.Printf("htpasswd: keeping current entries: %v", err)
+		return err
+	}
+	log.Printf("htpasswd: loaded %d users from %s", len(htpasswd.Load().users), *htpasswdPath)
+	return nil
+}
+
+// watchHtpasswd reloads the file whenever its mtime changes
+func watchHtpasswd() {
+	for range time.Tick(htpasswdPollInterval) {
+		st, err := os.Stat(*htpasswdPath)
+		if err != nil {
+			continue
+		}
+		cur := htpasswd.Load()
+		if st.ModTime().Equal(cur.modTime) {
+			continue
+		}
+		if reloadHtpasswd() != nil {
+			// don't retry a broken file until it changes again
+			htpasswd.CompareAndSwap(cur, &htpasswdFile{cur.users, st.ModTime()})
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+var userIdleTTL = flag.Duration("user-idle-ttl", 0, "remove mappings with no tunnel or change for this long (0 = never)")
+
+// idleSweepInterval bounds how often the table is scanned for idle users
+const idleSweepInterval = time.Minute
+
+var (
+	startedAt   = time.Now()
+	idleRemoved atomic.Uint64 // mappings removed for inactivity
+)
+
+func idleLoop() {
+	if *userIdleTTL <= 0 {
+		return
+	}
+	t := time.NewTicker(min(idleSweepInterval, *userIdleTTL))
+	defer t.Stop()
+	for now := range t.C {
+		removeIdleUpstreams(now)
+	}
+}
+
+// removeIdleUpstreams removes every mapping whose last tunnel and last change
+// are older than -user-idle-ttl. The default mapping and users with open
+// connections are kept. Usage isn't persisted, so after a restart users
+// count as active from the start.
+func removeIdleUpstreams(now time.Time) {
+	cutoff := now.Add(-*userIdleTTL)
+	idle := map[string]*Upstream{}
+	upstreamsMu.RLock()
+	usageMu.Lock()
+	for user, up := range upstreams {
+		if user == defaultUser {
+			continue
+		}
+		active := up.SetAt
+		if startedAt.After(active) {
+			active = startedAt
+		}
+		if u := usage[user]; u != nil && u.lastConnect.After(active) {
+			active = u.lastConnect
+		}
+		if active.Before(cutoff) {
+			idle[user] = up
+		}
+	}
+	usageMu.Unlock()
+	upstreamsMu.RUnlock()
+
+	for user, up := range idle {
+		ok, err := removeIdleUpstream(user, up)
+		if err != nil {
+			log.Printf("idle: removing %q failed: %v", user, err)
+			continue
+		}
+		if ok {
+			idleRemoved.Add(1)
+			log.Printf("idle: removed mapping for %q, unused for %s", user, *userIdleTTL)
+		}
+	}
+}
+
+// removeIdleUpstream removes user's mapping if it is still the given entry
+// and the user has no open connections
+func removeIdleUpstream(user string, up *Upstream) (bool, error) {
+	storeMu.Lock()
+	defer storeMu.Unlock()
+	upstreamsMu.RLock()
+	current := upstreams[user]
+	upstreamsMu.RUnlock()
+	if current != up || userConnCount(user) > 0 {
+		return false, nil
+	}
+	return removeUpstreamLocked(changeSource{Actor: "idle"}, user)
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"net/netip"
+	"sort"
+	"sync"
+)
+
+// ipMap identifies proxy clients that cannot send Proxy-Authorization by
+// their source address. It is only consulted for requests without the header.
+var (
+	ipMapMu sync.RWMutex
+	ipMap   = map[netip.Prefix]string{} // masked prefix -> user
+)
+
+type ipMapEntry struct {
+	CIDR string `json:"cidr"`
+	User string `json:"user"`
+}
+
+// ipMapUser returns the user of the longest prefix containing addr
+func ipMapUser(addr netip.Addr) (string, bool) {
+	addr = addr.Unmap()
+	ipMapMu.RLock()
+	defer ipMapMu.RUnlock()
+	best, user := -1, ""
+	for p, u := range ipMap {
+		if p.Bits() > best && p.Contains(addr) {
+			best, user = p.Bits(), u
+		}
+	}
+	return user, best >= 0
+}
+
+// helper to find the IP-mapped user of a proxy request's client address
+func ipMapUserFor(r *http.Request) (string, bool) {
+	addr, ok := clientAddr(r)
+	if !ok {
+		return "", false
+	}
+	return ipMapUser(addr)
+}
+
+// parseCIDR accepts a CIDR or a bare address, which maps just that address
+func parseCIDR(s string) (netip.Prefix, error) {
+	if s == "" {
+		return netip.Prefix{}, &fieldError{"cidr", "missing"}
+	}
+	p, err := netip.ParsePrefix(s)
+	if err != nil {
+		addr, aerr := netip.ParseAddr(s)
+		if aerr != nil {
+			return netip.Prefix{}, &fieldError{"cidr", "not a CIDR or IP address"}
+		}
+		addr = addr.Unmap()
+		return netip.PrefixFrom(addr, addr.BitLen()), nil
+	}
+	if p.Addr().Is4In6() {
+		p = netip.PrefixFrom(p.Addr().Unmap(), max(p.Bits()-96, 0))
+	}
+	return p.Masked(), nil
+}
+
+func snapshotIPMap() map[string]string {
+	ipMapMu.RLock()
+	defer ipMapMu.RUnlock()
+	out := make(map[string]string, len(ipMap))
+	for p, u := range ipMap {
+		out[p.String()] = u
+	}
+	return out
+}
+
+// restoreIPMap loads the entries saved in the state file
+func restoreIPMap(saved map[string]string) {
+	m := make(map[netip.Prefix]string, len(saved))
+	for cidr, user := range saved {
+		p, err := parseCIDR(cidr)
+		if err != nil {
+			log.Printf("state: skipping ip map entry %q: %v", cidr, err)
+			continue
+		}
+		m[p] = user
+	}
+	ipMapMu.Lock()
+	ipMap = m
+	ipMapMu.Unlock()
+}
+
+func ipMapHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		listIPMapHandler(w, r)
+	case http.MethodPost:
+		setIPMapHandler(w, r)
+	case http.MethodDelete:
+		deleteIPMapHandler(w, r)
+	default:
+		writeMethodNotAllowed(w)
+	}
+}
+
+// GET /ipmap
+func listIPMapHandler(w http.ResponseWriter, r *http.Request) {
+	ipMapMu.RLock()
+	entries := make([]ipMapEntry, 0, len(ipMap))
+	for p, u := range ipMap {
+		entries = append(entries, ipMapEntry{p.String(), u})
+	}
+	ipMapMu.RUnlock()
+	sort.Slice(entries, func(i, j int) bool { return entries[i].CIDR < entries[j].CIDR })
+
+	writeJSON(w, http.StatusOK, entries)
+}
+
+// POST /ipmap { "cidr":"10.1.2.0/24", "user":"u" }
+//
+// Requests without Proxy-Authorization from inside the CIDR are handled as
+// that user. Setting a CIDR again replaces its user.
+func setIPMapHandler(w http.ResponseWriter, r *http.Request) {
+	var req ipMapEntry
+	if !decodeJSON(w, r, *maxBodyBytes, &req) {
+		return
+	}
+	p, err := parseCIDR(req.CIDR)
+	if err != nil {
+		writeInvalid(w, err)
+		return
+	}
+	if err := validateUser(req.User); err != nil {
+		writeInvalid(w, err)
+		return
+	}
+
+	ipMapMu.Lock()
+	ipMap[p] = req.User
+	ipMapMu.Unlock()
+	scheduleStateSave()
+	log.Printf("admin: %s mapped %s to %q", sourceOf(r).Actor, p, req.User)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// DELETE /ipmap?cidr=10.1.2.0/24
+func deleteIPMapHandler(w http.ResponseWriter, r *http.Request) {
+	cidr := r.URL.Query().Get("cidr")
+	if cidr == "" && r.ContentLength != 0 {
+		var req struct {
+			CIDR string `json:"cidr"`
+		}
+		if !decodeJSON(w, r, *maxBodyBytes, &req) {
+			return
+		}
+		cidr = req.CIDR
+	}
+	p, err := parseCIDR(cidr)
+	if err != nil {
+		writeInvalid(w, err)
+		return
+	}
+
+	ipMapMu.Lock()
+	_, ok := ipMap[p]
+	delete(ipMap, p)
+	ipMapMu.Unlock()
+	if !ok {
+		writeError(w, http.StatusNotFound, "ipmap_not_found", "no ip map entry for cidr")
+		return
+	}
+	scheduleStateSave()
+	log.Printf("admin: %s removed ip map entry %s", sourceOf(r).Actor, p)
+
+	w.WriteHeader(http.StatusNoContent)
+}
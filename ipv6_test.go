@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// rawConnectProxy is an HTTP proxy that records each CONNECT exactly as it
+// was written, since net/http would fold the Host header into the request
+// line's authority
+type rawConnectProxy struct {
+	addr string
+
+	mu    sync.Mutex
+	lines []string // request lines
+	hosts []string // Host headers
+}
+
+func startRawConnectProxy(t *testing.T, addr string) *rawConnectProxy {
+	t.Helper()
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	p := &rawConnectProxy{addr: ln.Addr().String()}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go p.serve(conn)
+		}
+	}()
+	return p
+}
+
+func (p *rawConnectProxy) serve(conn net.Conn) {
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+	tr := textproto.NewReader(br)
+	line, err := tr.ReadLine()
+	if err != nil {
+		return
+	}
+	header, err := tr.ReadMIMEHeader()
+	if err != nil {
+		return
+	}
+	p.mu.Lock()
+	p.lines = append(p.lines, line)
+	p.hosts = append(p.hosts, header.Get("Host"))
+	p.mu.Unlock()
+
+	method, rest, _ := strings.Cut(line, " ")
+	target, _, _ := strings.Cut(rest, " ")
+	if method != http.MethodConnect {
+		return
+	}
+	dest, err := net.Dial("tcp", target)
+	if err != nil {
+		io.WriteString(conn, "HTTP/1.1 502 Bad Gateway\r\nContent-Length: 0\r\n\r\n")
+		return
+	}
+	io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+	relay(&bufferedConn{conn, br}, dest)
+}
+
+// listenIPv6 skips the test where ::1 can't be listened on
+func listenIPv6(t *testing.T) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skipf("no IPv6 loopback: %v", err)
+	}
+	ln.Close()
+}
+
+func TestIPv6UpstreamsAndTargets(t *testing.T) {
+	listenIPv6(t)
+	echo4 := startEchoServer(t)
+	echo6 := startEchoServerOn(t, "[::1]:0")
+	proxyAddr := startProxy(t)
+
+	for _, tt := range []struct {
+		name, upstreamOn, target string
+	}{
+		{"v4 upstream, v6 target", "127.0.0.1:0", echo6},
+		{"v6 upstream, v4 target", "[::1]:0", echo4},
+		{"v6 upstream, v6 target", "[::1]:0", echo6},
+	} {
+		t.Run("http "+tt.name, func(t *testing.T) {
+			upstream := startRawConnectProxy(t, tt.upstreamOn)
+			setTestMapping(t, "alice", "http://"+upstream.addr, "")
+
+			resp, conn := dialConnect(t, proxyAddr, tt.target, basicAuth("alice", "x"))
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("status = %d, want 200", resp.StatusCode)
+			}
+			expectEcho(t, conn, "over IPv6")
+			upstream.mu.Lock()
+			defer upstream.mu.Unlock()
+			// the target keeps its brackets in both places
+			if want := "CONNECT " + tt.target + " HTTP/1.1"; len(upstream.lines) != 1 || upstream.lines[0] != want {
+				t.Errorf("request lines = %q, want %q", upstream.lines, want)
+			}
+			if len(upstream.hosts) != 1 || upstream.hosts[0] != tt.target {
+				t.Errorf("Host = %q, want %s", upstream.hosts, tt.target)
+			}
+		})
+
+		t.Run("socks5 "+tt.name, func(t *testing.T) {
+			upstream := startFakeSOCKS5On(t, tt.upstreamOn, "", "")
+			setTestMapping(t, "alice", "socks5://"+upstream.addr, "")
+
+			resp, conn := dialConnect(t, proxyAddr, tt.target, basicAuth("alice", "x"))
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("status = %d, want 200", resp.StatusCode)
+			}
+			expectEcho(t, conn, "over IPv6")
+			host, _, _ := net.SplitHostPort(tt.target)
+			addrType := byte(1)
+			if host == "::1" {
+				addrType = 4
+			}
+			if req := upstream.lastRequest(t); req.addrType != addrType || req.host != host {
+				t.Errorf("upstream got type %d %s, want type %d %s", req.addrType, req.host, addrType, host)
+			}
+		})
+	}
+}
+
+func TestConnectTargetRejects(t *testing.T) {
+	proxyAddr := startProxy(t)
+	upstream := startRawConnectProxy(t, "127.0.0.1:0")
+	setTestMapping(t, "alice", "http://"+upstream.addr, "")
+
+	for _, target := range []string{
+		"::1:443",           // no brackets
+		"[::1]",             // no port
+		"[example.com]:443", // a name in brackets
+		"[127.0.0.1]:443",   // IPv4 in brackets
+		"[::1]:0",           // port 0
+		"[::1]:65536",       // port out of range
+		"2001:db8::1]:443",  // half bracketed
+		"example.com:https", // named port
+		":443",              // no host
+	} {
+		resp, _ := dialConnect(t, proxyAddr, target, basicAuth("alice", "x"))
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("CONNECT %s: status = %d, want 400", target, resp.StatusCode)
+		}
+	}
+	upstream.mu.Lock()
+	defer upstream.mu.Unlock()
+	if len(upstream.lines) != 0 {
+		t.Errorf("upstream got %q", upstream.lines)
+	}
+}
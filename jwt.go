@@ -0,0 +1,336 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	jwtJWKSURL     = flag.String("jwt-jwks-url", "", "accept Bearer JWTs in Proxy-Authorization, verified with the keys at this JWKS URL")
+	jwtPublicKey   = flag.String("jwt-public-key", "", "accept Bearer JWTs in Proxy-Authorization, verified with this PEM public key file")
+	jwtAudience    = flag.String("jwt-audience", "", "audience Bearer JWTs must be issued for (required with -jwt-jwks-url or -jwt-public-key)")
+	jwtIssuer      = flag.String("jwt-issuer", "", "issuer Bearer JWTs must carry in iss; empty accepts any")
+	jwtUserClaim   = flag.String("jwt-user-claim", "sub", "JWT claim holding the proxy username")
+	jwtJWKSRefresh = flag.Duration("jwt-jwks-refresh", 10*time.Minute, "how often -jwt-jwks-url is fetched again")
+)
+
+const (
+	// jwtLeeway allows for clock skew between the gateway and the issuer
+	jwtLeeway = 30 * time.Second
+	// jwksMinRefresh bounds how often a token with an unknown key ID can
+	// make the JWKS be fetched early
+	jwksMinRefresh = 30 * time.Second
+	maxJWKSBytes   = 1 << 20
+)
+
+// jwtKey is one verification key; kid is empty for -jwt-public-key
+type jwtKey struct {
+	kid string
+	key crypto.PublicKey
+}
+
+var (
+	jwtKeys     atomic.Pointer[[]jwtKey]
+	jwksFetched atomic.Int64 // unix nanos of the last fetch attempt
+	jwksNudge   = make(chan struct{}, 1)
+)
+
+func jwtEnabled() bool {
+	return *jwtJWKSURL != "" || *jwtPublicKey != ""
+}
+
+// loadJWTKeys checks the JWT flags and loads the static key or does the
+// first JWKS fetch
+func loadJWTKeys() error {
+	switch {
+	case *jwtJWKSURL != "" && *jwtPublicKey != "":
+		return errors.New("-jwt-jwks-url and -jwt-public-key are mutually exclusive")
+	case *jwtAudience == "":
+		return errors.New("-jwt-audience is required")
+	case *jwtUserClaim == "":
+		return errors.New("-jwt-user-claim may not be empty")
+	}
+	if *jwtPublicKey != "" {
+		b, err := os.ReadFile(*jwtPublicKey)
+		if err != nil {
+			return err
+		}
+		block, _ := pem.Decode(b)
+		if block == nil {
+			return fmt.Errorf("%s: no PEM block", *jwtPublicKey)
+		}
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return fmt.Errorf("%s: %v", *jwtPublicKey, err)
+		}
+		jwtKeys.Store(&[]jwtKey{{key: key}})
+		return nil
+	}
+	return fetchJWKS()
+}
+
+// fetchJWKS replaces the keys with the ones at -jwt-jwks-url, keeping the
+// current keys on error
+func fetchJWKS() error {
+	jwksFetched.Store(time.Now().UnixNano())
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(*jwtJWKSURL)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	var doc struct {
+		Keys []json.RawMessage `json:"keys"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxJWKSBytes)).Decode(&doc); err != nil {
+		return err
+	}
+	var keys []jwtKey
+	for _, raw := range doc.Keys {
+		k, err := parseJWK(raw)
+		if err != nil {
+			log.Printf("jwt: skipping key: %v", err)
+			continue
+		}
+		if k.key != nil {
+			keys = append(keys, k)
+		}
+	}
+	if len(keys) == 0 {
+		return errors.New("no usable signing keys")
+	}
+	jwtKeys.Store(&keys)
+	return nil
+}
+
+// parseJWK decodes one JWKS entry; encryption keys come back without a key
+func parseJWK(raw json.RawMessage) (jwtKey, error) {
+	var j struct {
+		Kty, Kid, Use, Crv string
+		N, E, X, Y         string
+	}
+	if err := json.Unmarshal(raw, &j); err != nil {
+		return jwtKey{}, err
+	}
+	if j.Use == "enc" {
+		return jwtKey{}, nil
+	}
+	b64 := base64.RawURLEncoding.DecodeString
+	switch j.Kty {
+	case "RSA":
+		n, err1 := b64(j.N)
+		e, err2 := b64(j.E)
+		if err := errors.Join(err1, err2); err != nil || len(e) == 0 || len(e) > 4 {
+			return jwtKey{}, fmt.Errorf("kid %q: bad RSA key", j.Kid)
+		}
+		return jwtKey{j.Kid, &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}}, nil
+	case "EC":
+		var curve elliptic.Curve
+		var check ecdh.Curve
+		switch j.Crv {
+		case "P-256":
+			curve, check = elliptic.P256(), ecdh.P256()
+		case "P-384":
+			curve, check = elliptic.P384(), ecdh.P384()
+		case "P-521":
+			curve, check = elliptic.P521(), ecdh.P521()
+		default:
+			return jwtKey{}, fmt.Errorf("kid %q: unsupported curve %q", j.Kid, j.Crv)
+		}
+		x, err1 := b64(j.X)
+		y, err2 := b64(j.Y)
+		size := (curve.Params().BitSize + 7) / 8
+		if errors.Join(err1, err2) != nil || len(x) != size || len(y) != size {
+			return jwtKey{}, fmt.Errorf("kid %q: bad EC key", j.Kid)
+		}
+		// ecdh rejects points that aren't on the curve
+		if _, err := check.NewPublicKey(append(append([]byte{4}, x...), y...)); err != nil {
+			return jwtKey{}, fmt.Errorf("kid %q: %v", j.Kid, err)
+		}
+		return jwtKey{j.Kid, &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}}, nil
+	case "OKP":
+		x, err := b64(j.X)
+		if j.Crv != "Ed25519" || err != nil || len(x) != ed25519.PublicKeySize {
+			return jwtKey{}, fmt.Errorf("kid %q: unsupported OKP key", j.Kid)
+		}
+		return jwtKey{j.Kid, ed25519.PublicKey(x)}, nil
+	}
+	return jwtKey{}, fmt.Errorf("kid %q: unsupported key type %q", j.Kid, j.Kty)
+}
+
+// refreshJWKS fetches the JWKS every -jwt-jwks-refresh, or early when a
+// token names a key ID it doesn't know
+func refreshJWKS() {
+	t := time.NewTicker(*jwtJWKSRefresh)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+		case <-jwksNudge:
+			if time.Since(time.Unix(0, jwksFetched.Load())) < jwksMinRefresh {
+				continue
+			}
+		}
+		if err := fetchJWKS(); err != nil {
+			log.Printf("jwt: keeping current keys: %s: %v", *jwtJWKSURL, err)
+		}
+	}
+}
+
+// verifyJWT checks a token's signature, expiry, audience and issuer and
+// returns the username from -jwt-user-claim
+func verifyJWT(token string, now time.Time) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", errors.New("malformed token")
+	}
+	var hdr struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &hdr); err != nil {
+		return "", err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", err
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+
+	keys := jwtKeys.Load()
+	if keys == nil {
+		return "", errors.New("no keys")
+	}
+	known, verified := false, false
+	for _, k := range *keys {
+		if hdr.Kid != "" && k.kid != "" && k.kid != hdr.Kid {
+			continue
+		}
+		known = true
+		if jwtSignatureOK(hdr.Alg, k.key, signed, sig) {
+			verified = true
+			break
+		}
+	}
+	if !known && *jwtJWKSURL != "" {
+		select {
+		case jwksNudge <- struct{}{}:
+		default:
+		}
+	}
+	if !verified {
+		return "", errors.New("bad signature")
+	}
+
+	var claims map[string]any
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return "", err
+	}
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return "", errors.New("no exp claim")
+	}
+	if !now.Before(time.Unix(int64(exp), 0).Add(jwtLeeway)) {
+		return "", errors.New("expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(jwtLeeway).Before(time.Unix(int64(nbf), 0)) {
+		return "", errors.New("not valid yet")
+	}
+	if !jwtAudienceOK(claims["aud"]) {
+		return "", errors.New("wrong audience")
+	}
+	if iss, _ := claims["iss"].(string); *jwtIssuer != "" && iss != *jwtIssuer {
+		return "", errors.New("wrong issuer")
+	}
+	user, _ := claims[*jwtUserClaim].(string)
+	if user == "" {
+		return "", fmt.Errorf("no %q claim", *jwtUserClaim)
+	}
+	return user, nil
+}
+
+func decodeJWTPart(s string, v any) error {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// aud is a string or a list of strings
+func jwtAudienceOK(aud any) bool {
+	switch a := aud.(type) {
+	case string:
+		return a == *jwtAudience
+	case []any:
+		for _, v := range a {
+			if v == *jwtAudience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// jwtSignatureOK verifies an asymmetric signature; the algorithm must suit
+// the key, so "none" and HMAC algorithms are never accepted
+func jwtSignatureOK(alg string, key crypto.PublicKey, signed, sig []byte) bool {
+	var h crypto.Hash
+	switch alg[min(2, len(alg)):] {
+	case "256":
+		h = crypto.SHA256
+	case "384":
+		h = crypto.SHA384
+	case "512":
+		h = crypto.SHA512
+	}
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if h == 0 {
+			return false
+		}
+		d := h.New()
+		d.Write(signed)
+		switch alg[:2] {
+		case "RS":
+			return rsa.VerifyPKCS1v15(k, h, d.Sum(nil), sig) == nil
+		case "PS":
+			return rsa.VerifyPSS(k, h, d.Sum(nil), sig, nil) == nil
+		}
+	case *ecdsa.PublicKey:
+		size := (k.Curve.Params().BitSize + 7) / 8
+		want := map[int]string{32: "ES256", 48: "ES384", 66: "ES512"}[size]
+		if alg != want || len(sig) != 2*size {
+			return false
+		}
+		d := h.New()
+		d.Write(signed)
+		r, s := new(big.Int).SetBytes(sig[:size]), new(big.Int).SetBytes(sig[size:])
+		return ecdsa.Verify(k, d.Sum(nil), r, s)
+	case ed25519.PublicKey:
+		return (alg == "EdDSA" || alg == "Ed25519") && ed25519.Verify(k, signed, sig)
+	}
+	return false
+}
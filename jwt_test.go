@@ -0,0 +1,192 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+// signJWT builds a token with header and claims, signed by sign over the
+// first two parts
+func signJWT(t *testing.T, header, claims map[string]any, sign func(signed []byte) []byte) string {
+	t.Helper()
+	part := func(v any) string {
+		b, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+	signed := part(header) + "." + part(claims)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sign([]byte(signed)))
+}
+
+func TestVerifyJWT(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edPub, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := jwtKeys.Load()
+	jwtKeys.Store(&[]jwtKey{{"rsa", &rsaKey.PublicKey}, {"ec", &ecKey.PublicKey}, {"ed", edPub}})
+	t.Cleanup(func() { jwtKeys.Store(old) })
+	setFlag(t, jwtAudience, "upstreamgate")
+	setFlag(t, jwtIssuer, "https://idp.example.com")
+	setFlag(t, jwtUserClaim, "sub")
+
+	digest := func(b []byte) []byte {
+		sum := sha256.Sum256(b)
+		return sum[:]
+	}
+	rs256 := func(b []byte) []byte {
+		sig, err := rsa.SignPKCS1v15(rand.Reader, rsaKey, crypto.SHA256, digest(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sig
+	}
+	ps256 := func(b []byte) []byte {
+		sig, err := rsa.SignPSS(rand.Reader, rsaKey, crypto.SHA256, digest(b), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sig
+	}
+	es256 := func(b []byte) []byte {
+		r, s, err := ecdsa.Sign(rand.Reader, ecKey, digest(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	}
+	eddsa := func(b []byte) []byte { return ed25519.Sign(edKey, b) }
+	none := func([]byte) []byte { return nil }
+	// HS256 keyed with the RSA public key, the classic algorithm confusion
+	pubDER, err := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hs256 := func(b []byte) []byte {
+		mac := hmac.New(sha256.New, pubDER)
+		mac.Write(b)
+		return mac.Sum(nil)
+	}
+
+	now := time.Now()
+	claims := func(edit func(map[string]any)) map[string]any {
+		c := map[string]any{"sub": "alice", "aud": "upstreamgate", "iss": "https://idp.example.com", "exp": now.Add(time.Hour).Unix()}
+		if edit != nil {
+			edit(c)
+		}
+		return c
+	}
+	hdr := func(alg, kid string) map[string]any {
+		h := map[string]any{"alg": alg, "typ": "JWT"}
+		if kid != "" {
+			h["kid"] = kid
+		}
+		return h
+	}
+	valid := signJWT(t, hdr("RS256", "rsa"), claims(nil), rs256)
+	parts := strings.Split(valid, ".")
+	// one bit of the signature flipped
+	sig, _ := base64.RawURLEncoding.DecodeString(parts[2])
+	sig[len(sig)/2] ^= 1
+	tampered := parts[0] + "." + parts[1] + "." + base64.RawURLEncoding.EncodeToString(sig)
+	// other claims under the same signature
+	other := strings.Split(signJWT(t, hdr("RS256", "rsa"), claims(func(c map[string]any) { c["sub"] = "admin" }), none), ".")
+	swapped := parts[0] + "." + other[1] + "." + parts[2]
+
+	for _, tt := range []struct {
+		name  string
+		token string
+		err   string // empty when alice is accepted
+	}{
+		{"RS256", valid, ""},
+		{"PS256", signJWT(t, hdr("PS256", "rsa"), claims(nil), ps256), ""},
+		{"ES256", signJWT(t, hdr("ES256", "ec"), claims(nil), es256), ""},
+		{"EdDSA", signJWT(t, hdr("EdDSA", "ed"), claims(nil), eddsa), ""},
+		{"no kid tries every key", signJWT(t, hdr("ES256", ""), claims(nil), es256), ""},
+		{"aud in a list", signJWT(t, hdr("RS256", "rsa"), claims(func(c map[string]any) { c["aud"] = []string{"other", "upstreamgate"} }), rs256), ""},
+		{"expired within the leeway", signJWT(t, hdr("RS256", "rsa"), claims(func(c map[string]any) { c["exp"] = now.Add(-10 * time.Second).Unix() }), rs256), ""},
+
+		{"alg none", signJWT(t, hdr("none", "rsa"), claims(nil), none), "bad signature"},
+		{"alg none without kid", signJWT(t, hdr("none", ""), claims(nil), none), "bad signature"},
+		{"HS256 with the public key", signJWT(t, hdr("HS256", "rsa"), claims(nil), hs256), "bad signature"},
+		{"HS256 without kid", signJWT(t, hdr("HS256", ""), claims(nil), hs256), "bad signature"},
+		{"ES256 header on an RSA signature", signJWT(t, hdr("ES256", "rsa"), claims(nil), rs256), "bad signature"},
+		{"tampered signature", tampered, "bad signature"},
+		{"tampered claims", swapped, "bad signature"},
+		{"unknown kid", signJWT(t, hdr("RS256", "gone"), claims(nil), rs256), "bad signature"},
+
+		{"expired", signJWT(t, hdr("RS256", "rsa"), claims(func(c map[string]any) { c["exp"] = now.Add(-time.Hour).Unix() }), rs256), "expired"},
+		{"no exp", signJWT(t, hdr("RS256", "rsa"), claims(func(c map[string]any) { delete(c, "exp") }), rs256), "no exp claim"},
+		{"nbf in the future", signJWT(t, hdr("RS256", "rsa"), claims(func(c map[string]any) { c["nbf"] = now.Add(time.Hour).Unix() }), rs256), "not valid yet"},
+		{"wrong aud", signJWT(t, hdr("RS256", "rsa"), claims(func(c map[string]any) { c["aud"] = "other" }), rs256), "wrong audience"},
+		{"no aud", signJWT(t, hdr("RS256", "rsa"), claims(func(c map[string]any) { delete(c, "aud") }), rs256), "wrong audience"},
+		{"wrong iss", signJWT(t, hdr("RS256", "rsa"), claims(func(c map[string]any) { c["iss"] = "https://evil.example.com" }), rs256), "wrong issuer"},
+		{"no iss", signJWT(t, hdr("RS256", "rsa"), claims(func(c map[string]any) { delete(c, "iss") }), rs256), "wrong issuer"},
+		{"no sub", signJWT(t, hdr("RS256", "rsa"), claims(func(c map[string]any) { delete(c, "sub") }), rs256), `no "sub" claim`},
+		{"two parts", parts[0] + "." + parts[1], "malformed token"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			user, err := verifyJWT(tt.token, now)
+			switch {
+			case tt.err == "" && (err != nil || user != "alice"):
+				t.Errorf("verifyJWT = %q, %v, want alice", user, err)
+			case tt.err != "" && (err == nil || err.Error() != tt.err):
+				t.Errorf("verifyJWT = %q, %v, want %q", user, err, tt.err)
+			}
+		})
+	}
+}
+
+// Signatures of the wrong size for the curve are refused before they reach
+// ecdsa.Verify
+func TestJWTSignatureOKSizes(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := []byte("header.claims")
+	sum := crypto.SHA384.New()
+	sum.Write(signed)
+	r, s, err := ecdsa.Sign(rand.Reader, key, sum.Sum(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig := append(r.FillBytes(make([]byte, 48)), s.FillBytes(make([]byte, 48))...)
+	if !jwtSignatureOK("ES384", &key.PublicKey, signed, sig) {
+		t.Error("ES384 refused")
+	}
+	for _, tt := range []struct {
+		alg string
+		sig []byte
+	}{
+		{"ES256", sig},            // alg of another curve
+		{"ES384", sig[1:]},        // short
+		{"ES384", append(sig, 0)}, // long
+	} {
+		if jwtSignatureOK(tt.alg, &key.PublicKey, signed, tt.sig) {
+			t.Errorf("%s with a %d-byte signature accepted", tt.alg, len(tt.sig))
+		}
+	}
+}
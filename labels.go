@@ -0,0 +1,52 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+)
+
+var (
+	labelKeys = flag.String("label-keys", "", "comma-separated mapping label keys included in access logs and metrics")
+	accessLog = flag.Bool("access-log", false, "log one line per finished tunnel")
+)
+
+const (
+	maxLabels          = 32
+	maxLabelKeyLen     = 63
+	maxLabelValueLen   = 256
+	labelKeyCharacters = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_./"
+)
+
+func validateLabels(labels map[string]string) error {
+	if len(labels) > maxLabels {
+		return fmt.Errorf("at most %d labels allowed", maxLabels)
+	}
+	for k, v := range labels {
+		switch {
+		case k == "":
+			return fmt.Errorf("empty label key")
+		case len(k) > maxLabelKeyLen:
+			return fmt.Errorf("label key %.20q... longer than %d bytes", k, maxLabelKeyLen)
+		case strings.Trim(k, labelKeyCharacters) != "":
+			return fmt.Errorf("label key %q may only contain letters, digits and -_./", k)
+		case len(v) > maxLabelValueLen:
+			return fmt.Errorf("label %q value longer than %d bytes", k, maxLabelValueLen)
+		}
+	}
+	return nil
+}
+
+// selectedLabels returns the labels named by -label-keys as key=value pairs
+func selectedLabels(up *Upstream) []string {
+	if *labelKeys == "" || up == nil {
+		return nil
+	}
+	var out []string
+	for _, k := range strings.Split(*labelKeys, ",") {
+		if v, ok := up.Labels[k]; ok {
+			out = append(out, k+"="+v)
+		}
+	}
+	return out
+}
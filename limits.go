@@ -0,0 +1,123 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+)
+
+var (
+	maxUsers      = flag.Int("max-users", 0, "maximum number of user mappings (0 = unlimited); the \"*\" default is not counted")
+	maxUsersEvict = flag.Bool("max-users-evict", false, "at -max-users, evict the least recently used mapping instead of rejecting new users")
+)
+
+var errTooManyUsers = errors.New("user limit reached")
+
+// helper to count mappings against -max-users
+func userCount() int {
+	upstreamsMu.RLock()
+	defer upstreamsMu.RUnlock()
+	n := len(upstreams)
+	if _, ok := upstreams[defaultUser]; ok {
+		n--
+	}
+	return n
+}
+
+// makeRoomFor enforces -max-users before ups is written, evicting least
+// recently used mappings in eviction mode. Callers hold storeMu.
+func makeRoomFor(ups map[string]*Upstream) error {
+	if *maxUsers <= 0 {
+		return nil
+	}
+	added := 0
+	upstreamsMu.RLock()
+	for user := range ups {
+		if _, ok := upstreams[user]; !ok && user != defaultUser {
+			added++
+		}
+	}
+	upstreamsMu.RUnlock()
+	over := userCount() + added - *maxUsers
+	if over <= 0 {
+		return nil
+	}
+	if !*maxUsersEvict {
+		return errTooManyUsers
+	}
+
+	victims := leastRecentlyUsed(over, ups)
+	if len(victims) < over {
+		return errTooManyUsers // the batch alone is over the limit
+	}
+	for _, user := range victims {
+		if _, err := removeUpstreamLocked(changeSource{Actor: "evict"}, user); err != nil {
+			return err
+		}
+		log.Printf("limit: evicted least recently used mapping for %q", user)
+	}
+	return nil
+}
+
+// helper to pick the n least recently used users, never one in keep or the default
+func leastRecentlyUsed(n int, keep map[string]*Upstream) []string {
+	type candidate struct {
+		user string
+		used time.Time
+	}
+	var cands []candidate
+	upstreamsMu.RLock()
+	usageMu.Lock()
+	for user, up := range upstreams {
+		if _, ok := keep[user]; ok || user == defaultUser {
+			continue
+		}
+		used := up.SetAt
+		if u := usage[user]; u != nil && u.lastConnect.After(used) {
+			used = u.lastConnect
+		}
+		cands = append(cands, candidate{user, used})
+	}
+	usageMu.Unlock()
+	upstreamsMu.RUnlock()
+
+	sort.Slice(cands, func(i, j int) bool { return cands[i].used.Before(cands[j].used) })
+	var out []string
+	for _, c := range cands[:min(n, len(cands))] {
+		out = append(out, c.user)
+	}
+	return out
+}
+
+// GET /stats
+func statsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeMethodNotAllowed(w)
+		return
+	}
+
+	userConnsMu.Lock()
+	conns := 0
+	for _, c := range userConns {
+		conns += len(c)
+	}
+	userConnsMu.Unlock()
+
+	writeJSON(w, http.StatusOK, struct {
+		Users             int    `json:"users"`
+		MaxUsers          int    `json:"max_users"` // 0 means unlimited
+		Evict             bool   `json:"evict"`
+		ActiveConnections int    `json:"active_connections"`
+		IdleRemoved       uint64 `json:"idle_removed"`
+		OAuthFallbacks    uint64 `json:"oauth_introspection_fallbacks"` // cached results used while introspection failed
+		CredentialLogins  uint64 `json:"credential_logins"`             // logins by mapping passwords and credentials
+		APIKeyRequests    uint64 `json:"api_key_requests"`
+
+		UpstreamLatency map[string]map[string]latencySummary `json:"upstream_latency"`
+		UpstreamDials   map[string]dialStats                 `json:"upstream_dials,omitempty"` // with -upstream-dial-attempts above 1
+	}{userCount(), *maxUsers, *maxUsersEvict, conns, idleRemoved.Load(), oauthFallbacks.Load(), totalSecretUsage(), totalAPIKeyUsage(),
+		upstreamLatencySummary(), dialStatsSummary()})
+}
@@ -2,44 +2,176 @@ package main
 
 import (
 	"bufio"
+	"context"
+	"crypto/sha256"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"log"
+	"mime"
 	"net"
 	"net/http"
+	"net/netip"
 	"net/url"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"golang.org/x/net/proxy"
 )
 
+var listenAddr = flag.String("addr", ":8090", "address of the proxy listener")
+
+var adminAddr = flag.String("admin-addr", "", "serve the control API on this separate address (e.g. 127.0.0.1:8091) instead of the proxy port")
+
+// shutdownTimeout bounds how long graceful shutdown waits for in-flight requests
+const shutdownTimeout = 10 * time.Second
+
 type Upstream struct {
-	Raw string
-	URL *url.URL
+	Raw       string
+	URL       *url.URL
+	SetAt     time.Time
+	ExpiresAt time.Time // zero means the mapping never expires
+	Version   uint64    // bumped on every change, exposed as the ETag
+	Labels    map[string]string
+	Previous  *Upstream // the mapping this one replaced, for rollback; its own Previous is nil
+
+	// Headers are added to the CONNECT sent to an http or https upstream,
+	// with canonical names
+	Headers map[string]string
+	// ClientCert is presented in the TLS handshake with an https upstream
+	ClientCert *upstreamClientCert
+	// CA replaces -upstream-ca for an https upstream, and ServerName the
+	// host its certificate is checked for
+	CA         *upstreamCAConfig
+	ServerName string
+	// ForwardAuth sends the client's own Proxy-Authorization on the CONNECT
+	// to an http or https upstream, in place of the URL's credentials
+	ForwardAuth bool
+	// SessionTTL is how long a {session} token is kept; zero makes one per
+	// connection
+	SessionTTL time.Duration
+	// Routes send matching CONNECT targets through other upstreams
+	Routes []upstreamRoute
+	// Pool holds tagged upstreams that logins pick from; see pool.go
+	Pool []poolMember
+
+	// PasswordHash is the bcrypt hash of the proxy password the user must
+	// send; empty accepts any
+	PasswordHash string
+	// DigestMD5 and DigestSHA256 are the Digest auth hashes of the same
+	// password, set only with -proxy-digest
+	DigestMD5    string
+	DigestSHA256 string
+	// PasswordExpiresAt is when the password stops being accepted; zero never
+	PasswordExpiresAt time.Time
+	// on write, take the password hashes from the mapping being replaced, and
+	// its PasswordExpiresAt unless one is set
+	keepPassword bool
+	// on write, take Version and Previous from the mapping being replaced:
+	// only the credentials changed, so the upstream has nothing to roll
+	// back to
+	sameUpstream bool
+
+	// AllowedIPs restricts the source addresses the user may connect from;
+	// empty allows any
+	AllowedIPs     []netip.Prefix
+	keepAllowedIPs bool // on write, take AllowedIPs from the mapping being replaced
+
+	// Credentials are extra passwords managed with /credentials. Writes keep
+	// those of the mapping being replaced unless ownCredentials is set.
+	Credentials    []credential
+	ownCredentials bool
+}
+
+// redacted returns the upstream URL with any password masked
+func (up *Upstream) redacted() string {
+	if up == nil {
+		return ""
+	}
+	if isChain(up.Raw) {
+		return redactChain(up.Raw)
+	}
+	if _, ok := up.URL.User.Password(); !ok {
+		return up.Raw
+	}
+	// keep -user-params placeholders readable
+	return strings.NewReplacer("%7B", "{", "%7D", "}").Replace(up.URL.Redacted())
 }
 
+func (up *Upstream) expired(now time.Time) bool {
+	return !up.ExpiresAt.IsZero() && !now.Before(up.ExpiresAt)
+}
+
+var defaultUpstreamFlag = flag.String("default-upstream", "", "upstream for users without a mapping of their own (default direct); same as setting user \"*\"")
+
+var requireMapping = flag.Bool("require-mapping", false, "refuse users without a mapping of their own instead of using the default upstream or direct")
+var requirePassword = flag.Bool("require-password", false, "refuse proxy users whose mapping has no password, including users without a mapping")
+
+var (
+	allowAnonymous = flag.Bool("allow-anonymous", false, "accept requests without Proxy-Authorization as -anonymous-user, with no authentication at all")
+	anonymousUser  = flag.String("anonymous-user", "anonymous", "pseudo-user that -allow-anonymous requests are routed as")
+)
+
+// defaultUser is the mapping used for users without one of their own
+const defaultUser = "*"
+
 var (
 	upstreamsMu sync.RWMutex
 	upstreams   = map[string]*Upstream{}
 
 	userConnsMu sync.Mutex
-	userConns   = map[string][]net.Conn{} // active connections per user
+	userConns   = map[string][]userConn{} // active connections per user
 )
 
+// userConn is a client connection, or a forwarded request, along with the
+// upstream it was dialed through. Closing it ends the tunnel or request.
+type userConn struct {
+	io.Closer
+	up       *Upstream
+	fallback bool // routed by the default because the user had no mapping
+}
+
 // helper to register a connection for a user
-func registerConn(user string, conn net.Conn) {
+func registerConn(user string, conn io.Closer, up *Upstream, fallback bool) {
 	userConnsMu.Lock()
-	userConns[user] = append(userConns[user], conn)
+	userConns[user] = append(userConns[user], userConn{conn, up, fallback})
 	userConnsMu.Unlock()
 }
 
-// helper to close all active connections for a user
-func closeUserConns(user string) {
+// helper to drop a finished connection from a user's list
+func unregisterConn(user string, conn io.Closer) {
+	userConnsMu.Lock()
+	defer userConnsMu.Unlock()
+	conns := userConns[user]
+	for i, c := range conns {
+		if c.Closer == conn {
+			conns = append(conns[:i], conns[i+1:]...)
+			break
+		}
+	}
+	if len(conns) == 0 {
+		delete(userConns, user)
+	} else {
+		userConns[user] = conns
+	}
+}
+
+// helper to close all active connections for a user, returning how many were closed
+func closeUserConns(user string) int {
+	if user == defaultUser {
+		return closeFallbackConns()
+	}
 	userConnsMu.Lock()
 	conns := userConns[user]
 	delete(userConns, user)
@@ -47,192 +179,1869 @@ func closeUserConns(user string) {
 	for _, c := range conns {
 		c.Close()
 	}
+	return len(conns)
 }
 
-// POST { "user":"u", "password":"p", "upstream":"socks5://host:port" }
-func setUpstreamHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
-		return
+// helper to close every connection routed by the default upstream
+func closeFallbackConns() int {
+	var closing []userConn
+	userConnsMu.Lock()
+	for user, conns := range userConns {
+		kept := conns[:0]
+		for _, c := range conns {
+			if c.fallback {
+				closing = append(closing, c)
+			} else {
+				kept = append(kept, c)
+			}
+		}
+		if len(kept) == 0 {
+			delete(userConns, user)
+		} else {
+			userConns[user] = kept
+		}
+	}
+	userConnsMu.Unlock()
+	for _, c := range closing {
+		c.Close()
 	}
+	return len(closing)
+}
 
-	var req struct {
-		User     string `json:"user"`
-		Password string `json:"password"`
-		Upstream string `json:"upstream"`
+// helper to write v as a JSON response
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func upstreamHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		getUpstreamHandler(w, r)
+	case http.MethodPost:
+		setUpstreamHandler(w, r)
+	case http.MethodDelete:
+		deleteUpstreamHandler(w, r)
+	default:
+		writeMethodNotAllowed(w)
 	}
+}
 
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "invalid json", http.StatusBadRequest)
+// GET /upstream?user=u[&reveal=1]
+//
+// Header values are masked unless reveal is set.
+func getUpstreamHandler(w http.ResponseWriter, r *http.Request) {
+	user := r.URL.Query().Get("user")
+	if user == "" {
+		writeInvalid(w, &fieldError{"user", "missing"})
+		return
+	}
+	if !keyAllowsUser(w, r, user) {
 		return
 	}
 
-	u, err := url.Parse(req.Upstream)
-	if err != nil {
-		http.Error(w, "bad upstream url", http.StatusBadRequest)
+	now := time.Now()
+	upstreamsMu.RLock()
+	up, ok := upstreams[user]
+	upstreamsMu.RUnlock()
+	if !ok || up.expired(now) {
+		writeError(w, http.StatusNotFound, "mapping_not_found", "no mapping for user")
 		return
 	}
 
-	upstreamsMu.Lock()
-	upstreams[req.User] = &Upstream{Raw: req.Upstream, URL: u}
-	upstreamsMu.Unlock()
+	resp := struct {
+		User              string            `json:"user"`
+		Upstream          string            `json:"upstream"`
+		Scheme            string            `json:"scheme"`
+		Host              string            `json:"host"`
+		SetAt             time.Time         `json:"set_at"`
+		ExpiresAt         *time.Time        `json:"expires_at,omitempty"`
+		TTLSeconds        *int64            `json:"ttl_seconds,omitempty"`
+		Version           uint64            `json:"version"`
+		Labels            map[string]string `json:"labels,omitempty"`
+		Headers           map[string]string `json:"headers,omitempty"`
+		ClientCert        *clientCertInfo   `json:"client_cert,omitempty"`
+		SessionTTL        int64             `json:"session_ttl_seconds,omitempty"`
+		CA                string            `json:"ca,omitempty"` // path, or "inline"
+		ServerName        string            `json:"server_name,omitempty"`
+		ForwardAuth       bool              `json:"forward_auth,omitempty"`
+		Routes            []routeSpec       `json:"routes,omitempty"`
+		Pool              []poolMemberSpec  `json:"pool,omitempty"`
+		Password          bool              `json:"password_set"`
+		PasswordExpiresAt *time.Time        `json:"password_expires_at,omitempty"`
+		AllowedIPs        []netip.Prefix    `json:"allowed_ips,omitempty"`
+		Active            int               `json:"active_connections"`
+		Pinned            int               `json:"pinned_connections"` // still on a previous upstream
+	}{
+		User: user, Upstream: up.Raw, Scheme: up.URL.Scheme, Host: up.URL.Host, SetAt: up.SetAt, Version: up.Version,
+		Labels: up.Labels, Headers: redactHeaders(up.Headers), ClientCert: up.ClientCert.info(), SessionTTL: int64(up.SessionTTL / time.Second),
+		CA: up.CA.source(), ServerName: up.ServerName, ForwardAuth: up.ForwardAuth, Routes: up.routeSpecs(), Pool: up.poolSpecs(), Password: up.PasswordHash != "", AllowedIPs: up.AllowedIPs, Active: userConnCount(user), Pinned: pinnedConnCount(user, up),
+	}
+	if r.URL.Query().Get("reveal") == "1" {
+		resp.Headers = up.Headers
+	}
+	if !up.PasswordExpiresAt.IsZero() {
+		resp.PasswordExpiresAt = &up.PasswordExpiresAt
+	}
+	if !up.ExpiresAt.IsZero() {
+		ttl := int64(up.ExpiresAt.Sub(now).Round(time.Second).Seconds())
+		resp.ExpiresAt = &up.ExpiresAt
+		resp.TTLSeconds = &ttl
+	}
+	w.Header().Set("ETag", up.etag())
+	writeJSON(w, http.StatusOK, resp)
+}
 
-	// close any old connections for this user
-	closeUserConns(req.User)
+// helper to count active connections for a user
+func userConnCount(user string) int {
+	userConnsMu.Lock()
+	defer userConnsMu.Unlock()
+	return len(userConns[user])
+}
 
-	w.WriteHeader(http.StatusNoContent)
+// helper to count a user's connections still using an upstream other than current
+func pinnedConnCount(user string, current *Upstream) int {
+	userConnsMu.Lock()
+	defer userConnsMu.Unlock()
+	n := 0
+	for _, c := range userConns[user] {
+		// password and credential changes keep the upstream, so compare URLs
+		if c.up == nil || c.up.Raw != current.Raw {
+			n++
+		}
+	}
+	return n
 }
 
-func usernameFromRequest(r *http.Request) (string, error) {
-	auth := r.Header.Get("Proxy-Authorization")
-	if auth == "" {
-		return "", errors.New("no auth")
+func upstreamsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		listUpstreamsHandler(w, r)
+	case http.MethodPost:
+		bulkSetUpstreamsHandler(w, r)
+	case http.MethodDelete:
+		clearUpstreamHandler(w, r)
+	default:
+		writeMethodNotAllowed(w)
 	}
-	parts := strings.SplitN(auth, " ", 2)
-	if len(parts) != 2 || strings.ToLower(parts[0]) != "basic" {
-		return "", errors.New("unsupported auth")
+}
+
+type upstreamEntry struct {
+	User              string            `json:"user"`
+	Upstream          string            `json:"upstream"`
+	Version           uint64            `json:"version"`
+	Labels            map[string]string `json:"labels,omitempty"`
+	ActiveConnections int               `json:"active_connections"`
+	TotalConnections  uint64            `json:"total_connections"`
+	BytesUp           uint64            `json:"bytes_up"`     // client to target, over finished tunnels
+	BytesDown         uint64            `json:"bytes_down"`   // target to client
+	LastConnect       *time.Time        `json:"last_connect"` // null until the first tunnel
+	PasswordExpiresAt *time.Time        `json:"password_expires_at,omitempty"`
+	PasswordExpired   bool              `json:"password_expired,omitempty"` // every password has expired
+}
+
+// listPageMax caps the limit of a paginated GET /upstreams
+const listPageMax = 10000
+
+// GET /upstreams[?reveal=1][&scheme=s][&upstream_host=h][&user_prefix=p][&limit=n][&cursor=c]
+//
+// Without limit or cursor the whole (filtered) table is returned as an array.
+// With either, one page sorted by user is returned as
+// { "upstreams":[...], "next_cursor":"..." }; next_cursor is empty on the last page.
+func listUpstreamsHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	reveal := q.Get("reveal") == "1"
+	scheme, host, prefix := q.Get("scheme"), q.Get("upstream_host"), q.Get("user_prefix")
+
+	paginate := q.Has("limit") || q.Has("cursor")
+	limit := 1000
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > listPageMax {
+			writeInvalid(w, &fieldError{"limit", fmt.Sprintf("must be between 1 and %d", listPageMax)})
+			return
+		}
+		limit = n
 	}
-	b, err := base64.StdEncoding.DecodeString(parts[1])
-	if err != nil {
-		return "", err
+	var after string
+	if v := q.Get("cursor"); v != "" {
+		b, err := base64.RawURLEncoding.DecodeString(v)
+		if err != nil {
+			writeInvalid(w, &fieldError{"cursor", "not a cursor returned by this endpoint"})
+			return
+		}
+		after = string(b)
 	}
-	user := strings.SplitN(string(b), ":", 2)[0]
-	return user, nil
-}
 
-func pickUpstreamFor(r *http.Request) *Upstream {
-	user, _ := usernameFromRequest(r)
+	// only pointers are copied under the lock; redaction, sorting and
+	// encoding happen after it is released
+	type match struct {
+		user string
+		up   *Upstream
+	}
+	now := time.Now()
+	var matches []match
 	upstreamsMu.RLock()
-	defer upstreamsMu.RUnlock()
-	if u, ok := upstreams[user]; ok {
-		return u
+	for user, up := range upstreams {
+		if up.expired(now) || (after != "" && user <= after) || !strings.HasPrefix(user, prefix) {
+			continue
+		}
+		if (scheme != "" && up.URL.Scheme != scheme) || (host != "" && up.URL.Hostname() != host) {
+			continue
+		}
+		matches = append(matches, match{user, up})
 	}
-	return &Upstream{Raw: "direct", URL: &url.URL{Scheme: "direct"}}
-}
+	upstreamsMu.RUnlock()
+	sort.Slice(matches, func(i, j int) bool { return matches[i].user < matches[j].user })
 
-func dialerFor(up *Upstream) (proxy.Dialer, error) {
-	if up == nil || up.URL == nil || up.URL.Scheme == "direct" {
-		return proxy.FromEnvironment(), nil
+	var next string
+	if paginate && len(matches) > limit {
+		matches = matches[:limit]
+		next = base64.RawURLEncoding.EncodeToString([]byte(matches[limit-1].user))
 	}
 
-	switch up.URL.Scheme {
-	case "socks5":
-		var auth *proxy.Auth
-		if up.URL.User != nil {
-			pwd, _ := up.URL.User.Password()
-			auth = &proxy.Auth{User: up.URL.User.Username(), Password: pwd}
+	entries := make([]upstreamEntry, len(matches))
+	for i, m := range matches {
+		raw := m.up.Raw
+		if !reveal {
+			raw = m.up.redacted()
 		}
-		return proxy.SOCKS5("tcp", up.URL.Host, auth, proxy.Direct)
-	case "http", "https":
-		return &httpConnectDialer{upstreamURL: up.URL}, nil
-	default:
-		return nil, fmt.Errorf("unsupported scheme: %s", up.URL.Scheme)
+		e := upstreamEntry{User: m.user, Upstream: raw, Version: m.up.Version, Labels: m.up.Labels}
+		e.ActiveConnections = userConnCount(m.user)
+		e.LastConnect, e.TotalConnections = usageOf(m.user)
+		e.BytesUp, e.BytesDown = bytesOf(m.user)
+		if !m.up.PasswordExpiresAt.IsZero() {
+			e.PasswordExpiresAt = &m.up.PasswordExpiresAt
+		}
+		e.PasswordExpired = m.up.passwordExpired(now)
+		entries[i] = e
+	}
+
+	if !paginate {
+		writeJSON(w, http.StatusOK, entries)
+		return
 	}
+	writeJSON(w, http.StatusOK, struct {
+		Upstreams  []upstreamEntry `json:"upstreams"`
+		NextCursor string          `json:"next_cursor"`
+	}{entries, next})
 }
 
-// httpConnectDialer implements proxy.Dialer for HTTP proxies
-type httpConnectDialer struct {
-	upstreamURL *url.URL
+type bulkResult struct {
+	User  string `json:"user"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
 }
 
-func (d *httpConnectDialer) Dial(network, addr string) (net.Conn, error) {
-	conn, err := net.DialTimeout("tcp", d.upstreamURL.Host, 10*time.Second)
-	if err != nil {
-		return nil, err
+// POST /upstreams[?atomic=1] [ { "user":"u", "upstream":"socks5://host:port" }, ... ]
+//
+// All entries are validated before anything is applied. Without atomic the
+// valid entries are applied and the invalid ones reported; with atomic a
+// single invalid entry rejects the whole batch.
+func bulkSetUpstreamsHandler(w http.ResponseWriter, r *http.Request) {
+	allOrNothing := r.URL.Query().Get("atomic") == "1"
+
+	var req []struct {
+		User     string  `json:"user"`
+		Upstream string  `json:"upstream"`
+		Password *string `json:"password"`
+	}
+	if !decodeJSON(w, r, *maxBulkBodyBytes, &req) {
+		return
 	}
 
-	req := fmt.Sprintf("CONNECT %s HTTP/1.1\r\nHost: %s\r\n", addr, addr)
-	if d.upstreamURL.User != nil {
-		user := d.upstreamURL.User.Username()
-		pass, _ := d.upstreamURL.User.Password()
-		b := base64.StdEncoding.EncodeToString([]byte(user + ":" + pass))
-		req += "Proxy-Authorization: Basic " + b + "\r\n"
+	now := time.Now()
+	results := make([]bulkResult, len(req))
+	built := make([]*Upstream, len(req))
+	failed := false
+	seen := make(map[string]bool, len(req))
+	for i, e := range req {
+		results[i].User = e.User
+		if err := validateUser(e.User); err != nil {
+			results[i].Error = err.Error()
+			failed = true
+			continue
+		}
+		// a later entry would silently replace an earlier one
+		if seen[e.User] {
+			results[i].Error = "user given twice"
+			failed = true
+			continue
+		}
+		seen[e.User] = true
+		u, err := parseUpstream(e.Upstream)
+		if err != nil {
+			results[i].Error = "upstream: " + err.Error()
+			failed = true
+			continue
+		}
+		up := &Upstream{Raw: e.Upstream, URL: u, SetAt: now, keepAllowedIPs: true}
+		if err := setPassword(e.User, up, e.Password); err != nil {
+			results[i].Error = err.Error()
+			failed = true
+			continue
+		}
+		built[i] = up
+		results[i].OK = true
 	}
-	req += "\r\n"
 
-	if _, err = conn.Write([]byte(req)); err != nil {
-		conn.Close()
-		return nil, err
+	if allOrNothing && failed {
+		for i := range results {
+			results[i].OK = false
+		}
+		writeAPIError(w, http.StatusBadRequest, &apiError{Code: "validation_failed", Message: "some entries are invalid, nothing was applied", Details: results})
+		return
 	}
 
-	br := bufio.NewReader(conn)
-	resp, err := http.ReadResponse(br, nil)
-	if err != nil {
-		conn.Close()
-		return nil, err
+	changed := map[string]*Upstream{}
+	for i, e := range req {
+		if built[i] != nil {
+			changed[e.User] = built[i]
+		}
 	}
-	if resp.StatusCode != 200 {
-		conn.Close()
-		return nil, fmt.Errorf("proxy connect failed: %s", resp.Status)
+	err := putUpstreams(sourceOf(r), changed)
+	if err == errTooManyUsers {
+		writeUserLimit(w)
+		return
+	}
+	if err != nil {
+		log.Printf("store: bulk set failed: %v", err)
+		writeStoreError(w)
+		return
 	}
 
-	return conn, nil
+	writeJSON(w, http.StatusOK, results)
 }
 
-// relay raw bytes both ways
-func relay(a, b net.Conn) {
-	defer a.Close()
-	defer b.Close()
-	done := make(chan struct{}, 2)
-	go func() { io.Copy(a, b); done <- struct{}{} }()
-	go func() { io.Copy(b, a); done <- struct{}{} }()
-	<-done
-}
+// POST { "user":"u", "password":"p", "upstream":"socks5://host:port" }
+//
+// An optional "ttl_seconds" or "expires_at" makes the mapping expire, and
+// "verify": true dials through the upstream before accepting it. "headers"
+// are sent on the CONNECT to an http or https upstream, and "client_cert"
+// is presented in the TLS handshake with an https one. "routes" send
+// matching targets through other upstreams. A null or empty upstream
+// removes the mapping; "direct" stores an explicit direct one.
+func setUpstreamHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		User     string  `json:"user"`
+		Password *string `json:"password"` // omitted keeps the current password, "" removes it
+		// PasswordExpiresAt is when the password stops working; omitted with
+		// the password also omitted keeps the current deadline
+		PasswordExpiresAt *time.Time `json:"password_expires_at"`
+		Upstream          string     `json:"upstream"`
+		TTLSeconds        int64      `json:"ttl_seconds"`
+		ExpiresAt         *time.Time `json:"expires_at"`
+		Verify            bool       `json:"verify"`
+		Strict            bool       `json:"strict"` // with verify, also reject when the exit IP can't be determined
+		// CloseExisting false lets current connections finish on the old upstream
+		CloseExisting *bool             `json:"close_existing"`
+		Labels        map[string]string `json:"labels"`
+		AllowedIPs    []string          `json:"allowed_ips"` // omitted keeps the current list, [] removes it
+		Headers       map[string]string `json:"headers"`     // sent on the CONNECT to an http(s) upstream
+		ClientCert    *clientCertSpec   `json:"client_cert"` // presented to an https upstream
+		SessionTTL    int64             `json:"session_ttl_seconds"`
+		CA            string            `json:"ca"`          // PEM or a path, for an https upstream
+		ServerName    string            `json:"server_name"` // checked instead of the upstream's host
+		ForwardAuth   bool              `json:"forward_auth"`
+		Routes        []routeSpec       `json:"routes"` // tried in order before the upstream
+		Pool          []poolMemberSpec  `json:"pool"`   // picked from by the login's tag
+	}
 
-func proxyHandler(w http.ResponseWriter, r *http.Request) {
-	user, err := usernameFromRequest(r)
-	if err != nil {
-		w.Header().Set("Proxy-Authenticate", "Basic realm=\"proxy\"")
-		w.WriteHeader(http.StatusProxyAuthRequired)
+	if !decodeJSON(w, r, *maxBodyBytes, &req) {
 		return
 	}
 
-	up := pickUpstreamFor(r)
-	dialer, err := dialerFor(up)
+	if err := validateUser(req.User); err != nil {
+		writeInvalid(w, err)
+		return
+	}
+	if !keyAllowsUser(w, r, req.User) {
+		return
+	}
+	if req.Upstream == "" {
+		clearUserUpstream(w, r, req.User)
+		return
+	}
+	up, err := buildUpstream(req.Upstream, req.TTLSeconds, req.ExpiresAt, req.Labels)
 	if err != nil {
-		http.Error(w, "invalid upstream", http.StatusInternalServerError)
+		writeInvalid(w, err)
+		return
+	}
+	if err := setUpstreamHeaders(up, req.Headers); err != nil {
+		writeInvalid(w, err)
+		return
+	}
+	if err := setClientCert(up, req.ClientCert); err != nil {
+		writeInvalid(w, err)
+		return
+	}
+	if err := setSessionTTL(up, req.SessionTTL); err != nil {
+		writeInvalid(w, err)
+		return
+	}
+	if err := setUpstreamTLS(up, req.CA, req.ServerName); err != nil {
+		writeInvalid(w, err)
+		return
+	}
+	if err := setForwardAuth(up, req.ForwardAuth); err != nil {
+		writeInvalid(w, err)
+		return
+	}
+	if err := setUpstreamRoutes(up, req.Routes); err != nil {
+		writeInvalid(w, err)
+		return
+	}
+	if err := setUpstreamPool(up, req.Pool); err != nil {
+		writeInvalid(w, err)
+		return
+	}
+	if err := setPassword(req.User, up, req.Password); err != nil {
+		writeInvalid(w, err)
+		return
+	}
+	if err := setPasswordExpiry(up, req.Password, req.PasswordExpiresAt); err != nil {
+		writeInvalid(w, err)
+		return
+	}
+	if err := setAllowedIPs(up, req.AllowedIPs); err != nil {
+		writeInvalid(w, err)
 		return
 	}
 
-	if r.Method != http.MethodConnect {
-		http.Error(w, "only CONNECT supported for raw tcp", http.StatusBadRequest)
+	// dial through the new upstream before committing; no locks are held here
+	var exit *exitProbe
+	if req.Verify {
+		if err := probeUpstream(req.User, up, *probeTarget); err != nil {
+			writeError(w, http.StatusUnprocessableEntity, "verification_failed", "upstream verification failed: "+err.Error())
+			return
+		}
+		if *exitIPURL != "" {
+			res := probeExitIP(req.User, up, *exitIPURL)
+			if res.Error != "" && req.Strict {
+				writeError(w, http.StatusUnprocessableEntity, "exit_ip_probe_failed", "exit ip probe failed: "+res.Error)
+				return
+			}
+			exit = &res
+		}
+	}
+
+	src := sourceOf(r)
+	src.KeepConns = req.CloseExisting != nil && !*req.CloseExisting
+	if ifMatch := r.Header.Get("If-Match"); ifMatch != "" {
+		err = putUpstreamIfMatch(src, req.User, up, ifMatch)
+	} else {
+		err = putUpstreams(src, map[string]*Upstream{req.User: up})
+	}
+	if err == errPreconditionFailed {
+		writeError(w, http.StatusPreconditionFailed, "precondition_failed", "mapping was modified")
+		return
+	}
+	if err == errTooManyUsers {
+		writeUserLimit(w)
+		return
+	}
+	if err != nil {
+		log.Printf("store: set %q failed: %v", req.User, err)
+		writeStoreError(w)
 		return
 	}
+	w.Header().Set("ETag", up.etag())
 
-	hij, ok := w.(http.Hijacker)
-	if !ok {
-		http.Error(w, "hijack not supported", http.StatusInternalServerError)
+	if exit != nil {
+		writeJSON(w, http.StatusOK, exit)
 		return
 	}
+	w.WriteHeader(http.StatusNoContent)
+}
 
-	clientConn, _, err := hij.Hijack()
+// clearUserUpstream handles a POST /upstream with a null or empty upstream:
+// the mapping is removed like DELETE /upstream, but a missing mapping is not
+// an error, so clients limited to POST can reset a user idempotently.
+func clearUserUpstream(w http.ResponseWriter, r *http.Request, user string) {
+	var err error
+	if ifMatch := r.Header.Get("If-Match"); ifMatch != "" {
+		_, err = removeUpstreamIfMatch(sourceOf(r), user, ifMatch)
+	} else {
+		_, err = removeUpstream(sourceOf(r), user)
+	}
+	if err == errPreconditionFailed {
+		writeError(w, http.StatusPreconditionFailed, "precondition_failed", "mapping was modified")
+		return
+	}
 	if err != nil {
+		log.Printf("store: clear %q failed: %v", user, err)
+		writeStoreError(w)
 		return
 	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// validateUser rejects user names that can't be sent in Basic proxy auth
+func validateUser(user string) error {
+	switch {
+	case strings.TrimSpace(user) == "":
+		return &fieldError{"user", "missing or blank"}
+	case len(user) > 256:
+		return &fieldError{"user", "longer than 256 bytes"}
+	case strings.Contains(user, ":"):
+		return &fieldError{"user", "may not contain ':', it separates user and password in Basic auth"}
+	case strings.IndexFunc(user, unicode.IsControl) >= 0:
+		return &fieldError{"user", "may not contain control characters"}
+	}
+	return nil
+}
+
+// fieldError is a validation error in one field of a request
+type fieldError struct {
+	Field string
+	Msg   string
+}
+
+func (e *fieldError) Error() string { return e.Field + ": " + e.Msg }
 
-	// register connection so it can be closed if upstream changes
-	registerConn(user, clientConn)
+// code is the stable error code reported for the field
+func (e *fieldError) code() string {
+	if e.Field == "upstream" {
+		return "invalid_upstream_url"
+	}
+	return "invalid_" + e.Field
+}
 
-	targetConn, err := dialer.Dial("tcp", r.Host)
+// helper to validate the fields of a set request and build the mapping
+func buildUpstream(raw string, ttlSeconds int64, expiresAt *time.Time, labels map[string]string) (*Upstream, error) {
+	u, err := parseUpstream(raw)
 	if err != nil {
-		clientConn.Write([]byte("HTTP/1.1 502 Bad Gateway\r\n\r\n"))
-		clientConn.Close()
+		return nil, &fieldError{"upstream", err.Error()}
+	}
+	if err := validateLabels(labels); err != nil {
+		return nil, &fieldError{"labels", err.Error()}
+	}
+
+	now := time.Now()
+	up := &Upstream{Raw: raw, URL: u, SetAt: now, Labels: labels}
+	switch {
+	case ttlSeconds != 0 && expiresAt != nil:
+		return nil, &fieldError{"ttl_seconds", "ttl_seconds and expires_at are mutually exclusive"}
+	case ttlSeconds < 0:
+		return nil, &fieldError{"ttl_seconds", "must be positive"}
+	case ttlSeconds > 0:
+		up.ExpiresAt = now.Add(time.Duration(ttlSeconds) * time.Second)
+	case expiresAt != nil:
+		if !expiresAt.After(now) {
+			return nil, &fieldError{"expires_at", "is in the past"}
+		}
+		up.ExpiresAt = *expiresAt
+	}
+	return up, nil
+}
+
+// POST /upstream/rollback { "user":"u" }
+//
+// Restores the upstream the user had before the last change, keeping the
+// current password. Rolling back again flips back to the newer one. A
+// previous mapping that has since expired is refused with 409.
+func rollbackHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeMethodNotAllowed(w)
+		return
+	}
+	var req struct {
+		User string `json:"user"`
+	}
+	if !decodeJSON(w, r, *maxBodyBytes, &req) {
+		return
+	}
+	if req.User == "" {
+		writeInvalid(w, &fieldError{"user", "missing"})
+		return
+	}
+
+	up, err := rollbackUpstream(sourceOf(r), req.User)
+	if err == errNoPrevious {
+		writeError(w, http.StatusConflict, "no_previous_upstream", "no previous upstream to roll back to")
+		return
+	}
+	if err == errPreviousExpired {
+		writeError(w, http.StatusConflict, "previous_upstream_expired", "the previous upstream has expired")
+		return
+	}
+	if err != nil {
+		log.Printf("store: rollback %q failed: %v", req.User, err)
+		writeStoreError(w)
 		return
 	}
 
-	clientConn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
-	relay(clientConn, targetConn)
+	w.Header().Set("ETag", up.etag())
+	writeJSON(w, http.StatusOK, struct {
+		User     string `json:"user"`
+		Upstream string `json:"upstream"`
+		Version  uint64 `json:"version"`
+	}{req.User, up.Raw, up.Version})
 }
 
-func main() {
-	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if r.URL.Path == "/upstream" {
-			setUpstreamHandler(w, r)
+// DELETE /upstreams?upstream=url[&ignore_credentials=1]
+// or DELETE /upstreams { "upstream":"url", "ignore_credentials":true }
+//
+// Removes every user mapped to the given upstream, so they fall back to the
+// default. With ignore_credentials only scheme, host and port must match.
+func clearUpstreamHandler(w http.ResponseWriter, r *http.Request) {
+	req := struct {
+		Upstream          string `json:"upstream"`
+		IgnoreCredentials bool   `json:"ignore_credentials"`
+	}{
+		Upstream:          r.URL.Query().Get("upstream"),
+		IgnoreCredentials: r.URL.Query().Get("ignore_credentials") == "1",
+	}
+	if req.Upstream == "" && r.ContentLength != 0 {
+		if !decodeJSON(w, r, *maxBodyBytes, &req) {
 			return
 		}
-		proxyHandler(w, r)
+	}
+	target, err := parseUpstream(req.Upstream)
+	if err != nil {
+		writeInvalid(w, &fieldError{"upstream", err.Error()})
+		return
+	}
+
+	removed, err := removeUpstreamsWhere(sourceOf(r), func(user string, up *Upstream) bool {
+		if user == defaultUser {
+			return false
+		}
+		if !req.IgnoreCredentials {
+			return up.Raw == req.Upstream
+		}
+		return up.URL.Scheme == target.Scheme && up.URL.Host == target.Host
 	})
+	if err != nil {
+		log.Printf("store: clearing %s failed after %d users: %v", target.Redacted(), len(removed), err)
+		writeStoreError(w)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string][]string{"removed": removed})
+}
+
+// DELETE /upstream?user=u or DELETE { "user":"u" }
+func deleteUpstreamHandler(w http.ResponseWriter, r *http.Request) {
+	user := r.URL.Query().Get("user")
+	if user == "" && r.ContentLength != 0 {
+		var req struct {
+			User string `json:"user"`
+		}
+		if !decodeJSON(w, r, *maxBodyBytes, &req) {
+			return
+		}
+		user = req.User
+	}
+	if user == "" {
+		writeInvalid(w, &fieldError{"user", "missing"})
+		return
+	}
+	if !keyAllowsUser(w, r, user) {
+		return
+	}
+
+	ok, err := removeUpstream(sourceOf(r), user)
+	if err != nil {
+		log.Printf("store: delete %q failed: %v", user, err)
+		writeStoreError(w)
+		return
+	}
+	if !ok {
+		writeError(w, http.StatusNotFound, "mapping_not_found", "no mapping for user")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// POST /upstream/disconnect { "user":"u" }
+//
+// Closes the user's open tunnels without touching the mapping; clients
+// reconnect through whatever upstream is current. "*" closes the tunnels of
+// users on the default.
+func disconnectHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeMethodNotAllowed(w)
+		return
+	}
+	var req struct {
+		User string `json:"user"`
+	}
+	if !decodeJSON(w, r, *maxBodyBytes, &req) {
+		return
+	}
+	if req.User == "" {
+		writeInvalid(w, &fieldError{"user", "missing"})
+		return
+	}
 
-	log.Println("proxy listening on :8090")
-	log.Fatal(http.ListenAndServe(":8090", handler))
+	closed := closeUserConns(req.User)
+	log.Printf("admin: %s closed %d connections of %q", sourceOf(r).Actor, closed, req.User)
+	writeJSON(w, http.StatusOK, map[string]int{"closed": closed})
+}
+
+// proxyCredentials is what a client sent in Proxy-Authorization
+type proxyCredentials struct {
+	user     string
+	password string            // Basic only
+	params   map[string]string // Digest only; nil for Basic
+	bearer   bool              // a JWT or OAuth2 token that was already accepted
+
+	basic    string            // Basic only: the encoded user:password
+	cacheKey [sha256.Size]byte // Basic only: key into the basic cache
+	cached   *basicCacheEntry  // a recent login with the same header; password is unset
+}
+
+// credentialsFromRequest parses Basic proxy auth, Digest with -proxy-digest,
+// Bearer JWTs with -jwt-jwks-url or -jwt-public-key and OAuth2 access tokens
+// with -oauth-introspect-url
+func credentialsFromRequest(r *http.Request) (*proxyCredentials, error) {
+	auth := r.Header.Get("Proxy-Authorization")
+	if auth == "" {
+		return nil, errors.New("no auth")
+	}
+	// some clients pad the scheme with extra spaces
+	scheme, value, ok := strings.Cut(strings.TrimSpace(auth), " ")
+	if !ok {
+		return nil, errors.New("unsupported auth")
+	}
+	value = strings.TrimLeft(value, " ")
+	switch {
+	case strings.EqualFold(scheme, "basic"):
+		c := &proxyCredentials{basic: value, cacheKey: authMAC("basic", value)}
+		if c.cached = basicCacheLookup(c.cacheKey, time.Now()); c.cached != nil {
+			c.user = c.cached.user
+			return c, nil
+		}
+		var err error
+		if c.user, c.password, err = decodeBasic(value); err != nil {
+			return nil, err
+		}
+		if oauthEnabled() && c.user == *oauthUser {
+			user, err := oauthTokenUser(c.password, time.Now())
+			if err != nil {
+				return nil, err
+			}
+			return &proxyCredentials{user: user, bearer: true}, nil
+		}
+		return c, nil
+	case strings.EqualFold(scheme, "digest"):
+		if !*proxyDigest {
+			return nil, errors.New("unsupported auth")
+		}
+		params := parseDigestParams(value)
+		return &proxyCredentials{user: params["username"], params: params}, nil
+	case strings.EqualFold(scheme, "bearer"):
+		token := strings.TrimSpace(value)
+		var user string
+		var err error
+		switch {
+		// with both enabled, opaque tokens go to introspection
+		case jwtEnabled() && (!oauthEnabled() || strings.Count(token, ".") == 2):
+			user, err = verifyJWT(token, time.Now())
+		case oauthEnabled():
+			user, err = oauthTokenUser(token, time.Now())
+		default:
+			return nil, errors.New("unsupported auth")
+		}
+		if err != nil {
+			return nil, err
+		}
+		return &proxyCredentials{user: user, bearer: true}, nil
+	}
+	return nil, errors.New("unsupported auth")
+}
+
+// helper to split the base64 user:password of a Basic header, rejecting
+// anything that isn't a non-empty user, a colon and a password in UTF-8
+func decodeBasic(value string) (user, password string, err error) {
+	b, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return "", "", err
+	}
+	s := string(b)
+	user, password, ok := strings.Cut(s, ":")
+	switch {
+	case !ok:
+		return "", "", errors.New("basic credentials without a colon")
+	case user == "":
+		return "", "", errors.New("basic credentials without a user")
+	case !utf8.ValidString(s):
+		return "", "", errors.New("basic credentials not valid UTF-8")
+	case strings.IndexByte(s, 0) >= 0:
+		return "", "", errors.New("basic credentials contain NUL")
+	}
+	return user, password, nil
+}
+
+// verify checks the credentials against the user's mapping. stale means a
+// Digest nonce expired and the client should retry with a new one.
+func (c *proxyCredentials) verify(r *http.Request, up *Upstream, fallback bool) (ok, stale bool) {
+	if c.bearer {
+		return true, false // the token's issuer vouches for the user
+	}
+	if c.params != nil {
+		return digestOK(r, c, up, fallback)
+	}
+	now := time.Now()
+	if c.cached != nil {
+		if c.cached.validFor(up, now) {
+			c.cached.use.add(now)
+			return true, false
+		}
+		// checked against a mapping that has changed since
+		c.user, c.password, _ = decodeBasic(c.basic)
+	}
+	ip := ""
+	if addr, ok := clientAddr(r); ok {
+		ip = addr.String()
+	}
+	ok, use := passwordOK(c.user, up, fallback, c.password, ip)
+	if !ok {
+		return false, false
+	}
+	use.add(now)
+	// -auth-webhook and -auth-exec answers are cached on their own terms
+	if (*authWebhookURL == "" && *authExecPath == "") || (!fallback && up.hasPassword()) {
+		basicCacheStore(c.cacheKey, c.user, up, use, now)
+	}
+	return true, false
+}
+
+// pickUpstreamFor returns the user's upstream, and whether it is the
+// fallback for users without a mapping
+func pickUpstreamFor(user string) (*Upstream, bool) {
+	now := time.Now()
+	upstreamsMu.RLock()
+	defer upstreamsMu.RUnlock()
+	// expiry is checked here too so a late sweep never routes through a stale entry
+	if u, ok := upstreams[user]; ok && user != defaultUser && !u.expired(now) {
+		return u, false
+	}
+	if u, ok := upstreams[defaultUser]; ok && !u.expired(now) {
+		return u, true
+	}
+	return &Upstream{Raw: "direct", URL: &url.URL{Scheme: "direct"}}, true
+}
+
+// parseUpstream validates an upstream as given to the control API: "direct",
+// a socks5, socks5h, socks5+tls, socks4, socks4a, http, https, ntlm, h3,
+// ssh or ss URL with a host and port, or a comma-separated chain of those.
+// Braces are allowed in the credentials for -user-params placeholders.
+func parseUpstream(raw string) (*url.URL, error) {
+	if raw == "direct" {
+		return &url.URL{Scheme: "direct"}, nil
+	}
+	if isChain(raw) {
+		// the mapping's URL is the exit, the hop that reaches the target
+		hops, err := upstreamHops(raw)
+		if err != nil {
+			return nil, err
+		}
+		return hops[len(hops)-1], nil
+	}
+	u, err := url.Parse(placeholderEscaper.Replace(raw))
+	if err != nil {
+		if strings.Contains(raw, "@") {
+			return nil, errUnencodedCredentials
+		}
+		return nil, errors.New("not a valid URL")
+	}
+	// a / or # in the password ends the host early, leaving the rest of
+	// the credentials in the path or fragment
+	if strings.Contains(u.Path, "@") || strings.Contains(u.Fragment, "@") {
+		return nil, errUnencodedCredentials
+	}
+	switch u.Scheme {
+	case "direct":
+		if err := validateDirectUpstream(u); err != nil {
+			return nil, err
+		}
+		return u, nil
+	case "socks5", "socks5h", "socks5+tls", "socks5s":
+		if err := validateSOCKS5Credentials(u); err != nil {
+			return nil, err
+		}
+	case "http", "https", "ntlm":
+		if err := validateHTTPSProto(u); err != nil {
+			return nil, err
+		}
+		if err := validateHTTPAuth(u); err != nil {
+			return nil, err
+		}
+		if err := validateBasicCredentials(u); err != nil {
+			return nil, err
+		}
+	case "h3":
+		if err := validateH3Upstream(u); err != nil {
+			return nil, err
+		}
+		if err := validateBasicCredentials(u); err != nil {
+			return nil, err
+		}
+	case "ssh":
+		if err := validateSSHUpstream(u); err != nil {
+			return nil, err
+		}
+	case "ss":
+		if err := normalizeSSUpstream(u); err != nil {
+			return nil, err
+		}
+	case "socks4", "socks4a":
+		if _, ok := u.User.Password(); ok {
+			return nil, errors.New("socks4 has no passwords, only a user id")
+		}
+		if strings.ContainsRune(u.User.Username(), 0) {
+			return nil, errors.New("socks4 user id may not contain NUL")
+		}
+	case "":
+		return nil, errors.New(`missing scheme, want socks5://, socks5h://, socks5+tls://, socks4://, socks4a://, http://, https://, ntlm://, h3://, ssh://, ss:// or "direct"`)
+	default:
+		return nil, fmt.Errorf(`unsupported scheme %q, want socks5, socks5h, socks5+tls, socks4, socks4a, http, https, ntlm, h3, ssh, ss or "direct"`, u.Scheme)
+	}
+	if err := validateSNI(u); err != nil {
+		return nil, err
+	}
+	// url.Parse takes the last colon of an unbracketed IPv6 address for the
+	// port, which the dialers then refuse
+	if strings.Count(u.Host, ":") > 1 && !strings.HasPrefix(u.Host, "[") {
+		return nil, fmt.Errorf("IPv6 addresses must be in brackets, e.g. %s://[2001:db8::1]:1080", u.Scheme)
+	}
+	if u.Hostname() == "" || u.Port() == "" {
+		return nil, fmt.Errorf("%s upstream needs a host:port", u.Scheme)
+	}
+	return u, nil
+}
+
+var placeholderEscaper = strings.NewReplacer("{", "%7B", "}", "%7D")
+
+// Credentials in an upstream URL are percent-encoded like any URL's, and
+// the dialers send them decoded
+var errUnencodedCredentials = errors.New("not a valid URL; percent-encode special characters in the user and password, e.g. @ as %40, / as %2F, # as %23 and a space as %20")
+
+// validateBasicCredentials checks that the user of u can be sent with Basic
+// auth, which ends the user name at the first colon
+func validateBasicCredentials(u *url.URL) error {
+	if u.User != nil && strings.Contains(u.User.Username(), ":") {
+		return errors.New("the user name may not contain a colon, which Basic auth can't carry")
+	}
+	return nil
+}
+
+// validateSOCKS5Credentials checks the lengths RFC 1929 allows
+func validateSOCKS5Credentials(u *url.URL) error {
+	if u.User == nil {
+		return nil
+	}
+	pass, _ := u.User.Password()
+	if len(u.User.Username()) > 255 || len(pass) > 255 {
+		return errors.New("socks5 user names and passwords are limited to 255 bytes")
+	}
+	return nil
+}
+
+// dialerFor also rejects unsupported schemes, for mappings that bypassed
+// parseUpstream. params fill the placeholders of its credentials, if any,
+// and clientAuth is the Proxy-Authorization the client sent, for mappings
+// with forward_auth.
+func dialerFor(up *Upstream, params map[string]string, clientAuth string) (proxy.Dialer, error) {
+	if up == nil || up.URL == nil {
+		return proxy.FromEnvironment(), nil
+	}
+	if up.URL.Scheme == "direct" {
+		return directDialer(up.URL), nil
+	}
+
+	cfg := up.hopConfig(clientAuth)
+	if isChain(up.Raw) {
+		return chainDialer(up.Raw, params, cfg)
+	}
+	return hopDialer(expandUserParams(up.URL, params), upstreamDirect, "", cfg)
+}
+
+// hopConfig is what up sets for its last hop; clientAuth is the client's
+// Proxy-Authorization, forwarded with forward_auth
+func (up *Upstream) hopConfig(clientAuth string) hopConfig {
+	cfg := hopConfig{headers: up.Headers, clientCert: up.ClientCert, ca: up.CA, serverName: up.ServerName}
+	if up.ForwardAuth {
+		cfg.proxyAuth = clientAuth
+	}
+	return cfg
+}
+
+// hopConfig is what a mapping sets for its last hop beyond the URL; it only
+// applies to http, https and h3 proxies, and its TLS settings to
+// socks5+tls
+type hopConfig struct {
+	headers    map[string]string // added to the CONNECT
+	clientCert *upstreamClientCert
+	ca         *upstreamCAConfig
+	serverName string
+	proxyAuth  string // the client's Proxy-Authorization, sent instead of the URL's
+}
+
+// hopDialer returns a dialer for the proxy at u, reached through forward.
+// via identifies the hops before it, if any.
+func hopDialer(u *url.URL, forward proxy.Dialer, via string, cfg hopConfig) (proxy.Dialer, error) {
+	if sni := u.Query().Get("sni"); sni != "" {
+		cfg.serverName = sni
+	}
+	switch u.Scheme {
+	case "socks5", "socks5h":
+		// the SOCKS5 dialer sends host names through as they are
+		s, err := proxy.SOCKS5("tcp", u.Host, socks5Auth(u), contextHop{forward})
+		if err != nil {
+			return nil, err
+		}
+		var d proxy.Dialer = socks5Dialer{s.(proxy.ContextDialer), u.Host}
+		if u.Scheme == "socks5" && *socks5ResolveLocal {
+			return localResolveDialer{d}, nil
+		}
+		return d, nil
+	case "socks5+tls", "socks5s":
+		return &socks5TLSDialer{upstreamURL: u, forward: forward, hopConfig: cfg}, nil
+	case "socks4", "socks4a":
+		return &socks4Dialer{upstreamURL: u, remoteDNS: u.Scheme == "socks4a", forward: forward}, nil
+	case "ssh":
+		return &sshDialer{upstreamURL: u, forward: forward, via: via}, nil
+	case "ss":
+		return newSSDialer(u, forward)
+	case "http", "https", "ntlm":
+		if isH2Upstream(u) {
+			return &h2Dialer{upstreamURL: u, forward: forward, via: via, hopConfig: cfg}, nil
+		}
+		return &httpConnectDialer{upstreamURL: u, forward: forward, ntlm: isNTLMUpstream(u), hopConfig: cfg}, nil
+	case "h3":
+		early, _ := strconv.ParseBool(u.Query().Get("0rtt"))
+		return &h3Dialer{upstreamURL: u, early: early, hopConfig: cfg}, nil
+	default:
+		return nil, fmt.Errorf("unsupported scheme: %s", u.Scheme)
+	}
+}
+
+// httpConnectDialer implements proxy.Dialer for HTTP proxies, speaking TLS
+// to https:// ones
+type httpConnectDialer struct {
+	upstreamURL *url.URL
+	forward     proxy.Dialer // how the proxy itself is reached
+	ntlm        bool         // authenticate with NTLM instead of Basic
+	hopConfig
+}
+
+func (d *httpConnectDialer) Dial(network, addr string) (net.Conn, error) {
+	start := time.Now()
+	conn, err := d.dialProxy()
+	if err != nil {
+		return nil, handshakeTimeout(d.upstreamURL.Host, err)
+	}
+	h1Latency.handshake.observe(time.Since(start))
+	start = time.Now()
+	conn, err = d.tunnel(conn, addr)
+	if err != nil {
+		return nil, handshakeTimeout(d.upstreamURL.Host, err)
+	}
+	h1Latency.connect.observe(time.Since(start))
+	// the tunnel itself has no deadline
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// helper to CONNECT to addr over conn with the hop's credentials
+func (d *httpConnectDialer) tunnel(conn net.Conn, addr string) (net.Conn, error) {
+	// a Proxy-Authorization among the headers replaces the URL's credentials,
+	// and so does a forwarded one
+	_, set := d.headers["Proxy-Authorization"]
+	switch {
+	case d.proxyAuth != "" && !set:
+		return d.connect(conn, bufio.NewReader(conn), addr, d.proxyAuth)
+	case d.ntlm && !set:
+		return d.connectNTLM(conn, addr)
+	case d.upstreamURL.User != nil && !set:
+		return d.connect(conn, bufio.NewReader(conn), addr, basicProxyAuth(d.upstreamURL))
+	default:
+		return d.connect(conn, bufio.NewReader(conn), addr, "")
+	}
+}
+
+// helper to reach the proxy itself. The connection gets a deadline
+// covering the TLS and CONNECT exchanges, which Dial clears.
+func (d *httpConnectDialer) dialProxy() (net.Conn, error) {
+	conn, err := d.forward.Dial("tcp", d.upstreamURL.Host)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(*upstreamHandshakeTimeout))
+	if d.upstreamURL.Scheme == "https" {
+		tc, err := upstreamTLS(conn, d.upstreamURL.Host, d.hopConfig)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return tc, nil
+	}
+	return conn, nil
+}
+
+// basicProxyAuth is the Proxy-Authorization for the credentials of u,
+// which url.Parse has already percent-decoded
+func basicProxyAuth(u *url.URL) string {
+	user := u.User.Username()
+	pass, _ := u.User.Password()
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+pass))
+}
+
+// connect sends the CONNECT with auth as Proxy-Authorization, if set, and
+// returns the tunnel. conn is closed on failure.
+func (d *httpConnectDialer) connect(conn net.Conn, br *bufio.Reader, addr, auth string) (net.Conn, error) {
+	resp, err := d.roundTrip(conn, br, addr, auth)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if resp.StatusCode != 200 {
+		return nil, refuse(conn, resp)
+	}
+	return tunnelConn(conn, br), nil
+}
+
+// refuse closes the connection of a refused CONNECT, which is never
+// reused, and returns the refusal with what its body says
+func refuse(conn net.Conn, resp *http.Response) error {
+	text := refusalText(conn, resp)
+	// closed after the connection so an unbounded body isn't read off
+	conn.Close()
+	resp.Body.Close()
+	return &connectRefused{resp.Status, text}
+}
+
+// refusalTextTimeout bounds reading the body of a refused CONNECT, which
+// may run until the proxy closes the connection
+const refusalTextTimeout = time.Second
+
+// refusalText is the start of the body of a refused CONNECT as one line:
+// a plain text body, or the title of an HTML error page
+func refusalText(conn net.Conn, resp *http.Response) string {
+	mt, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if mt != "" && mt != "text/plain" && mt != "text/html" {
+		return ""
+	}
+	conn.SetReadDeadline(time.Now().Add(refusalTextTimeout))
+	b, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	text := string(b)
+	if mt == "text/html" {
+		start := strings.Index(strings.ToLower(text), "<title>")
+		end := strings.Index(strings.ToLower(text), "</title>")
+		if start < 0 || end < start {
+			return ""
+		}
+		text = text[start+len("<title>") : end]
+	}
+	// one line of printable text, so it can't break the client's response
+	text = strings.Join(strings.FieldsFunc(text, func(r rune) bool {
+		return unicode.IsSpace(r) || !unicode.IsPrint(r)
+	}), " ")
+	if len(text) > 200 {
+		text = strings.ToValidUTF8(text[:200], "") + "..."
+	}
+	return text
+}
+
+// tunnelConn is the tunnel after a 200 read through br. A 200 to CONNECT
+// has no body, so bytes the proxy sent right after it, already in br's
+// buffer, are the start of the tunnel and are read first.
+func tunnelConn(conn net.Conn, br *bufio.Reader) net.Conn {
+	if br.Buffered() > 0 {
+		return &bufferedConn{conn, br}
+	}
+	return conn
+}
+
+// roundTrip writes one CONNECT and reads the proxy's answer
+func (d *httpConnectDialer) roundTrip(conn net.Conn, br *bufio.Reader, addr, auth string) (*http.Response, error) {
+	// older proxies close the connection after their answer unless asked
+	// not to, which would end an NTLM handshake early
+	authority := connectAuthority(addr)
+	req := fmt.Sprintf("CONNECT %s HTTP/1.1\r\nHost: %s\r\nProxy-Connection: Keep-Alive\r\n", authority, authority)
+	if auth != "" {
+		req += "Proxy-Authorization: " + auth + "\r\n"
+	}
+	for _, name := range sortedHeaderNames(d.headers) {
+		req += name + ": " + d.headers[name] + "\r\n"
+	}
+	req += "\r\n"
+
+	if _, err := conn.Write([]byte(req)); err != nil {
+		return nil, err
+	}
+	return http.ReadResponse(br, nil)
+}
+
+// connectAuthority writes addr as the authority of a CONNECT: host:port,
+// with IPv6 addresses in brackets and their zone escaped as %25
+func connectAuthority(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	if strings.Contains(host, ":") {
+		return "[" + strings.Replace(host, "%", "%25", 1) + "]:" + port
+	}
+	return host + ":" + port
+}
+
+// connectNTLM runs the NTLM handshake over the CONNECT exchange. The 407
+// carrying the challenge must leave the connection open, since NTLM
+// authenticates the connection rather than the request. A proxy that
+// offers Basic but not NTLM gets Basic on a new connection.
+func (d *httpConnectDialer) connectNTLM(conn net.Conn, addr string) (net.Conn, error) {
+	br := bufio.NewReader(conn)
+	resp, err := d.roundTrip(conn, br, addr, "NTLM "+base64.StdEncoding.EncodeToString(ntlmNegotiate()))
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if resp.StatusCode == 200 {
+		return tunnelConn(conn, br), nil
+	}
+	if resp.StatusCode != http.StatusProxyAuthRequired {
+		return nil, refuse(conn, resp)
+	}
+	// the body must be read off before the connection can be reused
+	_, err = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	resp.Body.Close()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	offers := resp.Header.Values("Proxy-Authenticate")
+	msg, ntlm, err := ntlmChallengeHeader(offers)
+	switch {
+	case err != nil:
+		conn.Close()
+		return nil, fmt.Errorf("proxy sent a malformed NTLM challenge: %w", err)
+	case !ntlm && offersAuthScheme(offers, "Basic") && d.upstreamURL.User != nil:
+		conn.Close()
+		if conn, err = d.dialProxy(); err != nil {
+			return nil, err
+		}
+		return d.connect(conn, bufio.NewReader(conn), addr, basicProxyAuth(d.upstreamURL))
+	case msg == nil:
+		conn.Close()
+		return nil, fmt.Errorf("proxy connect failed: %s without an NTLM challenge", resp.Status)
+	case resp.Close:
+		conn.Close()
+		return nil, errors.New("proxy closed the connection during the NTLM handshake")
+	}
+	c, err := parseNTLMChallenge(msg)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	domain, user, pass := ntlmCredentials(d.upstreamURL)
+	auth, err := ntlmAuthenticate(c, domain, user, pass)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return d.connect(conn, br, addr, "NTLM "+base64.StdEncoding.EncodeToString(auth))
+}
+
+// checkConnectTarget makes sure a CONNECT target is host:port with IPv6
+// addresses in brackets, since it is passed on to the upstream as it is
+func checkConnectTarget(target string) error {
+	host, port, err := net.SplitHostPort(target)
+	if err == nil && strings.HasPrefix(target, "[") {
+		// SplitHostPort takes anything in brackets
+		if ip, perr := netip.ParseAddr(host); perr != nil || !ip.Is6() {
+			err = errors.New("not an IPv6 address")
+		}
+	}
+	if err != nil || host == "" {
+		return errors.New("CONNECT target must be host:port, with IPv6 addresses in brackets")
+	}
+	if n, err := strconv.ParseUint(port, 10, 16); err != nil || n == 0 {
+		return errors.New("CONNECT target has an invalid port")
+	}
+	return nil
+}
+
+// relay raw bytes both ways until either side closes, and report how many
+// bytes went from client to target and back
+func relay(client, target net.Conn) (up, down int64) {
+	done := make(chan struct{}, 2)
+	go func() { down, _ = io.Copy(client, target); done <- struct{}{} }()
+	go func() { up, _ = io.Copy(target, client); done <- struct{}{} }()
+	<-done
+	client.Close()
+	target.Close()
+	<-done
+	return up, down
+}
+
+// logAuth is what access log lines say about how the user was identified
+func logAuth(anonymous bool, ip string, params map[string]string) string {
+	auth := ""
+	if anonymous {
+		auth = " auth=none client=" + ip
+	}
+	if len(params) > 0 {
+		auth += " params=" + formatUserParams(params)
+	}
+	return auth
+}
+
+// dialFailure is the status a client gets for a failed upstream dial, and
+// why, when the upstream itself refused, couldn't be resolved or didn't
+// answer in time
+func dialFailure(err error) (int, string) {
+	var refused socks4Reply
+	var rejected *connectRefused
+	var unresolved *upstreamResolveError
+	var timedOut *handshakeTimeoutError
+	switch {
+	case errors.As(err, &refused):
+		return http.StatusBadGateway, refused.Error()
+	case errors.As(err, &rejected):
+		return http.StatusBadGateway, rejected.Error()
+	case errors.As(err, &unresolved):
+		return http.StatusBadGateway, unresolved.Error()
+	case errors.As(err, &timedOut):
+		return http.StatusGatewayTimeout, timedOut.Error()
+	}
+	return http.StatusBadGateway, ""
+}
+
+// bufferedConn reads what was already buffered, by the HTTP server or while
+// reading an upstream's answer to CONNECT, before the rest of the connection
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) { return c.r.Read(p) }
+
+// proxyClient is who a proxy client is routed as, once it is authenticated
+type proxyClient struct {
+	user      string
+	up        *Upstream
+	fallback  bool // routed by the default because the user had no mapping
+	anonymous bool
+	params    map[string]string // routing hints from -user-params
+	addr      netip.Addr
+	addrOK    bool
+	ip        string
+}
+
+// authRefusal is why authenticateProxy turned a client away
+type authRefusal struct {
+	banned bool
+	wait   time.Duration // how long the ban has left
+	stale  bool          // a Digest nonce expired; the client should retry
+}
+
+// authenticateProxy identifies the client of r by its address or its
+// Proxy-Authorization, checks bans and credentials, and picks the user's
+// upstream. Both listeners go through it: SOCKS5 logins arrive as Basic.
+func authenticateProxy(r *http.Request) (*proxyClient, *authRefusal) {
+	now := time.Now()
+	pc := &proxyClient{}
+	pc.addr, pc.addrOK = clientAddr(r)
+	if pc.addrOK {
+		pc.ip = pc.addr.String()
+	}
+	if wait, banned := authBanned(pc.ip, "", now); banned {
+		return nil, &authRefusal{banned: true, wait: wait}
+	}
+
+	// clients without credentials may still be known by their address
+	var creds *proxyCredentials
+	byIP := false
+	if r.Header.Get("Proxy-Authorization") == "" {
+		pc.user, byIP = ipMapUserFor(r)
+		if !byIP && *allowAnonymous {
+			pc.user, pc.anonymous = *anonymousUser, true
+		}
+	}
+	if !byIP && !pc.anonymous {
+		var err error
+		if creds, err = credentialsFromRequest(r); err != nil {
+			if r.Header.Get("Proxy-Authorization") != "" {
+				authFailed(pc.ip, "", now)
+			}
+			return nil, &authRefusal{}
+		}
+		// creds.user stays the login as sent; it is what passwords are checked for
+		pc.user, pc.params = routeUser(creds.user)
+		if wait, banned := authBanned("", pc.user, now); banned {
+			return nil, &authRefusal{banned: true, wait: wait}
+		}
+	}
+
+	pc.up, pc.fallback = pickUpstreamFor(pc.user)
+	if creds != nil {
+		if ok, stale := creds.verify(r, pc.up, pc.fallback); !ok {
+			if !stale {
+				authFailed(pc.ip, pc.user, now)
+			}
+			return nil, &authRefusal{stale: stale}
+		}
+	}
+	return pc, nil
+}
+
+// allowed checks the client against its mapping's allowed_ips and
+// -require-mapping
+func (pc *proxyClient) allowed() error {
+	if !addrAllowed(pc.up, pc.addr, pc.addrOK) {
+		return fmt.Errorf("source address not allowed for user %q", pc.user)
+	}
+	if pc.fallback && *requireMapping {
+		return fmt.Errorf("no upstream configured for user %q", pc.user)
+	}
+	return nil
+}
+
+// tunnel dials target through via for clientConn, answers the client with
+// reply and relays until either side closes. The connection is registered
+// for the user meanwhile, so it is closed when the user's upstream changes.
+func (pc *proxyClient) tunnel(clientConn net.Conn, target string, via *Upstream, dialer proxy.Dialer, reply func(net.Conn, error)) {
+	registerConn(pc.user, clientConn, pc.up, pc.fallback)
+	defer unregisterConn(pc.user, clientConn)
+
+	targetConn, attempts, err := dialWithRetry(dialer, target)
+	if *upstreamDialAttempts > 1 {
+		recordDial(via.redacted(), attempts, err != nil, time.Now())
+	}
+	retried := ""
+	if attempts > 1 {
+		retried = " attempts=" + strconv.Itoa(attempts)
+	}
+	if err != nil {
+		reply(clientConn, err)
+		clientConn.Close()
+		if *accessLog {
+			log.Printf("tunnel user=%q target=%s upstream=%s%s error=%q", pc.user, target, via.redacted(), retried, err)
+		}
+		return
+	}
+
+	reply(clientConn, nil)
+	start := time.Now()
+	if !pc.fallback {
+		touchUser(pc.user, start)
+	}
+	sent, received := relay(clientConn, targetConn)
+	if !pc.fallback {
+		addUserBytes(pc.user, sent, received)
+	}
+
+	if *accessLog {
+		log.Printf("tunnel user=%q%s target=%s upstream=%s%s duration=%s %s",
+			pc.user, logAuth(pc.anonymous, pc.ip, pc.params), target, via.redacted(), retried, time.Since(start).Round(time.Millisecond), strings.Join(selectedLabels(pc.up), " "))
+	}
+}
+
+// proxyHandler serves one proxy request. Credentials are checked on every
+// request, including each one on a kept-alive connection, so nothing
+// carries over from an earlier request on the same connection.
+func proxyHandler(w http.ResponseWriter, r *http.Request) {
+	pc, refused := authenticateProxy(r)
+	if refused != nil {
+		if refused.banned {
+			writeAuthBanned(w, refused.wait)
+		} else {
+			proxyAuthRequired(w, refused.stale)
+		}
+		return
+	}
+	if err := pc.allowed(); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	target := r.Host
+	if r.Method != http.MethodConnect {
+		// plain http:// requests are forwarded; see forward.go
+		if target = forwardTarget(r); target == "" {
+			http.Error(w, "proxy requests must be CONNECT or have an absolute http:// URL", http.StatusBadRequest)
+			return
+		}
+	}
+	// the mapping's routes and pool may send the target elsewhere
+	via, err := pc.up.pick(target, pc.params)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	upParams := upstreamParams(pc.user, via, pc.params)
+	dialer, err := dialerFor(via, upParams, r.Header.Get("Proxy-Authorization"))
+	if err != nil {
+		http.Error(w, "invalid upstream", http.StatusInternalServerError)
+		return
+	}
+
+	if r.Method != http.MethodConnect {
+		forwardHTTP(w, r, forwardRoute{user: pc.user, fallback: pc.fallback, up: pc.up, via: via, params: upParams, dialer: dialer,
+			logAuth: logAuth(pc.anonymous, pc.ip, pc.params), labels: selectedLabels(pc.up)})
+		return
+	}
+	if err := checkConnectTarget(r.Host); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if r.ProtoMajor == 2 {
+		// the stream is the tunnel; see h2inbound.go
+		stream := newH2StreamConn(w, r)
+		pc.tunnel(stream, r.Host, via, dialer, func(_ net.Conn, err error) { stream.reply(err) })
+		return
+	}
+
+	hij, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "hijack not supported", http.StatusInternalServerError)
+		return
+	}
+
+	clientConn, brw, err := hij.Hijack()
+	if err != nil {
+		return
+	}
+	if brw.Reader.Buffered() > 0 {
+		// bytes the client sent right after the CONNECT belong to the tunnel
+		clientConn = &bufferedConn{clientConn, brw.Reader}
+	}
+
+	pc.tunnel(clientConn, r.Host, via, dialer, func(conn net.Conn, err error) {
+		if err == nil {
+			conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+			return
+		}
+		status, reason := dialFailure(err)
+		resp := fmt.Sprintf("HTTP/1.1 %d %s\r\n\r\n", status, http.StatusText(status))
+		if reason != "" {
+			resp = fmt.Sprintf("HTTP/1.1 %d %s\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Length: %d\r\n\r\n%s\n", status, http.StatusText(status), len(reason)+1, reason)
+		}
+		conn.Write([]byte(resp))
+	})
+}
+
+func main() {
+	flag.Parse()
+	log.Print(build)
+	if err := checkPasswordCost(); err != nil {
+		log.Fatalf("password-cost: %v", err)
+	}
+	if err := loadTrustedProxies(); err != nil {
+		log.Fatalf("trusted-proxies: %v", err)
+	}
+	if err := checkAuthRealm(); err != nil {
+		log.Fatalf("auth-realm: %v", err)
+	}
+	if err := checkDigestFlags(); err != nil {
+		log.Fatalf("%v", err)
+	}
+	if *allowAnonymous {
+		if err := validateUser(*anonymousUser); err != nil || *anonymousUser == defaultUser {
+			log.Fatalf("anonymous-user: %q is not a valid user name", *anonymousUser)
+		}
+		log.Printf("anonymous: requests without Proxy-Authorization are accepted UNAUTHENTICATED as %q", *anonymousUser)
+	}
+	if *upstreamCA != "" {
+		if err := loadUpstreamCA(); err != nil {
+			log.Fatalf("upstream-ca: %v", err)
+		}
+	}
+	if err := checkUpstreamDNS(); err != nil {
+		log.Fatalf("upstream-dns: %v", err)
+	}
+	if err := checkDialRetry(); err != nil {
+		log.Fatalf("%v", err)
+	}
+	if *upstreamHandshakeTimeout <= 0 {
+		log.Fatalf("upstream-handshake-timeout must be positive")
+	}
+	if *upstreamTLSInsecure {
+		log.Print("upstream-tls-insecure: certificates of https:// upstreams are NOT verified")
+	}
+	if err := checkSSHFlags(); err != nil {
+		log.Fatalf("ssh: %v", err)
+	}
+	if *userParamNames != "" {
+		if err := checkUserParams(); err != nil {
+			log.Fatalf("user-params: %v", err)
+		}
+	}
+	if *authWebhookURL != "" {
+		if err := checkAuthWebhook(); err != nil {
+			log.Fatalf("auth-webhook: %v", err)
+		}
+	}
+	if *authExecPath != "" {
+		if err := checkAuthExec(); err != nil {
+			log.Fatalf("auth-exec: %v", err)
+		}
+	}
+	if oauthEnabled() {
+		if err := checkOAuth(); err != nil {
+			log.Fatalf("oauth: %v", err)
+		}
+	}
+	if jwtEnabled() {
+		if err := loadJWTKeys(); err != nil {
+			log.Fatalf("jwt: %v", err)
+		}
+		if *jwtJWKSURL != "" {
+			go refreshJWKS()
+		}
+	}
+	if *htpasswdPath != "" {
+		if err := loadHtpasswd(); err != nil {
+			log.Fatalf("htpasswd: %s: %v", *htpasswdPath, err)
+		}
+		go watchHtpasswd()
+	}
+	loadAdminTokens()
+	if err := openAuditLog(); err != nil {
+		log.Fatalf("audit: %v", err)
+	}
+	startWebhooks()
+
+	var cfg *configFile
+	if *configPath != "" {
+		var err error
+		if cfg, err = loadConfig(*configPath); err != nil {
+			log.Fatalf("config: %v", err)
+		}
+		if cfg.Listen != "" && !flagSet("addr") {
+			*listenAddr = cfg.Listen
+		}
+	}
+
+	loadState()
+	if err := hydrateStore(); err != nil {
+		log.Fatalf("store: %v", err)
+	}
+	if cfg != nil {
+		if err := applyConfig(cfg); err != nil {
+			log.Fatalf("config: %v", err)
+		}
+	}
+	if err := applyDefaultUpstreamFlag(); err != nil {
+		log.Fatalf("default-upstream: %v", err)
+	}
+	go expireLoop()
+	go idleLoop()
+	go watchReloadSignal()
+
+	admin := newAdminMux()
+	adminHandler := corsAdmin(rateLimitAdmin(requireAdmin(admin)))
+
+	var handler http.Handler = http.HandlerFunc(proxyHandler)
+	servers := []*namedServer{}
+	if *adminUnix != "" {
+		srv, err := newUnixServer(*adminUnix, *adminUnixMode, adminHandler)
+		if err != nil {
+			log.Fatalf("admin-unix: %v", err)
+		}
+		servers = append(servers, &namedServer{"admin-unix", *adminUnix, srv})
+	}
+	switch {
+	case *adminUnixOnly:
+		if *adminUnix == "" || *adminAddr != "" {
+			log.Fatal("-admin-unix-only needs -admin-unix and no -admin-addr")
+		}
+	case adminTLSEnabled() && *adminAddr == "":
+		log.Fatal("-admin-tls-* flags need -admin-addr; TLS is never applied to the proxy port")
+	case *adminAddr != "" && adminTLSEnabled():
+		if err := loadAdminTLS(); err != nil {
+			log.Fatalf("admin-tls: %v", err)
+		}
+		servers = append(servers, &namedServer{"admin", *adminAddr, newTLSServer(*adminAddr, adminHandler, &adminTLSConfig)})
+	case *adminAddr != "":
+		servers = append(servers, &namedServer{"admin", *adminAddr, &http.Server{Addr: *adminAddr, Handler: adminHandler}})
+	default:
+		// single-port mode: control API shares the proxy listener
+		handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// absolute URLs are for the proxy, even when the path matches an API route
+			if r.Method != http.MethodConnect && r.URL.IsAbs() {
+				proxyHandler(w, r)
+				return
+			}
+			if _, pattern := admin.Handler(r); pattern != "" {
+				adminHandler.ServeHTTP(w, r)
+				return
+			}
+			proxyHandler(w, r)
+		})
+	}
+	switch {
+	case proxyTLSEnabled():
+		if err := loadProxyTLS(); err != nil {
+			log.Fatalf("tls: %v", err)
+		}
+		if *proxyTLSAddr == "" {
+			servers = append(servers, &namedServer{"proxy (tls)", *listenAddr, newTLSServer(*listenAddr, handler, &proxyTLSConfig)})
+			break
+		}
+		// plain and TLS side by side, while clients move over
+		servers = append(servers, &namedServer{"proxy", *listenAddr, &http.Server{Addr: *listenAddr, Handler: handler}})
+		servers = append(servers, &namedServer{"proxy (tls)", *proxyTLSAddr, newTLSServer(*proxyTLSAddr, handler, &proxyTLSConfig)})
+	default:
+		servers = append(servers, &namedServer{"proxy", *listenAddr, &http.Server{Addr: *listenAddr, Handler: handler}})
+	}
+	if *grpcAddr != "" {
+		servers = append(servers, &namedServer{"grpc", *grpcAddr, newGRPCServer(*grpcAddr)})
+	}
+	if *socksAddr != "" {
+		servers = append(servers, &namedServer{"socks", *socksAddr, &tcpServer{name: "socks", addr: *socksAddr, handle: serveSOCKS}})
+	}
+	if *transparentAddr != "" {
+		servers = append(servers, &namedServer{"transparent", *transparentAddr, &tcpServer{name: "transparent", addr: *transparentAddr, listen: listenTransparent, handle: serveTransparent}})
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if err := serve(ctx, servers); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// applyDefaultUpstreamFlag makes -default-upstream the "*" mapping,
+// replacing whatever the state file, store or config provided
+func applyDefaultUpstreamFlag() error {
+	if *defaultUpstreamFlag == "" {
+		return nil
+	}
+	u, err := parseUpstream(*defaultUpstreamFlag)
+	if err != nil {
+		return err
+	}
+	upstreamsMu.RLock()
+	cur := upstreams[defaultUser]
+	upstreamsMu.RUnlock()
+	if cur != nil && cur.Raw == *defaultUpstreamFlag && cur.ExpiresAt.IsZero() {
+		return nil
+	}
+	up := &Upstream{Raw: *defaultUpstreamFlag, URL: u, SetAt: time.Now()}
+	return putUpstreams(changeSource{Actor: "flag"}, map[string]*Upstream{defaultUser: up})
+}
+
+// flagSet reports whether the named flag was given on the command line
+func flagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+// server is implemented by *http.Server and *grpcServer
+type server interface {
+	ListenAndServe() error
+	Shutdown(context.Context) error
+}
+
+type namedServer struct {
+	name string
+	addr string
+	server
+}
+
+// tcpServer accepts connections on addr and hands each to handle, for the
+// listeners that don't speak HTTP. listen defaults to a plain TCP listener.
+type tcpServer struct {
+	name   string
+	addr   string
+	listen func(addr string) (net.Listener, error)
+	handle func(net.Conn)
+
+	mu     sync.Mutex
+	ln     net.Listener
+	closed bool
+}
+
+func (s *tcpServer) ListenAndServe() error {
+	listen := s.listen
+	if listen == nil {
+		listen = func(addr string) (net.Listener, error) { return net.Listen("tcp", addr) }
+	}
+	ln, err := listen(s.addr)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		ln.Close()
+		return http.ErrServerClosed
+	}
+	s.ln = ln
+	s.mu.Unlock()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return http.ErrServerClosed
+			}
+			// out of file descriptors and the like; the listener stays open
+			log.Printf("%s: accept: %v", s.name, err)
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		go s.handle(conn)
+	}
+}
+
+// Shutdown stops accepting connections. Like the proxy port's, open
+// tunnels are left to finish.
+func (s *tcpServer) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	if s.ln != nil {
+		return s.ln.Close()
+	}
+	return nil
+}
+
+// serve runs all servers until ctx is cancelled or one of them fails, then
+// shuts every server down and flushes pending state.
+func serve(ctx context.Context, servers []*namedServer) error {
+	errc := make(chan error, len(servers))
+	for _, srv := range servers {
+		go func() {
+			log.Printf("%s listening on %s", srv.name, srv.addr)
+			if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				errc <- fmt.Errorf("%s: %w", srv.name, err)
+			}
+		}()
+	}
+
+	var err error
+	select {
+	case <-ctx.Done():
+		log.Println("shutting down")
+	case err = <-errc:
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	for _, srv := range servers {
+		srv.Shutdown(shutdownCtx)
+	}
+	if *stateFile != "" {
+		if serr := saveState(); serr != nil {
+			log.Printf("state: final save failed: %v", serr)
+		}
+	}
+	mappings.Close()
+	return err
 }
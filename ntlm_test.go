@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"golang.org/x/crypto/md4"
+)
+
+// fakeNTLMProxy is an HTTP proxy that only lets alice in, with NTLMv2. It
+// answers a negotiate with a challenge on the same connection and checks the
+// authenticate message against MS-NLMP itself. basicOnly makes it offer Basic
+// instead; closeOnChallenge makes it close the connection after the challenge.
+type fakeNTLMProxy struct {
+	addr                        string
+	domain, user, password      string
+	basicOnly, closeOnChallenge bool
+
+	mu     sync.Mutex
+	conns  int
+	logins []string // "DOMAIN\user ok" or "... bad", per authenticate message
+}
+
+// fakeNTLMServerChallenge and fakeNTLMTimestamp go out in every challenge
+var (
+	fakeNTLMServerChallenge = []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	fakeNTLMTimestamp       = []byte{0, 0x80, 0x3e, 0xd5, 0xde, 0xb1, 0x9d, 0x01}
+)
+
+func startFakeNTLMProxy(t *testing.T, basicOnly, closeOnChallenge bool) *fakeNTLMProxy {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	p := &fakeNTLMProxy{addr: ln.Addr().String(), domain: "CORP", user: "alice", password: "Winter2024!",
+		basicOnly: basicOnly, closeOnChallenge: closeOnChallenge}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go p.serve(conn)
+		}
+	}()
+	return p
+}
+
+func (p *fakeNTLMProxy) serve(conn net.Conn) {
+	defer conn.Close()
+	p.mu.Lock()
+	p.conns++
+	p.mu.Unlock()
+	br := bufio.NewReader(conn)
+	for {
+		req, err := http.ReadRequest(br)
+		if err != nil || req.Method != http.MethodConnect {
+			return
+		}
+		scheme, param, _ := strings.Cut(req.Header.Get("Proxy-Authorization"), " ")
+		msg, _ := base64.StdEncoding.DecodeString(param)
+		switch {
+		case p.basicOnly:
+			if user, pw, _ := strings.Cut(string(msg), ":"); scheme == "Basic" && user == p.user && pw == p.password {
+				p.tunnel(conn, br, req.Host)
+				return
+			}
+			io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\nProxy-Authenticate: Basic realm=\"corp\"\r\nContent-Length: 0\r\nConnection: close\r\n\r\n")
+			return
+		case scheme == "NTLM" && len(msg) >= 12 && binary.LittleEndian.Uint32(msg[8:]) == 1:
+			challenge := "NTLM " + base64.StdEncoding.EncodeToString(fakeNTLMChallenge(p.domain))
+			body := "<html><title>Authentication required</title></html>"
+			closing := ""
+			if p.closeOnChallenge {
+				closing = "Connection: close\r\n"
+			}
+			fmt.Fprintf(conn, "HTTP/1.1 407 Proxy Authentication Required\r\nProxy-Authenticate: %s\r\n%sContent-Length: %d\r\n\r\n%s", challenge, closing, len(body), body)
+			if p.closeOnChallenge {
+				return
+			}
+		case scheme == "NTLM" && len(msg) >= 12 && binary.LittleEndian.Uint32(msg[8:]) == 3:
+			login, ok := p.checkAuthenticate(msg)
+			p.mu.Lock()
+			p.logins = append(p.logins, login)
+			p.mu.Unlock()
+			if ok {
+				p.tunnel(conn, br, req.Host)
+			} else {
+				io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\nProxy-Authenticate: NTLM\r\nContent-Length: 0\r\nConnection: close\r\n\r\n")
+			}
+			return
+		default:
+			io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\nProxy-Authenticate: NTLM\r\nContent-Length: 0\r\n\r\n")
+		}
+	}
+}
+
+func (p *fakeNTLMProxy) tunnel(conn net.Conn, br *bufio.Reader, target string) {
+	dest, err := net.Dial("tcp", target)
+	if err != nil {
+		io.WriteString(conn, "HTTP/1.1 502 Bad Gateway\r\nContent-Length: 0\r\n\r\n")
+		return
+	}
+	io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+	relay(&bufferedConn{conn, br}, dest)
+}
+
+// helper to build a type 2 message with domain as the target name, and the
+// domain and timestamp in the target info
+func fakeNTLMChallenge(domain string) []byte {
+	name := utf16le(domain)
+	var info []byte
+	info = binary.LittleEndian.AppendUint16(info, 2) // MsvAvNbDomainName
+	info = binary.LittleEndian.AppendUint16(info, uint16(len(name)))
+	info = append(info, name...)
+	info = binary.LittleEndian.AppendUint16(info, ntlmAvTimestamp)
+	info = binary.LittleEndian.AppendUint16(info, 8)
+	info = append(info, fakeNTLMTimestamp...)
+	info = append(info, 0, 0, 0, 0) // MsvAvEOL
+
+	msg := make([]byte, 48)
+	copy(msg, "NTLMSSP\x00")
+	binary.LittleEndian.PutUint32(msg[8:], 2)
+	binary.LittleEndian.PutUint16(msg[12:], uint16(len(name)))
+	binary.LittleEndian.PutUint16(msg[14:], uint16(len(name)))
+	binary.LittleEndian.PutUint32(msg[16:], 48)
+	binary.LittleEndian.PutUint32(msg[20:], ntlmNegotiateUnicode|ntlmNegotiateNTLM|ntlmNegotiateExtendedSec)
+	copy(msg[24:], fakeNTLMServerChallenge)
+	binary.LittleEndian.PutUint16(msg[40:], uint16(len(info)))
+	binary.LittleEndian.PutUint16(msg[42:], uint16(len(info)))
+	binary.LittleEndian.PutUint32(msg[44:], uint32(48+len(name)))
+	return append(append(msg, name...), info...)
+}
+
+// checkAuthenticate verifies the NTProofStr of a type 3 message the way a
+// domain controller would, from the proxy's own copy of the password
+func (p *fakeNTLMProxy) checkAuthenticate(msg []byte) (string, bool) {
+	field := func(off int) []byte {
+		f, _ := ntlmField(msg, off)
+		return f
+	}
+	ntResp, domain, user := field(20), string(utf16Decode(field(28))), string(utf16Decode(field(36)))
+	login := domain + `\` + user
+	if len(ntResp) < 16+28 {
+		return login + " bad", false
+	}
+	nt := md4.New()
+	nt.Write(utf16le(p.password))
+	mac := hmac.New(md5.New, nt.Sum(nil))
+	mac.Write(utf16le(strings.ToUpper(user) + domain))
+	v2Hash := mac.Sum(nil)
+
+	blob := ntResp[16:]
+	mac = hmac.New(md5.New, v2Hash)
+	mac.Write(fakeNTLMServerChallenge)
+	mac.Write(blob)
+	// the blob must carry the server's timestamp, as NTLMv2 requires when
+	// the challenge has one
+	if !hmac.Equal(mac.Sum(nil), ntResp[:16]) || !bytes.Equal(blob[8:16], fakeNTLMTimestamp) ||
+		!strings.EqualFold(domain, p.domain) || user != p.user {
+		return login + " bad", false
+	}
+	return login + " ok", true
+}
+
+func TestNTLMUpstream(t *testing.T) {
+	echo := startEchoServer(t)
+	proxyAddr := startProxy(t)
+
+	for _, tt := range []struct {
+		name, upstream string // the upstream with %s for the proxy address
+		login          string
+	}{
+		{"domain in the user", "ntlm://CORP%%5Calice:Winter2024%%21@%s", `CORP\alice ok`},
+		{"domain from the challenge", "ntlm://alice:Winter2024%%21@%s", `CORP\alice ok`},
+		{"auth=ntlm on http", "http://CORP%%5Calice:Winter2024%%21@%s?auth=ntlm", `CORP\alice ok`},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream := startFakeNTLMProxy(t, false, false)
+			setTestMapping(t, "bob", fmt.Sprintf(tt.upstream, upstream.addr), "")
+
+			resp, conn := dialConnect(t, proxyAddr, echo, basicAuth("bob", "x"))
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("status = %d, want 200", resp.StatusCode)
+			}
+			expectEcho(t, conn, "through NTLM")
+			upstream.mu.Lock()
+			defer upstream.mu.Unlock()
+			if len(upstream.logins) != 1 || upstream.logins[0] != tt.login {
+				t.Errorf("logins = %q, want %q", upstream.logins, tt.login)
+			}
+			// NTLM authenticates the connection, so the whole handshake
+			// must happen on one
+			if upstream.conns != 1 {
+				t.Errorf("handshake used %d connections, want 1", upstream.conns)
+			}
+		})
+	}
+}
+
+func TestNTLMUpstreamFailures(t *testing.T) {
+	setFlag(t, accessLog, true)
+	logs := captureLog(t)
+	echo := startEchoServer(t)
+	proxyAddr := startProxy(t)
+
+	t.Run("wrong password", func(t *testing.T) {
+		upstream := startFakeNTLMProxy(t, false, false)
+		setTestMapping(t, "bob", "ntlm://CORP%5Calice:Summer2024@"+upstream.addr, "")
+		resp, _ := dialConnect(t, proxyAddr, echo, basicAuth("bob", "x"))
+		body, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != http.StatusBadGateway || !strings.Contains(string(body), "407") {
+			t.Errorf("%d %q, want 502 naming the 407", resp.StatusCode, body)
+		}
+		upstream.mu.Lock()
+		defer upstream.mu.Unlock()
+		if len(upstream.logins) != 1 || upstream.logins[0] != `CORP\alice bad` {
+			t.Errorf("logins = %q, want one refused", upstream.logins)
+		}
+	})
+
+	t.Run("basic fallback", func(t *testing.T) {
+		upstream := startFakeNTLMProxy(t, true, false)
+		setTestMapping(t, "bob", "ntlm://alice:Winter2024%21@"+upstream.addr, "")
+		resp, conn := dialConnect(t, proxyAddr, echo, basicAuth("bob", "x"))
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("status = %d, want 200", resp.StatusCode)
+		}
+		expectEcho(t, conn, "through Basic")
+		upstream.mu.Lock()
+		defer upstream.mu.Unlock()
+		// the 407 offering Basic closed the first connection
+		if upstream.conns != 2 {
+			t.Errorf("fallback used %d connections, want 2", upstream.conns)
+		}
+	})
+
+	t.Run("connection closed after the challenge", func(t *testing.T) {
+		upstream := startFakeNTLMProxy(t, false, true)
+		setTestMapping(t, "bob", "ntlm://CORP%5Calice:Winter2024%21@"+upstream.addr, "")
+		resp, _ := dialConnect(t, proxyAddr, echo, basicAuth("bob", "x"))
+		if resp.StatusCode != http.StatusBadGateway {
+			t.Errorf("status = %d, want 502", resp.StatusCode)
+		}
+		logs.waitFor(t, "proxy closed the connection during the NTLM handshake")
+	})
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	oauthIntrospectURL = flag.String("oauth-introspect-url", "", "RFC 7662 endpoint that checks OAuth2 access tokens sent as a Bearer header or as the password of -oauth-user")
+	oauthClientID      = flag.String("oauth-client-id", "", "client ID for -oauth-introspect-url")
+	oauthClientSecret  = flag.String("oauth-client-secret", "", "client secret for -oauth-introspect-url (default $UPSTREAMGATE_OAUTH_CLIENT_SECRET)")
+	oauthUserClaim     = flag.String("oauth-user-claim", "sub", "introspection response field holding the proxy username")
+	oauthUser          = flag.String("oauth-user", "oauth", "Basic username whose password is taken as an access token")
+	oauthMaxTTL        = flag.Duration("oauth-cache-max-ttl", 5*time.Minute, "longest an introspection result is used before asking again")
+)
+
+const (
+	// oauthNegativeTTL is how long an inactive token is remembered
+	oauthNegativeTTL = 30 * time.Second
+	// oauthStaleMax bounds how long a token without exp is still accepted
+	// from the cache while the endpoint is down
+	oauthStaleMax = time.Hour
+)
+
+type oauthResult struct {
+	user   string // "" for inactive tokens
+	fresh  time.Time
+	usable time.Time // until when it may stand in for an unreachable endpoint
+}
+
+var (
+	oauthClient    = &http.Client{Timeout: 5 * time.Second}
+	oauthCacheMu   sync.Mutex
+	oauthCache     = map[[sha256.Size]byte]oauthResult{} // HMAC of the token
+	oauthFallbacks atomic.Uint64
+)
+
+func oauthEnabled() bool {
+	return *oauthIntrospectURL != ""
+}
+
+// checkOAuth validates the introspection flags
+func checkOAuth() error {
+	if *oauthClientSecret == "" {
+		*oauthClientSecret = os.Getenv("UPSTREAMGATE_OAUTH_CLIENT_SECRET")
+	}
+	u, err := url.Parse(*oauthIntrospectURL)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "https" && !(u.Scheme == "http" && isLoopbackHost(u.Hostname())) {
+		return errors.New("must use https unless it points at a loopback address")
+	}
+	if *oauthClientID == "" {
+		return errors.New("-oauth-client-id is required")
+	}
+	if *oauthUserClaim == "" {
+		return errors.New("-oauth-user-claim may not be empty")
+	}
+	return nil
+}
+
+// oauthTokenUser returns the user an access token belongs to. Results are
+// cached until the token expires or for -oauth-cache-max-ttl, and an expired
+// entry is still used, and counted, while the endpoint can't be reached.
+func oauthTokenUser(token string, now time.Time) (string, error) {
+	key := authMAC("oauth", token)
+	oauthCacheMu.Lock()
+	cached, ok := oauthCache[key]
+	oauthCacheMu.Unlock()
+	if ok && now.Before(cached.fresh) {
+		return oauthResultUser(cached)
+	}
+
+	res, err := introspect(token, now)
+	if err != nil {
+		if ok && cached.user != "" && now.Before(cached.usable) {
+			oauthFallbacks.Add(1)
+			log.Printf("oauth: introspection failed, using cached result for %q: %v", cached.user, err)
+			return cached.user, nil
+		}
+		log.Printf("oauth: introspection failed: %v", err)
+		return "", err
+	}
+
+	oauthCacheMu.Lock()
+	if len(oauthCache) >= authCacheMax {
+		for k, r := range oauthCache {
+			if !now.Before(r.usable) {
+				delete(oauthCache, k)
+			}
+		}
+		if len(oauthCache) >= authCacheMax {
+			clear(oauthCache)
+		}
+	}
+	oauthCache[key] = res
+	oauthCacheMu.Unlock()
+	return oauthResultUser(res)
+}
+
+func oauthResultUser(r oauthResult) (string, error) {
+	if r.user == "" {
+		return "", errors.New("inactive token")
+	}
+	return r.user, nil
+}
+
+// helper to POST one token to the introspection endpoint
+func introspect(token string, now time.Time) (oauthResult, error) {
+	form := url.Values{"token": {token}, "token_type_hint": {"access_token"}}
+	req, err := http.NewRequest(http.MethodPost, *oauthIntrospectURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return oauthResult{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(*oauthClientID), url.QueryEscape(*oauthClientSecret))
+	resp, err := oauthClient.Do(req)
+	if err != nil {
+		return oauthResult{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(io.Discard, io.LimitReader(resp.Body, 4<<10))
+		return oauthResult{}, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	var body map[string]any
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&body); err != nil {
+		return oauthResult{}, err
+	}
+
+	if active, _ := body["active"].(bool); !active {
+		return oauthResult{fresh: now.Add(oauthNegativeTTL), usable: now.Add(oauthNegativeTTL)}, nil
+	}
+	user, _ := body[*oauthUserClaim].(string)
+	if user == "" {
+		return oauthResult{}, fmt.Errorf("active token without %q", *oauthUserClaim)
+	}
+	res := oauthResult{user: user, fresh: now.Add(*oauthMaxTTL), usable: now.Add(oauthStaleMax)}
+	if exp, ok := body["exp"].(float64); ok {
+		t := time.Unix(int64(exp), 0)
+		if !now.Before(t) {
+			return oauthResult{fresh: now.Add(oauthNegativeTTL), usable: now.Add(oauthNegativeTTL)}, nil
+		}
+		res.usable = t
+		if t.Before(res.fresh) {
+			res.fresh = t
+		}
+	}
+	return res, nil
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"flag"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	passwordCost          = flag.Int("password-cost", bcrypt.DefaultCost, "bcrypt cost for stored proxy passwords (4-31)")
+	closeExpiredPasswords = flag.Bool("close-expired-passwords", false, "close a user's connections once every password it can use has expired")
+)
+
+// authCacheTTL is how long a verified password skips bcrypt. It is keyed by
+// the stored hash too, so a password change takes effect immediately.
+const (
+	authCacheTTL = time.Minute
+	authCacheMax = 1 << 16
+)
+
+var (
+	authKey     = newAuthKey() // per-process, so cache keys are useless elsewhere
+	authCacheMu sync.Mutex
+	authCache   = map[[sha256.Size]byte]time.Time{} // HMAC of user, hash and password -> expiry
+)
+
+func newAuthKey() []byte {
+	k := make([]byte, 32)
+	if _, err := rand.Read(k); err != nil {
+		panic(err)
+	}
+	return k
+}
+
+func checkPasswordCost() error {
+	if *passwordCost < bcrypt.MinCost || *passwordCost > bcrypt.MaxCost {
+		return errors.New("must be between 4 and 31")
+	}
+	return nil
+}
+
+// hashPassword returns the bcrypt hash stored for password, "" for none
+func hashPassword(password string) (string, error) {
+	if password == "" {
+		return "", nil
+	}
+	if len(password) > 72 {
+		return "", &fieldError{"password", "longer than 72 bytes"}
+	}
+	h, err := bcrypt.GenerateFromPassword([]byte(password), *passwordCost)
+	if err != nil {
+		return "", err
+	}
+	return string(h), nil
+}
+
+// helper to check a plaintext password against a stored hash, "" matching ""
+func hashMatches(hash, password string) bool {
+	if hash == "" || password == "" {
+		return hash == "" && password == ""
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+// helper to apply the optional password of a set request: nil keeps the
+// password of the mapping being replaced, "" removes it
+func setPassword(user string, up *Upstream, password *string) error {
+	if password == nil {
+		up.keepPassword = true
+		return nil
+	}
+	return storePassword(user, up, *password)
+}
+
+// helper to apply the optional password_expires_at of a set request
+func setPasswordExpiry(up *Upstream, password *string, expiresAt *time.Time) error {
+	switch {
+	case expiresAt == nil:
+		return nil
+	case password != nil && *password == "":
+		return &fieldError{"password_expires_at", "set without a password"}
+	case !expiresAt.After(time.Now()):
+		return &fieldError{"password_expires_at", "is in the past"}
+	}
+	up.PasswordExpiresAt = *expiresAt
+	return nil
+}
+
+// storePassword sets the hashes kept for the user's password
+func storePassword(user string, up *Upstream, password string) error {
+	s, err := hashSecret(user, password)
+	if err != nil {
+		return err
+	}
+	up.PasswordHash, up.DigestMD5, up.DigestSHA256 = s.Hash, s.DigestMD5, s.DigestSHA256
+	return nil
+}
+
+// secret holds the hashes kept for one password
+type secret struct {
+	Hash         string // bcrypt
+	DigestMD5    string // only with -proxy-digest
+	DigestSHA256 string
+}
+
+// hashSecret hashes the user's password, plus its Digest hashes when
+// -proxy-digest is on; "" gives an empty secret
+func hashSecret(user, password string) (secret, error) {
+	h, err := hashPassword(password)
+	if err != nil || h == "" {
+		return secret{}, err
+	}
+	s := secret{Hash: h}
+	if *proxyDigest {
+		s.DigestMD5, s.DigestSHA256 = digestHA1(user, password)
+	}
+	return s, nil
+}
+
+// passwordOK checks the password sent by a proxy client against the user's
+// password, unexpired credentials and -htpasswd entry. Users with none of
+// them, including users on the default, are left to -auth-webhook or
+// -auth-exec, or let in with any password unless -require-password is set;
+// mappings whose passwords have all expired accept none. use counts the
+// logins of the mapping password or credential that matched, if one did.
+func passwordOK(user string, up *Upstream, fallback bool, password, clientIP string) (ok bool, use *secretUsage) {
+	fileHash, inFile := htpasswdHash(user)
+	if !inFile && (fallback || !up.hasPassword()) {
+		switch {
+		case *authWebhookURL != "":
+			return webhookAllows(user, password, clientIP), nil
+		case *authExecPath != "":
+			return execAllows(user, password, clientIP), nil
+		}
+		return !*requirePassword, nil
+	}
+	now := time.Now()
+	var hashes []string
+	if !fallback {
+		for _, s := range up.liveSecrets(now) {
+			hashes = append(hashes, s.Hash)
+		}
+	}
+	if inFile {
+		hashes = append(hashes, fileHash)
+	}
+	// htpasswd entries aren't counted
+	usage := func(h string) *secretUsage {
+		if inFile && h == fileHash {
+			return nil
+		}
+		return usageOfSecret(h)
+	}
+	authCacheMu.Lock()
+	for _, h := range hashes {
+		if exp, ok := authCache[authMAC(user, h, password)]; ok && now.Before(exp) {
+			authCacheMu.Unlock()
+			return true, usage(h)
+		}
+	}
+	authCacheMu.Unlock()
+
+	i := slices.IndexFunc(hashes, func(h string) bool { return verifyHash(h, password) })
+	if i < 0 {
+		return false, nil
+	}
+	key := authMAC(user, hashes[i], password)
+	authCacheMu.Lock()
+	if len(authCache) >= authCacheMax {
+		for k, exp := range authCache {
+			if !now.Before(exp) {
+				delete(authCache, k)
+			}
+		}
+		if len(authCache) >= authCacheMax {
+			clear(authCache)
+		}
+	}
+	authCache[key] = now.Add(authCacheTTL)
+	authCacheMu.Unlock()
+	return true, usage(hashes[i])
+}
+
+// passwordsClosed holds users whose connections were closed because their
+// passwords expired, so it happens once per expiry
+var (
+	passwordsClosedMu sync.Mutex
+	passwordsClosed   = map[string]bool{}
+)
+
+// closeExpiredPasswordConns closes the connections of users who have just
+// lost their last unexpired password, with -close-expired-passwords
+func closeExpiredPasswordConns(now time.Time) {
+	if !*closeExpiredPasswords {
+		return
+	}
+	expired := map[string]bool{}
+	upstreamsMu.RLock()
+	for user, up := range upstreams {
+		if up.passwordExpired(now) {
+			expired[user] = true
+		}
+	}
+	upstreamsMu.RUnlock()
+
+	passwordsClosedMu.Lock()
+	defer passwordsClosedMu.Unlock()
+	for user := range expired {
+		if !passwordsClosed[user] {
+			if n := closeUserConns(user); n > 0 {
+				log.Printf("expiry: passwords of %q expired, closed %d connections", user, n)
+			}
+		}
+	}
+	passwordsClosed = expired
+}
+
+// authMAC keys values derived from passwords without keeping them around
+func authMAC(parts ...string) [sha256.Size]byte {
+	m := authMACs.Get().(hash.Hash)
+	defer authMACs.Put(m)
+	m.Reset()
+	for _, p := range parts {
+		io.WriteString(m, p)
+		m.Write([]byte{0})
+	}
+	var out [sha256.Size]byte
+	m.Sum(out[:0])
+	return out
+}
+
+// authMACs reuses HMAC states, since authMAC runs on every proxy login
+var authMACs = sync.Pool{New: func() any { return hmac.New(sha256.New, authKey) }}
+
+// POST /password { "user":"u", "password":"new", "close_connections":true }
+//
+// Replaces the user's password without touching the upstream. Its expiry is
+// cleared unless password_expires_at is given; credentials are kept.
+func passwordHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeMethodNotAllowed(w)
+		return
+	}
+	var req struct {
+		User              string     `json:"user"`
+		Password          string     `json:"password"`
+		PasswordExpiresAt *time.Time `json:"password_expires_at"`
+		CloseConnections  bool       `json:"close_connections"`
+	}
+	if !decodeJSON(w, r, *maxBodyBytes, &req) {
+		return
+	}
+	if err := validateUser(req.User); err != nil {
+		writeInvalid(w, err)
+		return
+	}
+	if req.Password == "" {
+		writeInvalid(w, &fieldError{"password", "missing"})
+		return
+	}
+	var up Upstream
+	if err := storePassword(req.User, &up, req.Password); err != nil {
+		writeInvalid(w, err)
+		return
+	}
+	if err := setPasswordExpiry(&up, &req.Password, req.PasswordExpiresAt); err != nil {
+		writeInvalid(w, err)
+		return
+	}
+
+	src := sourceOf(r)
+	src.KeepConns, src.Event = !req.CloseConnections, "password.changed"
+	err := updateMapping(src, req.User, func(cur *Upstream) error {
+		cur.PasswordHash, cur.DigestMD5, cur.DigestSHA256 = up.PasswordHash, up.DigestMD5, up.DigestSHA256
+		cur.PasswordExpiresAt = up.PasswordExpiresAt
+		return nil
+	})
+	switch err {
+	case nil:
+	case errNoMapping:
+		writeError(w, http.StatusNotFound, "mapping_not_found", "no mapping for user")
+		return
+	default:
+		log.Printf("store: changing password of %q failed: %v", req.User, err)
+		writeStoreError(w)
+		return
+	}
+
+	log.Printf("admin: %s changed the password of %q (close_connections=%t)", src.Actor, req.User, req.CloseConnections)
+	w.WriteHeader(http.StatusNoContent)
+}
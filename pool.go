@@ -0,0 +1,129 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"strings"
+)
+
+// A mapping's pool lets clients pick an exit by tag from the login: with
+// -user-params country, the login "alice-country-us" goes through one of
+// the members of alice's pool tagged "us". A login without the tag, or a
+// user without a pool, uses the mapping's own upstream. When no member
+// carries the tag, any member is used, or with -pool-strict the tunnel is
+// refused. Routes still win over the pool.
+var (
+	poolTagParam = flag.String("pool-tag-param", "country", "the -user-params parameter whose value picks pool members by tag")
+	poolStrict   = flag.Bool("pool-strict", false, "refuse tunnels whose tag matches no member of the user's pool, instead of using any member")
+)
+
+// maxPoolMembers bounds the pool of a mapping, and maxPoolTags the tags of
+// one member
+const (
+	maxPoolMembers = 64
+	maxPoolTags    = 16
+)
+
+// poolMemberSpec is a member as given to the control API and stored
+type poolMemberSpec struct {
+	Upstream string   `json:"upstream"`
+	Tags     []string `json:"tags,omitempty"`
+}
+
+// poolMember is a parsed member. Like a route's, its upstream only has Raw
+// and URL set.
+type poolMember struct {
+	spec poolMemberSpec
+	up   *Upstream
+	tags []string // lower case
+}
+
+// errNoPoolMember refuses a tag no member carries, with -pool-strict
+type errNoPoolMember struct{ tag string }
+
+func (e *errNoPoolMember) Error() string {
+	return fmt.Sprintf("no upstream in the pool is tagged %q", e.tag)
+}
+
+// helper to apply the optional pool of a set request
+func setUpstreamPool(up *Upstream, specs []poolMemberSpec) error {
+	if len(specs) == 0 {
+		return nil
+	}
+	if len(specs) > maxPoolMembers {
+		return &fieldError{"pool", fmt.Sprintf("at most %d members allowed", maxPoolMembers)}
+	}
+	pool := make([]poolMember, 0, len(specs))
+	for i, spec := range specs {
+		m, err := parsePoolMember(spec)
+		if err != nil {
+			return &fieldError{"pool", fmt.Sprintf("member %d: %v", i+1, err)}
+		}
+		pool = append(pool, m)
+	}
+	up.Pool = pool
+	return nil
+}
+
+func parsePoolMember(spec poolMemberSpec) (poolMember, error) {
+	m := poolMember{spec: spec}
+	if len(spec.Tags) > maxPoolTags {
+		return m, fmt.Errorf("at most %d tags allowed", maxPoolTags)
+	}
+	for _, tag := range spec.Tags {
+		if tag == "" || len(tag) > maxLabelKeyLen || strings.Trim(tag, labelKeyCharacters) != "" {
+			return m, fmt.Errorf("tag %q must be 1-63 letters, digits or -_./", tag)
+		}
+		m.tags = append(m.tags, strings.ToLower(tag))
+	}
+	u, err := parseUpstream(spec.Upstream)
+	if err != nil {
+		return m, fmt.Errorf("upstream: %v", err)
+	}
+	m.up = &Upstream{Raw: spec.Upstream, URL: u}
+	return m, nil
+}
+
+// pick returns the upstream a tunnel to target goes through for a login
+// with params: a matching route's, else a pool member for the login's tag,
+// else up itself
+func (up *Upstream) pick(target string, params map[string]string) (*Upstream, error) {
+	via := up.route(target)
+	tag := strings.ToLower(params[*poolTagParam])
+	if via != up || len(up.Pool) == 0 || tag == "" {
+		return via, nil
+	}
+	var tagged []*Upstream
+	for i := range up.Pool {
+		if slices.Contains(up.Pool[i].tags, tag) {
+			tagged = append(tagged, up.Pool[i].up)
+		}
+	}
+	if len(tagged) > 0 {
+		return tagged[rand.IntN(len(tagged))], nil
+	}
+	if *poolStrict {
+		return nil, &errNoPoolMember{tag}
+	}
+	return up.Pool[rand.IntN(len(up.Pool))].up, nil
+}
+
+// poolSpecs lists the members of up as they were given
+func (up *Upstream) poolSpecs() []poolMemberSpec {
+	if len(up.Pool) == 0 {
+		return nil
+	}
+	specs := make([]poolMemberSpec, len(up.Pool))
+	for i, m := range up.Pool {
+		specs[i] = m.spec
+	}
+	return specs
+}
+
+func samePool(a, b []poolMember) bool {
+	return slices.EqualFunc(a, b, func(x, y poolMember) bool {
+		return x.spec.Upstream == y.spec.Upstream && slices.Equal(x.spec.Tags, y.spec.Tags)
+	})
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestUpstreamPoolPick(t *testing.T) {
+	pooled, err := buildUpstream("http://own:3128", 0, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := setUpstreamRoutes(pooled, []routeSpec{{Match: "*.internal.example", Upstream: "http://office:3128"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := setUpstreamPool(pooled, []poolMemberSpec{
+		{Upstream: "http://us1:3128", Tags: []string{"us"}},
+		{Upstream: "http://de1:3128", Tags: []string{"DE", "eu"}},
+		{Upstream: "http://untagged:3128"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	plain, err := buildUpstream("http://own:3128", 0, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	all := []string{"http://us1:3128", "http://de1:3128", "http://untagged:3128"}
+
+	for _, tt := range []struct {
+		name   string
+		up     *Upstream
+		target string
+		tag    string
+		strict bool
+		want   []string // any of them
+		err    bool
+	}{
+		{name: "no tag", up: pooled, want: []string{"http://own:3128"}},
+		{name: "tagged member", up: pooled, tag: "us", want: []string{"http://us1:3128"}},
+		{name: "tags ignore case", up: pooled, tag: "de", want: []string{"http://de1:3128"}},
+		{name: "second tag", up: pooled, tag: "EU", want: []string{"http://de1:3128"}},
+		{name: "unknown country falls back to any member", up: pooled, tag: "fr", want: all},
+		{name: "unknown country with -pool-strict", up: pooled, tag: "fr", strict: true, err: true},
+		{name: "known country with -pool-strict", up: pooled, tag: "us", strict: true, want: []string{"http://us1:3128"}},
+		{name: "route wins over the pool", up: pooled, target: "git.internal.example:443", tag: "us", want: []string{"http://office:3128"}},
+		{name: "user without a pool", up: plain, tag: "us", want: []string{"http://own:3128"}},
+		{name: "user without a pool with -pool-strict", up: plain, tag: "fr", strict: true, want: []string{"http://own:3128"}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			setFlag(t, poolStrict, tt.strict)
+			target := tt.target
+			if target == "" {
+				target = "example.com:443"
+			}
+			var params map[string]string
+			if tt.tag != "" {
+				params = map[string]string{"country": tt.tag}
+			}
+			// enough picks to see a member other than the first
+			for range 20 {
+				via, err := tt.up.pick(target, params)
+				var noMember *errNoPoolMember
+				if tt.err {
+					if !errors.As(err, &noMember) {
+						t.Fatalf("err = %v, want errNoPoolMember", err)
+					}
+					return
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !slices.Contains(tt.want, via.Raw) {
+					t.Fatalf("picked %s, want one of %q", via.Raw, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestSetUpstreamPoolRejects(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		spec poolMemberSpec
+		want string
+	}{
+		{"bad upstream", poolMemberSpec{Upstream: "ftp://x:1"}, "member 1: upstream"},
+		{"empty tag", poolMemberSpec{Upstream: "direct", Tags: []string{""}}, "tag"},
+		{"tag with a space", poolMemberSpec{Upstream: "direct", Tags: []string{"us east"}}, "tag"},
+	} {
+		up := &Upstream{}
+		err := setUpstreamPool(up, []poolMemberSpec{tt.spec})
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: err = %v, want %q", tt.name, err, tt.want)
+		}
+	}
+}
+
+// The login's country picks the member a tunnel goes through
+func TestUpstreamPoolLogin(t *testing.T) {
+	names := *userParamNames
+	t.Cleanup(func() {
+		*userParamNames = names
+		userParamSet = nil
+	})
+	*userParamNames = "session,country"
+	if err := checkUserParams(); err != nil {
+		t.Fatal(err)
+	}
+	echo := startEchoServer(t)
+	proxyAddr := startProxy(t)
+	own, us, de := startFakeSOCKS5(t, "", ""), startFakeSOCKS5(t, "", ""), startFakeSOCKS5(t, "", "")
+	setTestMapping(t, "alice", "socks5://"+own.addr, "", func(up *Upstream) {
+		if err := setUpstreamPool(up, []poolMemberSpec{
+			{Upstream: "socks5://" + us.addr, Tags: []string{"us"}},
+			{Upstream: "socks5://" + de.addr, Tags: []string{"de"}},
+		}); err != nil {
+			t.Fatal(err)
+		}
+	})
+	requests := func(s *fakeSOCKS5) int {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return len(s.requests)
+	}
+
+	for _, tt := range []struct {
+		login string
+		via   *fakeSOCKS5
+	}{
+		{"alice", own},
+		{"alice-country-us", us},
+		{"alice-session-7-country-de", de},
+	} {
+		before := requests(tt.via)
+		resp, conn := dialConnect(t, proxyAddr, echo, basicAuth(tt.login, "x"))
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: status = %d, want 200", tt.login, resp.StatusCode)
+		}
+		expectEcho(t, conn, "through the pool")
+		if requests(tt.via) != before+1 {
+			t.Errorf("%s: tunnel didn't go through %s", tt.login, tt.via.addr)
+		}
+	}
+
+	t.Run("unknown country with -pool-strict", func(t *testing.T) {
+		setFlag(t, poolStrict, true)
+		resp, _ := dialConnect(t, proxyAddr, echo, basicAuth("alice-country-fr", "x"))
+		body, _ := io.ReadAll(resp.Body)
+		if want := `no upstream in the pool is tagged "fr"`; resp.StatusCode != http.StatusBadGateway || !strings.Contains(string(body), want) {
+			t.Errorf("%d %q, want 502 %q", resp.StatusCode, body, want)
+		}
+	})
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+var (
+	probeTarget  = flag.String("probe-target", "example.com:443", "host:port dialed through an upstream to verify it")
+	probeTimeout = flag.Duration("probe-timeout", 10*time.Second, "timeout for upstream verification dials")
+	exitIPURL    = flag.String("exit-ip-url", "https://api.ipify.org", "IP-echo endpoint fetched through an upstream on verified sets to report its exit IP (empty disables)")
+)
+
+// dialTimeout dials addr through d, giving up after timeout. Dialers without
+// context support are raced against the timer and late connections closed.
+func dialTimeout(d proxy.Dialer, addr string, timeout time.Duration) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if cd, ok := d.(proxy.ContextDialer); ok {
+		return cd.DialContext(ctx, "tcp", addr)
+	}
+
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		c, err := d.Dial("tcp", addr)
+		done <- result{c, err}
+	}()
+	select {
+	case res := <-done:
+		return res.conn, res.err
+	case <-ctx.Done():
+		go func() {
+			if res := <-done; res.conn != nil {
+				res.conn.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
+
+// probeUpstream checks that target can be reached through up, the mapping
+// of user
+func probeUpstream(user string, up *Upstream, target string) error {
+	d, err := dialerFor(up, upstreamParams(user, up, nil), "")
+	if err != nil {
+		return err
+	}
+	conn, err := dialTimeout(d, target, *probeTimeout)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// exitProbe is the outcome of fetching -exit-ip-url through an upstream
+type exitProbe struct {
+	ExitIP    string  `json:"exit_ip,omitempty"`
+	LatencyMs float64 `json:"latency_ms"` // time to establish the tunnel
+	Error     string  `json:"probe_error,omitempty"`
+}
+
+// probeExitIP fetches endpoint through up, dialing exactly like proxied
+// traffic, and expects the body to be the IP address the request came from
+func probeExitIP(user string, up *Upstream, endpoint string) exitProbe {
+	var res exitProbe
+	d, err := dialerFor(up, upstreamParams(user, up, nil), "")
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	client := &http.Client{
+		Timeout: *probeTimeout,
+		Transport: &http.Transport{
+			Proxy: nil, // the upstream is the proxy
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				start := time.Now()
+				conn, err := dialTimeout(d, addr, *probeTimeout)
+				res.LatencyMs = float64(time.Since(start).Microseconds()) / 1000
+				return conn, err
+			},
+			DisableKeepAlives: true,
+		},
+	}
+	resp, err := client.Get(endpoint)
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64))
+	ip := net.ParseIP(strings.TrimSpace(string(body)))
+	switch {
+	case resp.StatusCode != http.StatusOK:
+		res.Error = "ip echo endpoint returned " + resp.Status
+	case ip == nil:
+		res.Error = fmt.Sprintf("ip echo endpoint returned %q, not an IP address", body)
+	default:
+		res.ExitIP = ip.String()
+	}
+	return res
+}
+
+// POST /upstream/test { "upstream":"socks5://host:port", "target":"host:port" }
+//
+// Dials target through the given upstream without touching any mapping.
+func testUpstreamHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeMethodNotAllowed(w)
+		return
+	}
+
+	var req struct {
+		Upstream string `json:"upstream"`
+		Target   string `json:"target"`
+	}
+	if !decodeJSON(w, r, *maxBodyBytes, &req) {
+		return
+	}
+	u, err := parseUpstream(req.Upstream)
+	if err != nil {
+		writeInvalid(w, &fieldError{"upstream", err.Error()})
+		return
+	}
+	if req.Target == "" {
+		req.Target = *probeTarget
+	}
+
+	var resp struct {
+		Success   bool    `json:"success"`
+		LatencyMs float64 `json:"latency_ms"`
+		Error     string  `json:"error,omitempty"`
+	}
+	start := time.Now()
+	err = probeUpstream("", &Upstream{Raw: req.Upstream, URL: u}, req.Target)
+	resp.LatencyMs = float64(time.Since(start).Microseconds()) / 1000
+	if err != nil {
+		resp.Error = err.Error()
+	} else {
+		resp.Success = true
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
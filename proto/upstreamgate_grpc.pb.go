@@ -0,0 +1,285 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.3.0
+// - protoc             (unknown)
+// source: upstreamgate.proto
+
+package upstreamgatepb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+const (
+	UpstreamGate_SetUpstream_FullMethodName    = "/upstreamgate.v1.UpstreamGate/SetUpstream"
+	UpstreamGate_GetUpstream_FullMethodName    = "/upstreamgate.v1.UpstreamGate/GetUpstream"
+	UpstreamGate_DeleteUpstream_FullMethodName = "/upstreamgate.v1.UpstreamGate/DeleteUpstream"
+	UpstreamGate_ListUpstreams_FullMethodName  = "/upstreamgate.v1.UpstreamGate/ListUpstreams"
+	UpstreamGate_WatchChanges_FullMethodName   = "/upstreamgate.v1.UpstreamGate/WatchChanges"
+)
+
+// UpstreamGateClient is the client API for UpstreamGate service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type UpstreamGateClient interface {
+	SetUpstream(ctx context.Context, in *SetUpstreamRequest, opts ...grpc.CallOption) (*Mapping, error)
+	GetUpstream(ctx context.Context, in *GetUpstreamRequest, opts ...grpc.CallOption) (*Mapping, error)
+	DeleteUpstream(ctx context.Context, in *DeleteUpstreamRequest, opts ...grpc.CallOption) (*DeleteUpstreamResponse, error)
+	ListUpstreams(ctx context.Context, in *ListUpstreamsRequest, opts ...grpc.CallOption) (*ListUpstreamsResponse, error)
+	WatchChanges(ctx context.Context, in *WatchChangesRequest, opts ...grpc.CallOption) (UpstreamGate_WatchChangesClient, error)
+}
+
+type upstreamGateClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewUpstreamGateClient(cc grpc.ClientConnInterface) UpstreamGateClient {
+	return &upstreamGateClient{cc}
+}
+
+func (c *upstreamGateClient) SetUpstream(ctx context.Context, in *SetUpstreamRequest, opts ...grpc.CallOption) (*Mapping, error) {
+	out := new(Mapping)
+	err := c.cc.Invoke(ctx, UpstreamGate_SetUpstream_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *upstreamGateClient) GetUpstream(ctx context.Context, in *GetUpstreamRequest, opts ...grpc.CallOption) (*Mapping, error) {
+	out := new(Mapping)
+	err := c.cc.Invoke(ctx, UpstreamGate_GetUpstream_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *upstreamGateClient) DeleteUpstream(ctx context.Context, in *DeleteUpstreamRequest, opts ...grpc.CallOption) (*DeleteUpstreamResponse, error) {
+	out := new(DeleteUpstreamResponse)
+	err := c.cc.Invoke(ctx, UpstreamGate_DeleteUpstream_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *upstreamGateClient) ListUpstreams(ctx context.Context, in *ListUpstreamsRequest, opts ...grpc.CallOption) (*ListUpstreamsResponse, error) {
+	out := new(ListUpstreamsResponse)
+	err := c.cc.Invoke(ctx, UpstreamGate_ListUpstreams_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *upstreamGateClient) WatchChanges(ctx context.Context, in *WatchChangesRequest, opts ...grpc.CallOption) (UpstreamGate_WatchChangesClient, error) {
+	stream, err := c.cc.NewStream(ctx, &UpstreamGate_ServiceDesc.Streams[0], UpstreamGate_WatchChanges_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &upstreamGateWatchChangesClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type UpstreamGate_WatchChangesClient interface {
+	Recv() (*ChangeEvent, error)
+	grpc.ClientStream
+}
+
+type upstreamGateWatchChangesClient struct {
+	grpc.ClientStream
+}
+
+func (x *upstreamGateWatchChangesClient) Recv() (*ChangeEvent, error) {
+	m := new(ChangeEvent)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// UpstreamGateServer is the server API for UpstreamGate service.
+// All implementations must embed UnimplementedUpstreamGateServer
+// for forward compatibility
+type UpstreamGateServer interface {
+	SetUpstream(context.Context, *SetUpstreamRequest) (*Mapping, error)
+	GetUpstream(context.Context, *GetUpstreamRequest) (*Mapping, error)
+	DeleteUpstream(context.Context, *DeleteUpstreamRequest) (*DeleteUpstreamResponse, error)
+	ListUpstreams(context.Context, *ListUpstreamsRequest) (*ListUpstreamsResponse, error)
+	WatchChanges(*WatchChangesRequest, UpstreamGate_WatchChangesServer) error
+	mustEmbedUnimplementedUpstreamGateServer()
+}
+
+// UnimplementedUpstreamGateServer must be embedded to have forward compatible implementations.
+type UnimplementedUpstreamGateServer struct {
+}
+
+func (UnimplementedUpstreamGateServer) SetUpstream(context.Context, *SetUpstreamRequest) (*Mapping, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SetUpstream not implemented")
+}
+func (UnimplementedUpstreamGateServer) GetUpstream(context.Context, *GetUpstreamRequest) (*Mapping, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetUpstream not implemented")
+}
+func (UnimplementedUpstreamGateServer) DeleteUpstream(context.Context, *DeleteUpstreamRequest) (*DeleteUpstreamResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method DeleteUpstream not implemented")
+}
+func (UnimplementedUpstreamGateServer) ListUpstreams(context.Context, *ListUpstreamsRequest) (*ListUpstreamsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListUpstreams not implemented")
+}
+func (UnimplementedUpstreamGateServer) WatchChanges(*WatchChangesRequest, UpstreamGate_WatchChangesServer) error {
+	return status.Errorf(codes.Unimplemented, "method WatchChanges not implemented")
+}
+func (UnimplementedUpstreamGateServer) mustEmbedUnimplementedUpstreamGateServer() {}
+
+// UnsafeUpstreamGateServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to UpstreamGateServer will
+// result in compilation errors.
+type UnsafeUpstreamGateServer interface {
+	mustEmbedUnimplementedUpstreamGateServer()
+}
+
+func RegisterUpstreamGateServer(s grpc.ServiceRegistrar, srv UpstreamGateServer) {
+	s.RegisterService(&UpstreamGate_ServiceDesc, srv)
+}
+
+func _UpstreamGate_SetUpstream_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SetUpstreamRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(UpstreamGateServer).SetUpstream(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: UpstreamGate_SetUpstream_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(UpstreamGateServer).SetUpstream(ctx, req.(*SetUpstreamRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _UpstreamGate_GetUpstream_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetUpstreamRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(UpstreamGateServer).GetUpstream(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: UpstreamGate_GetUpstream_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(UpstreamGateServer).GetUpstream(ctx, req.(*GetUpstreamRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _UpstreamGate_DeleteUpstream_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DeleteUpstreamRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(UpstreamGateServer).DeleteUpstream(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: UpstreamGate_DeleteUpstream_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(UpstreamGateServer).DeleteUpstream(ctx, req.(*DeleteUpstreamRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _UpstreamGate_ListUpstreams_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListUpstreamsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(UpstreamGateServer).ListUpstreams(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: UpstreamGate_ListUpstreams_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(UpstreamGateServer).ListUpstreams(ctx, req.(*ListUpstreamsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _UpstreamGate_WatchChanges_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchChangesRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(UpstreamGateServer).WatchChanges(m, &upstreamGateWatchChangesServer{stream})
+}
+
+type UpstreamGate_WatchChangesServer interface {
+	Send(*ChangeEvent) error
+	grpc.ServerStream
+}
+
+type upstreamGateWatchChangesServer struct {
+	grpc.ServerStream
+}
+
+func (x *upstreamGateWatchChangesServer) Send(m *ChangeEvent) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+// UpstreamGate_ServiceDesc is the grpc.ServiceDesc for UpstreamGate service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var UpstreamGate_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "upstreamgate.v1.UpstreamGate",
+	HandlerType: (*UpstreamGateServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "SetUpstream",
+			Handler:    _UpstreamGate_SetUpstream_Handler,
+		},
+		{
+			MethodName: "GetUpstream",
+			Handler:    _UpstreamGate_GetUpstream_Handler,
+		},
+		{
+			MethodName: "DeleteUpstream",
+			Handler:    _UpstreamGate_DeleteUpstream_Handler,
+		},
+		{
+			MethodName: "ListUpstreams",
+			Handler:    _UpstreamGate_ListUpstreams_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "WatchChanges",
+			Handler:       _UpstreamGate_WatchChanges_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "upstreamgate.proto",
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"flag"
+	"sync/atomic"
+)
+
+var (
+	proxyTLSCert = flag.String("tls-cert", "", "serve the proxy over TLS with this certificate file, so clients can use it as an HTTPS proxy; re-read on SIGHUP")
+	proxyTLSKey  = flag.String("tls-key", "", "private key for -tls-cert")
+	proxyTLSAddr = flag.String("tls-addr", "", "serve the TLS proxy on this address and keep -addr as plain HTTP (e.g. :8443)")
+)
+
+// proxyTLSConfig is swapped on SIGHUP like adminTLSConfig. Tunnels already
+// running keep the connection they were handshaken on.
+var proxyTLSConfig atomic.Pointer[tls.Config]
+
+func proxyTLSEnabled() bool {
+	return *proxyTLSCert != "" || *proxyTLSKey != "" || *proxyTLSAddr != ""
+}
+
+// loadProxyTLS reads the proxy certificate and key from disk
+func loadProxyTLS() error {
+	if *proxyTLSCert == "" || *proxyTLSKey == "" {
+		return errors.New("-tls-cert and -tls-key are both required")
+	}
+	cert, err := tls.LoadX509KeyPair(*proxyTLSCert, *proxyTLSKey)
+	if err != nil {
+		return err
+	}
+	proxyTLSConfig.Store(&tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+		// HTTP/2 clients carry each CONNECT as a stream; see h2inbound.go
+		NextProtos: []string{"h2", "http/1.1"},
+	})
+	return nil
+}
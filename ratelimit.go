@@ -0,0 +1,133 @@
+package main
+
+import (
+	"container/list"
+	"flag"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+var (
+	adminRate       = flag.Float64("admin-rate", 0, "control API requests per second allowed from one source IP (0 = unlimited)")
+	adminGlobalRate = flag.Float64("admin-global-rate", 0, "control API requests per second allowed in total (0 = unlimited)")
+	adminBurst      = flag.Int("admin-burst", 20, "burst size for -admin-rate and -admin-global-rate")
+)
+
+// maxRateLimiters bounds how many source IPs are tracked; the least
+// recently seen one is forgotten first
+const maxRateLimiters = 4096
+
+// adminLimiter applies token buckets per source IP and across all sources
+type adminLimiter struct {
+	global *rate.Limiter // nil when unlimited
+
+	perIP rate.Limit // 0 when unlimited
+	burst int
+
+	mu    sync.Mutex
+	lru   *list.List // of *ipLimiter, most recent first
+	byKey map[string]*list.Element
+}
+
+type ipLimiter struct {
+	key string
+	*rate.Limiter
+}
+
+func newAdminLimiter(perIP, global float64, burst int) *adminLimiter {
+	l := &adminLimiter{
+		perIP: rate.Limit(perIP),
+		burst: max(burst, 1),
+		lru:   list.New(),
+		byKey: map[string]*list.Element{},
+	}
+	if global > 0 {
+		l.global = rate.NewLimiter(rate.Limit(global), l.burst)
+	}
+	return l
+}
+
+// limiterFor returns the bucket for key, creating it and evicting the
+// least recently seen one if needed
+func (l *adminLimiter) limiterFor(key string) *rate.Limiter {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if e, ok := l.byKey[key]; ok {
+		l.lru.MoveToFront(e)
+		return e.Value.(*ipLimiter).Limiter
+	}
+	if l.lru.Len() >= maxRateLimiters {
+		oldest := l.lru.Back()
+		l.lru.Remove(oldest)
+		delete(l.byKey, oldest.Value.(*ipLimiter).key)
+	}
+	lim := &ipLimiter{key, rate.NewLimiter(l.perIP, l.burst)}
+	l.byKey[key] = l.lru.PushFront(lim)
+	return lim.Limiter
+}
+
+// allow takes a token from the bucket of the caller at ip and the global
+// one, or reports how long to wait before retrying
+func (l *adminLimiter) allow(ip string) (bool, time.Duration) {
+	now := time.Now()
+	var own *rate.Reservation
+	if l.perIP > 0 {
+		own = l.limiterFor(ip).ReserveN(now, 1)
+		if d := own.DelayFrom(now); d > 0 {
+			own.CancelAt(now)
+			return false, d
+		}
+	}
+	if l.global != nil {
+		g := l.global.ReserveN(now, 1)
+		if d := g.DelayFrom(now); d > 0 {
+			g.CancelAt(now)
+			if own != nil {
+				own.CancelAt(now)
+			}
+			return false, d
+		}
+	}
+	return true, 0
+}
+
+// helper to get the IP part of a request's remote address
+func sourceIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// adminLimits is the limiter shared by the HTTP and gRPC control APIs, so
+// a caller can't double its rate by using both; nil when unlimited
+var adminLimits = sync.OnceValue(func() *adminLimiter {
+	if *adminRate <= 0 && *adminGlobalRate <= 0 {
+		return nil
+	}
+	return newAdminLimiter(*adminRate, *adminGlobalRate, *adminBurst)
+})
+
+// rateLimitAdmin answers 429 once a caller exceeds -admin-rate or all
+// callers together exceed -admin-global-rate
+func rateLimitAdmin(next http.Handler) http.Handler {
+	l := adminLimits()
+	if l == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ok, wait := l.allow(sourceIP(r)); !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			writeError(w, http.StatusTooManyRequests, "rate_limited", "too many requests")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+var reloadMu sync.Mutex // one reload at a time
+
+type reloadResult struct {
+	Source  string   `json:"source"`
+	Changed []string `json:"changed"`
+	Removed []string `json:"removed"`
+}
+
+// reload re-reads the config file, or the state file when no config is in
+// use, and applies the difference to the live table. Only users whose
+// upstream actually changed have their connections closed. On error the
+// running state is left untouched.
+func reload() (*reloadResult, error) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	var (
+		res     = &reloadResult{Changed: []string{}, Removed: []string{}}
+		set     = map[string]*Upstream{}
+		removed []string
+	)
+
+	upstreamsMu.RLock()
+	live := make(map[string]*Upstream, len(upstreams))
+	for user, up := range upstreams {
+		live[user] = up
+	}
+	upstreamsMu.RUnlock()
+
+	switch {
+	case *configPath != "":
+		cfg, err := loadConfig(*configPath)
+		if err != nil {
+			return nil, err
+		}
+		res.Source = *configPath
+
+		// only entries that changed in the file are applied, so runtime
+		// overrides of untouched entries survive a reload
+		prev := loadedConfigUsers()
+		for user, up := range cfg.upstreams {
+			if prev[user] == cfg.entry(user) {
+				continue
+			}
+			if cur, ok := live[user]; ok && cur.Raw == up.Raw && hashMatches(cur.PasswordHash, cfg.passwords[user]) &&
+				(cur.DigestSHA256 != "" || cur.PasswordHash == "" || !*proxyDigest) {
+				continue
+			}
+			if err := cfg.hashPassword(user, up); err != nil {
+				return nil, err
+			}
+			up.keepAllowedIPs = true // the file has no allowlists; keep the runtime one
+			set[user] = up
+		}
+		for user, e := range prev {
+			if _, ok := cfg.upstreams[user]; ok {
+				continue
+			}
+			if cur, ok := live[user]; ok && cur.Raw == e.raw {
+				removed = append(removed, user)
+			}
+		}
+
+		rememberConfigUsers(cfg)
+
+	case *stateFile != "":
+		// changes still inside the save debounce would otherwise be undone
+		flushStateSave()
+		loaded, err := readState()
+		if err != nil {
+			return nil, err
+		}
+		res.Source = *stateFile
+		for user, up := range loaded {
+			if !sameUpstream(live[user], up) {
+				set[user] = up
+			}
+		}
+		for user := range live {
+			if _, ok := loaded[user]; !ok {
+				removed = append(removed, user)
+			}
+		}
+
+	default:
+		return nil, errors.New("no -config or -state-file to reload")
+	}
+
+	if len(set) > 0 {
+		if err := putUpstreams(changeSource{Actor: "reload"}, set); err != nil {
+			return nil, err
+		}
+	}
+	for user := range set {
+		res.Changed = append(res.Changed, user)
+	}
+	for _, user := range removed {
+		if _, err := removeUpstream(changeSource{Actor: "reload"}, user); err != nil {
+			log.Printf("reload: removing %q failed: %v", user, err)
+			continue
+		}
+		res.Removed = append(res.Removed, user)
+	}
+	return res, nil
+}
+
+// watchReloadSignal reloads mappings and TLS certificates on every SIGHUP
+func watchReloadSignal() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		if adminTLSEnabled() {
+			if err := loadAdminTLS(); err != nil {
+				log.Printf("reload: admin TLS: keeping current certificates: %v", err)
+			} else {
+				log.Printf("reload: admin TLS certificates reloaded")
+			}
+		}
+		if proxyTLSEnabled() {
+			if err := loadProxyTLS(); err != nil {
+				log.Printf("reload: proxy TLS: keeping current certificates: %v", err)
+			} else {
+				log.Printf("reload: proxy TLS certificates reloaded")
+			}
+		}
+		if *htpasswdPath != "" {
+			reloadHtpasswd()
+		}
+		reloadUpstreamCAs()
+		if *configPath == "" && *stateFile == "" && (adminTLSEnabled() || proxyTLSEnabled() || *htpasswdPath != "") {
+			continue // nothing else to reload
+		}
+		res, err := reload()
+		if err != nil {
+			log.Printf("reload: failed, keeping current state: %v", err)
+			continue
+		}
+		log.Printf("reload: %s: %d changed, %d removed", res.Source, len(res.Changed), len(res.Removed))
+	}
+}
+
+// POST /reload
+func reloadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeMethodNotAllowed(w)
+		return
+	}
+	res, err := reload()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "reload_failed", "reload failed: "+err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, res)
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"net"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+var socks5ResolveLocal = flag.Bool("socks5-resolve-local", false, "resolve destinations of socks5:// and socks5+tls:// upstreams locally and send the upstream an IP address; socks5h:// always sends the host name")
+
+// resolveTimeout bounds resolving a destination before dialing an upstream
+const resolveTimeout = 10 * time.Second
+
+// resolveHost looks host up with the local resolver; network is "ip" or "ip4"
+func resolveHost(network, host string) (net.IP, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), resolveTimeout)
+	defer cancel()
+	ips, err := net.DefaultResolver.LookupIP(ctx, network, host)
+	if err != nil {
+		return nil, err
+	}
+	return ips[0], nil
+}
+
+// localResolveDialer resolves host names before handing the address to an
+// upstream dialer that would otherwise pass them through
+type localResolveDialer struct {
+	proxy.Dialer
+}
+
+func (d localResolveDialer) Dial(network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if net.ParseIP(host) == nil {
+		ip, err := resolveHost("ip", host)
+		if err != nil {
+			return nil, err
+		}
+		addr = net.JoinHostPort(ip.String(), port)
+	}
+	return d.Dialer.Dial(network, addr)
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// socks5Request is what a fake SOCKS5 server was asked to connect to
+type socks5Request struct {
+	user, password string
+	addrType       byte // 1 IPv4, 3 name, 4 IPv6
+	host           string
+	port           uint16
+}
+
+// fakeSOCKS5 is a SOCKS5 server that records each CONNECT, then connects to
+// the destination and relays. With a user set it requires that login.
+type fakeSOCKS5 struct {
+	addr           string
+	user, password string
+
+	mu       sync.Mutex
+	requests []socks5Request
+}
+
+func startFakeSOCKS5(t *testing.T, user, password string) *fakeSOCKS5 {
+	t.Helper()
+	return startFakeSOCKS5On(t, "127.0.0.1:0", user, password)
+}
+
+// startFakeSOCKS5On is startFakeSOCKS5 listening on addr
+func startFakeSOCKS5On(t *testing.T, addr, user, password string) *fakeSOCKS5 {
+	t.Helper()
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return serveFakeSOCKS5(t, ln, user, password)
+}
+
+// serveFakeSOCKS5 is startFakeSOCKS5 on ln, which is closed when the test ends
+func serveFakeSOCKS5(t *testing.T, ln net.Listener, user, password string) *fakeSOCKS5 {
+	t.Cleanup(func() { ln.Close() })
+	s := &fakeSOCKS5{addr: ln.Addr().String(), user: user, password: password}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *fakeSOCKS5) serve(conn net.Conn) {
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+	var head [2]byte
+	if _, err := io.ReadFull(br, head[:]); err != nil || head[0] != 5 {
+		return
+	}
+	methods := make([]byte, head[1])
+	if _, err := io.ReadFull(br, methods); err != nil {
+		return
+	}
+	var req socks5Request
+	if s.user == "" {
+		conn.Write([]byte{5, 0})
+	} else {
+		conn.Write([]byte{5, 2})
+		field := func() string {
+			n, _ := br.ReadByte()
+			b := make([]byte, n)
+			io.ReadFull(br, b)
+			return string(b)
+		}
+		br.ReadByte() // version
+		req.user, req.password = field(), field()
+		if req.user != s.user || req.password != s.password {
+			conn.Write([]byte{1, 1})
+			return
+		}
+		conn.Write([]byte{1, 0})
+	}
+
+	var rh [4]byte
+	if _, err := io.ReadFull(br, rh[:]); err != nil || rh[1] != 1 {
+		return
+	}
+	req.addrType = rh[3]
+	switch rh[3] {
+	case 1, 4:
+		ip := make([]byte, 4)
+		if rh[3] == 4 {
+			ip = make([]byte, 16)
+		}
+		io.ReadFull(br, ip)
+		addr, _ := netip.AddrFromSlice(ip)
+		req.host = addr.String()
+	case 3:
+		n, _ := br.ReadByte()
+		name := make([]byte, n)
+		io.ReadFull(br, name)
+		req.host = string(name)
+	default:
+		return
+	}
+	var port [2]byte
+	io.ReadFull(br, port[:])
+	req.port = binary.BigEndian.Uint16(port[:])
+	s.mu.Lock()
+	s.requests = append(s.requests, req)
+	s.mu.Unlock()
+
+	target, err := net.Dial("tcp", net.JoinHostPort(req.host, strconv.Itoa(int(req.port))))
+	if err != nil {
+		conn.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+	relay(&bufferedConn{conn, br}, target)
+}
+
+func (s *fakeSOCKS5) lastRequest(t *testing.T) socks5Request {
+	t.Helper()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.requests) == 0 {
+		t.Fatal("the socks5 upstream got no request")
+	}
+	return s.requests[len(s.requests)-1]
+}
+
+func TestSOCKS5Resolution(t *testing.T) {
+	echo := startEchoServer(t)
+	_, port, _ := net.SplitHostPort(echo)
+	byName := net.JoinHostPort("localhost", port)
+	proxyAddr := startProxy(t)
+	defer func(local bool) { *socks5ResolveLocal = local }(*socks5ResolveLocal)
+
+	for _, tt := range []struct {
+		name         string
+		scheme       string
+		resolveLocal bool
+		target       string
+		addrType     byte
+		host         string
+	}{
+		{"socks5 sends names by default", "socks5", false, byName, 3, "localhost"},
+		{"socks5 resolves with -socks5-resolve-local", "socks5", true, byName, 1, "127.0.0.1"},
+		{"socks5h sends names", "socks5h", false, byName, 3, "localhost"},
+		{"socks5h ignores -socks5-resolve-local", "socks5h", true, byName, 3, "localhost"},
+		{"socks5 sends IPs as they are", "socks5", true, echo, 1, "127.0.0.1"},
+		{"socks5h sends IPs as they are", "socks5h", true, echo, 1, "127.0.0.1"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			*socks5ResolveLocal = tt.resolveLocal
+			upstream := startFakeSOCKS5(t, "up", "pw")
+			setTestMapping(t, "alice", tt.scheme+"://up:pw@"+upstream.addr, "")
+
+			resp, conn := dialConnect(t, proxyAddr, tt.target, basicAuth("alice", "x"))
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("status = %d, want 200", resp.StatusCode)
+			}
+			expectEcho(t, conn, "via "+tt.scheme)
+			req := upstream.lastRequest(t)
+			if req.addrType != tt.addrType || req.host != tt.host || strconv.Itoa(int(req.port)) != port {
+				t.Errorf("upstream got type %d %s:%d, want type %d %s:%s", req.addrType, req.host, req.port, tt.addrType, tt.host, port)
+			}
+		})
+	}
+}
+
+// A name that doesn't resolve locally fails with 502, and the upstream never
+// sees the request
+func TestSOCKS5ResolveLocalFailure(t *testing.T) {
+	defer func(local bool) { *socks5ResolveLocal = local }(*socks5ResolveLocal)
+	*socks5ResolveLocal = true
+	proxyAddr := startProxy(t)
+	upstream := startFakeSOCKS5(t, "", "")
+	setTestMapping(t, "alice", "socks5://"+upstream.addr, "")
+
+	resp, _ := dialConnect(t, proxyAddr, "no-such-host.invalid:443", basicAuth("alice", "x"))
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("status = %d, want 502", resp.StatusCode)
+	}
+	upstream.mu.Lock()
+	defer upstream.mu.Unlock()
+	if len(upstream.requests) != 0 {
+		t.Errorf("upstream got %+v", upstream.requests)
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+)
+
+// A mapping's routes send some CONNECT targets through other upstreams.
+// Rules are tried in order and the first match wins; targets matching none
+// use the mapping's own upstream. A rule matches
+//
+//	host.example       that host
+//	*.example          any host under example, but not example itself
+//	10.0.0.0/8         IP literals in the prefix; a bare address is a /32 or /128
+//
+// Rules are parsed when the mapping is set, so picking one is a scan
+// without allocations.
+
+// maxUpstreamRoutes bounds the rules of a mapping
+const maxUpstreamRoutes = 64
+
+// routeSpec is a rule as given to the control API and stored
+type routeSpec struct {
+	Match    string `json:"match"`
+	Upstream string `json:"upstream"`
+}
+
+// upstreamRoute is a parsed rule. Its upstream only has Raw and URL set:
+// headers, TLS settings and the rest of the mapping apply to the mapping's
+// own upstream.
+type upstreamRoute struct {
+	spec   routeSpec
+	up     *Upstream
+	host   string // exact host, lower case
+	suffix string // ".example" for *.example
+	prefix netip.Prefix
+}
+
+// helper to apply the optional routes of a set request
+func setUpstreamRoutes(up *Upstream, specs []routeSpec) error {
+	if len(specs) == 0 {
+		return nil
+	}
+	if len(specs) > maxUpstreamRoutes {
+		return &fieldError{"routes", fmt.Sprintf("at most %d routes allowed", maxUpstreamRoutes)}
+	}
+	routes := make([]upstreamRoute, 0, len(specs))
+	for i, spec := range specs {
+		r, err := parseRoute(spec)
+		if err != nil {
+			return &fieldError{"routes", fmt.Sprintf("route %d: %v", i+1, err)}
+		}
+		routes = append(routes, r)
+	}
+	up.Routes = routes
+	return nil
+}
+
+func parseRoute(spec routeSpec) (upstreamRoute, error) {
+	r := upstreamRoute{spec: spec}
+	match := strings.ToLower(strings.TrimSuffix(spec.Match, "."))
+	switch {
+	case match == "":
+		return r, fmt.Errorf("match is missing")
+	case strings.Contains(match, "/"):
+		p, err := netip.ParsePrefix(match)
+		if err != nil {
+			return r, fmt.Errorf("match %q is not a valid CIDR prefix", spec.Match)
+		}
+		r.prefix = p.Masked()
+	case strings.HasPrefix(match, "*."):
+		r.suffix = match[1:]
+		if !validRouteHost(r.suffix[1:]) {
+			return r, fmt.Errorf("match %q is not a valid wildcard", spec.Match)
+		}
+	default:
+		if ip, err := netip.ParseAddr(strings.TrimSuffix(strings.TrimPrefix(match, "["), "]")); err == nil {
+			r.prefix = netip.PrefixFrom(ip.WithZone(""), ip.BitLen())
+			break
+		}
+		if !validRouteHost(match) {
+			return r, fmt.Errorf("match %q is not a host, *.suffix or CIDR prefix", spec.Match)
+		}
+		r.host = match
+	}
+	u, err := parseUpstream(spec.Upstream)
+	if err != nil {
+		return r, fmt.Errorf("upstream: %v", err)
+	}
+	r.up = &Upstream{Raw: spec.Upstream, URL: u}
+	return r, nil
+}
+
+func validRouteHost(host string) bool {
+	return host != "" && len(host) <= 253 && !strings.ContainsAny(host, "*:/[] ")
+}
+
+// route returns the upstream a tunnel to target goes through: the first
+// matching rule's, or up itself
+func (up *Upstream) route(target string) *Upstream {
+	if len(up.Routes) == 0 {
+		return up
+	}
+	host, _, err := net.SplitHostPort(target)
+	if err != nil {
+		return up
+	}
+	host = strings.TrimSuffix(host, ".")
+	ip, ipErr := netip.ParseAddr(host)
+	if ipErr == nil {
+		ip = ip.WithZone("").Unmap()
+	}
+	for i := range up.Routes {
+		r := &up.Routes[i]
+		switch {
+		case r.prefix.IsValid():
+			if ipErr == nil && r.prefix.Contains(ip) {
+				return r.up
+			}
+		case ipErr == nil:
+		case r.suffix != "":
+			if len(host) > len(r.suffix) && strings.EqualFold(host[len(host)-len(r.suffix):], r.suffix) {
+				return r.up
+			}
+		case strings.EqualFold(host, r.host):
+			return r.up
+		}
+	}
+	return up
+}
+
+// routeSpecs lists the rules of up as they were given
+func (up *Upstream) routeSpecs() []routeSpec {
+	if len(up.Routes) == 0 {
+		return nil
+	}
+	specs := make([]routeSpec, len(up.Routes))
+	for i, r := range up.Routes {
+		specs[i] = r.spec
+	}
+	return specs
+}
+
+func sameRoutes(a, b []upstreamRoute) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].spec != b[i].spec {
+			return false
+		}
+	}
+	return true
+}
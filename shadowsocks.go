@@ -0,0 +1,315 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/net/proxy"
+)
+
+// ssCipher is a Shadowsocks AEAD method. Each direction of a connection
+// starts with a random salt of keySize bytes, from which the session key is
+// derived.
+type ssCipher interface {
+	keySize() int
+	aead(key []byte) (cipher.AEAD, error)
+}
+
+// ssCiphers are the methods ss:// upstreams may use
+var ssCiphers = map[string]ssCipher{
+	"aes-256-gcm":            ssAEAD{32, newGCM},
+	"chacha20-ietf-poly1305": ssAEAD{32, chacha20poly1305.New},
+}
+
+type ssAEAD struct {
+	size    int
+	newAEAD func(key []byte) (cipher.AEAD, error)
+}
+
+func (c ssAEAD) keySize() int                         { return c.size }
+func (c ssAEAD) aead(key []byte) (cipher.AEAD, error) { return c.newAEAD(key) }
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	b, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(b)
+}
+
+const (
+	// ssMaxPayload is the largest payload of one chunk
+	ssMaxPayload       = 0x3fff
+	ssHandshakeTimeout = 10 * time.Second
+)
+
+// errSSAuth is a reply that doesn't decrypt, which is what a wrong password
+// or method looks like from this side. It can only show up once the tunnel
+// is open and the client already has its 200; see ssDialer.Dial.
+var errSSAuth = errors.New("shadowsocks upstream reply failed authentication after the tunnel was opened (wrong password or method?)")
+
+// normalizeSSUpstream accepts both SIP002 forms, ss://method:password@ and
+// ss://base64url(method:password)@, and rewrites u to the first so the
+// password is masked wherever the URL is shown
+func normalizeSSUpstream(u *url.URL) error {
+	if u.User == nil {
+		return errors.New("shadowsocks upstream needs a method and password, e.g. ss://aes-256-gcm:secret@host:8388")
+	}
+	if u.Query().Has("plugin") {
+		return errors.New("shadowsocks plugins are not supported")
+	}
+	method, password, ok := u.User.Username(), "", false
+	if password, ok = u.User.Password(); !ok {
+		b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(method, "="))
+		if err != nil {
+			return errors.New("shadowsocks user info is neither method:password nor base64 of it")
+		}
+		if method, password, ok = strings.Cut(string(b), ":"); !ok {
+			return errors.New("shadowsocks user info is missing the password")
+		}
+	}
+	method = strings.ToLower(method)
+	if ssCiphers[method] == nil {
+		return fmt.Errorf("unsupported shadowsocks method %q, want %s", method, strings.Join(ssMethods(), " or "))
+	}
+	if password == "" {
+		return errors.New("shadowsocks upstream needs a password")
+	}
+	u.User = url.UserPassword(method, password)
+	return nil
+}
+
+// helper to list the supported methods for error messages
+func ssMethods() []string {
+	var out []string
+	for m := range ssCiphers {
+		out = append(out, m)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// ssDialer implements proxy.Dialer for Shadowsocks upstreams
+type ssDialer struct {
+	upstreamURL *url.URL
+	forward     proxy.Dialer
+	cipher      ssCipher
+	key         []byte // derived from the password
+}
+
+func newSSDialer(u *url.URL, forward proxy.Dialer) (*ssDialer, error) {
+	c := ssCiphers[strings.ToLower(u.User.Username())]
+	if c == nil {
+		return nil, fmt.Errorf("unsupported shadowsocks method %q", u.User.Username())
+	}
+	pwd, _ := u.User.Password()
+	return &ssDialer{upstreamURL: u, forward: forward, cipher: c, key: ssPasswordKey(pwd, c.keySize())}, nil
+}
+
+// Dial connects to the server and sends the destination. Shadowsocks has no
+// reply to a connect: the server answers only with data from the
+// destination, and most servers silently drop a connection they can't
+// decrypt. Waiting for that reply here would hang every protocol where the
+// client speaks first, so a wrong password or method isn't a dial error. It
+// shows up later, as a tunnel that closes without data or as errSSAuth on
+// the first read.
+func (d *ssDialer) Dial(network, addr string) (net.Conn, error) {
+	header, err := ssAddress(addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := d.forward.Dial("tcp", d.upstreamURL.Host)
+	if err != nil {
+		return nil, err
+	}
+	c := &ssConn{Conn: conn, cipher: d.cipher, key: d.key, upstream: d.upstreamURL.Redacted()}
+	conn.SetDeadline(time.Now().Add(ssHandshakeTimeout))
+	if _, err := c.Write(header); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return c, nil
+}
+
+// helper to encode addr the way SOCKS5 does, which is what Shadowsocks
+// expects in front of the first payload
+func ssAddress(addr string) ([]byte, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("bad port %q", portStr)
+	}
+	var b []byte
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return nil, errors.New("host name too long for shadowsocks")
+		}
+		b = append([]byte{3, byte(len(host))}, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		b = append([]byte{1}, ip4...)
+	} else {
+		b = append([]byte{4}, ip...)
+	}
+	return binary.BigEndian.AppendUint16(b, uint16(port)), nil
+}
+
+// ssPasswordKey derives the master key from a password like OpenSSL's
+// EVP_BytesToKey with MD5, as every Shadowsocks implementation does
+func ssPasswordKey(password string, size int) []byte {
+	var key, prev []byte
+	for len(key) < size {
+		h := md5.New()
+		h.Write(prev)
+		h.Write([]byte(password))
+		prev = h.Sum(nil)
+		key = append(key, prev...)
+	}
+	return key[:size]
+}
+
+// helper to derive the session AEAD of one direction from its salt
+func ssSession(c ssCipher, key, salt []byte) (cipher.AEAD, error) {
+	sub := make([]byte, c.keySize())
+	if _, err := io.ReadFull(hkdf.New(sha1.New, key, salt, []byte("ss-subkey")), sub); err != nil {
+		return nil, err
+	}
+	return c.aead(sub)
+}
+
+// ssConn frames a connection into Shadowsocks AEAD chunks: an encrypted
+// two-byte length followed by the encrypted payload, each with its own tag
+type ssConn struct {
+	net.Conn
+	cipher   ssCipher
+	key      []byte
+	upstream string // redacted, for the log
+
+	enc, dec           cipher.AEAD // nil until the salt of that direction
+	encNonce, decNonce []byte
+	pending            []byte // decrypted but not yet read
+}
+
+func (c *ssConn) Write(p []byte) (int, error) {
+	var buf []byte
+	if c.enc == nil {
+		salt := make([]byte, c.cipher.keySize())
+		if _, err := rand.Read(salt); err != nil {
+			return 0, err
+		}
+		aead, err := ssSession(c.cipher, c.key, salt)
+		if err != nil {
+			return 0, err
+		}
+		c.enc, c.encNonce = aead, make([]byte, aead.NonceSize())
+		buf = salt
+	}
+	written := 0
+	for len(p) > 0 {
+		n := min(len(p), ssMaxPayload)
+		buf = c.seal(buf, binary.BigEndian.AppendUint16(nil, uint16(n)))
+		buf = c.seal(buf, p[:n])
+		if _, err := c.Conn.Write(buf); err != nil {
+			return written, err
+		}
+		written += n
+		p = p[n:]
+		buf = buf[:0]
+	}
+	return written, nil
+}
+
+// helper to append the sealed plaintext to buf and advance the nonce
+func (c *ssConn) seal(buf, plaintext []byte) []byte {
+	buf = c.enc.Seal(buf, c.encNonce, plaintext, nil)
+	ssNextNonce(c.encNonce)
+	return buf
+}
+
+func (c *ssConn) Read(p []byte) (int, error) {
+	if len(c.pending) == 0 {
+		if err := c.readChunk(); err != nil {
+			if err == errSSAuth {
+				log.Printf("upstream %s: %v", c.upstream, err)
+			}
+			return 0, err
+		}
+	}
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// helper to read and decrypt the next chunk into c.pending
+func (c *ssConn) readChunk() error {
+	if c.dec == nil {
+		salt := make([]byte, c.cipher.keySize())
+		if _, err := io.ReadFull(c.Conn, salt); err != nil {
+			return err
+		}
+		aead, err := ssSession(c.cipher, c.key, salt)
+		if err != nil {
+			return err
+		}
+		c.dec, c.decNonce = aead, make([]byte, aead.NonceSize())
+	}
+	overhead := c.dec.Overhead()
+	buf := make([]byte, 2+overhead)
+	if _, err := io.ReadFull(c.Conn, buf); err != nil {
+		return err
+	}
+	size, err := c.open(buf)
+	if err != nil {
+		return err
+	}
+	n := int(binary.BigEndian.Uint16(size) & ssMaxPayload)
+	buf = make([]byte, n+overhead)
+	if _, err := io.ReadFull(c.Conn, buf); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	c.pending, err = c.open(buf)
+	return err
+}
+
+// helper to decrypt one sealed part of a chunk in place and advance the nonce
+func (c *ssConn) open(sealed []byte) ([]byte, error) {
+	out, err := c.dec.Open(sealed[:0], c.decNonce, sealed, nil)
+	if err != nil {
+		return nil, errSSAuth
+	}
+	ssNextNonce(c.decNonce)
+	return out, nil
+}
+
+// helper to increment a little-endian nonce
+func ssNextNonce(n []byte) {
+	for i := range n {
+		n[i]++
+		if n[i] != 0 {
+			return
+		}
+	}
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// fakeSS is a Shadowsocks AEAD server with its own framing, so the tests
+// don't check ssConn against itself. It records each destination and drops
+// connections it can't decrypt, as real servers do. With replyPassword set
+// it answers under that password instead, like a server with another key.
+type fakeSS struct {
+	addr                    string
+	method                  string
+	password, replyPassword string
+
+	mu        sync.Mutex
+	targets   []string
+	undecoded int // connections dropped because they didn't decrypt
+}
+
+func startFakeSS(t *testing.T, method, password, replyPassword string) *fakeSS {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	s := &fakeSS{addr: ln.Addr().String(), method: method, password: password, replyPassword: replyPassword}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+// ssStream is one direction of a fake server connection
+type ssStream struct {
+	aead  cipher.AEAD
+	nonce uint64
+}
+
+// helper to derive a direction's AEAD from the password and salt, spelled
+// out from SIP004 rather than calling ssSession
+func newSSStream(method, password string, salt []byte) (*ssStream, error) {
+	c := ssCiphers[method]
+	sub := make([]byte, c.keySize())
+	r := hkdf.New(sha1.New, ssPasswordKey(password, c.keySize()), salt, []byte("ss-subkey"))
+	if _, err := io.ReadFull(r, sub); err != nil {
+		return nil, err
+	}
+	aead, err := c.aead(sub)
+	return &ssStream{aead: aead}, err
+}
+
+func (s *ssStream) nextNonce() []byte {
+	n := make([]byte, s.aead.NonceSize())
+	binary.LittleEndian.PutUint64(n, s.nonce)
+	s.nonce++
+	return n
+}
+
+func (s *ssStream) readChunk(r io.Reader) ([]byte, error) {
+	size := make([]byte, 2+s.aead.Overhead())
+	if _, err := io.ReadFull(r, size); err != nil {
+		return nil, err
+	}
+	size, err := s.aead.Open(size[:0], s.nextNonce(), size, nil)
+	if err != nil {
+		return nil, err
+	}
+	payload := make([]byte, int(binary.BigEndian.Uint16(size))+s.aead.Overhead())
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+	return s.aead.Open(payload[:0], s.nextNonce(), payload, nil)
+}
+
+func (s *ssStream) writeChunk(w io.Writer, p []byte) error {
+	buf := s.aead.Seal(nil, s.nextNonce(), binary.BigEndian.AppendUint16(nil, uint16(len(p))), nil)
+	_, err := w.Write(s.aead.Seal(buf, s.nextNonce(), p, nil))
+	return err
+}
+
+func (s *fakeSS) serve(conn net.Conn) {
+	defer conn.Close()
+	keySize := ssCiphers[s.method].keySize()
+	salt := make([]byte, keySize)
+	if _, err := io.ReadFull(conn, salt); err != nil {
+		return
+	}
+	in, _ := newSSStream(s.method, s.password, salt)
+	header, err := in.readChunk(conn)
+	if err != nil {
+		s.mu.Lock()
+		s.undecoded++
+		s.mu.Unlock()
+		return
+	}
+	target, err := parseSSAddress(header)
+	if err != nil {
+		return
+	}
+	s.mu.Lock()
+	s.targets = append(s.targets, target)
+	s.mu.Unlock()
+
+	dest, err := net.Dial("tcp", target)
+	if err != nil {
+		return
+	}
+	defer dest.Close()
+	replyPassword := s.password
+	if s.replyPassword != "" {
+		replyPassword = s.replyPassword
+	}
+	rand.Read(salt)
+	out, _ := newSSStream(s.method, replyPassword, salt)
+	if _, err := conn.Write(salt); err != nil {
+		return
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			p, err := in.readChunk(conn)
+			if err != nil {
+				dest.Close()
+				return
+			}
+			dest.Write(p)
+		}
+	}()
+	buf := make([]byte, ssMaxPayload)
+	for {
+		n, err := dest.Read(buf)
+		if n > 0 && out.writeChunk(conn, buf[:n]) != nil {
+			break
+		}
+		if err != nil {
+			break
+		}
+	}
+	conn.Close()
+	<-done
+}
+
+// helper to decode the SOCKS5-style address that starts a connection
+func parseSSAddress(b []byte) (string, error) {
+	if len(b) < 1 {
+		return "", errors.New("empty header")
+	}
+	var host string
+	switch b[0] {
+	case 1:
+		host, b = net.IP(b[1:5]).String(), b[5:]
+	case 3:
+		host, b = string(b[2:2+b[1]]), b[2+b[1]:]
+	case 4:
+		host, b = net.IP(b[1:17]).String(), b[17:]
+	default:
+		return "", errors.New("bad address type")
+	}
+	if len(b) != 2 {
+		return "", errors.New("data after the address")
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(b)))), nil
+}
+
+func TestShadowsocksUpstream(t *testing.T) {
+	echo := startEchoServer(t)
+	_, port, _ := net.SplitHostPort(echo)
+	proxyAddr := startProxy(t)
+	// more than one chunk each way
+	long := strings.Repeat("0123456789", 4000)
+
+	for _, tt := range []struct {
+		name, method string
+		userinfo     func(method string) string
+		target       string
+	}{
+		{"aes-256-gcm to an IP", "aes-256-gcm", plainSSUser, echo},
+		{"chacha20 to a name", "chacha20-ietf-poly1305", plainSSUser, net.JoinHostPort("localhost", port)},
+		{"base64 user info", "chacha20-ietf-poly1305", base64SSUser, echo},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream := startFakeSS(t, tt.method, "correct horse", "")
+			up := setTestMapping(t, "alice", "ss://"+tt.userinfo(tt.method)+"@"+upstream.addr, "")
+			if want := "ss://" + tt.method + ":xxxxx@" + upstream.addr; up.URL.Redacted() != want {
+				t.Errorf("mapping shown as %s, want %s", up.URL.Redacted(), want)
+			}
+
+			resp, conn := dialConnect(t, proxyAddr, tt.target, basicAuth("alice", "x"))
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("status = %d, want 200", resp.StatusCode)
+			}
+			expectEcho(t, conn, "hello")
+			expectEcho(t, conn, long)
+
+			upstream.mu.Lock()
+			defer upstream.mu.Unlock()
+			if len(upstream.targets) != 1 || upstream.targets[0] != tt.target {
+				t.Errorf("server was asked for %q, want %s", upstream.targets, tt.target)
+			}
+		})
+	}
+}
+
+func plainSSUser(method string) string { return method + ":" + url.PathEscape("correct horse") }
+
+func base64SSUser(method string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(method + ":correct horse"))
+}
+
+// A wrong password or method can't fail the CONNECT, which is documented;
+// the tunnel closes without data, or logs errSSAuth when a reply arrives
+func TestShadowsocksWrongKey(t *testing.T) {
+	echo := startEchoServer(t)
+	proxyAddr := startProxy(t)
+	logs := captureLog(t)
+
+	// expectClosed sends data through the tunnel and wants it closed
+	// without an answer, which may show as a reset since what was sent is
+	// never read
+	expectClosed := func(t *testing.T, conn net.Conn) {
+		t.Helper()
+		conn.Write([]byte("hello"))
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, err := conn.Read(make([]byte, 16))
+		if ne, ok := err.(net.Error); n > 0 || err == nil || ok && ne.Timeout() {
+			t.Errorf("read %d bytes, err %v, want the tunnel closed", n, err)
+		}
+	}
+
+	for _, tt := range []struct {
+		name, method, password string
+	}{
+		{"wrong password", "aes-256-gcm", "wrong"},
+		{"wrong method", "chacha20-ietf-poly1305", "correct horse"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream := startFakeSS(t, "aes-256-gcm", "correct horse", "")
+			setTestMapping(t, "alice", "ss://"+tt.method+":"+url.PathEscape(tt.password)+"@"+upstream.addr, "")
+
+			resp, conn := dialConnect(t, proxyAddr, echo, basicAuth("alice", "x"))
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("status = %d, want 200", resp.StatusCode)
+			}
+			expectClosed(t, conn)
+			upstream.mu.Lock()
+			defer upstream.mu.Unlock()
+			if upstream.undecoded != 1 || len(upstream.targets) != 0 {
+				t.Errorf("server dropped %d connections and connected to %q, want the one dropped", upstream.undecoded, upstream.targets)
+			}
+		})
+	}
+
+	t.Run("reply under another key", func(t *testing.T) {
+		upstream := startFakeSS(t, "aes-256-gcm", "correct horse", "something else")
+		setTestMapping(t, "alice", "ss://aes-256-gcm:"+url.PathEscape("correct horse")+"@"+upstream.addr, "")
+
+		resp, conn := dialConnect(t, proxyAddr, echo, basicAuth("alice", "x"))
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("status = %d, want 200", resp.StatusCode)
+		}
+		expectClosed(t, conn)
+		logs.waitFor(t, "upstream ss://aes-256-gcm:xxxxx@"+upstream.addr+": "+errSSAuth.Error())
+	})
+}
+
+// ssPasswordKey must match EVP_BytesToKey, or no real server can talk to us
+func TestSSPasswordKey(t *testing.T) {
+	want := "b3adc47839e047eb228870526dc8fc30b347287ffca3045dcea06b3fdf090acb"
+	if got := hex.EncodeToString(ssPasswordKey("barfoo!", 32)); got != want {
+		t.Errorf("key = %s, want %s", got, want)
+	}
+}
+
+func TestNormalizeSSUpstream(t *testing.T) {
+	for _, tt := range []struct {
+		raw, want, wantErr string
+	}{
+		{raw: "ss://AES-256-GCM:pw@h:8388", want: "ss://aes-256-gcm:pw@h:8388"},
+		{raw: "ss://" + base64.URLEncoding.EncodeToString([]byte("aes-256-gcm:p:w")) + "@h:8388", want: "ss://aes-256-gcm:p%3Aw@h:8388"},
+		{raw: "ss://h:8388", wantErr: "needs a method and password"},
+		{raw: "ss://rc4-md5:pw@h:8388", wantErr: `unsupported shadowsocks method "rc4-md5"`},
+		{raw: "ss://aes-256-gcm:@h:8388", wantErr: "needs a password"},
+		{raw: "ss://not*base64@h:8388", wantErr: "neither method:password nor base64"},
+		{raw: "ss://" + base64.RawURLEncoding.EncodeToString([]byte("aes-256-gcm")) + "@h:8388", wantErr: "missing the password"},
+		{raw: "ss://aes-256-gcm:pw@h:8388/?plugin=obfs-local", wantErr: "plugins are not supported"},
+	} {
+		u, err := url.Parse(tt.raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = normalizeSSUpstream(u)
+		switch {
+		case tt.wantErr != "":
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("%s: err = %v, want %q", tt.raw, err, tt.wantErr)
+			}
+		case err != nil:
+			t.Errorf("%s: %v", tt.raw, err)
+		case u.String() != tt.want:
+			t.Errorf("%s became %s, want %s", tt.raw, u, tt.want)
+		}
+	}
+}
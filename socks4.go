@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// socks4Dialer implements proxy.Dialer for SOCKS4 upstreams, which
+// x/net/proxy doesn't support. SOCKS4 resolves the destination locally;
+// SOCKS4a leaves that to the upstream.
+type socks4Dialer struct {
+	upstreamURL *url.URL
+	remoteDNS   bool // socks4a
+	forward     proxy.Dialer
+}
+
+// socks4Reply is a SOCKS4 request the upstream refused; its message is shown
+// to the client in the 502
+type socks4Reply byte
+
+func (r socks4Reply) Error() string {
+	switch r {
+	case 0x5b:
+		return "socks4 upstream rejected the request or it failed"
+	case 0x5c:
+		return "socks4 upstream could not reach identd on the client"
+	case 0x5d:
+		return "socks4 upstream: identd reported a different user id"
+	}
+	return fmt.Sprintf("socks4 upstream answered with unknown code 0x%02x", byte(r))
+}
+
+func (d *socks4Dialer) Dial(network, addr string) (net.Conn, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("bad port %q", portStr)
+	}
+
+	var ip net.IP
+	if parsed := net.ParseIP(host); parsed != nil {
+		if ip = parsed.To4(); ip == nil {
+			return nil, errors.New("socks4 upstreams only reach IPv4 destinations")
+		}
+	} else if !d.remoteDNS {
+		if ip, err = resolveHost("ip4", host); err != nil {
+			return nil, err
+		}
+		ip = ip.To4()
+	}
+
+	// VN, CD, DSTPORT, DSTIP, USERID, NUL[, host, NUL for SOCKS4a]
+	req := []byte{4, 1}
+	req = binary.BigEndian.AppendUint16(req, uint16(port))
+	if ip != nil {
+		req = append(req, ip...)
+	} else {
+		req = append(req, 0, 0, 0, 1) // 0.0.0.x asks the upstream to resolve
+	}
+	if d.upstreamURL.User != nil {
+		req = append(req, d.upstreamURL.User.Username()...)
+	}
+	req = append(req, 0)
+	if ip == nil {
+		req = append(append(req, host...), 0)
+	}
+
+	conn, err := d.forward.Dial("tcp", d.upstreamURL.Host)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(*upstreamHandshakeTimeout))
+	if _, err := conn.Write(req); err != nil {
+		conn.Close()
+		return nil, handshakeTimeout(d.upstreamURL.Host, err)
+	}
+	var resp [8]byte
+	if _, err := io.ReadFull(conn, resp[:]); err != nil {
+		conn.Close()
+		return nil, handshakeTimeout(d.upstreamURL.Host, fmt.Errorf("socks4 handshake: %w", err))
+	}
+	if resp[1] != 0x5a {
+		conn.Close()
+		return nil, socks4Reply(resp[1])
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
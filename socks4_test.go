@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// socks4Request is what a fake SOCKS4 server was asked for
+type socks4Request struct {
+	version, command byte
+	port             uint16
+	ip               net.IP
+	userID           string
+	host             string // SOCKS4a only
+}
+
+// fakeSOCKS4 is a SOCKS4/4a server that records each request and answers
+// with reply; on 0x5a it connects to the destination and relays
+type fakeSOCKS4 struct {
+	addr  string
+	reply byte
+
+	mu       sync.Mutex
+	requests []socks4Request
+}
+
+func startFakeSOCKS4(t *testing.T, reply byte) *fakeSOCKS4 {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	s := &fakeSOCKS4{addr: ln.Addr().String(), reply: reply}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *fakeSOCKS4) serve(conn net.Conn) {
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+	var head [8]byte
+	if _, err := io.ReadFull(br, head[:]); err != nil {
+		return
+	}
+	req := socks4Request{version: head[0], command: head[1], port: binary.BigEndian.Uint16(head[2:4]), ip: net.IP(head[4:8])}
+	userID, err := br.ReadString(0)
+	if err != nil {
+		return
+	}
+	req.userID = strings.TrimSuffix(userID, "\x00")
+	dest := req.ip.String()
+	if head[4] == 0 && head[5] == 0 && head[6] == 0 && head[7] != 0 {
+		host, err := br.ReadString(0)
+		if err != nil {
+			return
+		}
+		req.host = strings.TrimSuffix(host, "\x00")
+		dest = req.host
+	}
+	s.mu.Lock()
+	s.requests = append(s.requests, req)
+	s.mu.Unlock()
+
+	if s.reply != 0x5a {
+		conn.Write([]byte{0, s.reply, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	target, err := net.Dial("tcp", net.JoinHostPort(dest, strconv.Itoa(int(req.port))))
+	if err != nil {
+		conn.Write([]byte{0, 0x5b, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	conn.Write([]byte{0, 0x5a, 0, 0, 0, 0, 0, 0})
+	relay(&bufferedConn{conn, br}, target)
+}
+
+func (s *fakeSOCKS4) lastRequest(t *testing.T) socks4Request {
+	t.Helper()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.requests) == 0 {
+		t.Fatal("the socks4 upstream got no request")
+	}
+	return s.requests[len(s.requests)-1]
+}
+
+func TestSOCKS4Upstream(t *testing.T) {
+	echo := startEchoServer(t)
+	_, port, _ := net.SplitHostPort(echo)
+	proxyAddr := startProxy(t)
+
+	for _, tt := range []struct {
+		name, scheme, target string
+		ip, host             string // what the upstream should be sent
+	}{
+		{"socks4 to an IP", "socks4", echo, "127.0.0.1", ""},
+		{"socks4 resolves names itself", "socks4", net.JoinHostPort("localhost", port), "127.0.0.1", ""},
+		{"socks4a passes names on", "socks4a", net.JoinHostPort("localhost", port), "0.0.0.1", "localhost"},
+		{"socks4a to an IP", "socks4a", echo, "127.0.0.1", ""},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream := startFakeSOCKS4(t, 0x5a)
+			setTestMapping(t, "alice", tt.scheme+"://ident-42@"+upstream.addr, "")
+
+			resp, conn := dialConnect(t, proxyAddr, tt.target, basicAuth("alice", "x"))
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("status = %d, want 200", resp.StatusCode)
+			}
+			expectEcho(t, conn, "through "+tt.scheme)
+
+			req := upstream.lastRequest(t)
+			if req.version != 4 || req.command != 1 {
+				t.Errorf("version %d command %d, want a SOCKS4 CONNECT", req.version, req.command)
+			}
+			if strconv.Itoa(int(req.port)) != port {
+				t.Errorf("port = %d, want %s", req.port, port)
+			}
+			if req.ip.String() != tt.ip || req.host != tt.host {
+				t.Errorf("destination ip %s host %q, want %s %q", req.ip, req.host, tt.ip, tt.host)
+			}
+			if req.userID != "ident-42" {
+				t.Errorf("user id = %q, want the URL's", req.userID)
+			}
+		})
+	}
+}
+
+func TestSOCKS4UpstreamRefusals(t *testing.T) {
+	echo := startEchoServer(t)
+	proxyAddr := startProxy(t)
+
+	for _, tt := range []struct {
+		reply  byte
+		reason string
+	}{
+		{0x5b, "rejected the request or it failed"},
+		{0x5c, "could not reach identd"},
+		{0x5d, "identd reported a different user id"},
+		{0x42, "unknown code 0x42"},
+	} {
+		upstream := startFakeSOCKS4(t, tt.reply)
+		setTestMapping(t, "alice", "socks4://"+upstream.addr, "")
+
+		resp, _ := dialConnect(t, proxyAddr, echo, basicAuth("alice", "x"))
+		body, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != http.StatusBadGateway || !strings.Contains(string(body), tt.reason) {
+			t.Errorf("reply 0x%02x: %d %q, want 502 %q", tt.reply, resp.StatusCode, body, tt.reason)
+		}
+	}
+
+	// SOCKS4 has no room for an IPv6 destination; nothing is sent upstream
+	upstream := startFakeSOCKS4(t, 0x5a)
+	setTestMapping(t, "alice", "socks4://"+upstream.addr, "")
+	if resp, _ := dialConnect(t, proxyAddr, "[::1]:80", basicAuth("alice", "x")); resp.StatusCode == http.StatusOK {
+		t.Error("IPv6 destination through socks4 succeeded")
+	}
+	upstream.mu.Lock()
+	defer upstream.mu.Unlock()
+	if len(upstream.requests) != 0 {
+		t.Errorf("upstream got %d requests for an IPv6 destination", len(upstream.requests))
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+
+	"golang.org/x/net/proxy"
+)
+
+// socks5+tls upstreams, also written socks5s, are SOCKS5 servers behind
+// TLS: the handshake with the proxy port is the same as for https, and the
+// SOCKS5 greeting runs inside it
+
+func isSOCKS5TLS(scheme string) bool {
+	return scheme == "socks5+tls" || scheme == "socks5s"
+}
+
+// socks5Auth is the username/password auth for the credentials of u, if any
+func socks5Auth(u *url.URL) *proxy.Auth {
+	if u.User == nil {
+		return nil
+	}
+	pwd, _ := u.User.Password()
+	return &proxy.Auth{User: u.User.Username(), Password: pwd}
+}
+
+// socks5TLSDialer implements proxy.Dialer for socks5+tls upstreams
+type socks5TLSDialer struct {
+	upstreamURL *url.URL
+	forward     proxy.Dialer
+	hopConfig
+}
+
+func (d *socks5TLSDialer) Dial(network, addr string) (net.Conn, error) {
+	// the SOCKS5 dialer reaches the proxy through tlsHop, which records
+	// whether the TLS handshake got done
+	hop := &tlsHop{forward: d.forward, cfg: d.hopConfig}
+	sd, err := proxy.SOCKS5("tcp", d.upstreamURL.Host, socks5Auth(d.upstreamURL), hop)
+	if err != nil {
+		return nil, err
+	}
+	var s proxy.Dialer = socks5Dialer{sd.(proxy.ContextDialer), d.upstreamURL.Host}
+	if *socks5ResolveLocal {
+		s = localResolveDialer{s}
+	}
+	conn, err := s.Dial(network, addr)
+	if err != nil && hop.ready {
+		// with TLS 1.3 the server refuses a client certificate after the
+		// client considers the handshake done; crypto/tls reports the
+		// alert it sent as a "remote error"
+		if alert := tlsAlert(err); alert != nil {
+			return nil, fmt.Errorf("tls handshake with upstream %s: %w", d.upstreamURL.Host, alert)
+		}
+		return nil, fmt.Errorf("socks5 handshake with upstream %s over tls: %w", d.upstreamURL.Host, err)
+	}
+	return conn, err
+}
+
+func tlsAlert(err error) error {
+	for err != nil {
+		if oe, ok := err.(*net.OpError); ok && oe.Op == "remote error" {
+			return oe
+		}
+		err = errors.Unwrap(err)
+	}
+	return nil
+}
+
+// tlsHop dials the proxy through forward and wraps the connection in TLS
+type tlsHop struct {
+	forward proxy.Dialer
+	cfg     hopConfig
+	ready   bool // the TLS handshake succeeded
+}
+
+func (h *tlsHop) Dial(network, addr string) (net.Conn, error) {
+	return h.DialContext(context.Background(), network, addr)
+}
+
+// DialContext bounds the TLS handshake by ctx as well, which carries
+// -upstream-handshake-timeout
+func (h *tlsHop) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, err := contextHop{h.forward}.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	tc, err := upstreamTLS(conn, addr, h.cfg)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	h.ready = true
+	return tc, nil
+}
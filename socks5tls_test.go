@@ -0,0 +1,132 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/pem"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// tlsSOCKS5 is a fakeSOCKS5 behind TLS, remembering the server name of each
+// handshake
+type tlsSOCKS5 struct {
+	*fakeSOCKS5
+	ca string // PEM of the certificate, valid for 127.0.0.1 and example.com
+
+	mu   sync.Mutex
+	snis []string
+}
+
+// startTLSFakeSOCKS5 serves a fakeSOCKS5 over TLS with httptest's
+// certificate
+func startTLSFakeSOCKS5(t *testing.T, user, password string) *tlsSOCKS5 {
+	t.Helper()
+	certSrv := httptest.NewUnstartedServer(http.NotFoundHandler())
+	certSrv.StartTLS()
+	cert, leaf := certSrv.TLS.Certificates[0], certSrv.Certificate()
+	certSrv.Close()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &tlsSOCKS5{ca: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: leaf.Raw}))}
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			s.mu.Lock()
+			s.snis = append(s.snis, hello.ServerName)
+			s.mu.Unlock()
+			return nil, nil
+		},
+	}
+	s.fakeSOCKS5 = serveFakeSOCKS5(t, tls.NewListener(ln, cfg), user, password)
+	return s
+}
+
+func TestSOCKS5TLSUpstream(t *testing.T) {
+	setFlag(t, accessLog, true)
+	setFlag(t, upstreamHandshakeTimeout, 300*time.Millisecond)
+	logs := captureLog(t)
+	echo := startEchoServer(t)
+	proxyAddr := startProxy(t)
+	upstream := startTLSFakeSOCKS5(t, "u", "p@ss")
+
+	withCA := func(serverName string) func(*Upstream) {
+		return func(up *Upstream) {
+			var err error
+			if up.CA, err = loadUpstreamCAConfig(upstream.ca); err != nil {
+				t.Fatal(err)
+			}
+			up.ServerName = serverName
+		}
+	}
+	lastSNI := func() string {
+		upstream.mu.Lock()
+		defer upstream.mu.Unlock()
+		return upstream.snis[len(upstream.snis)-1]
+	}
+
+	for _, tt := range []struct {
+		name, scheme, serverName, sni string
+	}{
+		{"socks5+tls", "socks5+tls", "", "127.0.0.1"},
+		{"socks5s with server_name", "socks5s", "example.com", "example.com"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			setTestMapping(t, "alice", tt.scheme+"://u:p%40ss@"+upstream.addr, "", withCA(tt.serverName))
+			resp, conn := dialConnect(t, proxyAddr, echo, basicAuth("alice", "x"))
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("status = %d, want 200", resp.StatusCode)
+			}
+			expectEcho(t, conn, "socks5 in tls")
+			if req := upstream.lastRequest(t); req.user != "u" || req.password != "p@ss" || req.host != "127.0.0.1" {
+				t.Errorf("upstream got %+v", req)
+			}
+			// the client sends no SNI for an IP address
+			if got := lastSNI(); got != tt.sni && !(got == "" && net.ParseIP(tt.sni) != nil) {
+				t.Errorf("SNI = %q, want %q", got, tt.sni)
+			}
+		})
+	}
+
+	// TLS and SOCKS5 failures read differently in the log
+	for _, tt := range []struct {
+		name, raw string
+		edit      func(*Upstream)
+		logged    string
+	}{
+		{"unknown certificate", "socks5+tls://u:p%40ss@" + upstream.addr, nil,
+			"certificate of upstream " + upstream.addr + " (as 127.0.0.1) failed verification"},
+		{"wrong password", "socks5+tls://u:wrong@" + upstream.addr, withCA(""),
+			"socks5 handshake with upstream " + upstream.addr + " over tls"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var edits []func(*Upstream)
+			if tt.edit != nil {
+				edits = append(edits, tt.edit)
+			}
+			setTestMapping(t, "alice", tt.raw, "", edits...)
+			logs.Reset()
+			resp, _ := dialConnect(t, proxyAddr, echo, basicAuth("alice", "x"))
+			if resp.StatusCode != http.StatusBadGateway {
+				t.Errorf("status = %d, want 502", resp.StatusCode)
+			}
+			logs.waitFor(t, tt.logged)
+		})
+	}
+
+	// the greeting is shorter than a TLS record header, so the server
+	// waits for more until the handshake times out
+	t.Run("plain socks5 to the TLS port", func(t *testing.T) {
+		setTestMapping(t, "alice", "socks5://u:p%40ss@"+upstream.addr, "")
+		resp, _ := dialConnect(t, proxyAddr, echo, basicAuth("alice", "x"))
+		if resp.StatusCode != http.StatusGatewayTimeout {
+			t.Errorf("status = %d, want 504", resp.StatusCode)
+		}
+	})
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"flag"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var socksAddr = flag.String("socks-addr", "", "also accept SOCKS5 clients on this address (e.g. :1080), with username/password auth")
+
+// SOCKS5 clients (RFC 1928) are served like CONNECT requests. A login
+// (RFC 1929) is checked as if it came as Basic Proxy-Authorization, so
+// -user-params, passwords, htpasswd, -auth-webhook and bans all apply, and
+// the tunnel is registered, counted and logged the same way. Clients that
+// offer no authentication are only served when their address is in /ipmap
+// or -allow-anonymous is set. BIND and UDP ASSOCIATE are not supported.
+
+// socksHandshakeTimeout bounds a client's greeting, login and request
+const socksHandshakeTimeout = 30 * time.Second
+
+// SOCKS5 reply codes
+const (
+	socksSucceeded        = 0x00
+	socksGeneralFailure   = 0x01
+	socksNotAllowed       = 0x02
+	socksNetUnreachable   = 0x03
+	socksHostUnreachable  = 0x04
+	socksConnRefused      = 0x05
+	socksCmdNotSupported  = 0x07
+	socksAddrNotSupported = 0x08
+)
+
+// SOCKS5 authentication methods
+const (
+	socksMethodNone         = 0x00
+	socksMethodPassword     = 0x02
+	socksMethodNoAcceptable = 0xff
+)
+
+// serveSOCKS runs one client connection: greeting, login, request, tunnel
+func serveSOCKS(conn net.Conn) {
+	conn.SetDeadline(time.Now().Add(socksHandshakeTimeout))
+	br := bufio.NewReader(conn)
+
+	method, err := socksGreeting(conn, br)
+	if err != nil || method == socksMethodNoAcceptable {
+		conn.Close()
+		return
+	}
+	// the login becomes a Basic header, so authentication is the proxy port's
+	r := &http.Request{Method: http.MethodConnect, Header: http.Header{}, RemoteAddr: conn.RemoteAddr().String()}
+	if method == socksMethodPassword {
+		user, password, err := socksLogin(br)
+		if err != nil {
+			conn.Close()
+			return
+		}
+		r.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(user+":"+password)))
+	}
+	pc, refused := authenticateProxy(r)
+	if method == socksMethodPassword {
+		status := byte(0)
+		if refused != nil {
+			status = 1
+		}
+		if _, err := conn.Write([]byte{1, status}); err != nil || refused != nil {
+			conn.Close()
+			return
+		}
+	}
+
+	target, err := socksRequest(conn, br)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	if refused == nil {
+		if err := pc.allowed(); err != nil {
+			refused = &authRefusal{}
+		}
+	}
+	if refused != nil {
+		socksReply(conn, socksNotAllowed)
+		conn.Close()
+		return
+	}
+	if err := checkConnectTarget(target); err != nil {
+		socksReply(conn, socksGeneralFailure)
+		conn.Close()
+		return
+	}
+
+	via, err := pc.up.pick(target, pc.params)
+	if err != nil {
+		socksReply(conn, socksNotAllowed)
+		conn.Close()
+		return
+	}
+	dialer, err := dialerFor(via, upstreamParams(pc.user, via, pc.params), r.Header.Get("Proxy-Authorization"))
+	if err != nil {
+		socksReply(conn, socksGeneralFailure)
+		conn.Close()
+		return
+	}
+	// the upstream dial has deadlines of its own
+	conn.SetDeadline(time.Time{})
+	pc.tunnel(tunnelConn(conn, br), target, via, dialer, func(conn net.Conn, err error) {
+		socksReply(conn, socksReplyCode(err))
+	})
+}
+
+// socksGreeting reads the client's methods and answers with the one used:
+// username/password when offered, else none
+func socksGreeting(conn net.Conn, br *bufio.Reader) (byte, error) {
+	var head [2]byte
+	if _, err := io.ReadFull(br, head[:]); err != nil {
+		return 0, err
+	}
+	if head[0] != 5 {
+		return 0, errors.New("not SOCKS5")
+	}
+	methods := make([]byte, head[1])
+	if _, err := io.ReadFull(br, methods); err != nil {
+		return 0, err
+	}
+	method := byte(socksMethodNoAcceptable)
+	for _, m := range methods {
+		if m == socksMethodPassword {
+			method = m
+			break
+		}
+		if m == socksMethodNone {
+			method = m
+		}
+	}
+	_, err := conn.Write([]byte{5, method})
+	return method, err
+}
+
+// socksLogin reads an RFC 1929 username and password
+func socksLogin(br *bufio.Reader) (user, password string, err error) {
+	var ver [1]byte
+	if _, err := io.ReadFull(br, ver[:]); err != nil {
+		return "", "", err
+	}
+	if ver[0] != 1 {
+		return "", "", errors.New("unknown login version")
+	}
+	field := func() (string, error) {
+		n, err := br.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		b := make([]byte, n)
+		_, err = io.ReadFull(br, b)
+		return string(b), err
+	}
+	if user, err = field(); err != nil {
+		return "", "", err
+	}
+	if password, err = field(); err != nil {
+		return "", "", err
+	}
+	// a colon would end up in the password of the Basic header
+	if strings.Contains(user, ":") {
+		user = ""
+	}
+	return user, password, nil
+}
+
+// socksRequest reads the client's request and returns its target as
+// host:port. Commands other than CONNECT and unknown address types are
+// answered and reported as errors.
+func socksRequest(conn net.Conn, br *bufio.Reader) (string, error) {
+	var head [4]byte
+	if _, err := io.ReadFull(br, head[:]); err != nil {
+		return "", err
+	}
+	if head[0] != 5 {
+		return "", errors.New("not SOCKS5")
+	}
+	var host string
+	switch head[3] {
+	case 1, 4:
+		ip := make([]byte, 4)
+		if head[3] == 4 {
+			ip = make([]byte, 16)
+		}
+		if _, err := io.ReadFull(br, ip); err != nil {
+			return "", err
+		}
+		addr, _ := netip.AddrFromSlice(ip)
+		host = addr.String()
+	case 3:
+		n, err := br.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		name := make([]byte, n)
+		if _, err := io.ReadFull(br, name); err != nil {
+			return "", err
+		}
+		host = string(name)
+	default:
+		socksReply(conn, socksAddrNotSupported)
+		return "", errors.New("unknown address type")
+	}
+	var port [2]byte
+	if _, err := io.ReadFull(br, port[:]); err != nil {
+		return "", err
+	}
+	if head[1] != 1 {
+		socksReply(conn, socksCmdNotSupported)
+		return "", errors.New("only CONNECT is supported")
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(port[0])<<8|int(port[1]))), nil
+}
+
+// socksReply answers a request. The bound address is left unspecified,
+// since the tunnel's far end is the upstream's to know.
+func socksReply(conn net.Conn, code byte) error {
+	_, err := conn.Write([]byte{5, code, 0, 1, 0, 0, 0, 0, 0, 0})
+	return err
+}
+
+// socksReplyCode is the reply for the outcome of an upstream dial
+func socksReplyCode(err error) byte {
+	if err == nil {
+		return socksSucceeded
+	}
+	var rejected *connectRefused
+	var refused socks4Reply
+	var unresolved *upstreamResolveError
+	var timedOut *handshakeTimeoutError
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED), errors.As(err, &rejected), errors.As(err, &refused):
+		return socksConnRefused
+	case errors.Is(err, syscall.ENETUNREACH):
+		return socksNetUnreachable
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.As(err, &unresolved), errors.As(err, &timedOut):
+		return socksHostUnreachable
+	}
+	return socksGeneralFailure
+}
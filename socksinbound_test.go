@@ -0,0 +1,253 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// startSOCKSProxy serves the SOCKS5 port on loopback and returns its
+// address; like startProxy, its cleanup waits for every tunnel to close
+func startSOCKSProxy(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var handlers sync.WaitGroup
+	t.Cleanup(func() {
+		ln.Close()
+		handlers.Wait()
+	})
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			handlers.Add(1)
+			go func() {
+				defer handlers.Done()
+				serveSOCKS(conn)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// socksClient speaks the client side of RFC 1928 and 1929 byte by byte, so
+// each answer of the gateway can be checked
+type socksClient struct {
+	t    *testing.T
+	conn net.Conn
+}
+
+func dialSOCKS(t *testing.T, addr string) *socksClient {
+	t.Helper()
+	conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	t.Cleanup(func() { conn.Close() })
+	return &socksClient{t, conn}
+}
+
+// send writes b and reads an answer of n bytes
+func (c *socksClient) send(b []byte, n int) []byte {
+	c.t.Helper()
+	if _, err := c.conn.Write(b); err != nil {
+		c.t.Fatal(err)
+	}
+	got := make([]byte, n)
+	if _, err := io.ReadFull(c.conn, got); err != nil {
+		c.t.Fatalf("reading %d bytes of answer: %v", n, err)
+	}
+	return got
+}
+
+// greet offers methods and returns the one chosen
+func (c *socksClient) greet(methods ...byte) byte {
+	c.t.Helper()
+	return c.send(append([]byte{5, byte(len(methods))}, methods...), 2)[1]
+}
+
+// login sends user and password and returns the status, 0 for success
+func (c *socksClient) login(user, password string) byte {
+	c.t.Helper()
+	b := append([]byte{1, byte(len(user))}, user...)
+	b = append(append(b, byte(len(password))), password...)
+	return c.send(b, 2)[1]
+}
+
+// request sends cmd for host:port, as an IPv4, IPv6 or domain address, and
+// returns the reply code
+func (c *socksClient) request(cmd byte, target string) byte {
+	c.t.Helper()
+	host, portStr, err := net.SplitHostPort(target)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	b := []byte{5, cmd, 0}
+	if ip, err := netip.ParseAddr(host); err == nil && ip.Is4() {
+		b = append(append(b, 1), ip.AsSlice()...)
+	} else if err == nil {
+		b = append(append(b, 4), ip.AsSlice()...)
+	} else {
+		b = append(append(b, 3, byte(len(host))), host...)
+	}
+	port, _ := strconv.Atoi(portStr)
+	b = binary.BigEndian.AppendUint16(b, uint16(port))
+	reply := c.send(b, 10)
+	if reply[0] != 5 {
+		c.t.Fatalf("reply version %d", reply[0])
+	}
+	return reply[1]
+}
+
+// expectClosed checks the gateway ends the connection
+func (c *socksClient) expectClosed() {
+	c.t.Helper()
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if n, err := c.conn.Read(make([]byte, 1)); n != 0 || err == nil {
+		c.t.Errorf("connection still open: %d bytes, %v", n, err)
+	}
+}
+
+func TestSOCKSInbound(t *testing.T) {
+	echo := startEchoServer(t)
+	socksAddr := startSOCKSProxy(t)
+	setTestMapping(t, "alice", "direct", "s3cret")
+
+	t.Run("no auth refused", func(t *testing.T) {
+		c := dialSOCKS(t, socksAddr)
+		if m := c.greet(socksMethodNone); m != socksMethodNone {
+			t.Fatalf("method = %#x, want none", m)
+		}
+		// without a login or an /ipmap entry the request is not allowed
+		if code := c.request(1, echo); code != socksNotAllowed {
+			t.Errorf("reply = %#x, want %#x", code, socksNotAllowed)
+		}
+		c.expectClosed()
+	})
+
+	t.Run("no acceptable method", func(t *testing.T) {
+		c := dialSOCKS(t, socksAddr)
+		if m := c.greet(1); m != socksMethodNoAcceptable { // GSSAPI only
+			t.Fatalf("method = %#x, want %#x", m, socksMethodNoAcceptable)
+		}
+		c.expectClosed()
+	})
+
+	t.Run("password preferred over none", func(t *testing.T) {
+		c := dialSOCKS(t, socksAddr)
+		if m := c.greet(socksMethodNone, socksMethodPassword); m != socksMethodPassword {
+			t.Fatalf("method = %#x, want username/password", m)
+		}
+	})
+
+	t.Run("login succeeds", func(t *testing.T) {
+		c := dialSOCKS(t, socksAddr)
+		c.greet(socksMethodPassword)
+		if status := c.login("alice", "s3cret"); status != 0 {
+			t.Fatalf("login status = %d, want 0", status)
+		}
+		if code := c.request(1, echo); code != socksSucceeded {
+			t.Fatalf("reply = %#x, want success", code)
+		}
+		expectEcho(t, c.conn, "over socks")
+	})
+
+	t.Run("login fails", func(t *testing.T) {
+		c := dialSOCKS(t, socksAddr)
+		c.greet(socksMethodPassword)
+		if status := c.login("alice", "wrong"); status == 0 {
+			t.Fatal("login with a wrong password succeeded")
+		}
+		c.expectClosed()
+	})
+
+	t.Run("unknown user fails with -require-password", func(t *testing.T) {
+		setFlag(t, requirePassword, true)
+		c := dialSOCKS(t, socksAddr)
+		c.greet(socksMethodPassword)
+		if status := c.login("nobody", "x"); status == 0 {
+			t.Fatal("login of an unknown user succeeded")
+		}
+		c.expectClosed()
+	})
+
+	for _, tt := range []struct {
+		name string
+		cmd  byte
+	}{
+		{"BIND", 2},
+		{"UDP ASSOCIATE", 3},
+	} {
+		t.Run(tt.name+" not supported", func(t *testing.T) {
+			c := dialSOCKS(t, socksAddr)
+			c.greet(socksMethodPassword)
+			c.login("alice", "s3cret")
+			if code := c.request(tt.cmd, echo); code != socksCmdNotSupported {
+				t.Errorf("reply = %#x, want %#x", code, socksCmdNotSupported)
+			}
+			c.expectClosed()
+		})
+	}
+}
+
+func TestSOCKSInboundTargets(t *testing.T) {
+	echo := startEchoServer(t)
+	_, port, _ := net.SplitHostPort(echo)
+	socksAddr := startSOCKSProxy(t)
+
+	t.Run("domain", func(t *testing.T) {
+		// socks5h passes the name on, so the upstream sees what the client sent
+		upstream := startFakeSOCKS5(t, "", "")
+		setTestMapping(t, "alice", "socks5h://"+upstream.addr, "s3cret")
+		c := dialSOCKS(t, socksAddr)
+		c.greet(socksMethodPassword)
+		c.login("alice", "s3cret")
+		if code := c.request(1, "localhost:"+port); code != socksSucceeded {
+			t.Fatalf("reply = %#x, want success", code)
+		}
+		expectEcho(t, c.conn, "to a name")
+		if req := upstream.lastRequest(t); req.addrType != 3 || req.host != "localhost" {
+			t.Errorf("upstream got type %d %s, want the name", req.addrType, req.host)
+		}
+	})
+
+	t.Run("IPv6", func(t *testing.T) {
+		listenIPv6(t)
+		echo6 := startEchoServerOn(t, "[::1]:0")
+		setTestMapping(t, "alice", "direct", "s3cret")
+		c := dialSOCKS(t, socksAddr)
+		c.greet(socksMethodPassword)
+		c.login("alice", "s3cret")
+		if code := c.request(1, echo6); code != socksSucceeded {
+			t.Fatalf("reply = %#x, want success", code)
+		}
+		expectEcho(t, c.conn, "to ::1")
+	})
+
+	t.Run("refused target", func(t *testing.T) {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		closed := ln.Addr().String()
+		ln.Close()
+		setTestMapping(t, "alice", "direct", "s3cret")
+		c := dialSOCKS(t, socksAddr)
+		c.greet(socksMethodPassword)
+		c.login("alice", "s3cret")
+		if code := c.request(1, closed); code != socksConnRefused {
+			t.Errorf("reply = %#x, want %#x", code, socksConnRefused)
+		}
+	})
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"golang.org/x/net/proxy"
+)
+
+var (
+	sshKnownHosts   = flag.String("ssh-known-hosts", "", "known_hosts file that ssh:// upstreams' host keys are checked against")
+	sshInsecureKeys = flag.Bool("ssh-insecure-host-keys", false, "accept any host key from ssh:// upstreams")
+)
+
+const (
+	sshHandshakeTimeout = 10 * time.Second
+	// sshIdleTimeout is how long a session without tunnels is kept open
+	sshIdleTimeout = 5 * time.Minute
+	// sessions that don't answer a keepalive within sshKeepaliveInterval are
+	// closed, so the next dial reconnects instead of hanging
+	sshKeepaliveInterval = 30 * time.Second
+)
+
+// sshHostKeys checks upstream host keys; nil until checkSSHFlags loads it
+var sshHostKeys ssh.HostKeyCallback
+
+// checkSSHFlags loads -ssh-known-hosts
+func checkSSHFlags() error {
+	switch {
+	case *sshKnownHosts != "" && *sshInsecureKeys:
+		return errors.New("-ssh-known-hosts and -ssh-insecure-host-keys are mutually exclusive")
+	case *sshKnownHosts != "":
+		cb, err := knownhosts.New(*sshKnownHosts)
+		if err != nil {
+			return err
+		}
+		sshHostKeys = cb
+	case *sshInsecureKeys:
+		sshHostKeys = ssh.InsecureIgnoreHostKey()
+	}
+	return nil
+}
+
+// validateSSHUpstream checks what parseUpstream can't: a user and at most a
+// key query parameter
+func validateSSHUpstream(u *url.URL) error {
+	if u.User == nil || u.User.Username() == "" {
+		return errors.New("ssh upstream needs a user, e.g. ssh://user@host:22")
+	}
+	for k := range u.Query() {
+		if k != "key" {
+			return fmt.Errorf("unknown ssh upstream parameter %q, want key", k)
+		}
+	}
+	return nil
+}
+
+// sshSession is an SSH connection shared by every tunnel through the same
+// upstream URL
+type sshSession struct {
+	mu     sync.Mutex // held while connecting
+	client *ssh.Client
+
+	active   int // open tunnels, guarded by sshSessionsMu
+	lastUsed time.Time
+}
+
+var (
+	sshSessionsMu sync.Mutex
+	sshSessions   = map[string]*sshSession{} // upstream URL -> session
+)
+
+// sshDialer implements proxy.Dialer by opening a channel on a cached SSH
+// session, reconnecting once if the session has died
+type sshDialer struct {
+	upstreamURL *url.URL
+	forward     proxy.Dialer
+	via         string // hops before this one, so chains get their own sessions
+}
+
+func (d *sshDialer) Dial(network, addr string) (net.Conn, error) {
+	key := d.via + d.upstreamURL.String()
+	sshSessionsMu.Lock()
+	s := sshSessions[key]
+	if s == nil {
+		s = &sshSession{}
+		sshSessions[key] = s
+	}
+	// counted from here on so an idle sweep leaves the session alone
+	s.active++
+	sshSessionsMu.Unlock()
+
+	conn, err := d.open(s, network, addr)
+	if err != nil {
+		s.release()
+		return nil, err
+	}
+	return &sshConn{Conn: conn, session: s}, nil
+}
+
+// helper to open a channel to addr, connecting the session first if needed
+func (d *sshDialer) open(s *sshSession, network, addr string) (net.Conn, error) {
+	for attempt := 0; ; attempt++ {
+		s.mu.Lock()
+		if s.client == nil {
+			client, err := d.connect()
+			if err != nil {
+				s.mu.Unlock()
+				return nil, err
+			}
+			s.client = client
+		}
+		client := s.client
+		s.mu.Unlock()
+
+		conn, err := client.Dial(network, addr)
+		if err == nil {
+			return conn, nil
+		}
+		// a refused channel means the session is fine and the target isn't
+		var refused *ssh.OpenChannelError
+		if errors.As(err, &refused) || attempt > 0 {
+			return nil, err
+		}
+		s.mu.Lock()
+		if s.client == client {
+			client.Close()
+			s.client = nil
+		}
+		s.mu.Unlock()
+	}
+}
+
+func (s *sshSession) release() {
+	sshSessionsMu.Lock()
+	s.active--
+	s.lastUsed = time.Now()
+	sshSessionsMu.Unlock()
+}
+
+// helper to open a new SSH connection to the upstream
+func (d *sshDialer) connect() (*ssh.Client, error) {
+	if sshHostKeys == nil {
+		return nil, errors.New("ssh upstreams need -ssh-known-hosts or -ssh-insecure-host-keys")
+	}
+	u := d.upstreamURL
+	cfg := &ssh.ClientConfig{User: u.User.Username(), HostKeyCallback: sshHostKeys, Timeout: sshHandshakeTimeout}
+	if pwd, ok := u.User.Password(); ok {
+		cfg.Auth = append(cfg.Auth, ssh.Password(pwd))
+	}
+	if path := u.Query().Get("key"); path != "" {
+		pem, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		signer, err := ssh.ParsePrivateKey(pem)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		cfg.Auth = append(cfg.Auth, ssh.PublicKeys(signer))
+	}
+
+	conn, err := d.forward.Dial("tcp", u.Host)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(sshHandshakeTimeout))
+	c, chans, reqs, err := ssh.NewClientConn(conn, u.Host, cfg)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	client := ssh.NewClient(c, chans, reqs)
+	go sshKeepalive(client)
+	return client, nil
+}
+
+// helper to close client once the server stops answering keepalives
+func sshKeepalive(client *ssh.Client) {
+	t := time.NewTicker(sshKeepaliveInterval)
+	defer t.Stop()
+	for range t.C {
+		timeout := time.AfterFunc(sshKeepaliveInterval, func() { client.Close() })
+		_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+		timeout.Stop()
+		if err != nil {
+			client.Close()
+			return
+		}
+	}
+}
+
+// sshConn is a tunnel over an SSH session, counted while it is open
+type sshConn struct {
+	net.Conn
+	session *sshSession
+	once    sync.Once
+}
+
+func (c *sshConn) Close() error {
+	c.once.Do(c.session.release)
+	return c.Conn.Close()
+}
+
+// closeIdleSSHSessions closes sessions that have had no tunnels for
+// sshIdleTimeout, which also drops those of upstreams no longer in use
+func closeIdleSSHSessions(now time.Time) {
+	var idle []*sshSession
+	sshSessionsMu.Lock()
+	for key, s := range sshSessions {
+		if s.active == 0 && now.Sub(s.lastUsed) >= sshIdleTimeout {
+			idle = append(idle, s)
+			delete(sshSessions, key)
+		}
+	}
+	sshSessionsMu.Unlock()
+
+	for _, s := range idle {
+		s.mu.Lock()
+		if s.client != nil {
+			s.client.Close()
+		}
+		s.mu.Unlock()
+	}
+}
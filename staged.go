@@ -0,0 +1,307 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+var stageTTL = flag.Duration("stage-ttl", time.Hour, "discard staged upstream changes that are not committed within this time")
+
+// stagedChange is an upstream waiting for POST /upstream/commit
+type stagedChange struct {
+	up         *Upstream
+	ttl        time.Duration // mapping TTL, applied from commit time
+	actor      string
+	stagedAt   time.Time
+	discardsAt time.Time
+}
+
+var (
+	stagedMu sync.Mutex
+	staged   = map[string]*stagedChange{}
+)
+
+// POST /upstream/stage { "user":"u", "upstream":"socks5://host:port", ... }
+//
+// Accepts the same fields as POST /upstream but only records the change;
+// traffic is unaffected until it is committed.
+func stageHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeMethodNotAllowed(w)
+		return
+	}
+	var req struct {
+		User              string            `json:"user"`
+		Password          *string           `json:"password"`
+		PasswordExpiresAt *time.Time        `json:"password_expires_at"`
+		Upstream          string            `json:"upstream"`
+		TTLSeconds        int64             `json:"ttl_seconds"`
+		Verify            bool              `json:"verify"`
+		Labels            map[string]string `json:"labels"`
+		AllowedIPs        []string          `json:"allowed_ips"`
+		Headers           map[string]string `json:"headers"`
+		ClientCert        *clientCertSpec   `json:"client_cert"`
+		SessionTTL        int64             `json:"session_ttl_seconds"`
+		CA                string            `json:"ca"`
+		ServerName        string            `json:"server_name"`
+		ForwardAuth       bool              `json:"forward_auth"`
+		Routes            []routeSpec       `json:"routes"`
+		Pool              []poolMemberSpec  `json:"pool"`
+	}
+	if !decodeJSON(w, r, *maxBodyBytes, &req) {
+		return
+	}
+	if err := validateUser(req.User); err != nil {
+		writeInvalid(w, err)
+		return
+	}
+	up, err := buildUpstream(req.Upstream, req.TTLSeconds, nil, req.Labels)
+	if err != nil {
+		writeInvalid(w, err)
+		return
+	}
+	if err := setUpstreamHeaders(up, req.Headers); err != nil {
+		writeInvalid(w, err)
+		return
+	}
+	if err := setClientCert(up, req.ClientCert); err != nil {
+		writeInvalid(w, err)
+		return
+	}
+	if err := setSessionTTL(up, req.SessionTTL); err != nil {
+		writeInvalid(w, err)
+		return
+	}
+	if err := setUpstreamTLS(up, req.CA, req.ServerName); err != nil {
+		writeInvalid(w, err)
+		return
+	}
+	if err := setForwardAuth(up, req.ForwardAuth); err != nil {
+		writeInvalid(w, err)
+		return
+	}
+	if err := setUpstreamRoutes(up, req.Routes); err != nil {
+		writeInvalid(w, err)
+		return
+	}
+	if err := setUpstreamPool(up, req.Pool); err != nil {
+		writeInvalid(w, err)
+		return
+	}
+	if err := setPassword(req.User, up, req.Password); err != nil {
+		writeInvalid(w, err)
+		return
+	}
+	if err := setPasswordExpiry(up, req.Password, req.PasswordExpiresAt); err != nil {
+		writeInvalid(w, err)
+		return
+	}
+	if err := setAllowedIPs(up, req.AllowedIPs); err != nil {
+		writeInvalid(w, err)
+		return
+	}
+	if req.Verify {
+		if err := probeUpstream(req.User, up, *probeTarget); err != nil {
+			writeError(w, http.StatusUnprocessableEntity, "verification_failed", "upstream verification failed: "+err.Error())
+			return
+		}
+	}
+
+	now := time.Now()
+	stagedMu.Lock()
+	staged[req.User] = &stagedChange{
+		up:         up,
+		ttl:        time.Duration(req.TTLSeconds) * time.Second,
+		actor:      sourceOf(r).Actor,
+		stagedAt:   now,
+		discardsAt: now.Add(*stageTTL),
+	}
+	stagedMu.Unlock()
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type stagedEntry struct {
+	User       string            `json:"user"`
+	Upstream   string            `json:"upstream"`
+	Current    string            `json:"current,omitempty"` // what the user is on now
+	Labels     map[string]string `json:"labels,omitempty"`
+	Actor      string            `json:"actor"`
+	StagedAt   time.Time         `json:"staged_at"`
+	DiscardsAt time.Time         `json:"discards_at"`
+}
+
+// GET /upstream/staged
+func stagedHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeMethodNotAllowed(w)
+		return
+	}
+
+	now := time.Now()
+	entries := []stagedEntry{}
+	stagedMu.Lock()
+	upstreamsMu.RLock()
+	for user, c := range staged {
+		if !now.Before(c.discardsAt) {
+			continue
+		}
+		entries = append(entries, stagedEntry{
+			User:       user,
+			Upstream:   c.up.redacted(),
+			Current:    upstreams[user].redacted(),
+			Labels:     c.up.Labels,
+			Actor:      c.actor,
+			StagedAt:   c.stagedAt,
+			DiscardsAt: c.discardsAt,
+		})
+	}
+	upstreamsMu.RUnlock()
+	stagedMu.Unlock()
+	sort.Slice(entries, func(i, j int) bool { return entries[i].User < entries[j].User })
+
+	writeJSON(w, http.StatusOK, entries)
+}
+
+// helper to decode the optional { "users": [...] } body of commit and abort;
+// on failure the error response has been written
+func stagedUsers(w http.ResponseWriter, r *http.Request) ([]string, bool) {
+	var req struct {
+		Users []string `json:"users"`
+	}
+	if r.ContentLength == 0 {
+		return nil, true
+	}
+	if !decodeJSON(w, r, *maxBodyBytes, &req) {
+		return nil, false
+	}
+	return req.Users, true
+}
+
+// helper to remove and return the live staged changes for users, or all of
+// them when users is nil; missing lists requested users with nothing staged
+func takeStaged(users []string, now time.Time) (taken map[string]*stagedChange, missing []string) {
+	stagedMu.Lock()
+	defer stagedMu.Unlock()
+	if users == nil {
+		for user := range staged {
+			users = append(users, user)
+		}
+	}
+	taken = map[string]*stagedChange{}
+	for _, user := range users {
+		c, ok := staged[user]
+		if !ok || !now.Before(c.discardsAt) {
+			missing = append(missing, user)
+			continue
+		}
+		taken[user] = c
+	}
+	for user := range taken {
+		delete(staged, user)
+	}
+	return taken, missing
+}
+
+// POST /upstream/commit [{ "users":["u", ...] }]
+//
+// Applies the staged changes for the listed users, or all of them, in one
+// locked pass. If any listed user has nothing staged, nothing is applied.
+func commitHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeMethodNotAllowed(w)
+		return
+	}
+	users, ok := stagedUsers(w, r)
+	if !ok {
+		return
+	}
+
+	now := time.Now()
+	taken, missing := takeStaged(users, now)
+	if len(missing) > 0 && users != nil {
+		restoreStaged(taken)
+		sort.Strings(missing)
+		writeAPIError(w, http.StatusConflict, &apiError{Code: "not_staged", Message: "some users have nothing staged", Details: map[string][]string{"not_staged": missing}})
+		return
+	}
+
+	set := make(map[string]*Upstream, len(taken))
+	committed := make([]string, 0, len(taken))
+	for user, c := range taken {
+		up := *c.up
+		up.SetAt = now
+		if c.ttl > 0 {
+			up.ExpiresAt = now.Add(c.ttl)
+		}
+		set[user] = &up
+		committed = append(committed, user)
+	}
+	if len(set) > 0 {
+		err := putUpstreams(sourceOf(r), set)
+		if err == errTooManyUsers {
+			restoreStaged(taken)
+			writeUserLimit(w)
+			return
+		}
+		if err != nil {
+			restoreStaged(taken)
+			log.Printf("store: commit failed: %v", err)
+			writeStoreError(w)
+			return
+		}
+	}
+	sort.Strings(committed)
+
+	writeJSON(w, http.StatusOK, map[string][]string{"committed": committed})
+}
+
+// helper to put changes back after a failed commit, unless restaged meanwhile
+func restoreStaged(changes map[string]*stagedChange) {
+	stagedMu.Lock()
+	defer stagedMu.Unlock()
+	for user, c := range changes {
+		if _, ok := staged[user]; !ok {
+			staged[user] = c
+		}
+	}
+}
+
+// POST /upstream/abort [{ "users":["u", ...] }]
+//
+// Discards the staged changes for the listed users, or all of them.
+func abortHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeMethodNotAllowed(w)
+		return
+	}
+	users, ok := stagedUsers(w, r)
+	if !ok {
+		return
+	}
+
+	taken, _ := takeStaged(users, time.Now())
+	aborted := make([]string, 0, len(taken))
+	for user := range taken {
+		aborted = append(aborted, user)
+	}
+	sort.Strings(aborted)
+
+	writeJSON(w, http.StatusOK, map[string][]string{"aborted": aborted})
+}
+
+// expireStaged drops staged changes that were not committed in time
+func expireStaged(now time.Time) {
+	stagedMu.Lock()
+	defer stagedMu.Unlock()
+	for user, c := range staged {
+		if !now.Before(c.discardsAt) {
+			delete(staged, user)
+			log.Printf("stage: discarding uncommitted change for %q", user)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+var stateFile = flag.String("state-file", "", "persist upstream mappings to this JSON file and restore them on startup")
+
+// stateSaveDelay bounds how often a burst of updates hits the disk
+const stateSaveDelay = time.Second
+
+var (
+	stateSaveMu    sync.Mutex
+	stateSaveTimer *time.Timer
+	stateSaveDone  chan struct{} // closed once the latest scheduled save is written
+
+	// stateWriteMu serializes saves, snapshot and write together, so an
+	// older snapshot is never renamed over a newer one
+	stateWriteMu sync.Mutex
+)
+
+type stateDoc struct {
+	Upstreams map[string]upstreamRecord `json:"upstreams"`
+	History   map[string][]historyEntry `json:"history,omitempty"`
+	IPMap     map[string]string         `json:"ip_map,omitempty"` // cidr -> user
+	APIKeys   []apiKeyRecord            `json:"api_keys,omitempty"`
+	// CredentialUsage counts logins per mapping password and credential
+	CredentialUsage []secretUsageRecord `json:"credential_usage,omitempty"`
+}
+
+// helper to schedule a debounced write of the state file
+func scheduleStateSave() {
+	if *stateFile == "" {
+		return
+	}
+	stateSaveMu.Lock()
+	defer stateSaveMu.Unlock()
+	if stateSaveTimer != nil {
+		return // a save is already pending and will pick up this change
+	}
+	done := make(chan struct{})
+	stateSaveDone = done
+	stateSaveTimer = time.AfterFunc(stateSaveDelay, func() { writeScheduledState(done) })
+}
+
+// writeScheduledState runs a debounced save and then closes done
+func writeScheduledState(done chan struct{}) {
+	stateSaveMu.Lock()
+	stateSaveTimer = nil
+	stateSaveMu.Unlock()
+	if err := saveState(); err != nil {
+		log.Printf("state: save failed: %v", err)
+	}
+	close(done)
+}
+
+// flushStateSave writes a save that is still waiting out the debounce
+// now, or waits for one already under way, so the file is current
+func flushStateSave() {
+	stateSaveMu.Lock()
+	t, done := stateSaveTimer, stateSaveDone
+	stateSaveMu.Unlock()
+	if done == nil {
+		return
+	}
+	if t != nil && t.Stop() {
+		writeScheduledState(done)
+		return
+	}
+	<-done
+}
+
+// saveState writes the current mappings to the state file via temp file + rename
+func saveState() error {
+	stateWriteMu.Lock()
+	defer stateWriteMu.Unlock()
+
+	doc := stateDoc{Upstreams: map[string]upstreamRecord{}}
+	upstreamsMu.RLock()
+	for user, up := range upstreams {
+		doc.Upstreams[user] = up.record()
+	}
+	upstreamsMu.RUnlock()
+	doc.History = snapshotHistory()
+	doc.IPMap = snapshotIPMap()
+	doc.APIKeys = snapshotAPIKeys()
+	doc.CredentialUsage = snapshotSecretUsage()
+
+	b, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(*stateFile), filepath.Base(*stateFile)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), *stateFile)
+}
+
+// loadState restores mappings from the state file. A missing or corrupt file
+// is logged and leaves the map empty.
+func loadState() {
+	if *stateFile == "" {
+		return
+	}
+	doc, err := readStateDoc()
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("state: cannot load %s, starting empty: %v", *stateFile, err)
+		}
+		return
+	}
+	loaded := doc.upstreams()
+	restoreHistory(doc.History, loaded)
+	restoreIPMap(doc.IPMap)
+	restoreAPIKeys(doc.APIKeys)
+	restoreSecretUsage(doc.CredentialUsage, loaded)
+
+	upstreamsMu.Lock()
+	upstreams = loaded
+	upstreamsMu.Unlock()
+	log.Printf("state: restored %d mappings from %s", len(loaded), *stateFile)
+}
+
+// readState parses the state file, skipping entries with bad upstreams
+func readState() (map[string]*Upstream, error) {
+	doc, err := readStateDoc()
+	if err != nil {
+		return nil, err
+	}
+	return doc.upstreams(), nil
+}
+
+func readStateDoc() (*stateDoc, error) {
+	b, err := os.ReadFile(*stateFile)
+	if err != nil {
+		return nil, err
+	}
+	var doc stateDoc
+	if err := json.Unmarshal(b, &doc); err != nil {
+		return nil, err
+	}
+	return &doc, nil
+}
+
+// upstreams converts the saved records, skipping entries with bad upstreams
+func (doc *stateDoc) upstreams() map[string]*Upstream {
+	loaded := map[string]*Upstream{}
+	for user, rec := range doc.Upstreams {
+		up, err := rec.upstream()
+		if err != nil {
+			log.Printf("state: skipping user %q with bad upstream: %v", user, err)
+			continue
+		}
+		loaded[user] = up
+	}
+	return loaded
+}
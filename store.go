@@ -0,0 +1,513 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"maps"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+var storeSpec = flag.String("store", "memory", "mapping store: memory, sqlite://path.db, redis://host:6379/0 or etcd://host:2379[,host:2379]")
+
+// store persists user→upstream mappings. The upstreams map remains the
+// in-memory cache consulted on the hot path; stores are only touched on
+// writes and at startup.
+type store interface {
+	Load() (map[string]*Upstream, error)
+	Put(ups map[string]*Upstream) error
+	Delete(user string) (bool, error)
+	Close() error
+}
+
+// syncingStore is implemented by stores shared between gateway instances.
+// Watch runs until the store is closed, reporting single-user changes made
+// elsewhere (nil for a removal) and full snapshots after reconnecting.
+type syncingStore interface {
+	store
+	Watch(onChange func(user string, up *Upstream), onResync func(all map[string]*Upstream))
+}
+
+var (
+	mappings store      = memoryStore{}
+	storeMu  sync.Mutex // serializes store writes with cache updates
+)
+
+// upstreamRecord is the serialized form of an Upstream used by the state
+// file and the persistent stores.
+type upstreamRecord struct {
+	Upstream  string            `json:"upstream"`
+	SetAt     time.Time         `json:"set_at"`
+	ExpiresAt *time.Time        `json:"expires_at,omitempty"`
+	Version   uint64            `json:"version,omitempty"`
+	Labels    map[string]string `json:"labels,omitempty"`
+	Headers   map[string]string `json:"headers,omitempty"`
+	// ClientCert may hold an inline private key; GET /export leaves it out
+	ClientCert *clientCertSpec `json:"client_cert,omitempty"`
+	SessionTTL int64           `json:"session_ttl_seconds,omitempty"`
+	CA         string          `json:"ca,omitempty"`
+	ServerName string          `json:"server_name,omitempty"`
+	// ForwardAuth passes the client's Proxy-Authorization to the upstream
+	ForwardAuth bool             `json:"forward_auth,omitempty"`
+	Routes      []routeSpec      `json:"routes,omitempty"`
+	Pool        []poolMemberSpec `json:"pool,omitempty"`
+	// PasswordHash is a bcrypt hash; plaintext passwords are never stored
+	PasswordHash      string     `json:"password_hash,omitempty"`
+	PasswordExpiresAt *time.Time `json:"password_expires_at,omitempty"`
+	// DigestMD5 and DigestSHA256 are password-equivalent for Digest auth
+	DigestMD5    string             `json:"digest_md5,omitempty"`
+	DigestSHA256 string             `json:"digest_sha256,omitempty"`
+	AllowedIPs   []string           `json:"allowed_ips,omitempty"`
+	Credentials  []credentialRecord `json:"credentials,omitempty"`
+	Previous     *upstreamRecord    `json:"previous,omitempty"`
+}
+
+func (up *Upstream) record() upstreamRecord {
+	rec := upstreamRecord{Upstream: up.Raw, SetAt: up.SetAt, Version: up.Version, Labels: up.Labels, Headers: up.Headers,
+		SessionTTL: int64(up.SessionTTL / time.Second), ServerName: up.ServerName, ForwardAuth: up.ForwardAuth, Routes: up.routeSpecs(), Pool: up.poolSpecs(), PasswordHash: up.PasswordHash, DigestMD5: up.DigestMD5, DigestSHA256: up.DigestSHA256}
+	if !up.PasswordExpiresAt.IsZero() {
+		rec.PasswordExpiresAt = &up.PasswordExpiresAt
+	}
+	if up.ClientCert != nil {
+		spec := up.ClientCert.spec
+		rec.ClientCert = &spec
+	}
+	if up.CA != nil {
+		rec.CA = up.CA.spec
+	}
+	for _, p := range up.AllowedIPs {
+		rec.AllowedIPs = append(rec.AllowedIPs, p.String())
+	}
+	for _, c := range up.Credentials {
+		rec.Credentials = append(rec.Credentials, c.record())
+	}
+	if !up.ExpiresAt.IsZero() {
+		rec.ExpiresAt = &up.ExpiresAt
+	}
+	if up.Previous != nil {
+		prev := up.Previous.record()
+		rec.Previous = &prev
+	}
+	return rec
+}
+
+func (rec upstreamRecord) upstream() (*Upstream, error) {
+	u, err := parseUpstream(rec.Upstream)
+	if err != nil {
+		return nil, err
+	}
+	if rec.PasswordHash != "" {
+		if _, err := bcrypt.Cost([]byte(rec.PasswordHash)); err != nil {
+			return nil, errors.New("password_hash is not a bcrypt hash")
+		}
+	}
+	up := &Upstream{Raw: rec.Upstream, URL: u, SetAt: rec.SetAt, Version: rec.Version, Labels: rec.Labels,
+		PasswordHash: rec.PasswordHash, DigestMD5: rec.DigestMD5, DigestSHA256: rec.DigestSHA256}
+	if rec.PasswordExpiresAt != nil {
+		up.PasswordExpiresAt = *rec.PasswordExpiresAt
+	}
+	if err := setUpstreamHeaders(up, rec.Headers); err != nil {
+		return nil, err
+	}
+	if err := setClientCert(up, rec.ClientCert); err != nil {
+		return nil, err
+	}
+	if err := setSessionTTL(up, rec.SessionTTL); err != nil {
+		return nil, err
+	}
+	if err := setUpstreamTLS(up, rec.CA, rec.ServerName); err != nil {
+		return nil, err
+	}
+	if err := setForwardAuth(up, rec.ForwardAuth); err != nil {
+		return nil, err
+	}
+	if err := setUpstreamRoutes(up, rec.Routes); err != nil {
+		return nil, err
+	}
+	if err := setUpstreamPool(up, rec.Pool); err != nil {
+		return nil, err
+	}
+	if len(rec.AllowedIPs) > 0 {
+		if up.AllowedIPs, err = parseAllowedIPs(rec.AllowedIPs); err != nil {
+			return nil, err
+		}
+	}
+	for _, cr := range rec.Credentials {
+		c, err := cr.credential()
+		if err != nil {
+			return nil, err
+		}
+		up.Credentials = append(up.Credentials, c)
+	}
+	if rec.ExpiresAt != nil {
+		up.ExpiresAt = *rec.ExpiresAt
+	}
+	if rec.Previous != nil {
+		prev := *rec.Previous
+		prev.Previous = nil
+		if up.Previous, err = prev.upstream(); err != nil {
+			up.Previous = nil // an unusable previous value only disables rollback
+		}
+	}
+	return up, nil
+}
+
+func openStore(spec string) (store, error) {
+	switch {
+	case spec == "" || spec == "memory":
+		return memoryStore{}, nil
+	case strings.HasPrefix(spec, "sqlite://"):
+		return openSQLiteStore(strings.TrimPrefix(spec, "sqlite://"))
+	case strings.HasPrefix(spec, "redis://"), strings.HasPrefix(spec, "rediss://"):
+		return openRedisStore(spec)
+	case strings.HasPrefix(spec, "etcd://"):
+		return openEtcdStore(spec)
+	default:
+		return nil, fmt.Errorf("unsupported store: %s", spec)
+	}
+}
+
+// hydrateStore opens the configured store and replaces the cache with its contents
+func hydrateStore() error {
+	s, err := openStore(*storeSpec)
+	if err != nil {
+		return err
+	}
+	ss, syncing := s.(syncingStore)
+	loaded, err := s.Load()
+	if err != nil {
+		if !syncing {
+			s.Close()
+			return err
+		}
+		// shared stores resync once reachable; keep serving what we have
+		log.Printf("store: %s unreachable, using local state until it returns: %v", *storeSpec, err)
+	}
+	mappings = s
+
+	if loaded != nil {
+		if _, ok := s.(memoryStore); !ok {
+			upstreamsMu.Lock()
+			upstreams = loaded
+			upstreamsMu.Unlock()
+		}
+	}
+
+	if syncing {
+		go ss.Watch(applyRemoteChange, applyRemoteSnapshot)
+	}
+	return nil
+}
+
+func sameUpstream(a, b *Upstream) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Version == b.Version && a.Raw == b.Raw && a.SetAt.Equal(b.SetAt) && a.ExpiresAt.Equal(b.ExpiresAt) &&
+		maps.Equal(a.Labels, b.Labels) && maps.Equal(a.Headers, b.Headers) && sameClientCert(a.ClientCert, b.ClientCert) && a.SessionTTL == b.SessionTTL &&
+		sameUpstreamCA(a.CA, b.CA) && a.ServerName == b.ServerName && a.ForwardAuth == b.ForwardAuth && sameRoutes(a.Routes, b.Routes) && samePool(a.Pool, b.Pool) && a.PasswordHash == b.PasswordHash && a.PasswordExpiresAt.Equal(b.PasswordExpiresAt) &&
+		a.DigestMD5 == b.DigestMD5 && a.DigestSHA256 == b.DigestSHA256 && slices.Equal(a.AllowedIPs, b.AllowedIPs) &&
+		slices.EqualFunc(a.Credentials, b.Credentials, credential.equal)
+}
+
+// applyRemoteChange updates the cache with a change made by another instance
+// and closes the user's connections if their upstream actually changed
+func applyRemoteChange(user string, up *Upstream) {
+	storeMu.Lock()
+	upstreamsMu.Lock()
+	old := upstreams[user]
+	if up == nil {
+		delete(upstreams, user)
+	} else {
+		upstreams[user] = up
+	}
+	upstreamsMu.Unlock()
+	storeMu.Unlock()
+
+	if !sameUpstream(old, up) {
+		scheduleStateSave()
+		closeUserConns(user)
+	}
+}
+
+// applyRemoteSnapshot replaces the cache with a full copy of the shared store
+func applyRemoteSnapshot(all map[string]*Upstream) {
+	var changed []string
+	storeMu.Lock()
+	upstreamsMu.Lock()
+	for user, old := range upstreams {
+		if !sameUpstream(old, all[user]) {
+			changed = append(changed, user)
+		}
+	}
+	for user := range all {
+		if _, ok := upstreams[user]; !ok {
+			changed = append(changed, user)
+		}
+	}
+	upstreams = all
+	upstreamsMu.Unlock()
+	storeMu.Unlock()
+
+	if len(changed) > 0 {
+		scheduleStateSave()
+	}
+	for _, user := range changed {
+		closeUserConns(user)
+	}
+}
+
+// errPreconditionFailed reports an If-Match version that no longer matches
+var errPreconditionFailed = errors.New("version does not match")
+
+// putUpstreams writes ups to the store and then to the in-memory cache,
+// giving each mapping the next version after the one it replaces. Existing
+// connections of every affected user are closed.
+func putUpstreams(src changeSource, ups map[string]*Upstream) error {
+	storeMu.Lock()
+	defer storeMu.Unlock()
+	return putUpstreamsLocked(src, ups)
+}
+
+// putUpstreamIfMatch sets a single mapping if its current version matches
+// ifMatch, which is an ETag as sent in an If-Match header ("*" matches any
+// existing mapping). The check and the write happen under storeMu.
+func putUpstreamIfMatch(src changeSource, user string, up *Upstream, ifMatch string) error {
+	storeMu.Lock()
+	defer storeMu.Unlock()
+	upstreamsMu.RLock()
+	cur := upstreams[user]
+	upstreamsMu.RUnlock()
+	if !etagMatches(cur, ifMatch) {
+		return errPreconditionFailed
+	}
+	return putUpstreamsLocked(src, map[string]*Upstream{user: up})
+}
+
+func putUpstreamsLocked(src changeSource, ups map[string]*Upstream) error {
+	old := make(map[string]*Upstream, len(ups))
+	upstreamsMu.RLock()
+	for user, up := range ups {
+		up.Version = 1
+		up.Previous = nil
+		keepPassword, keepAllowedIPs, keepCredentials, keepSame := up.keepPassword, up.keepAllowedIPs, !up.ownCredentials, up.sameUpstream
+		up.keepPassword, up.keepAllowedIPs, up.ownCredentials, up.sameUpstream = false, false, false, false
+		if cur, ok := upstreams[user]; ok {
+			if keepCredentials {
+				up.Credentials = cur.Credentials
+			}
+			if keepPassword {
+				up.PasswordHash, up.DigestMD5, up.DigestSHA256 = cur.PasswordHash, cur.DigestMD5, cur.DigestSHA256
+				if up.PasswordExpiresAt.IsZero() {
+					up.PasswordExpiresAt = cur.PasswordExpiresAt
+				}
+			}
+			if keepAllowedIPs {
+				up.AllowedIPs = cur.AllowedIPs
+			}
+			old[user] = cur
+			if keepSame {
+				up.Version, up.Previous = cur.Version, cur.Previous
+			} else {
+				up.Version = cur.Version + 1
+				prev := *cur
+				prev.Previous = nil
+				up.Previous = &prev
+			}
+		}
+	}
+	upstreamsMu.RUnlock()
+
+	if err := makeRoomFor(ups); err != nil {
+		return err
+	}
+	if err := mappings.Put(ups); err != nil {
+		return err
+	}
+	upstreamsMu.Lock()
+	for user, up := range ups {
+		upstreams[user] = up
+	}
+	upstreamsMu.Unlock()
+	scheduleStateSave()
+
+	for user, up := range ups {
+		closed := 0
+		if !src.KeepConns {
+			closed = closeUserConns(user)
+		}
+		recordChange(src, user, old[user], up, closed)
+	}
+	return nil
+}
+
+// updateMapping applies fn to a copy of the user's mapping and writes it
+// back, all under storeMu so concurrent changes aren't lost. fn may change
+// only the password and credentials: the version and previous upstream are
+// kept, and src.Event names the change.
+func updateMapping(src changeSource, user string, fn func(*Upstream) error) error {
+	storeMu.Lock()
+	defer storeMu.Unlock()
+	upstreamsMu.RLock()
+	cur := upstreams[user]
+	upstreamsMu.RUnlock()
+	if cur == nil || cur.expired(time.Now()) {
+		return errNoMapping
+	}
+	up := *cur
+	if err := fn(&up); err != nil {
+		return err
+	}
+	up.ownCredentials, up.sameUpstream = true, true
+	return putUpstreamsLocked(src, map[string]*Upstream{user: &up})
+}
+
+var (
+	errNoPrevious      = errors.New("no previous upstream")
+	errPreviousExpired = errors.New("previous upstream has expired")
+)
+
+// rollbackUpstream makes the user's previous upstream current again, as a
+// regular change. Only the upstream is restored: the password, credentials
+// and allowed IPs stay as they are now. A previous mapping whose expiry has
+// passed is not brought back.
+func rollbackUpstream(src changeSource, user string) (*Upstream, error) {
+	storeMu.Lock()
+	defer storeMu.Unlock()
+	upstreamsMu.RLock()
+	cur := upstreams[user]
+	upstreamsMu.RUnlock()
+	if cur == nil || cur.Previous == nil {
+		return nil, errNoPrevious
+	}
+
+	now := time.Now()
+	prev := cur.Previous
+	if prev.expired(now) {
+		return nil, errPreviousExpired
+	}
+	up := &Upstream{Raw: prev.Raw, URL: prev.URL, SetAt: now, ExpiresAt: prev.ExpiresAt, Labels: prev.Labels, Headers: prev.Headers, ClientCert: prev.ClientCert, SessionTTL: prev.SessionTTL,
+		CA: prev.CA, ServerName: prev.ServerName, ForwardAuth: prev.ForwardAuth, Routes: prev.Routes, Pool: prev.Pool,
+		keepPassword: true, keepAllowedIPs: true}
+	if err := putUpstreamsLocked(src, map[string]*Upstream{user: up}); err != nil {
+		return nil, err
+	}
+	return up, nil
+}
+
+func (up *Upstream) etag() string {
+	return `"` + strconv.FormatUint(up.Version, 10) + `"`
+}
+
+func etagMatches(cur *Upstream, ifMatch string) bool {
+	if cur == nil {
+		return false
+	}
+	for _, tag := range strings.Split(ifMatch, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == "*" || tag == cur.etag() {
+			return true
+		}
+	}
+	return false
+}
+
+// removeUpstream deletes user from the store and the cache, closing their
+// connections and reporting whether a mapping existed
+func removeUpstream(src changeSource, user string) (bool, error) {
+	storeMu.Lock()
+	defer storeMu.Unlock()
+	return removeUpstreamLocked(src, user)
+}
+
+// removeUpstreamIfMatch removes user's mapping only if ifMatch matches its
+// current ETag, as putUpstreamIfMatch does for sets
+func removeUpstreamIfMatch(src changeSource, user, ifMatch string) (bool, error) {
+	storeMu.Lock()
+	defer storeMu.Unlock()
+	upstreamsMu.RLock()
+	cur := upstreams[user]
+	upstreamsMu.RUnlock()
+	if !etagMatches(cur, ifMatch) {
+		return false, errPreconditionFailed
+	}
+	return removeUpstreamLocked(src, user)
+}
+
+func removeUpstreamLocked(src changeSource, user string) (bool, error) {
+	if _, err := mappings.Delete(user); err != nil {
+		return false, err
+	}
+	upstreamsMu.Lock()
+	old, ok := upstreams[user]
+	delete(upstreams, user)
+	upstreamsMu.Unlock()
+	if ok {
+		scheduleStateSave()
+		recordChange(src, user, old, nil, closeUserConns(user))
+	}
+	return ok, nil
+}
+
+// removeUpstreamsWhere removes every mapping for which match returns true,
+// in one locked pass, and returns the affected users
+func removeUpstreamsWhere(src changeSource, match func(user string, up *Upstream) bool) ([]string, error) {
+	storeMu.Lock()
+	defer storeMu.Unlock()
+	var users []string
+	upstreamsMu.RLock()
+	for user, up := range upstreams {
+		if match(user, up) {
+			users = append(users, user)
+		}
+	}
+	upstreamsMu.RUnlock()
+	sort.Strings(users)
+
+	removed := []string{}
+	for _, user := range users {
+		if _, err := removeUpstreamLocked(src, user); err != nil {
+			return removed, err
+		}
+		removed = append(removed, user)
+	}
+	return removed, nil
+}
+
+// expireUpstream removes user's mapping if it is still the given expired
+// entry, so a mapping re-set in the meantime is left alone
+func expireUpstream(user string, up *Upstream) (bool, error) {
+	storeMu.Lock()
+	defer storeMu.Unlock()
+	upstreamsMu.RLock()
+	current := upstreams[user]
+	upstreamsMu.RUnlock()
+	if current != up {
+		return false, nil
+	}
+	if _, err := mappings.Delete(user); err != nil {
+		return false, err
+	}
+	upstreamsMu.Lock()
+	delete(upstreams, user)
+	upstreamsMu.Unlock()
+	scheduleStateSave()
+	recordChange(changeSource{Actor: "expiry"}, user, up, nil, closeUserConns(user))
+	return true, nil
+}
+
+// memoryStore keeps nothing beyond the cache itself
+type memoryStore struct{}
+
+func (memoryStore) Load() (map[string]*Upstream, error) { return map[string]*Upstream{}, nil }
+func (memoryStore) Put(map[string]*Upstream) error      { return nil }
+func (memoryStore) Delete(string) (bool, error)         { return false, nil }
+func (memoryStore) Close() error                        { return nil }
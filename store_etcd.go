@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"log"
+	"strings"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+var etcdPrefix = flag.String("etcd-prefix", "/upstreamgate", "key prefix for the etcd store, so several gateways can share one cluster")
+
+const etcdTimeout = 5 * time.Second
+
+// etcdStore keeps one key per user under <prefix>/users/ and follows a
+// prefix watch to pick up changes made by other instances.
+type etcdStore struct {
+	cli    *clientv3.Client
+	keys   string // "<prefix>/users/"
+	rev    int64  // revision of the last full load
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// openEtcdStore takes a spec of the form etcd://host1:2379,host2:2379
+func openEtcdStore(spec string) (*etcdStore, error) {
+	var endpoints []string
+	for _, ep := range strings.Split(strings.TrimPrefix(spec, "etcd://"), ",") {
+		if ep != "" {
+			endpoints = append(endpoints, ep)
+		}
+	}
+	cli, err := clientv3.New(clientv3.Config{
+		Endpoints:   endpoints,
+		DialTimeout: etcdTimeout,
+	})
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &etcdStore{
+		cli:    cli,
+		keys:   strings.TrimSuffix(*etcdPrefix, "/") + "/users/",
+		ctx:    ctx,
+		cancel: cancel,
+	}, nil
+}
+
+func (s *etcdStore) Load() (map[string]*Upstream, error) {
+	ups, rev, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	s.rev = rev
+	return ups, nil
+}
+
+func (s *etcdStore) load() (map[string]*Upstream, int64, error) {
+	ctx, cancel := context.WithTimeout(s.ctx, etcdTimeout)
+	defer cancel()
+	resp, err := s.cli.Get(ctx, s.keys, clientv3.WithPrefix())
+	if err != nil {
+		return nil, 0, err
+	}
+	ups := map[string]*Upstream{}
+	for _, kv := range resp.Kvs {
+		user := strings.TrimPrefix(string(kv.Key), s.keys)
+		up, err := decodeEtcdRecord(kv.Value)
+		if err != nil {
+			log.Printf("etcd: skipping user %q: %v", user, err)
+			continue
+		}
+		ups[user] = up
+	}
+	return ups, resp.Header.Revision, nil
+}
+
+func (s *etcdStore) Put(ups map[string]*Upstream) error {
+	ops := make([]clientv3.Op, 0, len(ups))
+	for user, up := range ups {
+		b, err := json.Marshal(up.record())
+		if err != nil {
+			return err
+		}
+		ops = append(ops, clientv3.OpPut(s.keys+user, string(b)))
+	}
+	ctx, cancel := context.WithTimeout(s.ctx, etcdTimeout)
+	defer cancel()
+	_, err := s.cli.Txn(ctx).Then(ops...).Commit()
+	return err
+}
+
+func (s *etcdStore) Delete(user string) (bool, error) {
+	ctx, cancel := context.WithTimeout(s.ctx, etcdTimeout)
+	defer cancel()
+	resp, err := s.cli.Delete(ctx, s.keys+user)
+	if err != nil {
+		return false, err
+	}
+	return resp.Deleted > 0, nil
+}
+
+func (s *etcdStore) Close() error {
+	s.cancel()
+	return s.cli.Close()
+}
+
+// Watch follows the user prefix from the last seen revision. Watches are
+// opened with WithRequireLeader so a partitioned member ends the stream
+// instead of going silent; they are then resumed from the last revision.
+// If that revision has been compacted away the store is reloaded in full.
+func (s *etcdStore) Watch(onChange func(string, *Upstream), onResync func(map[string]*Upstream)) {
+	rev := s.rev
+	backoff := 500 * time.Millisecond
+	for s.ctx.Err() == nil {
+		if rev == 0 {
+			all, r, err := s.load()
+			if err != nil {
+				log.Printf("etcd: resync failed, retrying in %s: %v", backoff, err)
+				s.sleep(&backoff)
+				continue
+			}
+			onResync(all)
+			rev = r
+		}
+
+		ctx, cancel := context.WithCancel(clientv3.WithRequireLeader(s.ctx))
+		wch := s.cli.Watch(ctx, s.keys, clientv3.WithPrefix(), clientv3.WithRev(rev+1))
+		for resp := range wch {
+			if resp.CompactRevision != 0 {
+				log.Printf("etcd: watch revision %d compacted, resyncing", rev+1)
+				rev = 0
+				break
+			}
+			if err := resp.Err(); err != nil {
+				log.Printf("etcd: watch interrupted: %v", err)
+				break
+			}
+			backoff = 500 * time.Millisecond
+			for _, ev := range resp.Events {
+				user := strings.TrimPrefix(string(ev.Kv.Key), s.keys)
+				rev = ev.Kv.ModRevision
+				if ev.Type == clientv3.EventTypeDelete {
+					onChange(user, nil)
+					continue
+				}
+				up, err := decodeEtcdRecord(ev.Kv.Value)
+				if err != nil {
+					log.Printf("etcd: ignoring bad record for %q: %v", user, err)
+					continue
+				}
+				onChange(user, up)
+			}
+		}
+		cancel()
+		s.sleep(&backoff)
+	}
+}
+
+func (s *etcdStore) sleep(backoff *time.Duration) {
+	select {
+	case <-s.ctx.Done():
+	case <-time.After(*backoff):
+	}
+	*backoff = min(*backoff*2, 30*time.Second)
+}
+
+func decodeEtcdRecord(b []byte) (*Upstream, error) {
+	var rec upstreamRecord
+	if err := json.Unmarshal(b, &rec); err != nil {
+		return nil, err
+	}
+	return rec.upstream()
+}
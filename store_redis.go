@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	redisKey     = "upstreamgate:upstreams" // hash of user -> JSON record
+	redisChannel = "upstreamgate:changes"   // publishes the user name on every change
+	redisTimeout = 5 * time.Second
+)
+
+// redisStore shares mappings between gateway instances. Writes go to a Redis
+// hash and are announced on a pub/sub channel; every instance re-reads the
+// announced user and updates its local cache.
+type redisStore struct {
+	rdb    *redis.Client
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func openRedisStore(spec string) (*redisStore, error) {
+	opt, err := redis.ParseURL(spec)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &redisStore{rdb: redis.NewClient(opt), ctx: ctx, cancel: cancel}, nil
+}
+
+func (s *redisStore) Load() (map[string]*Upstream, error) {
+	ctx, cancel := context.WithTimeout(s.ctx, redisTimeout)
+	defer cancel()
+	all, err := s.rdb.HGetAll(ctx, redisKey).Result()
+	if err != nil {
+		return nil, err
+	}
+	ups := map[string]*Upstream{}
+	for user, data := range all {
+		up, err := decodeRedisRecord(data)
+		if err != nil {
+			log.Printf("redis: skipping user %q: %v", user, err)
+			continue
+		}
+		ups[user] = up
+	}
+	return ups, nil
+}
+
+func (s *redisStore) Put(ups map[string]*Upstream) error {
+	ctx, cancel := context.WithTimeout(s.ctx, redisTimeout)
+	defer cancel()
+	_, err := s.rdb.TxPipelined(ctx, func(p redis.Pipeliner) error {
+		for user, up := range ups {
+			b, err := json.Marshal(up.record())
+			if err != nil {
+				return err
+			}
+			p.HSet(ctx, redisKey, user, b)
+		}
+		for user := range ups {
+			p.Publish(ctx, redisChannel, user)
+		}
+		return nil
+	})
+	return err
+}
+
+func (s *redisStore) Delete(user string) (bool, error) {
+	ctx, cancel := context.WithTimeout(s.ctx, redisTimeout)
+	defer cancel()
+	var del *redis.IntCmd
+	_, err := s.rdb.TxPipelined(ctx, func(p redis.Pipeliner) error {
+		del = p.HDel(ctx, redisKey, user)
+		p.Publish(ctx, redisChannel, user)
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+	return del.Val() > 0, nil
+}
+
+func (s *redisStore) Close() error {
+	s.cancel()
+	return s.rdb.Close()
+}
+
+// Watch follows the change channel, resubscribing with backoff when Redis
+// goes away. Every (re)subscription is followed by a full resync so
+// instances don't drift while disconnected; until then the local cache keeps
+// serving the last known state.
+func (s *redisStore) Watch(onChange func(string, *Upstream), onResync func(map[string]*Upstream)) {
+	backoff := 500 * time.Millisecond
+	for s.ctx.Err() == nil {
+		ps := s.rdb.Subscribe(s.ctx, redisChannel)
+		for {
+			msg, err := ps.Receive(s.ctx)
+			if err != nil {
+				if s.ctx.Err() == nil {
+					log.Printf("redis: subscription lost, retrying in %s: %v", backoff, err)
+				}
+				break
+			}
+			switch m := msg.(type) {
+			case *redis.Subscription:
+				if m.Kind != "subscribe" {
+					continue
+				}
+				all, err := s.Load()
+				if err != nil {
+					log.Printf("redis: resync failed: %v", err)
+					continue
+				}
+				onResync(all)
+				backoff = 500 * time.Millisecond
+			case *redis.Message:
+				up, err := s.get(m.Payload)
+				if err != nil {
+					log.Printf("redis: reading change for %q failed: %v", m.Payload, err)
+					continue
+				}
+				onChange(m.Payload, up)
+			}
+		}
+		ps.Close()
+
+		select {
+		case <-s.ctx.Done():
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, 30*time.Second)
+	}
+}
+
+// get fetches a single user's record, returning nil if it no longer exists
+func (s *redisStore) get(user string) (*Upstream, error) {
+	ctx, cancel := context.WithTimeout(s.ctx, redisTimeout)
+	defer cancel()
+	data, err := s.rdb.HGet(ctx, redisKey, user).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return decodeRedisRecord(data)
+}
+
+func decodeRedisRecord(data string) (*Upstream, error) {
+	var rec upstreamRecord
+	if err := json.Unmarshal([]byte(data), &rec); err != nil {
+		return nil, err
+	}
+	return rec.upstream()
+}
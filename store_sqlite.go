@@ -0,0 +1,112 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+
+	_ "modernc.org/sqlite"
+)
+
+// sqliteStore keeps mappings in a single SQLite table, one JSON record per user
+type sqliteStore struct {
+	db *sql.DB
+}
+
+func openSQLiteStore(path string) (*sqliteStore, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, err
+	}
+	// sqlite allows a single writer; a single connection avoids SQLITE_BUSY
+	db.SetMaxOpenConns(1)
+
+	stmts := []string{
+		`PRAGMA journal_mode=WAL`,
+		`PRAGMA busy_timeout=5000`,
+		`CREATE TABLE IF NOT EXISTS upstreams (
+			user   TEXT PRIMARY KEY,
+			record TEXT NOT NULL
+		)`,
+	}
+	for _, stmt := range stmts {
+		if _, err := db.Exec(stmt); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	return &sqliteStore{db: db}, nil
+}
+
+func (s *sqliteStore) Load() (map[string]*Upstream, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`SELECT user, record FROM upstreams`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ups := map[string]*Upstream{}
+	for rows.Next() {
+		var user, data string
+		if err := rows.Scan(&user, &data); err != nil {
+			return nil, err
+		}
+		var rec upstreamRecord
+		if err := json.Unmarshal([]byte(data), &rec); err != nil {
+			log.Printf("sqlite: skipping user %q with corrupt record: %v", user, err)
+			continue
+		}
+		up, err := rec.upstream()
+		if err != nil {
+			log.Printf("sqlite: skipping user %q with bad upstream: %v", user, err)
+			continue
+		}
+		ups[user] = up
+	}
+	return ups, rows.Err()
+}
+
+func (s *sqliteStore) Put(ups map[string]*Upstream) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare(`INSERT INTO upstreams (user, record) VALUES (?, ?)
+		ON CONFLICT(user) DO UPDATE SET record = excluded.record`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for user, up := range ups {
+		b, err := json.Marshal(up.record())
+		if err != nil {
+			return err
+		}
+		if _, err := stmt.Exec(user, string(b)); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *sqliteStore) Delete(user string) (bool, error) {
+	res, err := s.db.Exec(`DELETE FROM upstreams WHERE user = ?`, user)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func (s *sqliteStore) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+)
+
+var (
+	transparentAddr   = flag.String("transparent-addr", "", "accept TCP connections redirected by iptables on this address and tunnel them for the user /ipmap maps the client to (Linux only)")
+	transparentTProxy = flag.Bool("transparent-tproxy", false, "the -transparent-addr connections come from a TPROXY rule rather than REDIRECT (needs CAP_NET_ADMIN)")
+)
+
+// Transparent mode serves devices that can't be told to use a proxy. The
+// firewall sends their TCP connections to -transparent-addr, the original
+// destination is recovered from the socket (SO_ORIGINAL_DST for REDIRECT,
+// the local address for TPROXY), and the connection is tunnelled to it
+// through the upstream of the user the client's address maps to. Nothing
+// is parsed, so targets are IP addresses and only routes with CIDR matches
+// apply. Clients not in /ipmap are only served with -allow-anonymous.
+
+// serveTransparent tunnels one redirected connection to its original
+// destination
+func serveTransparent(conn net.Conn) {
+	dst, err := originalDst(conn)
+	if err != nil {
+		log.Printf("transparent: %s: %v", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	target := netip.AddrPortFrom(dst.Addr().Unmap(), dst.Port()).String()
+	// only the client's address identifies the user
+	r := &http.Request{Method: http.MethodConnect, Header: http.Header{}, RemoteAddr: conn.RemoteAddr().String()}
+	pc, refused := authenticateProxy(r)
+	if refused == nil {
+		if err := pc.allowed(); err != nil {
+			refused = &authRefusal{}
+		}
+	}
+	if refused != nil {
+		if *accessLog {
+			log.Printf("transparent client=%s target=%s error=%q", conn.RemoteAddr(), target, "no user for this client address")
+		}
+		conn.Close()
+		return
+	}
+
+	// transparent clients send no login, so the pool is never picked from
+	via := pc.up.route(target)
+	dialer, err := dialerFor(via, upstreamParams(pc.user, via, pc.params), "")
+	if err != nil {
+		conn.Close()
+		return
+	}
+	// the client already thinks it is connected, so there is nothing to answer
+	pc.tunnel(conn, target, via, dialer, func(net.Conn, error) {})
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// soOriginalDst is SO_ORIGINAL_DST from linux/netfilter_ipv4.h, which has
+// the same value as IP6T_SO_ORIGINAL_DST
+const soOriginalDst = 80
+
+// listenTransparent listens on addr for redirected connections. With
+// -transparent-tproxy the socket is made IP_TRANSPARENT, so it accepts
+// connections addressed to other hosts.
+func listenTransparent(addr string) (net.Listener, error) {
+	var lc net.ListenConfig
+	if *transparentTProxy {
+		lc.Control = func(network, address string, c syscall.RawConn) error {
+			var serr error
+			err := c.Control(func(fd uintptr) {
+				serr = unix.SetsockoptInt(int(fd), unix.SOL_IP, unix.IP_TRANSPARENT, 1)
+				if serr == nil && network == "tcp6" {
+					serr = unix.SetsockoptInt(int(fd), unix.SOL_IPV6, unix.IPV6_TRANSPARENT, 1)
+				}
+			})
+			if err != nil {
+				return err
+			}
+			if serr != nil {
+				return fmt.Errorf("TPROXY needs CAP_NET_ADMIN: %w", serr)
+			}
+			return nil
+		}
+	}
+	return lc.Listen(context.Background(), "tcp", addr)
+}
+
+// originalDst is where the client of a redirected connection meant to go
+func originalDst(conn net.Conn) (netip.AddrPort, error) {
+	tc, ok := conn.(*net.TCPConn)
+	if !ok {
+		return netip.AddrPort{}, errors.New("not a TCP connection")
+	}
+	local := tc.LocalAddr().(*net.TCPAddr).AddrPort()
+	if *transparentTProxy {
+		// TPROXY leaves the destination as the local address
+		return redirectedTo(local)
+	}
+	raw, err := tc.SyscallConn()
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	var dst netip.AddrPort
+	var serr error
+	err = raw.Control(func(fd uintptr) {
+		if local.Addr().Unmap().Is4() {
+			// the sockaddr_in comes back in the bytes of an ipv6_mreq
+			var mreq *unix.IPv6Mreq
+			if mreq, serr = unix.GetsockoptIPv6Mreq(int(fd), unix.SOL_IP, soOriginalDst); serr == nil {
+				sa := mreq.Multiaddr
+				dst = netip.AddrPortFrom(netip.AddrFrom4([4]byte(sa[4:8])), binary.BigEndian.Uint16(sa[2:4]))
+			}
+			return
+		}
+		// and the sockaddr_in6 in those of an ip6_mtuinfo
+		var info *unix.IPv6MTUInfo
+		if info, serr = unix.GetsockoptIPv6MTUInfo(int(fd), unix.SOL_IPV6, soOriginalDst); serr == nil {
+			var port [2]byte
+			binary.NativeEndian.PutUint16(port[:], info.Addr.Port)
+			dst = netip.AddrPortFrom(netip.AddrFrom16(info.Addr.Addr), binary.BigEndian.Uint16(port[:]))
+		}
+	})
+	if err == nil {
+		err = serr
+	}
+	if errors.Is(err, unix.ENOENT) {
+		return netip.AddrPort{}, errors.New("connection was not redirected")
+	}
+	if err != nil {
+		return netip.AddrPort{}, fmt.Errorf("original destination: %w", err)
+	}
+	// with conntrack loaded, a direct connection has an original
+	// destination too: the listener's own address
+	return redirectedTo(dst)
+}
+
+// redirectedTo returns dst, unless it is one of our own addresses on the
+// listening port: the client connected directly, and tunnelling it would
+// have the gateway dial itself over and over
+func redirectedTo(dst netip.AddrPort) (netip.AddrPort, error) {
+	_, port, _ := net.SplitHostPort(*transparentAddr)
+	if strconv.Itoa(int(dst.Port())) == port && localAddr(dst.Addr()) {
+		return netip.AddrPort{}, errors.New("connection was not redirected")
+	}
+	return dst, nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+)
+
+func TestRedirectedTo(t *testing.T) {
+	setFlag(t, transparentAddr, ":8095")
+	for _, tt := range []struct {
+		dst  string
+		want bool // taken as redirected
+	}{
+		{"127.0.0.1:8095", false},
+		{"[::ffff:127.0.0.1]:8095", false},
+		{"127.0.0.1:443", true},
+		{"192.0.2.10:8095", true},
+		{"192.0.2.10:443", true},
+	} {
+		dst := netip.MustParseAddrPort(tt.dst)
+		got, err := redirectedTo(dst)
+		switch {
+		case tt.want && (err != nil || got != dst):
+			t.Errorf("%s: %s, %v, want it back", tt.dst, got, err)
+		case !tt.want && err == nil:
+			t.Errorf("%s: taken as redirected, want refused", tt.dst)
+		}
+	}
+}
+
+// A client connecting straight to the listener isn't tunnelled back to it,
+// whether or not conntrack knows the connection
+func TestTransparentDirectConnection(t *testing.T) {
+	ln, err := listenTransparent("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	setFlag(t, transparentAddr, ln.Addr().String())
+
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if dst, err := originalDst(conn); err == nil || err.Error() != "connection was not redirected" {
+		t.Errorf("originalDst = %s, %v, want not redirected", dst, err)
+	}
+}
@@ -0,0 +1,20 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"runtime"
+)
+
+var errTransparentUnsupported = errors.New("transparent proxying is not supported on " + runtime.GOOS + ", only on Linux")
+
+func listenTransparent(addr string) (net.Listener, error) {
+	return nil, errTransparentUnsupported
+}
+
+func originalDst(conn net.Conn) (netip.AddrPort, error) {
+	return netip.AddrPort{}, errTransparentUnsupported
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/netip"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	upstreamDNS       = flag.String("upstream-dns", "", "resolve the host names of upstream proxies with this DNS server (host:port) instead of the system resolver")
+	upstreamDNSPrefer = flag.String("upstream-dns-prefer", "", "try the ipv4 or ipv6 addresses of an upstream proxy first (default: the resolver's order)")
+)
+
+const (
+	upstreamDNSTimeout     = 5 * time.Second
+	upstreamDNSTTL         = 30 * time.Second // how long a lookup is reused
+	upstreamDNSNegativeTTL = 5 * time.Second  // how long a failed lookup is reused
+)
+
+// upstreamResolver looks up upstream proxy hosts; -upstream-dns replaces it
+var upstreamResolver = net.DefaultResolver
+
+// checkUpstreamDNS validates the -upstream-dns flags and sets up the resolver
+func checkUpstreamDNS() error {
+	switch *upstreamDNSPrefer {
+	case "", "ipv4", "ipv6":
+	default:
+		return fmt.Errorf("-upstream-dns-prefer is %q, want ipv4 or ipv6", *upstreamDNSPrefer)
+	}
+	if *upstreamDNS == "" {
+		return nil
+	}
+	if _, _, err := net.SplitHostPort(*upstreamDNS); err != nil {
+		return fmt.Errorf("-upstream-dns: %w", err)
+	}
+	upstreamResolver = &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, *upstreamDNS)
+		},
+	}
+	return nil
+}
+
+// upstreamResolveError is a failure to look up the upstream itself, as
+// opposed to reaching it
+type upstreamResolveError struct {
+	host string
+	err  error
+}
+
+func (e *upstreamResolveError) Error() string {
+	// a DNSError names the system resolver's server even with -upstream-dns
+	var dnsErr *net.DNSError
+	if errors.As(e.err, &dnsErr) {
+		return fmt.Sprintf("can't resolve upstream host %s: %s", e.host, dnsErr.Err)
+	}
+	return fmt.Sprintf("can't resolve upstream host %s: %v", e.host, e.err)
+}
+func (e *upstreamResolveError) Unwrap() error { return e.err }
+
+type dnsCacheEntry struct {
+	ips     []net.IP
+	err     error
+	expires time.Time
+}
+
+var (
+	upstreamDNSMu    sync.Mutex
+	upstreamDNSCache = map[string]dnsCacheEntry{}
+)
+
+// lookupUpstreamHost resolves host with upstreamResolver, reusing recent
+// answers, and orders the addresses by -upstream-dns-prefer
+func lookupUpstreamHost(host string) ([]net.IP, error) {
+	now := time.Now()
+	upstreamDNSMu.Lock()
+	e, ok := upstreamDNSCache[host]
+	upstreamDNSMu.Unlock()
+	if ok && now.Before(e.expires) {
+		return e.ips, e.err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), upstreamDNSTimeout)
+	defer cancel()
+	ips, err := upstreamResolver.LookupIP(ctx, "ip", host)
+	if err == nil && *upstreamDNSPrefer != "" {
+		v4 := *upstreamDNSPrefer == "ipv4"
+		sort.SliceStable(ips, func(i, j int) bool {
+			return (ips[i].To4() != nil) == v4 && (ips[j].To4() != nil) != v4
+		})
+	}
+	e = dnsCacheEntry{ips: ips, err: err, expires: now.Add(upstreamDNSTTL)}
+	if err != nil {
+		e.expires = now.Add(upstreamDNSNegativeTTL)
+	}
+	upstreamDNSMu.Lock()
+	upstreamDNSCache[host] = e
+	upstreamDNSMu.Unlock()
+	return ips, err
+}
+
+// expireUpstreamDNS drops lookups that can't be reused any more
+func expireUpstreamDNS(now time.Time) {
+	upstreamDNSMu.Lock()
+	defer upstreamDNSMu.Unlock()
+	for host, e := range upstreamDNSCache {
+		if !now.Before(e.expires) {
+			delete(upstreamDNSCache, host)
+		}
+	}
+}
+
+// upstreamHostDialer dials the first hop of an upstream, resolving its host
+// with lookupUpstreamHost and trying each address in turn
+type upstreamHostDialer struct {
+	timeout time.Duration // for the whole dial, lookup included
+}
+
+func (d upstreamHostDialer) Dial(network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	var nd net.Dialer
+	ctx, cancel := context.WithTimeout(context.Background(), d.timeout)
+	defer cancel()
+	// netip takes the zone of a link-local address, which net.ParseIP doesn't
+	if _, err := netip.ParseAddr(host); err == nil {
+		return nd.DialContext(ctx, network, addr)
+	}
+
+	ips, err := lookupUpstreamHost(host)
+	if err != nil {
+		return nil, &upstreamResolveError{host, err}
+	}
+	deadline, _ := ctx.Deadline()
+	for i, ip := range ips {
+		// like net.Dialer, split the time left between the addresses left
+		actx, acancel := context.WithTimeout(ctx, time.Until(deadline)/time.Duration(len(ips)-i))
+		conn, err := nd.DialContext(actx, network, net.JoinHostPort(ip.String(), port))
+		acancel()
+		if err == nil || i == len(ips)-1 {
+			return conn, err
+		}
+	}
+	return nil, &upstreamResolveError{host, errors.New("no addresses")}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"golang.org/x/net/http/httpguts"
+)
+
+const (
+	maxUpstreamHeaders        = 32
+	maxUpstreamHeaderValueLen = 4096
+)
+
+// reservedUpstreamHeaders are written by the dialer or would change how the
+// CONNECT request is framed
+var reservedUpstreamHeaders = map[string]bool{
+	"Host": true, "Connection": true, "Proxy-Connection": true, "Keep-Alive": true, "Upgrade": true,
+	"Content-Length": true, "Transfer-Encoding": true, "Te": true, "Trailer": true,
+}
+
+// helper to apply the optional headers of a set request. They are sent on
+// the CONNECT to the upstream, the last hop of a chain, which must be an
+// http, https or h3 proxy.
+func setUpstreamHeaders(up *Upstream, headers map[string]string) error {
+	if len(headers) == 0 {
+		return nil
+	}
+	if s := up.URL.Scheme; s != "http" && s != "https" && s != "ntlm" && s != "h3" {
+		return &fieldError{"headers", "only http, https, ntlm and h3 upstreams take headers"}
+	}
+	h, err := canonicalUpstreamHeaders(headers)
+	up.Headers = h
+	return err
+}
+
+// helper to apply the optional forward_auth of a set request
+func setForwardAuth(up *Upstream, forward bool) error {
+	if !forward {
+		return nil
+	}
+	if s := up.URL.Scheme; s != "http" && s != "https" && s != "ntlm" && s != "h3" {
+		return &fieldError{"forward_auth", "only http, https, ntlm and h3 upstreams can be sent the client's credentials"}
+	}
+	up.ForwardAuth = true
+	return nil
+}
+
+// canonicalUpstreamHeaders validates headers and canonicalizes their names.
+// Values may not contain CR, LF or other control characters, so they can't
+// end the request early.
+func canonicalUpstreamHeaders(headers map[string]string) (map[string]string, error) {
+	if len(headers) > maxUpstreamHeaders {
+		return nil, &fieldError{"headers", fmt.Sprintf("at most %d headers allowed", maxUpstreamHeaders)}
+	}
+	out := make(map[string]string, len(headers))
+	for name, v := range headers {
+		key := http.CanonicalHeaderKey(name)
+		switch {
+		case !httpguts.ValidHeaderFieldName(name):
+			return nil, &fieldError{"headers", strconv.Quote(name) + " is not a valid header name"}
+		case reservedUpstreamHeaders[key]:
+			return nil, &fieldError{"headers", key + " can't be set"}
+		case out[key] != "":
+			return nil, &fieldError{"headers", key + " is given twice"}
+		case v == "":
+			return nil, &fieldError{"headers", key + " has an empty value"}
+		case len(v) > maxUpstreamHeaderValueLen:
+			return nil, &fieldError{"headers", fmt.Sprintf("%s value longer than %d bytes", key, maxUpstreamHeaderValueLen)}
+		case !httpguts.ValidHeaderFieldValue(v):
+			return nil, &fieldError{"headers", key + " value may not contain control characters"}
+		}
+		out[key] = v
+	}
+	return out, nil
+}
+
+// helper to list headers sorted by name, so requests are written the same
+// way every time
+func sortedHeaderNames(headers map[string]string) []string {
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// redactHeaders masks the values of headers, which often carry credentials
+func redactHeaders(headers map[string]string) map[string]string {
+	if headers == nil {
+		return nil
+	}
+	out := make(map[string]string, len(headers))
+	for name := range headers {
+		out[name] = "xxxxx"
+	}
+	return out
+}
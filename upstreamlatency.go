@@ -0,0 +1,66 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Upstream connect latencies, by how tunnels are carried: h1 is a CONNECT
+// per TCP connection (http, https and ntlm), h2 and h3 are CONNECT streams
+// on a shared HTTP/2 or QUIC connection. The handshake is the time to get a
+// connection to the proxy ready, TLS included, and the connect the time
+// from sending a CONNECT to its answer.
+
+// latencyStat sums up the successful tries of one step
+type latencyStat struct {
+	mu    sync.Mutex
+	count uint64
+	total time.Duration
+	max   time.Duration
+}
+
+func (s *latencyStat) observe(d time.Duration) {
+	s.mu.Lock()
+	s.count++
+	s.total += d
+	if d > s.max {
+		s.max = d
+	}
+	s.mu.Unlock()
+}
+
+type latencySummary struct {
+	Count uint64  `json:"count"`
+	AvgMs float64 `json:"avg_ms"`
+	MaxMs float64 `json:"max_ms"`
+}
+
+func (s *latencyStat) summary() latencySummary {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sum := latencySummary{Count: s.count, MaxMs: float64(s.max.Microseconds()) / 1000}
+	if s.count > 0 {
+		sum.AvgMs = float64((s.total / time.Duration(s.count)).Microseconds()) / 1000
+	}
+	return sum
+}
+
+type protoLatency struct {
+	handshake latencyStat
+	connect   latencyStat
+}
+
+var (
+	h1Latency protoLatency
+	h2Latency protoLatency
+	h3Latency protoLatency
+)
+
+// upstreamLatencySummary is the upstream_latency of /stats
+func upstreamLatencySummary() map[string]map[string]latencySummary {
+	out := map[string]map[string]latencySummary{}
+	for name, l := range map[string]*protoLatency{"h1": &h1Latency, "h2": &h2Latency, "h3": &h3Latency} {
+		out[name] = map[string]latencySummary{"handshake": l.handshake.summary(), "connect": l.connect.summary()}
+	}
+	return out
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Besides -user-params, an upstream's credentials may use placeholders the
+// gateway fills itself when a tunnel is dialed, the way rotating
+// residential providers expect:
+//
+//	{session}  a random token, kept for the mapping's session_ttl
+//	{conn_id}  a number unique to the connection
+//	{user}     the user the connection is routed as
+//
+// A {session} sent by the client as a -user-params parameter wins over the
+// generated one.
+
+// maxSessionTTL bounds session_ttl_seconds
+const maxSessionTTL = 7 * 24 * time.Hour
+
+// templateParams lists the placeholders filled by the gateway
+var templateParams = []string{"session", "conn_id", "user"}
+
+var connSeq atomic.Uint64
+
+// stickySession is the {session} token of a user's mapping
+type stickySession struct {
+	up      *Upstream // the mapping the token was made for
+	token   string
+	expires time.Time
+}
+
+var (
+	stickySessionsMu sync.Mutex
+	stickySessions   = map[string]*stickySession{}
+)
+
+// helper to apply the optional session_ttl_seconds of a set request
+func setSessionTTL(up *Upstream, seconds int64) error {
+	switch {
+	case seconds == 0:
+		return nil
+	case seconds < 0 || time.Duration(seconds)*time.Second > maxSessionTTL:
+		return &fieldError{"session_ttl_seconds", "must be between 1 and " + strconv.Itoa(int(maxSessionTTL/time.Second))}
+	case !strings.Contains(up.Raw, "{session}"):
+		return &fieldError{"session_ttl_seconds", "upstream has no {session} placeholder"}
+	}
+	up.SessionTTL = time.Duration(seconds) * time.Second
+	return nil
+}
+
+// upstreamParams adds the gateway's placeholders to the -user-params of a
+// connection routed as user through up
+func upstreamParams(user string, up *Upstream, params map[string]string) map[string]string {
+	if up == nil || up.URL == nil || !strings.Contains(up.Raw, "{") {
+		return params
+	}
+	out := make(map[string]string, len(params)+len(templateParams))
+	for k, v := range params {
+		out[k] = v
+	}
+	out["user"] = user
+	out["conn_id"] = strconv.FormatUint(connSeq.Add(1), 10)
+	if out["session"] == "" && strings.Contains(up.Raw, "{session}") {
+		out["session"] = sessionToken(user, up, time.Now())
+	}
+	return out
+}
+
+// sessionToken returns the {session} of user's mapping up, making a new one
+// when the mapping changed or its session_ttl ran out. Without a
+// session_ttl every connection gets its own.
+func sessionToken(user string, up *Upstream, now time.Time) string {
+	if up.SessionTTL <= 0 {
+		return newSessionToken()
+	}
+	stickySessionsMu.Lock()
+	defer stickySessionsMu.Unlock()
+	s := stickySessions[user]
+	if s == nil || s.up != up || !now.Before(s.expires) {
+		s = &stickySession{up: up, token: newSessionToken(), expires: now.Add(up.SessionTTL)}
+		stickySessions[user] = s
+	}
+	return s.token
+}
+
+func newSessionToken() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// expireStickySessions forgets tokens whose session_ttl ran out
+func expireStickySessions(now time.Time) {
+	stickySessionsMu.Lock()
+	defer stickySessionsMu.Unlock()
+	for user, s := range stickySessions {
+		if !now.Before(s.expires) {
+			delete(stickySessions, user)
+		}
+	}
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	upstreamCA          = flag.String("upstream-ca", "", "verify https://, h3:// and socks5+tls:// upstream proxies against this CA bundle instead of the system roots, re-read on SIGHUP")
+	upstreamTLSInsecure = flag.Bool("upstream-tls-insecure", false, "don't verify the certificates of https://, h3:// and socks5+tls:// upstream proxies")
+)
+
+// upstreamTLSHandshakeTimeout bounds the TLS handshake with an upstream
+const upstreamTLSHandshakeTimeout = 10 * time.Second
+
+// upstreamRoots is the -upstream-ca pool, nil for the system roots. It is
+// swapped on SIGHUP.
+var upstreamRoots atomic.Pointer[x509.CertPool]
+
+// loadUpstreamCA reads -upstream-ca
+func loadUpstreamCA() error {
+	pool, err := readCAPool(*upstreamCA)
+	if err != nil {
+		return err
+	}
+	upstreamRoots.Store(pool)
+	return nil
+}
+
+func readCAPool(name string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	return parseCAPool(name, pem)
+}
+
+func parseCAPool(name string, pem []byte) (*x509.CertPool, error) {
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("%s: no certificates found", name)
+	}
+	return pool, nil
+}
+
+// upstreamCAConfig is the ca of a mapping: a PEM bundle or the path of one
+// under -upstream-client-cert-dir. It replaces -upstream-ca and the system
+// roots for that upstream.
+type upstreamCAConfig struct {
+	spec string
+	file bool
+	pool *x509.CertPool // inline bundles only; files are in upstreamCAFiles
+	id   string         // tells bundles apart in h2 session keys
+}
+
+var (
+	upstreamCAFilesMu sync.Mutex
+	upstreamCAFiles   = map[string]*x509.CertPool{} // path -> pool, re-read on SIGHUP
+)
+
+// helper to apply the optional ca and server_name of a set request
+func setUpstreamTLS(up *Upstream, ca, serverName string) error {
+	if ca == "" && serverName == "" {
+		return nil
+	}
+	if s := up.URL.Scheme; s != "https" && s != "h3" && !isSOCKS5TLS(s) {
+		field := "ca"
+		if ca == "" {
+			field = "server_name"
+		}
+		return &fieldError{field, "only https, h3 and socks5+tls upstreams take " + field}
+	}
+	if serverName != "" {
+		if !validServerName(serverName) {
+			return &fieldError{"server_name", "must be a host name"}
+		}
+		if up.URL.Query().Has("sni") {
+			return &fieldError{"server_name", "the upstream already sets sni"}
+		}
+		up.ServerName = serverName
+	}
+	if ca != "" {
+		c, err := loadUpstreamCAConfig(ca)
+		if err != nil {
+			return &fieldError{"ca", err.Error()}
+		}
+		up.CA = c
+	}
+	return nil
+}
+
+// validateSNI checks the sni of an upstream URL, which replaces the host
+// in SNI and certificate checks for that hop, even one inside a chain
+func validateSNI(u *url.URL) error {
+	q := u.Query()
+	if !q.Has("sni") {
+		return nil
+	}
+	if s := u.Scheme; s != "https" && s != "h3" && !isSOCKS5TLS(s) {
+		return errors.New("only https, h3 and socks5+tls upstreams take sni")
+	}
+	if !validServerName(q.Get("sni")) {
+		return fmt.Errorf("sni is %q, want a host name", q.Get("sni"))
+	}
+	return nil
+}
+
+// validServerName accepts a DNS name, or an IP address for certificates
+// issued to one
+func validServerName(name string) bool {
+	if _, err := netip.ParseAddr(name); err == nil {
+		return true
+	}
+	if name == "" || len(name) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func loadUpstreamCAConfig(spec string) (*upstreamCAConfig, error) {
+	if strings.Contains(spec, "-----BEGIN") {
+		pool, err := parseCAPool("ca", []byte(spec))
+		if err != nil {
+			return nil, err
+		}
+		sum := sha256.Sum256([]byte(spec))
+		return &upstreamCAConfig{spec: spec, pool: pool, id: hex.EncodeToString(sum[:8])}, nil
+	}
+	pem, err := readUpstreamTLSFile(spec)
+	if err != nil {
+		return nil, err
+	}
+	pool, err := parseCAPool(spec, pem)
+	if err != nil {
+		return nil, err
+	}
+	upstreamCAFilesMu.Lock()
+	upstreamCAFiles[spec] = pool
+	upstreamCAFilesMu.Unlock()
+	return &upstreamCAConfig{spec: spec, file: true, id: spec}, nil
+}
+
+func (c *upstreamCAConfig) roots() *x509.CertPool {
+	if !c.file {
+		return c.pool
+	}
+	upstreamCAFilesMu.Lock()
+	defer upstreamCAFilesMu.Unlock()
+	return upstreamCAFiles[c.spec]
+}
+
+func sameUpstreamCA(a, b *upstreamCAConfig) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.spec == b.spec
+}
+
+// source describes the bundle in responses: its path, or "inline"
+func (c *upstreamCAConfig) source() string {
+	if c == nil {
+		return ""
+	}
+	if c.file {
+		return c.spec
+	}
+	return "inline"
+}
+
+// reloadUpstreamCAs re-reads -upstream-ca and the ca files of mappings. A
+// file that can't be read keeps its current certificates.
+func reloadUpstreamCAs() {
+	if *upstreamCA != "" {
+		if err := loadUpstreamCA(); err != nil {
+			log.Printf("reload: upstream-ca: keeping current certificates: %v", err)
+		} else {
+			log.Printf("reload: upstream-ca reloaded")
+		}
+	}
+	upstreamCAFilesMu.Lock()
+	paths := make([]string, 0, len(upstreamCAFiles))
+	for path := range upstreamCAFiles {
+		paths = append(paths, path)
+	}
+	upstreamCAFilesMu.Unlock()
+	for _, path := range paths {
+		pem, err := readUpstreamTLSFile(path)
+		var pool *x509.CertPool
+		if err == nil {
+			pool, err = parseCAPool(path, pem)
+		}
+		if err != nil {
+			log.Printf("reload: upstream ca %s: keeping current certificates: %v", path, err)
+			continue
+		}
+		upstreamCAFilesMu.Lock()
+		upstreamCAFiles[path] = pool
+		upstreamCAFilesMu.Unlock()
+		log.Printf("reload: upstream ca %s reloaded", path)
+	}
+}
+
+// tlsKey tells apart TLS settings that need their own h2 session
+func (c hopConfig) tlsKey() string {
+	var k string
+	if c.clientCert != nil {
+		k += "#cert=" + c.clientCert.sha256 // a session is authenticated as one client
+	}
+	if c.ca != nil {
+		k += "#ca=" + c.ca.id
+	}
+	if c.serverName != "" {
+		k += "#sni=" + c.serverName
+	}
+	return k
+}
+
+// upstreamTLS wraps conn in TLS to the upstream at addr, with SNI
+// and verification against its host or cfg's server name. cfg's client
+// certificate is presented if the upstream asks for one, and protos are
+// offered with ALPN, if any.
+func upstreamTLS(conn net.Conn, addr string, cfg hopConfig, protos ...string) (*tls.Conn, error) {
+	tc, err := upstreamTLSConfig(addr, cfg, protos...)
+	if err != nil {
+		return nil, err
+	}
+	c := tls.Client(conn, tc)
+	ctx, cancel := context.WithTimeout(context.Background(), upstreamTLSHandshakeTimeout)
+	defer cancel()
+	if err := c.HandshakeContext(ctx); err != nil {
+		return nil, upstreamTLSError(addr, tc.ServerName, err)
+	}
+	return c, nil
+}
+
+// upstreamTLSConfig is the client side of a handshake with the upstream at
+// addr, shared by TLS over TCP and QUIC
+func upstreamTLSConfig(addr string, cfg hopConfig, protos ...string) (*tls.Config, error) {
+	name, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.serverName != "" {
+		name = cfg.serverName
+	}
+	tc := &tls.Config{
+		ServerName:         name,
+		RootCAs:            upstreamRoots.Load(),
+		InsecureSkipVerify: *upstreamTLSInsecure,
+		MinVersion:         tls.VersionTLS12,
+		NextProtos:         protos,
+	}
+	if cfg.ca != nil {
+		tc.RootCAs = cfg.ca.roots()
+	}
+	if cfg.clientCert != nil {
+		tc.Certificates = []tls.Certificate{cfg.clientCert.cert}
+	}
+	return tc, nil
+}
+
+// upstreamTLSError names the upstream, and the name its certificate was
+// checked for, in a failed handshake
+func upstreamTLSError(addr, name string, err error) error {
+	var verr *tls.CertificateVerificationError
+	if errors.As(err, &verr) {
+		return fmt.Errorf("certificate of upstream %s (as %s) failed verification: %w", addr, name, verr.Err)
+	}
+	return fmt.Errorf("tls handshake with upstream %s: %w", addr, err)
+}
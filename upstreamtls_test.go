@@ -0,0 +1,185 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// connectProxy is an HTTP proxy that only tunnels CONNECT requests and
+// remembers the target, Proxy-Authorization and TLS server name of each
+type connectProxy struct {
+	mu      sync.Mutex
+	targets []string
+	auths   []string
+	snis    []string
+}
+
+func (p *connectProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	p.targets = append(p.targets, r.Host)
+	p.auths = append(p.auths, r.Header.Get("Proxy-Authorization"))
+	if r.TLS != nil {
+		p.snis = append(p.snis, r.TLS.ServerName)
+	}
+	p.mu.Unlock()
+	if r.Method != http.MethodConnect {
+		http.Error(w, "CONNECT only", http.StatusMethodNotAllowed)
+		return
+	}
+	target, err := net.Dial("tcp", r.Host)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	conn, brw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		target.Close()
+		return
+	}
+	relay(&bufferedConn{conn, brw.Reader}, target)
+}
+
+// startTLSConnectProxy serves a connectProxy over TLS with httptest's
+// certificate, which is valid for 127.0.0.1 and example.com, and returns it
+// with the PEM of that certificate
+func startTLSConnectProxy(t *testing.T) (*connectProxy, *httptest.Server, string) {
+	t.Helper()
+	p := &connectProxy{}
+	srv := httptest.NewTLSServer(p)
+	t.Cleanup(srv.Close)
+	ca := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}))
+	return p, srv, ca
+}
+
+func TestHTTPSUpstream(t *testing.T) {
+	echo := startEchoServer(t)
+	proxyAddr := startProxy(t)
+	upstream, srv, ca := startTLSConnectProxy(t)
+	addr := srv.Listener.Addr().String()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(srv.Certificate())
+	defer func(insecure bool) {
+		*upstreamTLSInsecure = insecure
+		upstreamRoots.Store(nil)
+	}(*upstreamTLSInsecure)
+
+	tunnel := func(t *testing.T) (int, string) {
+		t.Helper()
+		resp, conn := dialConnect(t, proxyAddr, echo, basicAuth("alice", "x"))
+		if resp.StatusCode != http.StatusOK {
+			body, _ := io.ReadAll(resp.Body)
+			return resp.StatusCode, string(body)
+		}
+		expectEcho(t, conn, "over tls")
+		return resp.StatusCode, ""
+	}
+
+	t.Run("system roots refuse the test certificate", func(t *testing.T) {
+		setTestMapping(t, "alice", "https://"+addr, "")
+		if status, _ := tunnel(t); status != http.StatusBadGateway {
+			t.Errorf("status = %d, want 502", status)
+		}
+	})
+
+	t.Run("-upstream-ca", func(t *testing.T) {
+		upstreamRoots.Store(roots)
+		defer upstreamRoots.Store(nil)
+		setTestMapping(t, "alice", "https://u:p%40ss@"+addr, "")
+		if status, body := tunnel(t); status != http.StatusOK {
+			t.Fatalf("status = %d %q, want 200", status, body)
+		}
+		upstream.mu.Lock()
+		defer upstream.mu.Unlock()
+		if got := upstream.auths[len(upstream.auths)-1]; got != basicAuth("u", "p@ss") {
+			t.Errorf("upstream got Proxy-Authorization %q, want the URL's credentials", got)
+		}
+	})
+
+	t.Run("mapping ca and server_name", func(t *testing.T) {
+		setTestMapping(t, "alice", "https://"+addr, "", func(up *Upstream) {
+			var err error
+			if up.CA, err = loadUpstreamCAConfig(ca); err != nil {
+				t.Fatal(err)
+			}
+			up.ServerName = "example.com"
+		})
+		if status, body := tunnel(t); status != http.StatusOK {
+			t.Fatalf("status = %d %q, want 200", status, body)
+		}
+		upstream.mu.Lock()
+		defer upstream.mu.Unlock()
+		if got := upstream.snis[len(upstream.snis)-1]; got != "example.com" {
+			t.Errorf("SNI = %q, want example.com", got)
+		}
+	})
+
+	t.Run("server_name the certificate doesn't cover", func(t *testing.T) {
+		setTestMapping(t, "alice", "https://"+addr, "", func(up *Upstream) {
+			up.CA, _ = loadUpstreamCAConfig(ca)
+			up.ServerName = "other.example.net"
+		})
+		if status, _ := tunnel(t); status != http.StatusBadGateway {
+			t.Errorf("status = %d, want 502", status)
+		}
+	})
+
+	t.Run("-upstream-tls-insecure", func(t *testing.T) {
+		*upstreamTLSInsecure = true
+		defer func() { *upstreamTLSInsecure = false }()
+		setTestMapping(t, "alice", "https://"+addr, "")
+		if status, body := tunnel(t); status != http.StatusOK {
+			t.Fatalf("status = %d %q, want 200", status, body)
+		}
+	})
+
+	t.Run("plain http to a TLS port", func(t *testing.T) {
+		setTestMapping(t, "alice", "http://"+addr, "")
+		if status, _ := tunnel(t); status == http.StatusOK {
+			t.Error("plain CONNECT to a TLS proxy succeeded")
+		}
+	})
+}
+
+// An https upstream that accepts the connection but never answers the
+// ClientHello fails with 504 once -upstream-handshake-timeout has passed
+func TestHTTPSUpstreamHandshakeTimeout(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+		}
+	}()
+
+	defer func(d time.Duration) { *upstreamHandshakeTimeout = d }(*upstreamHandshakeTimeout)
+	*upstreamHandshakeTimeout = 200 * time.Millisecond
+	proxyAddr := startProxy(t)
+	setTestMapping(t, "alice", "https://"+ln.Addr().String(), "")
+
+	start := time.Now()
+	resp, _ := dialConnect(t, proxyAddr, startEchoServer(t), basicAuth("alice", "x"))
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusGatewayTimeout || !strings.Contains(string(body), ln.Addr().String()) {
+		t.Errorf("%d %q, want 504 naming the upstream", resp.StatusCode, body)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("took %s with a 200ms handshake timeout", d)
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// userUsage counts tunnels established through a user's own mapping
+type userUsage struct {
+	lastConnect time.Time
+	connects    uint64
+	bytesUp     uint64 // client to target, added when a tunnel ends
+	bytesDown   uint64
+}
+
+var (
+	usageMu sync.Mutex
+	usage   = map[string]*userUsage{}
+)
+
+// helper to note a tunnel established through user's own mapping
+func touchUser(user string, now time.Time) {
+	usageMu.Lock()
+	u := usage[user]
+	if u == nil {
+		u = &userUsage{}
+		usage[user] = u
+	}
+	u.lastConnect = now
+	u.connects++
+	usageMu.Unlock()
+}
+
+// helper to add the traffic of a finished tunnel to user's totals
+func addUserBytes(user string, up, down int64) {
+	usageMu.Lock()
+	if u := usage[user]; u != nil {
+		u.bytesUp += uint64(up)
+		u.bytesDown += uint64(down)
+	}
+	usageMu.Unlock()
+}
+
+// helper to forget a user's usage once their mapping is gone
+func forgetUser(user string) {
+	usageMu.Lock()
+	delete(usage, user)
+	usageMu.Unlock()
+}
+
+// helper to read a user's usage; last is nil if they never connected
+func usageOf(user string) (last *time.Time, connects uint64) {
+	usageMu.Lock()
+	defer usageMu.Unlock()
+	u := usage[user]
+	if u == nil {
+		return nil, 0
+	}
+	t := u.lastConnect
+	return &t, u.connects
+}
+
+// helper to read the bytes relayed for user by finished tunnels
+func bytesOf(user string) (up, down uint64) {
+	usageMu.Lock()
+	defer usageMu.Unlock()
+	if u := usage[user]; u != nil {
+		return u.bytesUp, u.bytesDown
+	}
+	return 0, 0
+}
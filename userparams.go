@@ -0,0 +1,127 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// Session parameters let clients append routing hints to their username the
+// way residential proxy providers do: with -user-params session,country the
+// login "alice-session-42-country-de" uses alice's mapping and carries
+// session=42 and country=de, which the mapping's upstream credentials can
+// reference as {session} and {country}.
+var (
+	userParamNames = flag.String("user-params", "", "comma-separated parameters clients may append to their username, e.g. session,country; "+
+		"the mapping of the user before the first one is used and {name} in its upstream credentials is replaced by the value; not with -proxy-digest")
+	userParamSep = flag.String("user-param-separator", "-", "separator between the user, parameter names and values in -user-params logins")
+)
+
+// userParamSet holds the names of -user-params, nil when disabled
+var userParamSet map[string]bool
+
+// checkUserParams validates -user-params and -user-param-separator
+func checkUserParams() error {
+	if *proxyDigest {
+		// clients hash the whole login, and only the user's password hashes
+		// are stored, so no parameterized login could ever match
+		return errors.New("can't be combined with -proxy-digest, whose stored hashes cover only the user, not the parameters")
+	}
+	if *userParamSep == "" || strings.ContainsAny(*userParamSep, ":{}") {
+		return errors.New("-user-param-separator may not be empty or contain ':', '{' or '}'")
+	}
+	userParamSet = map[string]bool{}
+	for _, name := range strings.Split(*userParamNames, ",") {
+		name = strings.TrimSpace(name)
+		switch {
+		case name == "":
+			return errors.New("empty parameter name")
+		case strings.Trim(name, labelKeyCharacters) != "" || strings.Contains(name, *userParamSep):
+			return fmt.Errorf("parameter %q may only contain letters, digits and -_./, and not the separator", name)
+		}
+		userParamSet[name] = true
+	}
+	return nil
+}
+
+// splitUserParams splits a login into the user before the first known
+// parameter and the parameters after it. Unknown parameters and empty
+// values are skipped.
+func splitUserParams(login string) (string, map[string]string) {
+	parts := strings.Split(login, *userParamSep)
+	for i := 1; i < len(parts)-1; i++ {
+		base := strings.Join(parts[:i], *userParamSep)
+		if !userParamSet[parts[i]] || strings.Trim(base, *userParamSep) == "" {
+			continue
+		}
+		params := map[string]string{}
+		for j := i; j+1 < len(parts); j += 2 {
+			if userParamSet[parts[j]] && parts[j+1] != "" {
+				params[parts[j]] = parts[j+1]
+			}
+		}
+		return base, params
+	}
+	return login, nil
+}
+
+// routeUser returns the user whose mapping a login is routed through and
+// the session parameters it carries. A login that has a mapping of its own
+// is always taken as is.
+func routeUser(login string) (string, map[string]string) {
+	if userParamSet == nil {
+		return login, nil
+	}
+	upstreamsMu.RLock()
+	_, own := upstreams[login]
+	upstreamsMu.RUnlock()
+	if own {
+		return login, nil
+	}
+	return splitUserParams(login)
+}
+
+// expandUserParams returns u with {name} in its user and password replaced
+// by the login's parameters and the gateway's placeholders (see
+// upstreamParams); names the login didn't send become empty
+func expandUserParams(u *url.URL, params map[string]string) *url.URL {
+	if (userParamSet == nil && params == nil) || u.User == nil {
+		return u
+	}
+	expand := func(s string) string {
+		if !strings.Contains(s, "{") {
+			return s
+		}
+		for name := range userParamSet {
+			s = strings.ReplaceAll(s, "{"+name+"}", params[name])
+		}
+		for _, name := range templateParams {
+			if v, ok := params[name]; ok {
+				s = strings.ReplaceAll(s, "{"+name+"}", v)
+			}
+		}
+		return s
+	}
+	user := expand(u.User.Username())
+	pass, hasPass := u.User.Password()
+	out := *u
+	if hasPass {
+		out.User = url.UserPassword(user, expand(pass))
+	} else {
+		out.User = url.User(user)
+	}
+	return &out
+}
+
+// formatUserParams renders parameters for the access log
+func formatUserParams(params map[string]string) string {
+	out := make([]string, 0, len(params))
+	for k, v := range params {
+		out = append(out, k+"="+v)
+	}
+	sort.Strings(out)
+	return strings.Join(out, ",")
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckUserParams(t *testing.T) {
+	defer func(names, sep string, digest bool) {
+		*userParamNames, *userParamSep, *proxyDigest = names, sep, digest
+		userParamSet = nil
+	}(*userParamNames, *userParamSep, *proxyDigest)
+
+	for _, tt := range []struct {
+		names, sep string
+		digest     bool
+		wantErr    string
+	}{
+		{names: "session,country", sep: "-"},
+		{names: " session , country ", sep: "_"},
+		{names: "session", sep: "-", digest: true, wantErr: "-proxy-digest"},
+		{names: "session,", sep: "-", wantErr: "empty parameter name"},
+		{names: "ses:sion", sep: "-", wantErr: "may only contain"},
+		{names: "a-b", sep: "-", wantErr: "not the separator"},
+		{names: "session", sep: "", wantErr: "may not be empty"},
+		{names: "session", sep: ":", wantErr: "may not be empty or contain"},
+	} {
+		*userParamNames, *userParamSep, *proxyDigest = tt.names, tt.sep, tt.digest
+		err := checkUserParams()
+		switch {
+		case tt.wantErr == "" && err != nil:
+			t.Errorf("%q %q: %v", tt.names, tt.sep, err)
+		case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+			t.Errorf("%q %q digest=%t: err = %v, want %q", tt.names, tt.sep, tt.digest, err, tt.wantErr)
+		}
+	}
+}
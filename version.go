@@ -0,0 +1,86 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"time"
+)
+
+var publicVersion = flag.Bool("public-version", false, "serve GET /version without an admin token, for monitoring")
+
+// Build metadata, set with
+// -ldflags "-X main.version=v1.2.3 -X main.commit=abc123 -X main.buildDate=2024-01-01T00:00:00Z".
+// Anything left empty is filled from the module and VCS info Go embeds.
+var (
+	version   string
+	commit    string
+	buildDate string
+)
+
+type buildMeta struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit,omitempty"`
+	BuildDate string `json:"build_date,omitempty"`
+	GoVersion string `json:"go_version"`
+}
+
+var build = readBuildMeta()
+
+func readBuildMeta() buildMeta {
+	m := buildMeta{Version: version, Commit: commit, BuildDate: buildDate, GoVersion: runtime.Version()}
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		if m.Version == "" {
+			m.Version = "dev"
+		}
+		return m
+	}
+	if m.Version == "" && info.Main.Version != "" && info.Main.Version != "(devel)" {
+		m.Version = info.Main.Version
+	}
+	if m.Version == "" {
+		m.Version = "dev"
+	}
+	dirty := false
+	for _, s := range info.Settings {
+		switch {
+		case s.Key == "vcs.revision" && m.Commit == "":
+			m.Commit = s.Value
+		case s.Key == "vcs.time" && m.BuildDate == "":
+			m.BuildDate = s.Value
+		case s.Key == "vcs.modified":
+			dirty = s.Value == "true"
+		}
+	}
+	if dirty && commit == "" && m.Commit != "" {
+		m.Commit += "-dirty"
+	}
+	return m
+}
+
+func (m buildMeta) String() string {
+	s := "upstreamgate " + m.Version
+	if m.Commit != "" {
+		s += " (" + m.Commit + ")"
+	}
+	if m.BuildDate != "" {
+		s += " built " + m.BuildDate
+	}
+	return fmt.Sprintf("%s, %s", s, m.GoVersion)
+}
+
+// GET /version
+func versionHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeMethodNotAllowed(w)
+		return
+	}
+	writeJSON(w, http.StatusOK, struct {
+		buildMeta
+		StartedAt     time.Time `json:"started_at"`
+		UptimeSeconds int64     `json:"uptime_seconds"`
+	}{build, startedAt.UTC(), int64(time.Since(startedAt).Seconds())})
+}
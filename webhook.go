@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+var (
+	changeWebhookURL = flag.String("change-webhook", "", "URL that receives a JSON POST whenever a user's upstream changes")
+	webhookSecret    = flag.String("webhook-secret", "", "shared secret for the X-UpstreamGate-Signature HMAC-SHA256 header on webhook deliveries")
+)
+
+const (
+	webhookAttempts = 4
+	webhookQueueLen = 1024
+)
+
+type changeEvent struct {
+	Event             string    `json:"event"`
+	Time              time.Time `json:"time"`
+	User              string    `json:"user"`
+	OldUpstream       string    `json:"old_upstream,omitempty"`
+	NewUpstream       string    `json:"new_upstream,omitempty"`
+	ClosedConnections int       `json:"closed_connections"`
+}
+
+// webhook delivers JSON events to a URL from a background worker so the
+// request path never waits on the receiver
+type webhook struct {
+	url    string
+	secret string
+	queue  chan []byte
+	client *http.Client
+}
+
+var changeHook *webhook
+
+func newWebhook(url, secret string) *webhook {
+	h := &webhook{
+		url:    url,
+		secret: secret,
+		queue:  make(chan []byte, webhookQueueLen),
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+	go h.run()
+	return h
+}
+
+func startWebhooks() {
+	if *changeWebhookURL != "" {
+		changeHook = newWebhook(*changeWebhookURL, *webhookSecret)
+	}
+	startSecurityWebhook()
+}
+
+func notifyChange(e changeEvent) {
+	if changeHook != nil {
+		changeHook.send(e)
+	}
+}
+
+// send queues v for delivery, dropping it if the receiver has fallen too far behind
+func (h *webhook) send(v any) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return
+	}
+	select {
+	case h.queue <- b:
+	default:
+		log.Printf("webhook: queue full, dropping event for %s", h.url)
+	}
+}
+
+func (h *webhook) run() {
+	for body := range h.queue {
+		backoff := time.Second
+		for attempt := 1; ; attempt++ {
+			err := h.deliver(body)
+			if err == nil {
+				break
+			}
+			if attempt == webhookAttempts {
+				log.Printf("webhook: giving up on %s after %d attempts: %v", h.url, attempt, err)
+				break
+			}
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+}
+
+// signWebhook sets X-UpstreamGate-Signature to the HMAC-SHA256 of body,
+// unless there is no secret
+func signWebhook(req *http.Request, secret string, body []byte) {
+	if secret == "" {
+		return
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	req.Header.Set("X-UpstreamGate-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+}
+
+func (h *webhook) deliver(body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, h.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	signWebhook(req, h.secret, body)
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}